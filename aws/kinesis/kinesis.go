@@ -0,0 +1,142 @@
+package kinesis
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/enums/status"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+const (
+	// maxBatchSize is the maximum number of records of a PutRecords request
+	maxBatchSize = 500
+	// maxAttempts bounds the retries of records that failed (e.g., due to
+	// throttling)
+	maxAttempts = 3
+)
+
+var (
+	// retryDelay is the delay before the first retry of failed records; it
+	// grows quadratically with the attempts (overridden in tests)
+	retryDelay = 100 * time.Millisecond
+)
+
+// EventSink publishes event changes to a Kinesis stream as JSON records;
+// records are partitioned by user ID so that the changes of a user are
+// consumed in order.
+type EventSink struct {
+	client     kinesisiface.KinesisAPI
+	streamName string
+}
+
+// record is the JSON record of an event change.
+type record struct {
+	UserID       string             `json:"userID"`
+	ChangeType   storage.ChangeType `json:"changeType"`
+	UID          string             `json:"uid"`
+	Subject      string             `json:"subject,omitempty"`
+	Start        time.Time          `json:"start"`
+	End          time.Time          `json:"end"`
+	TimeZone     string             `json:"timeZone,omitempty"`
+	IsAllDay     bool               `json:"isAllDay"`
+	CalendarID   string             `json:"calendarID"`
+	LastModified time.Time          `json:"lastModified"`
+	// Status is the name of the event's status (e.g., "Cancelled")
+	Status string `json:"status"`
+}
+
+// statusEvent is implemented by events that expose their status; other
+// events are published as Unknown.
+type statusEvent interface {
+	Status() status.Status
+}
+
+// NewKinesisEventSink creates a sink that publishes to the given stream.
+func NewKinesisEventSink(client kinesisiface.KinesisAPI, streamName string) *EventSink {
+	return &EventSink{client: client, streamName: streamName}
+}
+
+// PublishEvent publishes a change of the given user's event.
+func (sink *EventSink) PublishEvent(userID string, event calendar.Event, changeType storage.ChangeType) error {
+	return sink.PublishEvents(userID, []calendar.Event{event}, changeType)
+}
+
+// PublishEvents publishes the same change of several of the given user's
+// events using PutRecords batches.
+func (sink *EventSink) PublishEvents(userID string, events []calendar.Event, changeType storage.ChangeType) error {
+	entries := make([]*kinesis.PutRecordsRequestEntry, 0, len(events))
+	for _, event := range events {
+		data, err := json.Marshal(newRecord(userID, event, changeType))
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &kinesis.PutRecordsRequestEntry{Data: data, PartitionKey: aws.String(userID)})
+	}
+
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		if err := sink.putRecords(entries[:n]); err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+	return nil
+}
+
+// putRecords puts a batch of records, retrying the ones that failed.
+func (sink *EventSink) putRecords(entries []*kinesis.PutRecordsRequestEntry) error {
+	for attempt := 1; ; attempt++ {
+		output, err := sink.client.PutRecords(&kinesis.PutRecordsInput{
+			StreamName: aws.String(sink.streamName),
+			Records:    entries,
+		})
+		if err != nil {
+			return err
+		}
+		if aws.Int64Value(output.FailedRecordCount) == 0 {
+			return nil
+		}
+
+		// results are in the order of the records
+		failed := []*kinesis.PutRecordsRequestEntry{}
+		for i, result := range output.Records {
+			if result.ErrorCode != nil {
+				failed = append(failed, entries[i])
+			}
+		}
+		if attempt == maxAttempts {
+			return errors.WF11201(len(entries), output)
+		}
+		entries = failed
+		time.Sleep(time.Duration(attempt*attempt) * retryDelay)
+	}
+}
+
+func newRecord(userID string, event calendar.Event, changeType storage.ChangeType) *record {
+	r := &record{
+		UserID:       userID,
+		ChangeType:   changeType,
+		UID:          event.UID(),
+		Subject:      event.Subject(),
+		Start:        event.Start().UTC(),
+		End:          event.End().UTC(),
+		TimeZone:     event.TimeZone(),
+		IsAllDay:     event.IsAllDay(),
+		CalendarID:   event.CalendarID(),
+		LastModified: event.LastModifiedAt().UTC(),
+		Status:       status.Unknown.String(),
+	}
+	if e, ok := event.(statusEvent); ok {
+		r.Status = e.Status().String()
+	}
+	return r
+}
@@ -0,0 +1,265 @@
+package kinesis
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/enums/status"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+func init() {
+	retryDelay = 0
+}
+
+// fakeKinesis records the PutRecords requests. It fails the records whose
+// UIDs are in failures as many times as given there.
+type fakeKinesis struct {
+	kinesisiface.KinesisAPI
+	requests [][]*kinesis.PutRecordsRequestEntry
+	failures map[string]int
+	err      error
+}
+
+func (k *fakeKinesis) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+	k.requests = append(k.requests, input.Records)
+
+	output := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for _, entry := range input.Records {
+		var r decodedRecord
+		if err := json.Unmarshal(entry.Data, &r); err != nil {
+			return nil, err
+		}
+		result := &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String("1"), ShardId: aws.String("shardId-000000000000")}
+		if k.failures[r.UID] > 0 {
+			k.failures[r.UID]--
+			result = &kinesis.PutRecordsResultEntry{ErrorCode: aws.String("ProvisionedThroughputExceededException"), ErrorMessage: aws.String("slow down")}
+			*output.FailedRecordCount++
+		}
+		output.Records = append(output.Records, result)
+	}
+	return output, nil
+}
+
+// decodedRecord is the part of a published record that tests check.
+type decodedRecord struct {
+	UserID     string `json:"userID"`
+	ChangeType string `json:"changeType"`
+	UID        string `json:"uid"`
+}
+
+// testEvents returns n test events with the UIDs 0, 1, and so on.
+func testEvents(n int) []calendar.Event {
+	events := make([]calendar.Event, n)
+	for i := range events {
+		events[i] = &testEvent{uid: fmt.Sprint(i)}
+	}
+	return events
+}
+
+// uidsOf returns the UIDs of the given records.
+func uidsOf(t *testing.T, entries []*kinesis.PutRecordsRequestEntry) []string {
+	uids := make([]string, len(entries))
+	for i, entry := range entries {
+		var r decodedRecord
+		if err := json.Unmarshal(entry.Data, &r); err != nil {
+			t.Fatal(err)
+		}
+		uids[i] = r.UID
+	}
+	return uids
+}
+
+// testEvent is an event of the given UID.
+type testEvent struct {
+	calendar.Event
+	uid string
+}
+
+func (event *testEvent) UID() string        { return event.uid }
+func (event *testEvent) Subject() string    { return "Meeting" }
+func (event *testEvent) Start() time.Time   { return time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC) }
+func (event *testEvent) End() time.Time     { return time.Date(2020, 1, 2, 11, 0, 0, 0, time.UTC) }
+func (event *testEvent) TimeZone() string   { return "UTC" }
+func (event *testEvent) IsAllDay() bool     { return false }
+func (event *testEvent) CalendarID() string { return "/calendars/user/work/" }
+func (event *testEvent) LastModifiedAt() time.Time {
+	return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// statusedEvent is a test event with the given status.
+type statusedEvent struct {
+	testEvent
+	status status.Status
+}
+
+func (event *statusedEvent) Status() status.Status { return event.status }
+
+func TestNewRecordStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		event calendar.Event
+		want  string
+	}{
+		{name: "confirmed", event: &statusedEvent{testEvent: testEvent{uid: "a"}, status: status.Confirmed}, want: "Confirmed"},
+		{name: "tentative", event: &statusedEvent{testEvent: testEvent{uid: "a"}, status: status.Tentative}, want: "Tentative"},
+		{name: "cancelled", event: &statusedEvent{testEvent: testEvent{uid: "a"}, status: status.Cancelled}, want: "Cancelled"},
+		{name: "without status", event: &testEvent{uid: "a"}, want: "Unknown"},
+	}
+	for _, test := range tests {
+		if got := newRecord("user-1", test.event, storage.Updated).Status; got != test.want {
+			t.Errorf("%s: Status = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPublishEventsPartitionsByUser(t *testing.T) {
+	client := &fakeKinesis{}
+	sink := NewKinesisEventSink(client, "events")
+
+	if err := sink.PublishEvent("user-1", &statusedEvent{testEvent: testEvent{uid: "a"}, status: status.Cancelled}, storage.Created); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.requests) != 1 || len(client.requests[0]) != 1 {
+		t.Fatalf("requests = %v, want one of one record", client.requests)
+	}
+	entry := client.requests[0][0]
+	if aws.StringValue(entry.PartitionKey) != "user-1" {
+		t.Errorf("PartitionKey = %q, want user-1", aws.StringValue(entry.PartitionKey))
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(entry.Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"userID":       "user-1",
+		"changeType":   "Created",
+		"uid":          "a",
+		"subject":      "Meeting",
+		"start":        "2020-01-02T10:00:00Z",
+		"end":          "2020-01-02T11:00:00Z",
+		"timeZone":     "UTC",
+		"isAllDay":     false,
+		"calendarID":   "/calendars/user/work/",
+		"lastModified": "2020-01-01T00:00:00Z",
+		"status":       "Cancelled",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("record = %v, want %v", got, want)
+	}
+}
+
+func TestPublishEventsDeletion(t *testing.T) {
+	client := &fakeKinesis{}
+	sink := NewKinesisEventSink(client, "events")
+
+	if err := sink.PublishEvents("user-1", []calendar.Event{storage.DeletedEvent("a")}, storage.Deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	var r decodedRecord
+	if err := json.Unmarshal(client.requests[0][0].Data, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.ChangeType != "Deleted" || r.UID != "a" || r.UserID != "user-1" {
+		t.Errorf("record = %+v, want the deletion of a", r)
+	}
+}
+
+func TestPublishEventsInBatches(t *testing.T) {
+	tests := []struct {
+		events int
+		want   []int
+	}{
+		{events: 0, want: []int{}},
+		{events: 1, want: []int{1}},
+		{events: 500, want: []int{500}},
+		{events: 501, want: []int{500, 1}},
+		{events: 1234, want: []int{500, 500, 234}},
+	}
+	for _, test := range tests {
+		client := &fakeKinesis{}
+		sink := NewKinesisEventSink(client, "events")
+
+		if err := sink.PublishEvents("user-1", testEvents(test.events), storage.Updated); err != nil {
+			t.Fatalf("%d events: PublishEvents() error = %v", test.events, err)
+		}
+
+		got := []int{}
+		for _, request := range client.requests {
+			got = append(got, len(request))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%d events: batches of %v records, want %v", test.events, got, test.want)
+		}
+	}
+}
+
+func TestPublishEventsRetriesFailedRecords(t *testing.T) {
+	client := &fakeKinesis{failures: map[string]int{"1": 1, "3": 2}}
+	sink := NewKinesisEventSink(client, "events")
+
+	if err := sink.PublishEvents("user-1", testEvents(5), storage.Updated); err != nil {
+		t.Fatalf("PublishEvents() error = %v", err)
+	}
+
+	want := [][]string{{"0", "1", "2", "3", "4"}, {"1", "3"}, {"3"}}
+	if len(client.requests) != len(want) {
+		t.Fatalf("made %d requests, want %d", len(client.requests), len(want))
+	}
+	for i := range want {
+		if got := uidsOf(t, client.requests[i]); fmt.Sprint(got) != fmt.Sprint(want[i]) {
+			t.Errorf("request %d put %v, want %v", i, got, want[i])
+		}
+	}
+}
+
+func TestPublishEventsRetriesFailedRecordsOfEachBatch(t *testing.T) {
+	client := &fakeKinesis{failures: map[string]int{"0": 1, "500": 1}}
+	sink := NewKinesisEventSink(client, "events")
+
+	if err := sink.PublishEvents("user-1", testEvents(600), storage.Updated); err != nil {
+		t.Fatalf("PublishEvents() error = %v", err)
+	}
+
+	got := []string{}
+	for _, request := range client.requests {
+		got = append(got, fmt.Sprint(len(request)))
+	}
+	if want := []string{"500", "1", "100", "1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("batches of %v records, want %v", got, want)
+	}
+}
+
+func TestPublishEventsFailsAfterMaxAttempts(t *testing.T) {
+	client := &fakeKinesis{failures: map[string]int{"2": maxAttempts}}
+	sink := NewKinesisEventSink(client, "events")
+
+	err := sink.PublishEvents("user-1", testEvents(3), storage.Updated)
+	if !errors.HasCode(err, "WF11201") {
+		t.Errorf("PublishEvents() error = %v, want WF11201", err)
+	}
+	if len(client.requests) != maxAttempts {
+		t.Errorf("made %d requests, want %d", len(client.requests), maxAttempts)
+	}
+}
+
+func TestPublishEventsFailsIfRequestFails(t *testing.T) {
+	client := &fakeKinesis{err: fmt.Errorf("ResourceNotFoundException")}
+	sink := NewKinesisEventSink(client, "events")
+
+	if err := sink.PublishEvents("user-1", testEvents(3), storage.Updated); err != client.err {
+		t.Errorf("PublishEvents() error = %v, want %v", err, client.err)
+	}
+}
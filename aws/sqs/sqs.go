@@ -2,6 +2,7 @@ package sqs
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/WF/commongo/polling"
 	"github.com/Cepreu/Archive/errors"
@@ -20,6 +21,9 @@ type Message struct {
 	// A new receipt handle is returned every time you receive a message.
 	// When deleting a message, provide the last received receipt handle.
 	Handle string
+	// ReceiveCount is the (approximate) number of times the message has been
+	// received, including this time.
+	ReceiveCount int
 }
 
 // MessageQueue represents a message queue.
@@ -34,6 +38,26 @@ type MessageDeleter interface {
 	DeleteMessages(handles []string) error
 }
 
+// VisibilityChanger delays the redelivery of messages.
+type VisibilityChanger interface {
+	// ChangeVisibility makes the message with the given receipt handle
+	// invisible for the given duration (at most 12h) from now.
+	ChangeVisibility(handle string, timeout time.Duration) error
+}
+
+// MessageSender sends messages to the queue.
+type MessageSender interface {
+	// SendMessage sends a message with the given body to the queue.
+	SendMessage(body string) error
+}
+
+// DelayedSender sends messages that become visible after a delay.
+type DelayedSender interface {
+	// SendDelayedMessage sends a message with the given body to the queue
+	// that stays invisible for the given duration (at most 15m).
+	SendDelayedMessage(body string, delay time.Duration) error
+}
+
 type queue struct {
 	*sqs.SQS
 	*sqs.ReceiveMessageInput
@@ -42,6 +66,7 @@ type queue struct {
 
 const (
 	nonExistentQueueErrorCode = "AWS.SimpleQueueService.NonExistentQueue"
+	receiveCountAttribute     = "ApproximateReceiveCount"
 )
 
 var (
@@ -56,6 +81,7 @@ func NewMessageQueue(queueURL string) MessageQueue {
 			QueueUrl:            aws.String(queueURL),
 			MaxNumberOfMessages: aws.Int64(10),
 			WaitTimeSeconds:     aws.Int64(20),
+			AttributeNames:      aws.StringSlice([]string{receiveCountAttribute}),
 		},
 	}
 	r.receiveMessage = r.ReceiveMessage
@@ -100,12 +126,41 @@ func (q *queue) DeleteMessages(handles []string) error {
 	return err
 }
 
+// ChangeVisibility makes the message with the given receipt handle invisible
+// for the given duration from now.
+func (q *queue) ChangeVisibility(handle string, timeout time.Duration) error {
+	_, err := q.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          q.ReceiveMessageInput.QueueUrl,
+		ReceiptHandle:     aws.String(handle),
+		VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+	})
+	return err
+}
+
+// SendMessage sends a message with the given body to the queue.
+func (q *queue) SendMessage(body string) error {
+	_, err := q.SQS.SendMessage(&sqs.SendMessageInput{QueueUrl: q.ReceiveMessageInput.QueueUrl, MessageBody: aws.String(body)})
+	return err
+}
+
+// SendDelayedMessage sends a message with the given body to the queue that
+// stays invisible for the given duration.
+func (q *queue) SendDelayedMessage(body string, delay time.Duration) error {
+	_, err := q.SQS.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:     q.ReceiveMessageInput.QueueUrl,
+		MessageBody:  aws.String(body),
+		DelaySeconds: aws.Int64(int64(delay / time.Second)),
+	})
+	return err
+}
+
 // adaptMessages converys SQS messages (a vendored data type) into objects
 // of type Message.
 func adaptMessages(input []*sqs.Message) []*Message {
 	output := make([]*Message, len(input))
 	for i, message := range input {
-		output[i] = &Message{Body: *message.Body, Handle: *message.ReceiptHandle}
+		receiveCount, _ := strconv.Atoi(aws.StringValue(message.Attributes[receiveCountAttribute]))
+		output[i] = &Message{Body: *message.Body, Handle: *message.ReceiptHandle, ReceiveCount: receiveCount}
 	}
 	return output
 }
@@ -0,0 +1,93 @@
+package caldav
+
+import (
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/WF/go/calendar"
+)
+
+// Attachment describes a file attached to an event (see RFC 5545 section
+// 3.8.1.1) without its contents. It's meant to move to the calendar package
+// (as calendar.Attachment) once the other calendar backends expose
+// attachments as well.
+type Attachment struct {
+	// Name is the file name; empty if unknown.
+	Name string
+	// MIMEType is the media type (e.g., application/pdf); empty if unknown.
+	MIMEType string
+	// Size is in bytes; zero if unknown.
+	Size int64
+	// URL is where the attachment can be downloaded from; empty for inline
+	// attachments.
+	URL string
+	// ID identifies the attachment to its provider (e.g., an EWS attachment
+	// ID); empty for CalDAV, whose attachments are identified by URL.
+	ID string
+}
+
+// AttachmentEvent is an event that may carry attachments.
+type AttachmentEvent interface {
+	calendar.Event
+	// Attachments returns the event's attachments; empty if it has none.
+	Attachments() []Attachment
+}
+
+// Attachments returns the event's ATTACH properties; inline (BINARY)
+// attachments are described by their size only, without decoding them.
+func (item *calendarItem) Attachments() []Attachment {
+	attachments := []Attachment{}
+	if item.raw == nil {
+		return attachments
+	}
+
+	for _, p := range item.raw.propertiesNamed("ATTACH") {
+		attachments = append(attachments, newAttachment(p))
+	}
+	return attachments
+}
+
+func newAttachment(p *property) Attachment {
+	attachment := Attachment{MIMEType: p.param("FMTTYPE"), Name: attachmentName(p)}
+	if size, err := strconv.ParseInt(p.param("SIZE"), 10, 64); err == nil && size > 0 {
+		attachment.Size = size
+	}
+
+	if strings.ToUpper(p.param("VALUE")) == "BINARY" || strings.ToUpper(p.param("ENCODING")) == "BASE64" {
+		if attachment.Size == 0 {
+			attachment.Size = base64DecodedLen(p.value)
+		}
+		return attachment
+	}
+
+	attachment.URL = p.value
+	if attachment.Name == "" {
+		if parsed, err := url.Parse(p.value); err == nil && parsed.Path != "" {
+			if name := path.Base(parsed.Path); name != "/" && name != "." {
+				attachment.Name = name
+			}
+		}
+	}
+	return attachment
+}
+
+// attachmentName returns the file name of an ATTACH property, which is
+// standardized by RFC 8607 (FILENAME) but often sent as an extension
+// parameter instead.
+func attachmentName(p *property) string {
+	for _, name := range []string{"FILENAME", "X-FILENAME", "X-APPLE-FILENAME"} {
+		if value := p.param(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// base64DecodedLen returns the number of bytes that the given base64 text
+// decodes to, without decoding it.
+func base64DecodedLen(text string) int64 {
+	text = strings.TrimRight(strings.TrimSpace(text), "=")
+	return int64(len(text)) * 3 / 4
+}
@@ -0,0 +1,56 @@
+package caldav
+
+import (
+	"net/http"
+
+	"github.com/Cepreu/Archive/errors"
+)
+
+const (
+	authorization = "Authorization"
+	bearerPrefix  = "Bearer "
+)
+
+// bearerTokenRoundTripper authenticates requests with OAuth bearer tokens.
+type bearerTokenRoundTripper struct {
+	innerRoundTripper http.RoundTripper
+	email             string
+	tokenSource       func() (string, error)
+}
+
+func (transport *bearerTokenRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	token, err := transport.tokenSource()
+	if err != nil {
+		return nil, err
+	}
+
+	// round trippers mustn't modify the caller's request (e.g., lest the token
+	// end up in its logged headers)
+	request = request.Clone(request.Context())
+	request.Header.Set(authorization, bearerPrefix+token)
+	return transport.innerRoundTripper.RoundTrip(request)
+}
+
+// unauthorizedRoundTripper turns 401 responses into WF10002 errors so that
+// rejected credentials (e.g., a changed password, or a token that's been
+// revoked or lacks the required scopes) can be told apart from other
+// failures. Credentials are sent preemptively, so a 401 is never a challenge.
+type unauthorizedRoundTripper struct {
+	innerRoundTripper http.RoundTripper
+	username          string
+}
+
+func (transport *unauthorizedRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	// the inner round trippers (e.g., commongo's basic auth) set credentials
+	// on the request they're given, which mustn't be the caller's
+	response, err := transport.innerRoundTripper.RoundTrip(request.Clone(request.Context()))
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusUnauthorized {
+		response.Body.Close()
+		return nil, errors.WF10002(request.URL.Host, transport.username)
+	}
+	return response, nil
+}
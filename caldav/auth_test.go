@@ -0,0 +1,34 @@
+package caldav
+
+import (
+	"net/http"
+	"testing"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+func TestBearerTokenRoundTripperDoesNotModifyRequest(t *testing.T) {
+	var sent string
+	transport := &bearerTokenRoundTripper{
+		innerRoundTripper: roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+			sent = request.Header.Get(authorization)
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+		tokenSource: func() (string, error) { return "secret", nil },
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, "https://caldav.example.com/", nil)
+	if _, err := transport.RoundTrip(request); err != nil {
+		t.Fatal(err)
+	}
+	if sent != bearerPrefix+"secret" {
+		t.Errorf("sent Authorization %q, want %q", sent, bearerPrefix+"secret")
+	}
+	if got := request.Header.Get(authorization); got != "" {
+		t.Errorf("caller's request has Authorization %q, want none", got)
+	}
+}
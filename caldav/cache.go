@@ -0,0 +1,82 @@
+package caldav
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/WF/go/calendar"
+)
+
+// EventCache caches the parsed events of calendar queries by calendar and
+// query window. An entry is only served while the calendar's CTag is
+// unchanged, so calendars whose server doesn't support CTags aren't cached.
+// It's bounded (least recently used entries are evicted) and safe for
+// concurrent use; a single cache can be shared by many clients.
+type EventCache struct {
+	sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	// lru orders the entries from most to least recently used
+	lru *list.List
+}
+
+type cacheEntry struct {
+	key    string
+	ctag   string
+	events []calendar.Event
+}
+
+// NewEventCache creates a cache that holds at most the given number of
+// entries (i.e., query results).
+func NewEventCache(maxEntries int) *EventCache {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return &EventCache{maxEntries: maxEntries, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+// get returns the cached events of the given key, provided that they were
+// cached with the given CTag.
+func (cache *EventCache) get(key string, ctag string) ([]calendar.Event, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if entry.ctag != ctag {
+		cache.lru.Remove(element)
+		delete(cache.entries, key)
+		return nil, false
+	}
+	cache.lru.MoveToFront(element)
+	return entry.events, true
+}
+
+func (cache *EventCache) put(key string, ctag string, events []calendar.Event) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		element.Value = &cacheEntry{key: key, ctag: ctag, events: events}
+		cache.lru.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.lru.PushFront(&cacheEntry{key: key, ctag: ctag, events: events})
+	for cache.lru.Len() > cache.maxEntries {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheKey identifies a query of the given calendar of the client's user in
+// the given window; only queries of the same window (to the second) match,
+// so callers that want hits have to align their windows (e.g., to days).
+func (client *client) cacheKey(cal *calendarListEntry, startUTC time.Time, endUTC time.Time) string {
+	return client.server.Host + "|" + client.emailAddress + "|" + cal.path + "|" + startUTC.UTC().Format(utcDateTimeFormat) + "|" + endUTC.UTC().Format(utcDateTimeFormat)
+}
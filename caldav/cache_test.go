@@ -0,0 +1,108 @@
+package caldav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCacheKeyOfWindow(t *testing.T) {
+	client := &client{server: &url.URL{Scheme: "https", Host: "caldav.example.com"}, emailAddress: "user@example.com"}
+	cal := &calendarListEntry{path: "/calendars/user/work/"}
+	start := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 15)
+
+	if a, b := client.cacheKey(cal, start, end), client.cacheKey(cal, start.In(time.FixedZone("CET", 3600)), end); a != b {
+		t.Errorf("keys of the same window differ: %q and %q", a, b)
+	}
+	if a, b := client.cacheKey(cal, start, end), client.cacheKey(cal, start, end.Add(time.Second)); a == b {
+		t.Errorf("keys of different windows are both %q", a)
+	}
+}
+
+func TestEventCache(t *testing.T) {
+	cache := NewEventCache(2)
+	cache.put("a", "ctag-1", nil)
+	cache.put("b", "ctag-1", nil)
+
+	if _, ok := cache.get("a", "ctag-1"); !ok {
+		t.Error("a isn't cached")
+	}
+	if _, ok := cache.get("b", "ctag-2"); ok {
+		t.Error("b is served although its calendar changed")
+	}
+	cache.put("c", "ctag-1", nil)
+	cache.put("d", "ctag-1", nil)
+	if _, ok := cache.get("a", "ctag-1"); ok {
+		t.Error("a is still cached beyond the cache's size")
+	}
+	if _, ok := cache.get("d", "ctag-1"); !ok {
+		t.Error("d isn't cached")
+	}
+}
+
+func TestDiscoveryCacheEvictsExpiredEntries(t *testing.T) {
+	now := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	cache := NewDiscoveryCache(time.Hour)
+	cache.now = func() time.Time { return now }
+
+	cache.put("caldav.example.com", "a", "https://caldav.example.com", "/calendars/a/")
+	now = now.Add(30 * time.Minute)
+	cache.put("caldav.example.com", "b", "https://caldav.example.com", "/calendars/b/")
+	if server, href, ok := cache.get("caldav.example.com", "a"); !ok || server != "https://caldav.example.com" || href != "/calendars/a/" {
+		t.Errorf("get(a) = %q, %q, %v, want the cached entry", server, href, ok)
+	}
+
+	// a expires after an hour, but it's only evicted by the next put
+	now = now.Add(29 * time.Minute)
+	cache.put("caldav.example.com", "c", "https://caldav.example.com", "/calendars/c/")
+	if len(cache.entries) != 3 {
+		t.Errorf("len(entries) = %d, want 3 before a expires", len(cache.entries))
+	}
+	now = now.Add(2 * time.Minute)
+	cache.put("caldav.example.com", "d", "https://caldav.example.com", "/calendars/d/")
+	if len(cache.entries) != 3 {
+		t.Errorf("len(entries) = %d, want 3 after the sweep", len(cache.entries))
+	}
+	if _, ok := cache.entries[discoveryKey{host: "caldav.example.com", username: "a"}]; ok {
+		t.Error("a is still cached after it expired")
+	}
+}
+
+func TestQueryEventsServesCachedEventsWhileCTagIsUnchanged(t *testing.T) {
+	reports := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		reports++
+		writer.WriteHeader(http.StatusMultiStatus)
+		writer.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"></d:multistatus>`))
+	}))
+	t.Cleanup(server.Close)
+	serverURL, _ := url.Parse(server.URL)
+	client := &client{server: serverURL, emailAddress: "user@example.com", httpClient: server.Client(), options: newClientOptions([]ClientOption{WithEventCache(NewEventCache(10))})}
+	start := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 15)
+
+	tests := []struct {
+		ctag        string
+		wantReports int
+	}{
+		{ctag: "1", wantReports: 1},
+		{ctag: "1", wantReports: 1}, // cached
+		{ctag: "2", wantReports: 2}, // changed
+		{ctag: "2", wantReports: 2},
+		{ctag: "", wantReports: 3}, // not cacheable
+		{ctag: "", wantReports: 4},
+	}
+	for i, test := range tests {
+		cal := &calendarListEntry{path: "/calendars/user/work/", ctag: test.ctag}
+		if _, err := client.queryEvents(context.Background(), cal, start, end); err != nil {
+			t.Fatal(err)
+		}
+		if reports != test.wantReports {
+			t.Errorf("query %d with CTag %q sent %d reports in total, want %d", i, test.ctag, reports, test.wantReports)
+		}
+	}
+}
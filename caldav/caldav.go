@@ -1,8 +1,11 @@
 package caldav
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/WF/caldav-go/caldav"
@@ -11,25 +14,38 @@ import (
 	common "github.com/WF/commongo/log"
 	"github.com/WF/commongo/web"
 	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/circuitbreaker"
 	"github.com/Cepreu/Archive/errors"
 	"github.com/Cepreu/Archive/log"
+	"github.com/Cepreu/Archive/tracing"
+	"golang.org/x/net/publicsuffix"
 )
 
 const (
-	reportMethod  = "REPORT"
-	depth         = "Depth"
-	prefer        = "Prefer"
-	returnMinimal = "return-minimal"
+	reportMethod    = "REPORT"
+	depth           = "Depth"
+	prefer          = "Prefer"
+	returnMinimal   = "return-minimal"
+	userAgentHeader = "User-Agent"
+	// breakerThreshold is how many consecutive failures open the circuit of
+	// a host, and breakerOpenDuration how long it stays open
+	breakerThreshold    = 5
+	breakerOpenDuration = 30 * time.Second
 )
 
 var (
-	paths = []string{"", "/caldav", "/caldav/st", "/.well-known/caldav"}
+	// paths are the generic candidate paths; the well-known URI (see RFC 6764)
+	// is the standard, so it's tried first
+	paths = []string{wellKnownPath, "", "/caldav", "/caldav/st"}
 	// Adds custom headers and logging to all CalDAV requests
-	transport = &customHeadersRoundTripper{innerRoundTripper: loggingTransport, depth: "1", prefer: returnMinimal}
+	transport = newCustomHeadersTransport(loggingTransport, "", nil)
 	// Adds a leveled logging with a CalDav: prefix to all CalDAV requests
-	loggingTransport = web.NewLeveledLoggerRoundTripper(
-		http.DefaultTransport,
-		common.NewPrefixedLeveledLogger(log.CurrentLogger(), "CalDAV:"))
+	loggingTransport = newLoggingTransport(&gzipRoundTripper{innerRoundTripper: retryingTransport})
+	// Retries the idempotent requests that are throttled
+	retryingTransport = newRetryRoundTripper(breakerTransport, defaultMaxRetries, defaultMaxRetryWait)
+	// Fails fast on hosts that keep failing (e.g., servers that are down)
+	breakerTransport = circuitbreaker.NewRoundTripper(&certificateRoundTripper{innerRoundTripper: http.DefaultTransport}, breakerThreshold, breakerOpenDuration)
+
 	findCurrentUserPrincipalRequestBody = &entities.Propfind{
 		Props: []*entities.Prop{
 			{CurrentUserPrincipal: &entities.CurrentUserPrincipal{}},
@@ -40,76 +56,396 @@ var (
 	}
 )
 
-// NewClient creates a new authenticated CalDAV client.
-func NewClient(host string, username string, password string) (calendar.Client, error) {
-	httpClient := &http.Client{
-		Timeout:   time.Minute,
-		Transport: web.NewBasicAuthRoundTripper(transport, username, password),
+// NewClient creates a new CalDAV client authenticated with basic auth.
+func NewClient(host string, username string, password string, options ...ClientOption) (calendar.Client, error) {
+	return NewClientContext(context.Background(), host, username, password, options...)
+}
+
+// NewClientWithOptions is like NewClient, but tunes the client's timeouts and
+// connection pooling with the given options (see WithOptions).
+func NewClientWithOptions(host string, username string, password string, opts Options) (calendar.Client, error) {
+	return NewClient(host, username, password, WithOptions(opts))
+}
+
+// NewClientContext is like NewClient, but discovery is cancelled with the
+// given context.
+func NewClientContext(ctx context.Context, host string, username string, password string, options ...ClientOption) (calendar.Client, error) {
+	o := newClientOptions(options)
+	client, err := discoverClient(ctx, host, username, web.NewBasicAuthRoundTripper(newTransport(o), username, password), o)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewClientWithToken creates a new CalDAV client authenticated with OAuth
+// bearer tokens (e.g., for Google). The token source is called for every
+// request so that tokens can be refreshed (outside this package) as needed.
+func NewClientWithToken(host string, email string, tokenSource func() (string, error), options ...ClientOption) (calendar.Client, error) {
+	return NewClientWithTokenContext(context.Background(), host, email, tokenSource, options...)
+}
+
+// NewClientWithTokenContext is like NewClientWithToken, but discovery is
+// cancelled with the given context.
+func NewClientWithTokenContext(ctx context.Context, host string, email string, tokenSource func() (string, error), options ...ClientOption) (calendar.Client, error) {
+	o := newClientOptions(options)
+	authTransport := &bearerTokenRoundTripper{innerRoundTripper: newTransport(o), email: email, tokenSource: tokenSource}
+	client, err := discoverClient(ctx, host, email, authTransport, o)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// discoverClient discovers the server at the given host (which may include a
+// scheme or port; see NormalizeHost) unless it's in the discovery cache, and
+// creates a client for it that authenticates using the given round tripper.
+// The discovery requests are cancelled with the given context; the client's
+// requests aren't.
+func discoverClient(ctx context.Context, host string, username string, authTransport http.RoundTripper, o *clientOptions) (*client, error) {
+	host = NormalizeHost(host)
+	httpClient := newHTTPClient(authTransport, username, o)
+
+	if o.discoveryCache != nil {
+		if server, href, ok := o.discoveryCache.get(host, username); ok {
+			log.Debug("Using cached CalDAV discovery", "host", host, "server", server, "calendarHomeSet", href)
+			return newDiscoveredClient(host, username, server, &entities.CalendarHomeSet{Href: href}, httpClient, o)
+		}
+	}
+
+	// each attempt (the detection included) gets a shorter timeout than the
+	// client's requests
+	discoveryClient := withContext(ctx, &http.Client{Timeout: o.attemptTimeout, Transport: httpClient.Transport})
+
+	serverType := o.serverType
+	if o.detectServerType {
+		serverType = detectServerType(host, discoveryClient)
 	}
+	log.Debug("Discovering CalDAV server", "host", host, "serverType", serverType)
 
-	calendarClient, calendarHomeSet, err := discoverServer(host, httpClient)
+	genericPaths := paths
+	if o.discoveryPaths != nil {
+		genericPaths = o.discoveryPaths
+	}
+
+	server, calendarHomeSet, err := discoverServer(ctx, host, discoveryClient, serverType.paths(genericPaths))
+	if err != nil && o.emailDomainFallback && !isFatalDiscoveryError(err) && ctx.Err() == nil {
+		server, calendarHomeSet, err = discoverEmailDomain(ctx, host, username, discoveryClient, serverType.paths(genericPaths), err)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if o.discoveryCache != nil {
+		o.discoveryCache.put(host, username, server, calendarHomeSet.Href)
+	}
+	return newDiscoveredClient(host, username, server, calendarHomeSet, httpClient, o)
+}
 
-	path, err := url.QueryUnescape(calendarHomeSet.Href)
+// newDiscoveredClient creates a client for the given server and calendar home
+// set, which were discovered for the given user of the given host.
+func newDiscoveredClient(host string, username string, server string, calendarHomeSet *entities.CalendarHomeSet, httpClient *http.Client, o *clientOptions) (*client, error) {
+	caldavServer, err := caldav.NewServer(server)
+	if err != nil {
+		return nil, err
+	}
+	calendarClient := caldav.NewClient(caldavServer, httpClient)
+
+	client, err := newClient(calendarClient, server, calendarHomeSet, username, httpClient, o)
+	if err != nil {
+		return nil, err
+	}
+	client.host = host
+	return client, nil
+}
+
+func newHTTPClient(authTransport http.RoundTripper, username string, o *clientOptions) *http.Client {
+	return tracing.WrapHTTPClient(&http.Client{
+		Timeout: o.requestTimeout,
+		Transport: &limitedRoundTripper{
+			innerRoundTripper: &unauthorizedRoundTripper{innerRoundTripper: authTransport, username: username},
+			limit:             o.maxResponseSize,
+		},
+	}, "caldav")
+}
+
+func newClient(calendarClient *caldav.Client, server string, calendarHomeSet *entities.CalendarHomeSet, emailAddress string, httpClient *http.Client, options *clientOptions) (*client, error) {
+	serverURL, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+
+	href, err := url.Parse(calendarHomeSet.Href)
+	if err != nil {
+		return nil, err
+	}
+	if href.Host != "" && !sameHost(serverURL, href) {
+		// e.g., iCloud serves each user's calendars from a partition
+		// (pNN-caldav.icloud.com) of the server that discovery ended at
+		if !isPartitionOf(href, serverURL) {
+			return nil, errors.WF11206(serverURL.Host, href.Host)
+		}
+		log.Debug("Moving to the partition of the calendar home set", "server", serverURL.Host, "partition", href.Host)
+		serverURL = &url.URL{Scheme: href.Scheme, Host: href.Host}
+		partition, err := caldav.NewServer(serverURL.String())
+		if err != nil {
+			return nil, err
+		}
+		calendarClient = caldav.NewClient(partition, httpClient)
+	}
+
+	path, err := resolveHref(serverURL, calendarHomeSet.Href)
 	if err != nil {
 		return nil, err
 	}
 
 	return &client{
+		server:         serverURL,
 		path:           path,
-		emailAddress:   username,
+		emailAddress:   emailAddress,
 		calendarClient: calendarClient,
 		httpClient:     httpClient,
+		options:        options,
 	}, nil
 }
 
+// isPartitionOf determines whether the given URL is on a partition of the
+// given server over HTTPS, i.e., on a sibling host that only differs in its
+// first label (e.g., p42-caldav.icloud.com of caldav.icloud.com). Siblings
+// under a public suffix (e.g., x.co.uk of dav.co.uk, or b.github.io of
+// a.github.io) belong to unrelated owners, so they aren't partitions.
+func isPartitionOf(u *url.URL, server *url.URL) bool {
+	parent := strings.ToLower(parentDomain(server.Hostname()))
+	if !strings.EqualFold(u.Scheme, "https") || parent == "" || !strings.EqualFold(parentDomain(u.Hostname()), parent) {
+		return false
+	}
+	suffix, _ := publicsuffix.PublicSuffix(parent)
+	return suffix != parent
+}
+
+// parentDomain strips the first label of the given host name (e.g., it
+// returns icloud.com for caldav.icloud.com).
+func parentDomain(host string) string {
+	if i := strings.Index(host, "."); i >= 0 {
+		return host[i+1:]
+	}
+	return ""
+}
+
 type client struct {
+	// host is the host that the server was discovered from; empty if it
+	// wasn't discovered (e.g., for iCloud)
+	host           string
+	server         *url.URL
 	path           string
 	emailAddress   string
 	calendarClient *caldav.Client
 	httpClient     *http.Client `test-hook:"verify-unexported"`
+	options        *clientOptions
+}
+
+// resolve returns the URL of the given path on the client's server.
+func (client *client) resolve(path string) string {
+	return client.requestURL(path).String()
 }
 
-func discoverServer(host string, client *http.Client) (*caldav.Client, *entities.CalendarHomeSet, error) {
+// requestURL returns the URL of the given path on the client's server.
+func (client *client) requestURL(path string) *url.URL {
+	resolved := *client.server
+	resolved.Path = path
+	return &resolved
+}
+
+// discoverServer probes the candidate servers and paths of the given host for
+// the user's calendar home set, following their redirects. The server that's
+// returned is the one the redirects ended at. Probing stops at the first
+// error that every path would fail with (see isFatalDiscoveryError).
+func discoverServer(ctx context.Context, host string, client *http.Client, paths []string) (string, *entities.CalendarHomeSet, error) {
 	// See https://tools.ietf.org/html/rfc6764 for thorough discovery methods.
-	errs := []error{}
+	candidates := lookupServiceCandidates(ctx, host)
 	for _, path := range paths {
-		candidate, err := caldav.NewServer("https://" + host)
-		client := caldav.NewClient(candidate, client)
-		calendarHomeSet, err := findCalendarHomeSet(client, path)
+		candidates = append(candidates, &candidate{server: "https://" + host, path: path})
+	}
+
+	errs := []error{}
+	for _, candidate := range candidates {
+		if ctx.Err() != nil {
+			return "", nil, ctx.Err()
+		}
+		resolved, principal, err := findPrincipal(client, candidate)
+		if isFatalDiscoveryError(err) {
+			return "", nil, err
+		}
 		if err != nil {
-			errs = append(errs, err)
-		} else {
-			return client, calendarHomeSet, nil
+			errs = append(errs, fmt.Errorf("%s%s: %v", candidate.server, candidate.path, err))
+			continue
 		}
+		candidate = resolved
+
+		server, err := caldav.NewServer(candidate.server)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s%s: %v", candidate.server, candidate.path, err))
+			continue
+		}
+
+		calendarHomeSet, err := findCalendarHomeSetOfPrincipal(caldav.NewClient(server, client), principal)
+		if err == nil {
+			return candidate.server, calendarHomeSet, nil
+		}
+		if isFatalDiscoveryError(err) {
+			return "", nil, err
+		}
+		errs = append(errs, fmt.Errorf("%s%s: %v", candidate.server, candidate.path, err))
 	}
-	return nil, nil, errors.WF11301(errs...)
+	return "", nil, errors.WF11301(errs...)
 }
 
-func findCalendarHomeSet(client *caldav.Client, path string) (*entities.CalendarHomeSet, error) {
+// discoverEmailDomain probes the hosts of the given email address's domain
+// (see emailDomainHosts) after discovery failed at the given host with the
+// given error. It returns WF11301 with the error of every host attempted if
+// none of them has a CalDAV server.
+func discoverEmailDomain(ctx context.Context, host string, email string, client *http.Client, paths []string, hostErr error) (string, *entities.CalendarHomeSet, error) {
+	errs := []error{fmt.Errorf("%s: %v", host, hostErr)}
+	for _, fallback := range emailDomainHosts(email) {
+		if fallback == host {
+			continue
+		}
+
+		log.Debug("Falling back to the email domain for CalDAV discovery", "host", host, "fallback", fallback)
+		server, calendarHomeSet, err := discoverServer(ctx, fallback, client, paths)
+		if err == nil {
+			return server, calendarHomeSet, nil
+		}
+		if isFatalDiscoveryError(err) || ctx.Err() != nil {
+			return "", nil, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %v", fallback, err))
+	}
+	return "", nil, errors.WF11301(errs...)
+}
+
+// emailDomainHosts returns the candidate CalDAV hosts of the domain of the
+// given email address: the domain itself and its dav. and calendar.
+// subdomains. It returns none if the address has no domain.
+func emailDomainHosts(email string) []string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 || i == len(email)-1 {
+		return nil
+	}
+
+	domain := strings.ToLower(email[i+1:])
+	return []string{domain, "dav." + domain, "calendar." + domain}
+}
+
+// isFatalDiscoveryError determines whether the given error fails discovery
+// as a whole: rejected credentials (WF10002) are rejected on every path, and
+// an unverifiable certificate (WF10004) is presented on every path.
+func isFatalDiscoveryError(err error) bool {
+	return errors.HasCode(err, "WF10002") || errors.HasCode(err, "WF10004")
+}
+
+func findCurrentUserPrincipal(client *caldav.Client, path string) (string, error) {
 	multistatus, err := client.WebDAV().Propfind(path, webdav.Depth0, findCurrentUserPrincipalRequestBody)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	prop, err := findProp(multistatus, path, "current-user-principal", func(prop *entities.Prop) bool {
+		return prop.CurrentUserPrincipal != nil && prop.CurrentUserPrincipal.Href != ""
+	})
+	if err != nil {
+		return "", err
 	}
+	return normalizeHref(prop.CurrentUserPrincipal.Href)
+}
 
-	path, err = url.QueryUnescape(multistatus.Responses[0].PropStats[0].Prop.CurrentUserPrincipal.Href)
+func findCalendarHomeSetOfPrincipal(client *caldav.Client, principal string) (*entities.CalendarHomeSet, error) {
+	multistatus, err := client.WebDAV().Propfind(principal, webdav.Depth0, findCalendarHomeSetRequestBody)
 	if err != nil {
 		return nil, err
 	}
 
-	multistatus, err = client.WebDAV().Propfind(path, webdav.Depth0, findCalendarHomeSetRequestBody)
+	prop, err := findProp(multistatus, principal, "calendar-home-set", func(prop *entities.Prop) bool {
+		return prop.CalendarHomeSet != nil && prop.CalendarHomeSet.Href != ""
+	})
 	if err != nil {
 		return nil, err
 	}
-	return multistatus.Responses[0].PropStats[0].Prop.CalendarHomeSet, nil
+	return prop.CalendarHomeSet, nil
+}
+
+// findProp returns the found properties of a Depth: 0 PROPFIND response,
+// provided that they include the given property. Servers may return an empty
+// multistatus or report the property as not found (e.g., 404); a WF11202
+// error with the status of the propstats is returned in that case.
+func findProp(multistatus *entities.Multistatus, path string, property string, hasProperty func(*entities.Prop) bool) (*entities.Prop, error) {
+	if multistatus == nil || len(multistatus.Responses) == 0 || multistatus.Responses[0] == nil {
+		return nil, errors.WF11202(path, property, "empty multistatus")
+	}
+
+	response := multistatus.Responses[0]
+	if prop := foundProps(response); hasProperty(prop) {
+		return prop, nil
+	}
+
+	statuses := []string{}
+	for _, propertyStatus := range response.PropStats {
+		if propertyStatus != nil {
+			statuses = append(statuses, propertyStatus.Status)
+		}
+	}
+	if len(statuses) == 0 {
+		return nil, errors.WF11202(path, property, "no propstat")
+	}
+	return nil, errors.WF11202(path, property, strings.Join(statuses, ", "))
+}
+
+// foundProps merges the properties of all 2xx propstats of the given
+// response. RFC 4918 lets servers split found and not found properties into
+// separate propstats in any order (e.g., Radicale and SOGo list 404s first),
+// so a property is only absent if no 2xx propstat carries it.
+func foundProps(response *entities.Response) *entities.Prop {
+	found := &entities.Prop{}
+	for _, propertyStatus := range response.PropStats {
+		if propertyStatus == nil || propertyStatus.Prop == nil || !isSuccessStatus(propertyStatus.Status) {
+			continue
+		}
+
+		prop := propertyStatus.Prop
+		if found.CurrentUserPrincipal == nil {
+			found.CurrentUserPrincipal = prop.CurrentUserPrincipal
+		}
+		if found.CalendarHomeSet == nil {
+			found.CalendarHomeSet = prop.CalendarHomeSet
+		}
+		if found.DisplayName == "" {
+			found.DisplayName = prop.DisplayName
+		}
+		if found.CalendarTimezone == nil {
+			found.CalendarTimezone = prop.CalendarTimezone
+		}
+		if found.SupportedCalendarComponentSet == nil {
+			found.SupportedCalendarComponentSet = prop.SupportedCalendarComponentSet
+		}
+	}
+	return found
+}
+
+func newCustomHeadersTransport(inner http.RoundTripper, userAgent string, headers map[string]string) http.RoundTripper {
+	return &customHeadersRoundTripper{innerRoundTripper: inner, depth: "1", prefer: returnMinimal, userAgent: userAgent, headers: headers}
+}
+
+func newLoggingTransport(inner http.RoundTripper) http.RoundTripper {
+	return web.NewLeveledLoggerRoundTripper(inner, common.NewPrefixedLeveledLogger(log.CurrentLogger(), "CalDAV:"))
 }
 
 type customHeadersRoundTripper struct {
 	innerRoundTripper http.RoundTripper
 	depth             string
 	prefer            string
+	// userAgent replaces Go's default User-Agent if set
+	userAgent string
+	// headers are added to requests that don't set them already
+	headers map[string]string
 }
 
 func (transport *customHeadersRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
@@ -117,5 +453,13 @@ func (transport *customHeadersRoundTripper) RoundTrip(request *http.Request) (*h
 		request.Header.Add(depth, transport.depth)
 	}
 	request.Header.Add(prefer, transport.prefer)
+	if transport.userAgent != "" && request.Header.Get(userAgentHeader) == "" {
+		request.Header.Set(userAgentHeader, transport.userAgent)
+	}
+	for name, value := range transport.headers {
+		if request.Header.Get(name) == "" {
+			request.Header.Set(name, value)
+		}
+	}
 	return transport.innerRoundTripper.RoundTrip(request)
 }
@@ -0,0 +1,153 @@
+package caldav
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/WF/caldav-go/webdav/entities"
+	"github.com/Cepreu/Archive/errors"
+)
+
+func TestIsPartitionOf(t *testing.T) {
+	tests := []struct {
+		href   string
+		server string
+		want   bool
+	}{
+		{href: "https://p42-caldav.icloud.com/123/calendars/", server: "https://caldav.icloud.com", want: true},
+		{href: "https://P42-CalDAV.iCloud.com/123/calendars/", server: "https://caldav.icloud.com:443", want: true},
+		{href: "http://p42-caldav.icloud.com/123/calendars/", server: "https://caldav.icloud.com", want: false},
+		{href: "https://p42.caldav.icloud.com/123/calendars/", server: "https://caldav.icloud.com", want: false},
+		{href: "https://caldav.example.org/calendars/", server: "https://caldav.icloud.com", want: false},
+		{href: "https://x.co.uk/calendars/", server: "https://dav.co.uk", want: false},
+		{href: "https://b.github.io/calendars/", server: "https://a.github.io", want: false},
+		{href: "https://evil.com/calendars/", server: "https://caldav.com", want: false},
+		{href: "https://other/calendars/", server: "https://localhost", want: false},
+	}
+	for _, test := range tests {
+		href, _ := url.Parse(test.href)
+		server, _ := url.Parse(test.server)
+		if got := isPartitionOf(href, server); got != test.want {
+			t.Errorf("isPartitionOf(%q, %q) = %v, want %v", test.href, test.server, got, test.want)
+		}
+	}
+}
+
+func TestFindProp(t *testing.T) {
+	principal := &entities.Prop{CurrentUserPrincipal: &entities.CurrentUserPrincipal{Href: "/principals/user/"}}
+	tests := []struct {
+		name        string
+		multistatus *entities.Multistatus
+		// wantErr is the status reported by the WF11202 error, if any
+		wantErr string
+	}{
+		{name: "nil", multistatus: nil, wantErr: "empty multistatus"},
+		{name: "no responses", multistatus: &entities.Multistatus{}, wantErr: "empty multistatus"},
+		{name: "nil response", multistatus: &entities.Multistatus{Responses: []*entities.Response{nil}}, wantErr: "empty multistatus"},
+		{name: "no propstat", multistatus: &entities.Multistatus{Responses: []*entities.Response{{Href: "/"}}}, wantErr: "no propstat"},
+		{
+			name: "not found",
+			multistatus: &entities.Multistatus{Responses: []*entities.Response{{Href: "/", PropStats: []*entities.PropStat{
+				{Status: "HTTP/1.1 404 Not Found", Prop: &entities.Prop{CurrentUserPrincipal: &entities.CurrentUserPrincipal{}}},
+			}}}},
+			wantErr: "HTTP/1.1 404 Not Found",
+		},
+		{
+			name: "found without a value",
+			multistatus: &entities.Multistatus{Responses: []*entities.Response{{Href: "/", PropStats: []*entities.PropStat{
+				{Status: "HTTP/1.1 200 OK", Prop: &entities.Prop{CurrentUserPrincipal: &entities.CurrentUserPrincipal{}}},
+				nil,
+			}}}},
+			wantErr: "HTTP/1.1 200 OK",
+		},
+		{
+			name: "not found first",
+			multistatus: &entities.Multistatus{Responses: []*entities.Response{{Href: "/", PropStats: []*entities.PropStat{
+				{Status: "HTTP/1.1 404 Not Found", Prop: &entities.Prop{CalendarHomeSet: &entities.CalendarHomeSet{}}},
+				{Status: "HTTP/1.1 200 OK", Prop: principal},
+			}}}},
+		},
+		{
+			name: "without a prop",
+			multistatus: &entities.Multistatus{Responses: []*entities.Response{{Href: "/", PropStats: []*entities.PropStat{
+				{Status: "HTTP/1.1 200 OK"},
+				{Status: "HTTP/1.1 200 OK", Prop: principal},
+			}}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prop, err := findProp(test.multistatus, "/", "current-user-principal", func(prop *entities.Prop) bool {
+				return prop.CurrentUserPrincipal != nil && prop.CurrentUserPrincipal.Href != ""
+			})
+			if test.wantErr != "" {
+				if !errors.HasCode(err, "WF11202") || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("findProp() = %v, %v, want WF11202 with %q", prop, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || prop.CurrentUserPrincipal.Href != "/principals/user/" {
+				t.Errorf("findProp() = %+v, %v, want the principal", prop, err)
+			}
+		})
+	}
+}
+
+// TestFoundProps covers responses whose not found properties come first, as
+// Radicale's and SOGo's do.
+func TestFoundProps(t *testing.T) {
+	response := &entities.Response{Href: "/user/", PropStats: []*entities.PropStat{
+		{Status: "HTTP/1.1 404 Not Found", Prop: &entities.Prop{
+			DisplayName:     "not found",
+			CalendarHomeSet: &entities.CalendarHomeSet{Href: "/not-found/"},
+		}},
+		nil,
+		{Status: "HTTP/1.1 200 OK", Prop: &entities.Prop{CurrentUserPrincipal: &entities.CurrentUserPrincipal{Href: "/user/"}}},
+		{Status: "HTTP/1.1 403 Forbidden", Prop: &entities.Prop{DisplayName: "forbidden"}},
+		{Status: "HTTP/1.0 200 OK", Prop: &entities.Prop{
+			CalendarHomeSet: &entities.CalendarHomeSet{Href: "/user/calendars/"},
+			DisplayName:     "User",
+		}},
+		{Status: "HTTP/1.1 200 OK", Prop: &entities.Prop{DisplayName: "later"}},
+	}}
+
+	found := foundProps(response)
+	if found.CurrentUserPrincipal == nil || found.CurrentUserPrincipal.Href != "/user/" {
+		t.Errorf("CurrentUserPrincipal = %+v, want /user/", found.CurrentUserPrincipal)
+	}
+	if found.CalendarHomeSet == nil || found.CalendarHomeSet.Href != "/user/calendars/" {
+		t.Errorf("CalendarHomeSet = %+v, want /user/calendars/", found.CalendarHomeSet)
+	}
+	if found.DisplayName != "User" {
+		t.Errorf("DisplayName = %q, want User", found.DisplayName)
+	}
+	if found.SupportedCalendarComponentSet != nil {
+		t.Errorf("SupportedCalendarComponentSet = %+v, want nil", found.SupportedCalendarComponentSet)
+	}
+
+	// only not found properties
+	if found := foundProps(&entities.Response{PropStats: response.PropStats[:2]}); found.CalendarHomeSet != nil || found.DisplayName != "" {
+		t.Errorf("foundProps() of not found properties = %+v, want none", found)
+	}
+}
+
+func TestIsSuccessStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   bool
+	}{
+		{status: "HTTP/1.1 200 OK", want: true},
+		{status: "HTTP/1.0 204 No Content", want: true},
+		{status: "HTTP/1.1 404 Not Found", want: false},
+		{status: "HTTP/1.1 424 Failed Dependency", want: false},
+		{status: "HTTP/1.1 2000", want: false},
+		{status: "200", want: false},
+		{status: "", want: false},
+	}
+	for _, test := range tests {
+		if got := isSuccessStatus(test.status); got != test.want {
+			t.Errorf("isSuccessStatus(%q) = %v, want %v", test.status, got, test.want)
+		}
+	}
+}
@@ -1,99 +1,325 @@
 package caldav
 
 import (
-	"net/url"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/WF/caldav-go/caldav/entities"
+	"github.com/WF/caldav-go/icalendar"
 	"github.com/WF/caldav-go/icalendar/components"
-	"github.com/WF/caldav-go/webdav"
-	props "github.com/WF/caldav-go/webdav/entities"
 	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/log"
+	"github.com/Cepreu/Archive/tracing"
 )
 
 const (
 	calendarType = "VEVENT"
-	httpOK       = "HTTP/1.1 200 OK"
+	taskType     = "VTODO"
+	// maxConcurrentQueries bounds the number of calendars queried at once
+	maxConcurrentQueries = 4
+)
+
+const (
+	// findCalendarsBody requests the properties of the calendar collections;
+	// calendar-color and calendar-order are Apple extensions and getctag is a
+	// CalendarServer extension; other servers (e.g., Nextcloud) support them
+	// as well
+	findCalendarsBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:A="http://apple.com/ns/ical/" xmlns:CS="http://calendarserver.org/ns/">
+  <D:prop>
+    <D:resourcetype/>
+    <D:displayname/>
+    <C:calendar-timezone/>
+    <C:supported-calendar-component-set/>
+    <A:calendar-color/>
+    <A:calendar-order/>
+    <CS:getctag/>
+  </D:prop>
+</D:propfind>`
 )
 
 var (
-	findCalendarsRequestBody = &props.Propfind{
-		Props: []*props.Prop{
-			&props.Prop{
-				DisplayName:                   " ", // non-empty so that it's not omitted
-				CalendarTimezone:              &components.TimeZone{},
-				SupportedCalendarComponentSet: &props.SupportedCalendarComponentSet{},
-			},
-		},
-	}
+	// floatingFallbacks records the calendars whose floating times have been
+	// logged as interpreted as UTC
+	floatingFallbacks = &loggedKeys{}
 )
 
+// ContextEventGetter gets events from a user's calendars with a context.
+type ContextEventGetter interface {
+	// CalendarEventsContext gets events from the user's calendars in the
+	// specified time window; the requests are cancelled (and traced) with the
+	// given context.
+	CalendarEventsContext(ctx context.Context, startUTC time.Time, endUTC time.Time) ([]calendar.Event, error)
+}
+
 // CalendarEvents gets events from the user's calendars in the specified time
-// window.
+// window. If only some of the calendars fail to be queried, the events of the
+// rest are returned alongside a WF11302 error.
 func (client *client) CalendarEvents(startUTC time.Time, endUTC time.Time) ([]calendar.Event, error) {
-	query, err := entities.NewEventRangeQuery(startUTC, endUTC)
+	return client.CalendarEventsContext(context.Background(), startUTC, endUTC)
+}
+
+// CalendarEventsContext is like CalendarEvents, but its requests are
+// cancelled with the given context and traced as part of its segment.
+func (client *client) CalendarEventsContext(ctx context.Context, startUTC time.Time, endUTC time.Time) ([]calendar.Event, error) {
+	ctx, endSubsegment := tracing.StartSubsegment(ctx, "caldav.CalendarEvents")
+	defer endSubsegment()
+
+	calendars, err := client.findCalendars(ctx)
 	if err != nil {
 		return nil, err
 	}
+	calendars = calendarsSupporting(calendars, calendarType) // skip task lists
+
+	// query calendars concurrently but aggregate the results in discovery order
+	results := make([][]calendar.Event, len(calendars))
+	errs := make([]error, len(calendars))
+	semaphore := make(chan struct{}, maxConcurrentQueries)
+	var wg sync.WaitGroup
+	for i, calendar := range calendars {
+		wg.Add(1)
+		go func(i int, calendar *calendarListEntry) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			results[i], errs[i] = client.queryEvents(ctx, calendar, startUTC, endUTC)
+		}(i, calendar)
+	}
+	wg.Wait()
 
-	calendars, err := client.findCalendars()
+	// tolerate failing calendars (e.g., permission-restricted ones) so that
+	// the user still gets the events of the healthy calendars
+	calendarItems := []calendar.Event{}
+	failures := []error{}
+	for i, cal := range calendars {
+		if errs[i] != nil {
+			failures = append(failures, errors.WF11203(cal.path, errs[i]))
+			continue
+		}
+		calendarItems = append(calendarItems, results[i]...)
+	}
+
+	switch {
+	case len(failures) == 0:
+		return calendarItems, nil
+	case len(failures) == len(calendars):
+		return nil, errors.WF11301(failures...)
+	case client.options.strict:
+		return nil, failures[0]
+	default:
+		return calendarItems, errors.WF11302(failures...)
+	}
+}
+
+// queryEvents gets the events of the given calendar in the specified time
+// window; they're served from the event cache (if any) while the calendar's
+// CTag is unchanged.
+func (client *client) queryEvents(ctx context.Context, cal *calendarListEntry, startUTC time.Time, endUTC time.Time) ([]calendar.Event, error) {
+	cache := client.options.eventCache
+	cacheable := cache != nil && cal.ctag != ""
+	key := client.cacheKey(cal, startUTC, endUTC)
+	if cacheable {
+		if events, ok := cache.get(key, cal.ctag); ok {
+			log.Debug("Serving cached events", "path", cal.path, "ctag", cal.ctag, "len(events)", len(events))
+			return events, nil
+		}
+	}
+
+	resources, err := client.queryResources(ctx, cal.path, calendarType, startUTC, endUTC)
 	if err != nil {
 		return nil, err
 	}
 
-	calendarItems := []calendar.Event{}
-	for _, calendar := range calendars {
-		events, err := client.calendarClient.QueryEvents(calendar.path, query)
+	calendarItems := make([]calendar.Event, 0, len(resources))
+	for _, resource := range resources {
+		events, err := newCalendarItems(resource, cal, client.options.maxDescriptionSize)
 		if err != nil {
 			return nil, err
 		}
-
-		for _, event := range events {
-			calendarItems = append(calendarItems, newCalendarItem(event, calendar))
-		}
+		calendarItems = append(calendarItems, withinWindow(events, startUTC, endUTC)...)
 	}
 
+	if cacheable {
+		cache.put(key, cal.ctag, calendarItems)
+	}
 	return calendarItems, nil
 }
 
-func (client *client) findCalendars() ([]*calendarListEntry, error) {
-	multistatus, err := client.calendarClient.WebDAV().Propfind(client.path, webdav.Depth1, findCalendarsRequestBody)
+// newCalendarItems converts the VEVENTs of the given resource into calendar
+// items whose HTML descriptions are truncated to the given size.
+func newCalendarItems(resource *resource, cal *calendarListEntry, maxDescriptionSize int) ([]calendar.Event, error) {
+	object := &components.Calendar{}
+	if err := icalendar.Unmarshal(resource.data, object); err != nil {
+		return nil, err
+	}
+
+	// caldav-go drops the properties (and value types) it doesn't model, so
+	// the raw VEVENTs are kept alongside; both are in document order
+	raw := rawComponents(resource, calendarType)
+	items := make([]calendar.Event, 0, len(object.Events))
+	for i, event := range object.Events {
+		var component *component
+		if len(raw) == len(object.Events) {
+			component = raw[i]
+		}
+		item := newCalendarItem(event, component, cal, resource)
+		item.maxDescriptionSize = maxDescriptionSize
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (client *client) findCalendars(ctx context.Context) ([]*calendarListEntry, error) {
+	multistatus, err := client.propfind(ctx, client.path, "1", findCalendarsBody)
 	if err != nil {
 		return nil, err
 	}
 
 	calendars := make([]*calendarListEntry, 0, len(multistatus.Responses))
 	for _, response := range multistatus.Responses {
-		propertyStatus := response.PropStats[0]
-		if propertyStatus.Status == httpOK && propertyStatus.Prop.SupportedCalendarComponentSet != nil {
-			for _, component := range propertyStatus.Prop.SupportedCalendarComponentSet.Components {
-				if component.Name == calendarType {
-					path, err := url.QueryUnescape(response.Href)
-					if err != nil {
-						return nil, err
-					}
-
-					cal := &calendarListEntry{
-						path:         path,
-						emailAddress: client.emailAddress,
-						displayName:  response.PropStats[0].Prop.DisplayName,
-						timeZone:     extractTimeZoneID(response.PropStats[0].Prop.CalendarTimezone),
-					}
-					calendars = append(calendars, cal)
-					break
-				}
-			}
+		prop := response.found()
+		supported := supportedComponents(prop)
+		if len(supported) == 0 {
+			continue
 		}
+
+		path, err := resolveHref(client.requestURL(client.path), response.Href)
+		if err != nil {
+			return nil, err
+		}
+
+		cal := &calendarListEntry{
+			path:         path,
+			emailAddress: client.emailAddress,
+			displayName:  prop.DisplayName,
+			timeZone:     extractTimeZoneID(prop.CalendarTimezone),
+			color:        prop.CalendarColor,
+			order:        parseCalendarOrder(prop.CalendarOrder),
+			ctag:         prop.CTag,
+			components:   supported,
+		}
+		calendars = append(calendars, cal)
 	}
 
 	return calendars, nil
 }
 
-func extractTimeZoneID(timeZone *components.TimeZone) string {
-	if timeZone == nil {
+// supportedComponents returns the component types (VEVENT and/or VTODO) that
+// the collection with the given properties supports, in any order. Servers
+// may omit supported-calendar-component-set (e.g., Nextcloud for some
+// collections), in which case calendar collections are assumed to support
+// VEVENT; other collections (e.g., the calendar home set) support none.
+func supportedComponents(prop *prop) []string {
+	if prop.SupportedComponentSet == nil {
+		if prop.ResourceType != nil && prop.ResourceType.Calendar != nil {
+			return []string{calendarType}
+		}
+		return nil
+	}
+
+	supported := []string{}
+	for _, component := range prop.SupportedComponentSet.Components {
+		if component.Name == calendarType || component.Name == taskType {
+			supported = append(supported, component.Name)
+		}
+	}
+	return supported
+}
+
+// CalendarInfo describes one of the user's calendars.
+type CalendarInfo struct {
+	Path        string
+	DisplayName string
+	// TimeZone is an IANA identifier; empty if the calendar has none.
+	TimeZone string
+	// CTag changes whenever the calendar's contents change, so a calendar
+	// whose CTag hasn't changed needn't be queried again. It's empty if the
+	// server doesn't support CTags, in which case the calendar always has to
+	// be queried.
+	CTag string
+	// Components lists the supported component types (VEVENT and/or VTODO).
+	Components []string
+}
+
+// CalendarLister lists a user's calendars.
+type CalendarLister interface {
+	// Calendars gets the user's calendars (and task lists).
+	Calendars() ([]CalendarInfo, error)
+}
+
+// Calendars gets the user's calendars (and task lists).
+func (client *client) Calendars() ([]CalendarInfo, error) {
+	return client.CalendarsContext(context.Background())
+}
+
+// CalendarsContext is like Calendars, but its request is cancelled with the
+// given context.
+func (client *client) CalendarsContext(ctx context.Context) ([]CalendarInfo, error) {
+	calendars, err := client.findCalendars(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]CalendarInfo, 0, len(calendars))
+	for _, cal := range calendars {
+		infos = append(infos, CalendarInfo{
+			Path:        cal.path,
+			DisplayName: cal.displayName,
+			TimeZone:    cal.timeZone,
+			CTag:        cal.ctag,
+			Components:  cal.components,
+		})
+	}
+	return infos, nil
+}
+
+// calendarsSupporting returns the calendars that support the given component
+// type (e.g., VEVENT).
+func calendarsSupporting(calendars []*calendarListEntry, componentType string) []*calendarListEntry {
+	supporting := []*calendarListEntry{}
+	for _, cal := range calendars {
+		if cal.supports(componentType) {
+			supporting = append(supporting, cal)
+		}
+	}
+	return supporting
+}
+
+// extractTimeZoneID returns the IANA identifier (see resolveTimeZone) of the
+// time zone defined by the given calendar-timezone property; that's an
+// iCalendar object with a single VTIMEZONE.
+func extractTimeZoneID(calendarTimezone string) string {
+	if strings.TrimSpace(calendarTimezone) == "" {
+		return ""
+	}
+
+	components, err := parseComponents(calendarTimezone)
+	if err != nil {
+		log.Debug("Failed to parse calendar-timezone", "err", err)
 		return ""
 	}
-	return timeZone.Id
+	for _, c := range components {
+		timeZones := append(c.children("VTIMEZONE"), c)
+		for _, timeZone := range timeZones {
+			if timeZone.name == "VTIMEZONE" && timeZone.value("TZID") != "" {
+				return resolveTimeZone(timeZone.value("TZID"))
+			}
+		}
+	}
+	return ""
+}
+
+// parseCalendarOrder parses a calendar-order property; calendars without one
+// (i.e., 0) are sorted last by clients.
+func parseCalendarOrder(value string) int {
+	order, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0
+	}
+	return order
 }
 
 type calendarListEntry struct {
@@ -101,4 +327,48 @@ type calendarListEntry struct {
 	emailAddress string
 	displayName  string
 	timeZone     string
+	// color is a CSS color (e.g., "#FF0000FF"); empty if unsupported
+	color string
+	order int
+	// ctag changes whenever the calendar's contents change; empty if
+	// unsupported
+	ctag       string
+	components []string
+	// resolvedLocation is the location of timeZone, loaded once
+	locationOnce     sync.Once
+	resolvedLocation *time.Location
+}
+
+func (cal *calendarListEntry) supports(componentType string) bool {
+	for _, component := range cal.components {
+		if component == componentType {
+			return true
+		}
+	}
+	return false
+}
+
+// location returns the calendar's time zone; UTC if it has none or it's not
+// recognized.
+func (cal *calendarListEntry) location() *time.Location {
+	cal.locationOnce.Do(func() {
+		cal.resolvedLocation = time.UTC
+		if location, err := time.LoadLocation(cal.timeZone); err == nil {
+			cal.resolvedLocation = location
+		}
+	})
+	return cal.resolvedLocation
+}
+
+// floatingLocation returns the time zone that floating times of the calendar
+// are in, i.e., location, but it logs (once per calendar) when that's UTC
+// only because the calendar's time zone isn't known.
+func (cal *calendarListEntry) floatingLocation() *time.Location {
+	location := cal.location()
+	if location == time.UTC && cal.timeZone != "UTC" {
+		if floatingFallbacks.first(cal.path) {
+			log.Warn("Interpreting floating times as UTC", "path", cal.path, "timeZone", cal.timeZone)
+		}
+	}
+	return location
 }
@@ -0,0 +1,427 @@
+package caldav
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/tracing"
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// nextcloudCalendars is a PROPFIND response of Nextcloud's calendar home set:
+// the home set, inbox, outbox, and trash bin have no component set, the
+// personal calendar lists VTODO first in a second propstat, and the shared
+// calendar omits its component set.
+const nextcloudCalendars = `<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:" xmlns:s="http://sabredav.org/ns" xmlns:cal="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/" xmlns:oc="http://owncloud.org/ns" xmlns:nc="http://nextcloud.org/ns" xmlns:x1="http://apple.com/ns/ical/">
+ <d:response>
+  <d:href>/remote.php/dav/calendars/user/</d:href>
+  <d:propstat>
+   <d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status>
+  </d:propstat>
+  <d:propstat>
+   <d:prop><d:displayname/><cal:supported-calendar-component-set/><cs:getctag/></d:prop>
+   <d:status>HTTP/1.1 404 Not Found</d:status>
+  </d:propstat>
+ </d:response>
+ <d:response>
+  <d:href>/remote.php/dav/calendars/user/personal/</d:href>
+  <d:propstat>
+   <d:prop><x1:calendar-color/></d:prop>
+   <d:status>HTTP/1.1 404 Not Found</d:status>
+  </d:propstat>
+  <d:propstat>
+   <d:prop>
+    <d:resourcetype><d:collection/><cal:calendar/></d:resourcetype>
+    <d:displayname>Personal</d:displayname>
+    <cal:supported-calendar-component-set><cal:comp name="VTODO"/><cal:comp name="VEVENT"/></cal:supported-calendar-component-set>
+    <cs:getctag>http://sabre.io/ns/sync/12</cs:getctag>
+   </d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status>
+  </d:propstat>
+ </d:response>
+ <d:response>
+  <d:href>/remote.php/dav/calendars/user/team_shared_by_admin/</d:href>
+  <d:propstat>
+   <d:prop>
+    <d:resourcetype><d:collection/><cal:calendar/><oc:shared/></d:resourcetype>
+    <d:displayname>Team</d:displayname>
+    <cs:getctag>http://sabre.io/ns/sync/3</cs:getctag>
+   </d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status>
+  </d:propstat>
+ </d:response>
+ <d:response>
+  <d:href>/remote.php/dav/calendars/user/inbox/</d:href>
+  <d:propstat>
+   <d:prop><d:resourcetype><d:collection/><cal:schedule-inbox/></d:resourcetype></d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status>
+  </d:propstat>
+ </d:response>
+ <d:response>
+  <d:href>/remote.php/dav/calendars/user/outbox/</d:href>
+  <d:propstat>
+   <d:prop><d:resourcetype><d:collection/><cal:schedule-outbox/></d:resourcetype></d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status>
+  </d:propstat>
+ </d:response>
+ <d:response>
+  <d:href>/remote.php/dav/calendars/user/trashbin/</d:href>
+  <d:propstat>
+   <d:prop><d:resourcetype><d:collection/><nc:trash-bin/></d:resourcetype></d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status>
+  </d:propstat>
+ </d:response>
+</d:multistatus>`
+
+// baikalCalendars is a PROPFIND response of Baïkal's calendar home set: the
+// default calendar supports events, the tasks calendar tasks only, and the
+// mixed calendar lists VEVENT last.
+const baikalCalendars = `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:" xmlns:s="http://sabredav.org/ns" xmlns:cal="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/">
+ <d:response>
+  <d:href>/dav.php/calendars/user/</d:href>
+  <d:propstat>
+   <d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status>
+  </d:propstat>
+ </d:response>
+ <d:response>
+  <d:href>/dav.php/calendars/user/default/</d:href>
+  <d:propstat>
+   <d:prop>
+    <d:resourcetype><d:collection/><cal:calendar/></d:resourcetype>
+    <d:displayname>Default calendar</d:displayname>
+    <cal:supported-calendar-component-set><cal:comp name="VEVENT"/></cal:supported-calendar-component-set>
+    <cs:getctag>7</cs:getctag>
+   </d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status>
+  </d:propstat>
+ </d:response>
+ <d:response>
+  <d:href>/dav.php/calendars/user/tasks/</d:href>
+  <d:propstat>
+   <d:prop>
+    <d:resourcetype><d:collection/><cal:calendar/></d:resourcetype>
+    <d:displayname>Tasks</d:displayname>
+    <cal:supported-calendar-component-set><cal:comp name="VTODO"/></cal:supported-calendar-component-set>
+   </d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status>
+  </d:propstat>
+ </d:response>
+ <d:response>
+  <d:href>/dav.php/calendars/user/mixed/</d:href>
+  <d:propstat>
+   <d:prop>
+    <d:resourcetype><d:collection/><cal:calendar/></d:resourcetype>
+    <d:displayname>Mixed</d:displayname>
+    <cal:supported-calendar-component-set><cal:comp name="VJOURNAL"/><cal:comp name="VTODO"/><cal:comp name="VEVENT"/></cal:supported-calendar-component-set>
+   </d:prop>
+   <d:status>HTTP/1.1 200 OK</d:status>
+  </d:propstat>
+ </d:response>
+</d:multistatus>`
+
+// newTestCalendarsClient returns a client of a server that answers
+// PROPFIND requests of the given calendar home set with the given body.
+func newTestCalendarsClient(t *testing.T, homeSet string, body string) *client {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != propfindMethod || request.URL.Path != homeSet {
+			http.NotFound(writer, request)
+			return
+		}
+		writer.Header().Set(contentType, xmlContentType)
+		writer.WriteHeader(http.StatusMultiStatus)
+		writer.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	serverURL, _ := url.Parse(server.URL)
+	return &client{server: serverURL, path: homeSet, emailAddress: "user@example.com", httpClient: server.Client(), options: newClientOptions(nil)}
+}
+
+func TestFindCalendars(t *testing.T) {
+	type found struct {
+		path        string
+		displayName string
+		ctag        string
+		components  []string
+	}
+	tests := []struct {
+		name    string
+		homeSet string
+		body    string
+		want    []found
+		// events is the number of calendars that support events
+		events int
+	}{
+		{
+			name:    "Nextcloud",
+			homeSet: "/remote.php/dav/calendars/user/",
+			body:    nextcloudCalendars,
+			want: []found{
+				{path: "/remote.php/dav/calendars/user/personal/", displayName: "Personal", ctag: "http://sabre.io/ns/sync/12", components: []string{taskType, calendarType}},
+				{path: "/remote.php/dav/calendars/user/team_shared_by_admin/", displayName: "Team", ctag: "http://sabre.io/ns/sync/3", components: []string{calendarType}},
+			},
+			events: 2,
+		},
+		{
+			name:    "Baikal",
+			homeSet: "/dav.php/calendars/user/",
+			body:    baikalCalendars,
+			want: []found{
+				{path: "/dav.php/calendars/user/default/", displayName: "Default calendar", ctag: "7", components: []string{calendarType}},
+				{path: "/dav.php/calendars/user/tasks/", displayName: "Tasks", components: []string{taskType}},
+				{path: "/dav.php/calendars/user/mixed/", displayName: "Mixed", components: []string{taskType, calendarType}},
+			},
+			events: 2,
+		},
+	}
+	for _, test := range tests {
+		client := newTestCalendarsClient(t, test.homeSet, test.body)
+		calendars, err := client.findCalendars(context.Background())
+		if err != nil {
+			t.Errorf("%s: findCalendars failed: %v", test.name, err)
+			continue
+		}
+
+		got := make([]found, len(calendars))
+		for i, cal := range calendars {
+			got[i] = found{path: cal.path, displayName: cal.displayName, ctag: cal.ctag, components: cal.components}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: findCalendars = %+v, want %+v", test.name, got, test.want)
+		}
+		if events := calendarsSupporting(calendars, calendarType); len(events) != test.events {
+			t.Errorf("%s: %d calendars support events, want %d", test.name, len(events), test.events)
+		}
+	}
+}
+
+func TestSupportedComponents(t *testing.T) {
+	calendarResource := &resourceType{Calendar: &struct{}{}}
+	components := func(names ...string) *supportedComponentSet {
+		set := &supportedComponentSet{}
+		for _, name := range names {
+			set.Components = append(set.Components, &supportedComponent{Name: name})
+		}
+		return set
+	}
+	tests := []struct {
+		name string
+		prop *prop
+		want []string
+	}{
+		{name: "home set", prop: &prop{}, want: nil},
+		{name: "calendar without component set", prop: &prop{ResourceType: calendarResource}, want: []string{calendarType}},
+		{name: "events", prop: &prop{ResourceType: calendarResource, SupportedComponentSet: components("VEVENT")}, want: []string{calendarType}},
+		{name: "tasks first", prop: &prop{ResourceType: calendarResource, SupportedComponentSet: components("VTODO", "VEVENT")}, want: []string{taskType, calendarType}},
+		{name: "journals only", prop: &prop{ResourceType: calendarResource, SupportedComponentSet: components("VJOURNAL")}, want: []string{}},
+	}
+	for _, test := range tests {
+		if got := supportedComponents(test.prop); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: supportedComponents = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// newTestEventsClient returns a client of a server with the given number of
+// calendars, which answers each REPORT with no events after the given
+// latency, except those of the given failing calendars, which it forbids.
+func newTestEventsClient(tb testing.TB, calendars int, latency time.Duration, failing ...int) *client {
+	homeSet := "/calendars/user/"
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">`)
+	for i := 0; i < calendars; i++ {
+		fmt.Fprintf(&body, `<D:response><D:href>%scalendar-%d/</D:href><D:propstat><D:prop><D:resourcetype><D:collection/><C:calendar/></D:resourcetype></D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`, homeSet, i)
+	}
+	body.WriteString(`</D:multistatus>`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set(contentType, xmlContentType)
+		switch {
+		case request.Method == propfindMethod && request.URL.Path == homeSet:
+			writer.WriteHeader(http.StatusMultiStatus)
+			writer.Write([]byte(body.String()))
+		case request.Method == reportMethod:
+			time.Sleep(latency)
+			for _, i := range failing {
+				if request.URL.Path == fmt.Sprintf("%scalendar-%d/", homeSet, i) {
+					http.Error(writer, "Forbidden", http.StatusForbidden)
+					return
+				}
+			}
+			writer.WriteHeader(http.StatusMultiStatus)
+			writer.Write([]byte(`<D:multistatus xmlns:D="DAV:"></D:multistatus>`))
+		default:
+			http.NotFound(writer, request)
+		}
+	}))
+	tb.Cleanup(server.Close)
+
+	serverURL, _ := url.Parse(server.URL)
+	return &client{server: serverURL, path: homeSet, emailAddress: "user@example.com", httpClient: server.Client(), options: newClientOptions(nil)}
+}
+
+// BenchmarkCalendarEvents measures querying calendars that take 5ms each to
+// answer; up to maxConcurrentQueries of them are queried at once.
+func BenchmarkCalendarEvents(b *testing.B) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, calendars := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("%d calendars", calendars), func(b *testing.B) {
+			client := newTestEventsClient(b, calendars, 5*time.Millisecond)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.CalendarEvents(start, start.AddDate(0, 0, 7)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCalendarEventsFailures(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		failing  []int
+		strict   bool
+		wantCode string
+		// wantEvents is set if the events of the healthy calendars are
+		// returned
+		wantEvents bool
+	}{
+		{name: "healthy", wantEvents: true},
+		{name: "healthy strict", strict: true, wantEvents: true},
+		{name: "some failing", failing: []int{1}, wantCode: "WF11302", wantEvents: true},
+		{name: "some failing strict", failing: []int{1}, strict: true, wantCode: "WF11203"},
+		{name: "all failing", failing: []int{0, 1, 2}, wantCode: "WF11301"},
+		{name: "all failing strict", failing: []int{0, 1, 2}, strict: true, wantCode: "WF11301"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestEventsClient(t, 3, 0, test.failing...)
+			client.options.strict = test.strict
+
+			events, err := client.CalendarEvents(start, start.AddDate(0, 0, 7))
+			switch {
+			case test.wantCode == "" && err != nil:
+				t.Fatalf("CalendarEvents() error = %v", err)
+			case test.wantCode != "" && !errors.HasCode(err, test.wantCode):
+				t.Fatalf("CalendarEvents() error = %v, want %s", err, test.wantCode)
+			}
+			if got := events != nil; got != test.wantEvents {
+				t.Errorf("CalendarEvents() returned events = %v, want %v", got, test.wantEvents)
+			}
+
+			// the paged query stops at the first failing calendar when strict
+			wantPagedCode := test.wantCode
+			if test.strict && len(test.failing) > 0 {
+				wantPagedCode = "WF11203"
+			}
+			pagedErr := client.CalendarEventsPaged(context.Background(), start, start.AddDate(0, 0, 7), PageOptions{}, func(string, []calendar.Event) error { return nil })
+			switch {
+			case wantPagedCode == "" && pagedErr != nil:
+				t.Errorf("CalendarEventsPaged() error = %v", pagedErr)
+			case wantPagedCode != "" && !errors.HasCode(pagedErr, wantPagedCode):
+				t.Errorf("CalendarEventsPaged() error = %v, want %s", pagedErr, wantPagedCode)
+			}
+		})
+	}
+}
+
+// segmentRecorder records the name of the X-Ray segment of each request.
+type segmentRecorder struct {
+	inner http.RoundTripper
+	names []string
+}
+
+func (recorder *segmentRecorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	if segment := xray.GetSegment(request.Context()); segment != nil {
+		recorder.names = append(recorder.names, segment.Name)
+	}
+	return recorder.inner.RoundTrip(request)
+}
+
+func TestCalendarEventsSubsegments(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	client := newTestEventsClient(t, 1, 0)
+	recorder := &segmentRecorder{inner: client.httpClient.Transport}
+	client.httpClient.Transport = recorder
+	ctx, endSegment := tracing.BeginSegment(context.Background(), "test")
+	defer endSegment(nil)
+
+	if _, err := client.CalendarEventsContext(ctx, start, start.AddDate(0, 0, 7)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CalendarEventsPaged(ctx, start, start.AddDate(0, 0, 7), PageOptions{}, func(string, []calendar.Event) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	// a PROPFIND and a REPORT each
+	want := []string{"caldav.CalendarEvents", "caldav.CalendarEvents", "caldav.CalendarEventsPaged", "caldav.CalendarEventsPaged"}
+	if !reflect.DeepEqual(recorder.names, want) {
+		t.Errorf("segments of the requests = %v, want %v", recorder.names, want)
+	}
+}
+
+// testPagedSeries is a weekly series that starts in the first week of 2020,
+// with its instance of the second week moved to a Friday.
+const testPagedSeries = `BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:series
+DTSTART:20200101T090000Z
+DTEND:20200101T100000Z
+RRULE:FREQ=WEEKLY;COUNT=4
+END:VEVENT
+BEGIN:VEVENT
+UID:series
+RECURRENCE-ID:20200108T090000Z
+DTSTART:20200110T090000Z
+DTEND:20200110T100000Z
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestCalendarEventsPagedYieldsOverridesOfLaterPages(t *testing.T) {
+	homeSet := "/calendars/user/"
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set(contentType, xmlContentType)
+		writer.WriteHeader(http.StatusMultiStatus)
+		if request.Method == propfindMethod {
+			fmt.Fprintf(writer, `<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:response><D:href>%swork/</D:href><D:propstat><D:prop><D:resourcetype><D:collection/><C:calendar/></D:resourcetype></D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response></D:multistatus>`, homeSet)
+			return
+		}
+		// the whole resource is returned for every page of the series
+		fmt.Fprintf(writer, `<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:response><D:href>%swork/series.ics</D:href><D:propstat><D:prop><D:getetag>"1"</D:getetag><C:calendar-data>%s</C:calendar-data></D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response></D:multistatus>`, homeSet, testPagedSeries)
+	}))
+	t.Cleanup(server.Close)
+	serverURL, _ := url.Parse(server.URL)
+	client := &client{server: serverURL, path: homeSet, emailAddress: "user@example.com", httpClient: server.Client(), options: newClientOptions(nil)}
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	got := []string{}
+	err := client.CalendarEventsPaged(context.Background(), start, start.AddDate(0, 0, 14), PageOptions{}, func(calendarPath string, events []calendar.Event) error {
+		for _, event := range events {
+			got = append(got, event.Start().UTC().Format("2006-01-02"))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the master with the first page, the override with the second
+	want := []string{"2020-01-01", "2020-01-10"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("yielded events starting on %v, want %v", got, want)
+	}
+}
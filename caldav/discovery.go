@@ -0,0 +1,99 @@
+package caldav
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Cepreu/Archive/log"
+)
+
+const (
+	// DefaultDiscoveryTTL is a suitable expiry for discovery results; servers
+	// rarely move users' calendar home sets
+	DefaultDiscoveryTTL = time.Hour
+)
+
+// DiscoveryCache caches the results of server discovery (i.e., the server and
+// calendar home set that a user's host resolves to) by host and username, so
+// that clients created for the same user don't repeat discovery. It's safe
+// for concurrent use.
+type DiscoveryCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[discoveryKey]*discoveryEntry
+	// lastSweep is the last time that the expired entries were evicted
+	lastSweep time.Time
+	now       func() time.Time `test-hook:"verify-unexported"`
+}
+
+type discoveryKey struct {
+	host     string
+	username string
+}
+
+type discoveryEntry struct {
+	server          string
+	calendarHomeSet string
+	expires         time.Time
+}
+
+// NewDiscoveryCache creates a cache whose entries expire after the given
+// duration.
+func NewDiscoveryCache(ttl time.Duration) *DiscoveryCache {
+	return &DiscoveryCache{ttl: ttl, entries: map[discoveryKey]*discoveryEntry{}, now: time.Now}
+}
+
+// get returns the server and calendar home set that were discovered for the
+// given user, unless they expired.
+func (cache *DiscoveryCache) get(host string, username string) (string, string, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	key := discoveryKey{host: host, username: username}
+	entry, ok := cache.entries[key]
+	if !ok {
+		return "", "", false
+	}
+	if cache.now().After(entry.expires) {
+		delete(cache.entries, key)
+		return "", "", false
+	}
+	return entry.server, entry.calendarHomeSet, true
+}
+
+// put caches the discovery results of the given user. At most once per TTL,
+// it also evicts the expired entries, so that those of users who aren't
+// synced anymore don't pile up.
+func (cache *DiscoveryCache) put(host string, username string, server string, calendarHomeSet string) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	now := cache.now()
+	cache.entries[discoveryKey{host: host, username: username}] = &discoveryEntry{
+		server:          server,
+		calendarHomeSet: calendarHomeSet,
+		expires:         now.Add(cache.ttl),
+	}
+
+	if now.Sub(cache.lastSweep) < cache.ttl {
+		return
+	}
+	cache.lastSweep = now
+	for key, entry := range cache.entries {
+		if now.After(entry.expires) {
+			delete(cache.entries, key)
+		}
+	}
+}
+
+// invalidate evicts the discovery results of the given user (e.g., because
+// their calendar home set no longer exists).
+func (cache *DiscoveryCache) invalidate(host string, username string) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if _, ok := cache.entries[discoveryKey{host: host, username: username}]; ok {
+		log.Debug("Invalidating cached discovery", "host", host, "username", username)
+		delete(cache.entries, discoveryKey{host: host, username: username})
+	}
+}
@@ -3,38 +3,86 @@ package caldav
 import (
 	"net/mail"
 	"reflect"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/WF/caldav-go/icalendar/components"
 	"github.com/WF/caldav-go/icalendar/properties"
 	"github.com/WF/caldav-go/icalendar/values"
 	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/conference"
 	"github.com/WF/go/convert"
 	"github.com/WF/go/enums/importance"
+	"github.com/Cepreu/Archive/enums/role"
 	"github.com/WF/go/enums/rsvp"
 	"github.com/WF/go/enums/sensitivity"
+	"github.com/Cepreu/Archive/enums/showas"
+	"github.com/Cepreu/Archive/enums/status"
+	"github.com/Cepreu/Archive/errors"
 	"github.com/Cepreu/Archive/log"
 )
 
-func newCalendarItem(event *components.Event, parentCalendar *calendarListEntry) *calendarItem {
-	attendees := resolveAttendees(event.Attendees)
+const (
+	mailtoScheme = "mailto:"
+	htmlFormat   = "text/html"
+	// truncationMarker is appended to HTML descriptions that were truncated
+	truncationMarker = "<!-- truncated -->"
+	// ExternalIDSeparator separates the href and the ETag of an external ID
+	// (see EncodeExternalID)
+	ExternalIDSeparator = "|"
+)
+
+var (
+	externalIDEscaper   = strings.NewReplacer("%", "%25", ExternalIDSeparator, "%7C")
+	externalIDUnescaper = strings.NewReplacer("%7C", ExternalIDSeparator, "%25", "%")
+)
+
+func newCalendarItem(event *components.Event, raw *component, parentCalendar *calendarListEntry, parentResource *resource) *calendarItem {
+	attendees := resolveAttendees(event.Attendees, raw)
 	return &calendarItem{
 		Event:        event,
+		raw:          raw,
 		calendar:     parentCalendar,
+		resource:     parentResource,
 		responseType: findResponseType(parentCalendar.emailAddress, attendees),
-		organizer:    resolveOrganizer(event.Organizer),
+		organizer:    resolveOrganizer(event.Organizer, raw),
 		attendees:    attendees,
 		sensitivity:  convert.EventAccessClassificationToSensitivity(event.AccessClassification),
 	}
 }
 
+// HTMLEvent is an event that may have an HTML description besides its plain
+// text one.
+type HTMLEvent interface {
+	calendar.Event
+	// HTMLDescription returns the event's description as HTML; empty if it
+	// only has a plain text one.
+	HTMLDescription() string
+}
+
+// SequencedEvent is an event whose revisions are numbered, so that the
+// authoritative one of two versions of it can be told apart.
+type SequencedEvent interface {
+	calendar.Event
+	// Sequence returns the event's revision number; zero for the original.
+	Sequence() int
+}
+
 type calendarItem struct {
 	*components.Event
+	// raw is the VEVENT as parsed by parseComponents; nil if it couldn't be
+	// matched with the caldav-go event
+	raw          *component
 	calendar     *calendarListEntry
+	resource     *resource
 	responseType rsvp.MeetingResponseType
 	organizer    calendar.EmailAddress
 	attendees    []calendar.Attendee
 	sensitivity  sensitivity.Sensitivity
+	// maxDescriptionSize bounds HTMLDescription; unbounded if zero
+	maxDescriptionSize int
 }
 
 func (item *calendarItem) UID() string {
@@ -49,18 +97,100 @@ func (item *calendarItem) Description() string {
 	return item.Event.Description
 }
 
+// HTMLDescription returns the event's X-ALT-DESC (i.e., the HTML body of
+// events from Outlook, whose DESCRIPTION is a lossy plain-text rendition of
+// it); empty if it has none. Descriptions longer than the client's limit (see
+// WithMaxDescriptionSize) are truncated and marked as such.
+func (item *calendarItem) HTMLDescription() string {
+	if item.raw == nil {
+		return ""
+	}
+	for _, p := range item.raw.propertiesNamed("X-ALT-DESC") {
+		if strings.EqualFold(p.param("FMTTYPE"), htmlFormat) {
+			return truncate(unescapeText(p.value), item.maxDescriptionSize)
+		}
+	}
+	return ""
+}
+
 func (item *calendarItem) URL() string {
 	return unsafeToString(item.Event.Url)
 }
 
+// Start returns the start of the event; that's midnight in the calendar's
+// time zone for all-day events. Floating start times (i.e., without a time
+// zone) are in the calendar's time zone as well.
 func (item *calendarItem) Start() time.Time {
+	if item.IsAllDay() {
+		if start, err := item.raw.property("DTSTART").dateTime(item.calendar.location()); err == nil {
+			return start
+		}
+	}
+	if start, ok := item.floatingTime("DTSTART"); ok {
+		return start
+	}
+	if item.Event.DateStart == nil {
+		return time.Time{}
+	}
 	return item.Event.DateStart.NativeTime()
 }
 
+// End returns the (exclusive) end of the event (see RFC 5545 section 3.6.1).
+// Events may specify a DURATION instead of a DTEND; events that specify
+// neither last a day if they're all-day events and end when they start
+// otherwise. All-day events end at midnight in the calendar's time zone, and
+// floating end times are in the calendar's time zone as well.
 func (item *calendarItem) End() time.Time {
-	return item.Event.DateEnd.NativeTime()
+	if item.IsAllDay() {
+		if end := item.raw.property("DTEND"); end != nil && end.isDate() {
+			if t, err := end.dateTime(item.calendar.location()); err == nil {
+				return t
+			}
+		}
+	}
+	if end, ok := item.floatingTime("DTEND"); ok {
+		return end
+	}
+	if item.Event.DateEnd != nil {
+		return item.Event.DateEnd.NativeTime()
+	}
+
+	if item.raw != nil {
+		if duration := item.raw.property("DURATION"); duration != nil {
+			days, exact, err := parseDuration(duration.value)
+			if err == nil {
+				return item.Start().AddDate(0, 0, days).Add(exact)
+			}
+			log.Warn("Ignoring invalid DURATION", "uid", item.Event.UID, "duration", duration.value, "err", err)
+		}
+	}
+	if item.IsAllDay() {
+		return item.Start().AddDate(0, 0, 1)
+	}
+	return item.Start()
 }
 
+// floatingTime returns the value of the given DATE-TIME property in the
+// calendar's time zone if it's floating (see RFC 5545 section 3.3.5);
+// caldav-go would read it as UTC instead.
+func (item *calendarItem) floatingTime(name string) (time.Time, bool) {
+	if item.raw == nil {
+		return time.Time{}, false
+	}
+	p := item.raw.property(name)
+	if p == nil || !p.isFloating() {
+		return time.Time{}, false
+	}
+
+	t, err := p.dateTime(item.calendar.floatingLocation())
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// TimeZone returns the IANA identifier of the calendar's time zone; Windows
+// names and vendor prefixed identifiers are mapped to their IANA equivalent.
 func (item *calendarItem) TimeZone() string {
 	return item.calendar.timeZone
 }
@@ -85,18 +215,118 @@ func (item *calendarItem) IsRecurring() bool {
 	return item.Event.IsRecurrence()
 }
 
+// IsAllDay checks whether or not the event's DTSTART is a DATE (rather than a
+// DATE-TIME) value.
 func (item *calendarItem) IsAllDay() bool {
-	return item.Start().Truncate(time.Millisecond).IsZero() && item.End().Truncate(time.Millisecond).IsZero()
+	if item.raw == nil {
+		return false
+	}
+	start := item.raw.property("DTSTART")
+	return start != nil && start.isDate()
 }
 
+// Importance derives the importance of the event from its PRIORITY.
 func (item *calendarItem) Importance() importance.Importance {
-	return importance.Unknown
+	if item.raw == nil {
+		return importance.Unknown
+	}
+	return priorityToImportance(item.raw.value("PRIORITY"))
+}
+
+// priorityToImportance maps the value of a PRIORITY property (see RFC 5545
+// section 3.8.1.9) to an importance: 1-4 is high, 5 normal and 6-9 low, while
+// 0 (i.e., undefined), a missing value and an invalid one are unknown.
+// It's meant to move to the convert package so that EWS can share it.
+func priorityToImportance(value string) importance.Importance {
+	priority, err := strconv.Atoi(strings.TrimSpace(value))
+	switch {
+	case err != nil || priority < 1 || priority > 9:
+		return importance.Unknown
+	case priority < 5:
+		return importance.High
+	case priority == 5:
+		return importance.Normal
+	default:
+		return importance.Low
+	}
+}
+
+// ShowAs returns how the event shows on free/busy schedules, as per its
+// TRANSP (opaque by default).
+func (item *calendarItem) ShowAs() showas.ShowAs {
+	if item.raw == nil {
+		return showas.Unknown
+	}
+	return showas.FromTransp(item.raw.value("TRANSP"))
+}
+
+// IsBusy determines whether the event blocks time. Events whose TRANSP isn't
+// recognized are assumed to, as every event was before TRANSP was read.
+func (item *calendarItem) IsBusy() bool {
+	showAs := item.ShowAs()
+	return showAs.IsBusy() || showAs == showas.Unknown
+}
+
+// Categories returns the event's categories (e.g., "Work") in the order they
+// first appear across its CATEGORIES properties, without duplicates.
+func (item *calendarItem) Categories() []string {
+	categories := []string{}
+	if item.raw == nil {
+		return categories
+	}
+
+	seen := map[string]bool{}
+	for _, p := range item.raw.propertiesNamed("CATEGORIES") {
+		for _, category := range splitTextList(p.value) {
+			category = strings.TrimSpace(category)
+			if category != "" && !seen[category] {
+				seen[category] = true
+				categories = append(categories, category)
+			}
+		}
+	}
+	return categories
+}
+
+// ConferenceURL returns the link to join the event's online meeting; empty if
+// none. It's taken from, in order: X-GOOGLE-CONFERENCE, URL, and the first
+// meeting link (see conference.FindURL) in the location or description.
+func (item *calendarItem) ConferenceURL() string {
+	if item.raw != nil {
+		for _, name := range []string{"X-GOOGLE-CONFERENCE", "URL"} {
+			if url := strings.TrimSpace(item.raw.value(name)); url != "" {
+				return url
+			}
+		}
+	}
+	if url := conference.FindURL(item.Location()); url != "" {
+		return url
+	}
+	return conference.FindURL(item.Description())
 }
 
 func (item *calendarItem) Sensitivity() sensitivity.Sensitivity {
 	return item.sensitivity
 }
 
+// Status returns the event's STATUS; events without one are confirmed.
+func (item *calendarItem) Status() status.Status {
+	if item.raw == nil {
+		return status.Confirmed
+	}
+
+	switch strings.ToUpper(item.raw.value("STATUS")) {
+	case "", "CONFIRMED":
+		return status.Confirmed
+	case "TENTATIVE":
+		return status.Tentative
+	case "CANCELLED":
+		return status.Cancelled
+	default:
+		return status.Unknown
+	}
+}
+
 func (item *calendarItem) CreatedAt() time.Time {
 	return item.Event.Created.NativeTime()
 }
@@ -108,6 +338,20 @@ func (item *calendarItem) LastModifiedAt() time.Time {
 	return item.Event.LastModified.NativeTime()
 }
 
+// Sequence returns the event's SEQUENCE (see RFC 5545 section 3.8.7.4),
+// which the organizer increments with every significant change; a missing or
+// invalid value is zero.
+func (item *calendarItem) Sequence() int {
+	if item.raw == nil {
+		return 0
+	}
+	sequence, err := strconv.Atoi(strings.TrimSpace(item.raw.value("SEQUENCE")))
+	if err != nil || sequence < 0 {
+		return 0
+	}
+	return sequence
+}
+
 func (item *calendarItem) CalendarID() string {
 	return item.calendar.path
 }
@@ -116,10 +360,64 @@ func (item *calendarItem) CalendarDisplayName() string {
 	return item.calendar.displayName
 }
 
+// CalendarColor returns the color of the event's calendar as a CSS color
+// (e.g., "#FF0000FF"); it's empty if the server doesn't support colors.
+func (item *calendarItem) CalendarColor() string {
+	return item.calendar.color
+}
+
+// CalendarOrder returns the display order of the event's calendar; it's 0 if
+// the server doesn't support ordering.
+func (item *calendarItem) CalendarOrder() int {
+	return item.calendar.order
+}
+
 func (item *calendarItem) CalendarItemID() string {
 	return item.Event.UID
 }
 
+// Href returns the path of the calendar resource that holds the event.
+func (item *calendarItem) Href() string {
+	return item.resource.href
+}
+
+// ETag returns the entity tag of the calendar resource that holds the event;
+// it's the precondition for updating or deleting the event.
+func (item *calendarItem) ETag() string {
+	return item.resource.etag
+}
+
+// ExternalID identifies the event to the server, for writing it back; for
+// CalDAV, it's the compound of Href and ETag (see EncodeExternalID).
+func (item *calendarItem) ExternalID() string {
+	return EncodeExternalID(item.Href(), item.ETag())
+}
+
+// ExternalVersion is the version of the event that ExternalID identifies; for
+// CalDAV, it's the same as ETag.
+func (item *calendarItem) ExternalVersion() string {
+	return item.ETag()
+}
+
+// EncodeExternalID encodes the href and ETag of a calendar resource as an
+// external ID: "<href>|<etag>", where "|" is ExternalIDSeparator. Any "%" and
+// "|" in either part are percent-encoded (as "%25" and "%7C"), so that hrefs
+// and ETags that contain the separator survive the round trip.
+func EncodeExternalID(href string, etag string) string {
+	return externalIDEscaper.Replace(href) + ExternalIDSeparator + externalIDEscaper.Replace(etag)
+}
+
+// DecodeExternalID decodes the href and ETag of a calendar resource from an
+// external ID (see EncodeExternalID); a WF12001 error is returned if it
+// isn't one.
+func DecodeExternalID(externalID string) (href string, etag string, err error) {
+	parts := strings.Split(externalID, ExternalIDSeparator)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", errors.WF12001("externalID", "not of the form <href>|<etag>")
+	}
+	return externalIDUnescaper.Replace(parts[0]), externalIDUnescaper.Replace(parts[1]), nil
+}
+
 func unsafeToString(value properties.CanEncodeValue) string {
 	if value == nil || reflect.ValueOf(value).IsNil() {
 		return ""
@@ -133,34 +431,141 @@ func unsafeToString(value properties.CanEncodeValue) string {
 	return s
 }
 
-func resolveOrganizer(organizer *values.OrganizerContact) calendar.EmailAddress {
+// truncate cuts the given text down to the given size in bytes (without
+// splitting a UTF-8 sequence) and marks it as truncated; texts that fit, or
+// any text if the size is zero, are returned as is.
+func truncate(text string, size int) string {
+	if size <= 0 || len(text) <= size {
+		return text
+	}
+	for size > 0 && !utf8.RuneStart(text[size]) {
+		size--
+	}
+	return text[:size] + truncationMarker
+}
+
+// resolveOrganizer converts the given organizer; its CN (when caldav-go
+// didn't yield a name) and SENT-BY parameters are taken from the raw VEVENT
+// (if any). An organizer without an address is treated as missing.
+func resolveOrganizer(organizer *values.OrganizerContact, raw *component) calendar.EmailAddress {
 	if organizer == nil { // can be nil (e.g., an apppointment)
 		return nil
 	}
-	return newEmailAddress(organizer.Entry)
+
+	address := newEmailAddress(organizer.Entry)
+	if address.address == "" {
+		log.Warn("Ignoring malformed organizer", "organizer", organizer.Entry)
+		return nil
+	}
+
+	var p *property
+	if raw != nil {
+		p = raw.property("ORGANIZER")
+	}
+	if p == nil {
+		return address
+	}
+
+	if address.name == "" {
+		address.name = p.param("CN")
+	}
+	resolved := &delegatedOrganizer{emailAddress: address}
+	if sentBy := normalizeEmailAddress(p.param("SENT-BY")); sentBy != "" {
+		resolved.sentBy = &emailAddress{address: sentBy}
+	}
+	return resolved
+}
+
+// DelegatedOrganizer is an organizer that may have had someone else (e.g.,
+// an assistant) send the invitation on their behalf.
+type DelegatedOrganizer interface {
+	calendar.EmailAddress
+	// SentBy returns the address of whoever sent the invitation on the
+	// organizer's behalf (i.e., the SENT-BY parameter); nil if the organizer
+	// sent it themselves.
+	SentBy() calendar.EmailAddress
+}
+
+type delegatedOrganizer struct {
+	*emailAddress
+	sentBy *emailAddress
+}
+
+func (organizer *delegatedOrganizer) SentBy() calendar.EmailAddress {
+	if organizer.sentBy == nil {
+		return nil
+	}
+	return organizer.sentBy
 }
 
-func resolveAttendees(eventAttendees []*values.Attendee) []calendar.Attendee {
+// resolveAttendees converts the given attendees; their roles are taken from
+// the raw VEVENT (if any) since caldav-go drops the ROLE parameter, and
+// default to required (as a missing ROLE does).
+func resolveAttendees(eventAttendees []*values.Attendee, raw *component) []calendar.Attendee {
+	roles := map[string]role.Role{}
+	if raw != nil {
+		for _, p := range raw.propertiesNamed("ATTENDEE") {
+			roles[strings.ToLower(normalizeEmailAddress(p.value))] = parseRole(p.param("ROLE"))
+		}
+	}
+
 	attendees := make([]calendar.Attendee, 0, len(eventAttendees))
 	for _, a := range eventAttendees {
 		responseType := convert.ParticipationStatusToMeetingResponseType(a.ParticipationStatus)
-		attendees = append(attendees, &attendee{newEmailAddress(a.Entry), &responseType})
+		emailAddress := newEmailAddress(a.Entry)
+		// attendees missing from the raw VEVENT have the default role
+		r, ok := roles[strings.ToLower(emailAddress.address)]
+		if !ok {
+			r = role.Required
+		}
+		attendees = append(attendees, &attendee{emailAddress, &responseType, r})
 	}
 	return attendees
 }
 
+// parseRole parses the value of a ROLE parameter. A missing ROLE means
+// REQ-PARTICIPANT, and so do unrecognized (e.g., experimental) ones as per
+// RFC 5545.
+func parseRole(value string) role.Role {
+	switch strings.ToUpper(value) {
+	case "OPT-PARTICIPANT":
+		return role.Optional
+	case "NON-PARTICIPANT":
+		return role.NonParticipant
+	case "CHAIR":
+		return role.Chair
+	default:
+		return role.Required
+	}
+}
+
+// findResponseType finds the response of the attendee with the given email
+// address. Addresses are compared case-insensitively: the domain is case
+// insensitive, and in practice so is the local part.
 func findResponseType(emailAddress string, attendees []calendar.Attendee) rsvp.MeetingResponseType {
+	emailAddress = normalizeEmailAddress(emailAddress)
 	for _, attendee := range attendees {
-		if attendee.EmailAddress().Address() == emailAddress {
+		if strings.EqualFold(attendee.EmailAddress().Address(), emailAddress) {
 			return *attendee.ResponseType()
 		}
 	}
 	return rsvp.Unknown
 }
 
+// AttendeeWithRole is an attendee whose participation role is known.
+// It's meant to be merged into calendar.Attendee once the other calendar
+// backends expose roles as well.
+type AttendeeWithRole interface {
+	calendar.Attendee
+	// Role returns the attendee's participation role (role.Unknown if it
+	// couldn't be determined).
+	Role() role.Role
+}
+
 type attendee struct {
 	*emailAddress
 	responseType *rsvp.MeetingResponseType
+	role         role.Role
 }
 
 func (a *attendee) EmailAddress() calendar.EmailAddress {
@@ -171,8 +576,26 @@ func (a *attendee) ResponseType() *rsvp.MeetingResponseType {
 	return a.responseType
 }
 
+func (a *attendee) Role() role.Role {
+	return a.role
+}
+
 func newEmailAddress(email mail.Address) *emailAddress {
-	return &emailAddress{name: email.Name, address: email.Address}
+	return &emailAddress{name: email.Name, address: normalizeEmailAddress(email.Address)}
+}
+
+// normalizeEmailAddress turns a CAL-ADDRESS (e.g., "mailto:Bob@Example.COM")
+// into a plain email address with a lowercase domain (e.g.,
+// "Bob@example.com").
+func normalizeEmailAddress(address string) string {
+	address = strings.TrimSpace(address)
+	if len(address) >= len(mailtoScheme) && strings.EqualFold(address[:len(mailtoScheme)], mailtoScheme) {
+		address = strings.TrimSpace(address[len(mailtoScheme):])
+	}
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		address = address[:at] + strings.ToLower(address[at:])
+	}
+	return address
 }
 
 type emailAddress struct {
@@ -0,0 +1,344 @@
+package caldav
+
+import (
+	"net/mail"
+	"testing"
+	"time"
+
+	"github.com/WF/caldav-go/icalendar/values"
+	"github.com/WF/go/calendar"
+	"github.com/WF/go/enums/importance"
+	"github.com/Cepreu/Archive/enums/role"
+	"github.com/WF/go/enums/rsvp"
+	"github.com/Cepreu/Archive/enums/showas"
+	"github.com/Cepreu/Archive/enums/status"
+	"github.com/Cepreu/Archive/errors"
+)
+
+func TestExternalIDRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		href string
+		etag string
+		want string
+	}{
+		{name: "plain", href: "/calendars/user/work/event.ics", etag: `"1234"`, want: `/calendars/user/work/event.ics|"1234"`},
+		{name: "weak ETag", href: "/calendars/user/work/event.ics", etag: `W/"1234"`, want: `/calendars/user/work/event.ics|W/"1234"`},
+		{name: "no ETag", href: "/calendars/user/work/event.ics", etag: "", want: "/calendars/user/work/event.ics|"},
+		{name: "separator in href", href: "/calendars/user/work/a|b.ics", etag: `"1"`, want: `/calendars/user/work/a%7Cb.ics|"1"`},
+		{name: "separator in ETag", href: "/calendars/user/work/event.ics", etag: `"a|b"`, want: `/calendars/user/work/event.ics|"a%7Cb"`},
+		{name: "percent in href", href: "/calendars/user/work/100%.ics", etag: `"1"`, want: `/calendars/user/work/100%25.ics|"1"`},
+		{name: "escaped separator in href", href: "/calendars/user/work/a%7Cb.ics", etag: `"1"`, want: `/calendars/user/work/a%257Cb.ics|"1"`},
+		{name: "separators only", href: "||", etag: "|", want: "%7C%7C|%7C"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			externalID := EncodeExternalID(test.href, test.etag)
+			if externalID != test.want {
+				t.Errorf("EncodeExternalID(%q, %q) = %q, want %q", test.href, test.etag, externalID, test.want)
+			}
+
+			href, etag, err := DecodeExternalID(externalID)
+			if err != nil {
+				t.Fatalf("DecodeExternalID(%q) error = %v", externalID, err)
+			}
+			if href != test.href || etag != test.etag {
+				t.Errorf("DecodeExternalID(%q) = %q, %q, want %q, %q", externalID, href, etag, test.href, test.etag)
+			}
+		})
+	}
+}
+
+func TestDecodeExternalIDRejectsMalformedIDs(t *testing.T) {
+	for _, externalID := range []string{"", "/calendars/user/work/event.ics", `|"1234"`, `/a|b|"1234"`} {
+		if _, _, err := DecodeExternalID(externalID); !errors.HasCode(err, "WF12001") {
+			t.Errorf("DecodeExternalID(%q) error = %v, want WF12001", externalID, err)
+		}
+	}
+}
+
+func TestCalendarItemExternalID(t *testing.T) {
+	item := &calendarItem{resource: &resource{href: "/calendars/user/work/a|b.ics", etag: `"5"`}}
+
+	if got, want := item.ExternalID(), `/calendars/user/work/a%7Cb.ics|"5"`; got != want {
+		t.Errorf("ExternalID() = %q, want %q", got, want)
+	}
+	if got, want := item.ExternalVersion(), `"5"`; got != want {
+		t.Errorf("ExternalVersion() = %q, want %q", got, want)
+	}
+	href, etag, err := DecodeExternalID(item.ExternalID())
+	if err != nil || href != item.Href() || etag != item.ETag() {
+		t.Errorf("DecodeExternalID(ExternalID()) = %q, %q, %v, want %q, %q", href, etag, err, item.Href(), item.ETag())
+	}
+}
+
+func TestAllDayEvents(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		properties string
+		allDay     bool
+		start      time.Time
+		end        time.Time
+	}{
+		{
+			name:       "a day",
+			properties: "DTSTART;VALUE=DATE:20200302\nDTEND;VALUE=DATE:20200303",
+			allDay:     true,
+			start:      time.Date(2020, 3, 2, 0, 0, 0, 0, newYork),
+			end:        time.Date(2020, 3, 3, 0, 0, 0, 0, newYork),
+		},
+		{
+			name:       "days",
+			properties: "DTSTART;VALUE=DATE:20200302\nDTEND;VALUE=DATE:20200305",
+			allDay:     true,
+			start:      time.Date(2020, 3, 2, 0, 0, 0, 0, newYork),
+			end:        time.Date(2020, 3, 5, 0, 0, 0, 0, newYork),
+		},
+		{
+			name:       "without a VALUE parameter",
+			properties: "DTSTART:20200302\nDTEND:20200303",
+			allDay:     true,
+			start:      time.Date(2020, 3, 2, 0, 0, 0, 0, newYork),
+			end:        time.Date(2020, 3, 3, 0, 0, 0, 0, newYork),
+		},
+		{
+			name:       "without an end",
+			properties: "DTSTART;VALUE=DATE:20200302",
+			allDay:     true,
+			start:      time.Date(2020, 3, 2, 0, 0, 0, 0, newYork),
+			end:        time.Date(2020, 3, 3, 0, 0, 0, 0, newYork),
+		},
+		{
+			name:       "with a duration",
+			properties: "DTSTART;VALUE=DATE:20200302\nDURATION:P2D",
+			allDay:     true,
+			start:      time.Date(2020, 3, 2, 0, 0, 0, 0, newYork),
+			end:        time.Date(2020, 3, 4, 0, 0, 0, 0, newYork),
+		},
+		{
+			name:       "across a DST change",
+			properties: "DTSTART;VALUE=DATE:20200307\nDTEND;VALUE=DATE:20200309",
+			allDay:     true,
+			start:      time.Date(2020, 3, 7, 0, 0, 0, 0, newYork),
+			end:        time.Date(2020, 3, 9, 0, 0, 0, 0, newYork),
+		},
+		{
+			name:       "at midnight",
+			properties: "DTSTART:20200302T000000\nDTEND:20200303T000000",
+			allDay:     false,
+			start:      time.Date(2020, 3, 2, 0, 0, 0, 0, newYork),
+			end:        time.Date(2020, 3, 3, 0, 0, 0, 0, newYork),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item := newTestRecurringItem(t, "America/New_York", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:event\n"+test.properties+"\nEND:VEVENT\nEND:VCALENDAR\n")
+			if got := item.IsAllDay(); got != test.allDay {
+				t.Errorf("IsAllDay() = %v, want %v", got, test.allDay)
+			}
+			if got := item.Start(); !got.Equal(test.start) {
+				t.Errorf("Start() = %v, want %v", got, test.start)
+			}
+			if got := item.End(); !got.Equal(test.end) {
+				t.Errorf("End() = %v, want %v", got, test.end)
+			}
+		})
+	}
+}
+
+func TestIsAllDayWithoutRawEvent(t *testing.T) {
+	if item := (&calendarItem{}); item.IsAllDay() {
+		t.Error("IsAllDay() of an event without its raw VEVENT = true, want false")
+	}
+}
+
+func TestNormalizeEmailAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{address: "bob@example.com", want: "bob@example.com"},
+		{address: "mailto:Bob@Example.COM", want: "Bob@example.com"},
+		{address: "MAILTO:bob@example.com", want: "bob@example.com"},
+		{address: "  MailTo: bob@EXAMPLE.com ", want: "bob@example.com"},
+		{address: "\"bob@work\"@Example.com", want: "\"bob@work\"@example.com"},
+		{address: "mailto:", want: ""},
+		{address: "mail", want: "mail"},
+		{address: "Bob", want: "Bob"},
+		{address: "", want: ""},
+	}
+	for _, test := range tests {
+		if got := normalizeEmailAddress(test.address); got != test.want {
+			t.Errorf("normalizeEmailAddress(%q) = %q, want %q", test.address, got, test.want)
+		}
+	}
+}
+
+func TestFindResponseType(t *testing.T) {
+	accepted, declined := rsvp.Accept, rsvp.Decline
+	attendees := []calendar.Attendee{
+		&attendee{emailAddress: newEmailAddress(mail.Address{Address: "mailto:Alice@Example.COM"}), responseType: &accepted},
+		&attendee{emailAddress: newEmailAddress(mail.Address{Address: "bob@example.com"}), responseType: &declined},
+	}
+	tests := []struct {
+		emailAddress string
+		want         rsvp.MeetingResponseType
+	}{
+		{emailAddress: "Alice@example.com", want: rsvp.Accept},
+		{emailAddress: "alice@EXAMPLE.com", want: rsvp.Accept},
+		{emailAddress: "mailto:ALICE@example.com", want: rsvp.Accept},
+		{emailAddress: " Bob@Example.com ", want: rsvp.Decline},
+		{emailAddress: "carol@example.com", want: rsvp.Unknown},
+		{emailAddress: "", want: rsvp.Unknown},
+	}
+	for _, test := range tests {
+		if got := findResponseType(test.emailAddress, attendees); got != test.want {
+			t.Errorf("findResponseType(%q) = %v, want %v", test.emailAddress, got, test.want)
+		}
+	}
+}
+
+func TestResolveAttendeesNormalizesAddresses(t *testing.T) {
+	raw := newTestRecurringItem(t, "UTC", `BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:event
+DTSTART:20200302T090000Z
+ATTENDEE;ROLE=OPT-PARTICIPANT:MAILTO:alice@EXAMPLE.com
+ATTENDEE;ROLE=CHAIR:mailto:Bob@example.com
+ATTENDEE;ROLE=NON-PARTICIPANT:mailto: dave@example.COM
+END:VEVENT
+END:VCALENDAR
+`).raw
+	attendees := resolveAttendees([]*values.Attendee{
+		{Entry: mail.Address{Name: "Alice", Address: "mailto:Alice@Example.COM"}},
+		{Entry: mail.Address{Address: "bob@Example.com"}},
+		{Entry: mail.Address{Address: "mailto:carol@example.com"}},
+		{Entry: mail.Address{Address: "Dave@Example.com"}},
+	}, raw)
+
+	tests := []struct {
+		name    string
+		address string
+		role    role.Role
+	}{
+		{name: "Alice", address: "Alice@example.com", role: role.Optional},
+		{name: "", address: "bob@example.com", role: role.Chair},
+		// missing from the raw VEVENT
+		{name: "", address: "carol@example.com", role: role.Required},
+		{name: "", address: "Dave@example.com", role: role.NonParticipant},
+	}
+	if len(attendees) != len(tests) {
+		t.Fatalf("resolveAttendees() returned %d attendees, want %d", len(attendees), len(tests))
+	}
+	for i, test := range tests {
+		a := attendees[i].(AttendeeWithRole)
+		if a.EmailAddress().Name() != test.name || a.EmailAddress().Address() != test.address || a.Role() != test.role {
+			t.Errorf("attendee %d = %q <%s> (%v), want %q <%s> (%v)", i, a.EmailAddress().Name(), a.EmailAddress().Address(), a.Role(), test.name, test.address, test.role)
+		}
+	}
+}
+
+func TestResolveAttendeesWithoutRawEvent(t *testing.T) {
+	attendees := resolveAttendees([]*values.Attendee{{Entry: mail.Address{Address: "mailto:alice@example.com"}}}, nil)
+	if len(attendees) != 1 {
+		t.Fatalf("resolveAttendees() returned %d attendees, want 1", len(attendees))
+	}
+	if got := attendees[0].(AttendeeWithRole).Role(); got != role.Required {
+		t.Errorf("Role() = %v, want %v", got, role.Required)
+	}
+}
+
+func TestPriorityToImportance(t *testing.T) {
+	tests := []struct {
+		priority string
+		want     importance.Importance
+	}{
+		{priority: "", want: importance.Unknown},
+		{priority: "0", want: importance.Unknown},
+		{priority: "1", want: importance.High},
+		{priority: "4", want: importance.High},
+		{priority: "5", want: importance.Normal},
+		{priority: " 5 ", want: importance.Normal},
+		{priority: "6", want: importance.Low},
+		{priority: "9", want: importance.Low},
+		{priority: "10", want: importance.Unknown},
+		{priority: "-1", want: importance.Unknown},
+		{priority: "1.5", want: importance.Unknown},
+		{priority: "high", want: importance.Unknown},
+	}
+	for _, test := range tests {
+		if got := priorityToImportance(test.priority); got != test.want {
+			t.Errorf("priorityToImportance(%q) = %v, want %v", test.priority, got, test.want)
+		}
+	}
+}
+
+func TestImportance(t *testing.T) {
+	item := newTestRecurringItem(t, "UTC", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:event\nDTSTART:20200302T090000Z\nPRIORITY:1\nEND:VEVENT\nEND:VCALENDAR\n")
+	if got := item.Importance(); got != importance.High {
+		t.Errorf("Importance() = %v, want %v", got, importance.High)
+	}
+	item = newTestRecurringItem(t, "UTC", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:event\nDTSTART:20200302T090000Z\nEND:VEVENT\nEND:VCALENDAR\n")
+	if got := item.Importance(); got != importance.Unknown {
+		t.Errorf("Importance() without PRIORITY = %v, want %v", got, importance.Unknown)
+	}
+	if got := (&calendarItem{}).Importance(); got != importance.Unknown {
+		t.Errorf("Importance() without the raw VEVENT = %v, want %v", got, importance.Unknown)
+	}
+}
+
+func TestShowAs(t *testing.T) {
+	tests := []struct {
+		name   string
+		transp string
+		want   showas.ShowAs
+		busy   bool
+	}{
+		{name: "opaque", transp: "TRANSP:OPAQUE\n", want: showas.Busy, busy: true},
+		{name: "transparent", transp: "TRANSP:TRANSPARENT\n", want: showas.Free, busy: false},
+		{name: "missing", transp: "", want: showas.Busy, busy: true},
+		{name: "unrecognized", transp: "TRANSP:X-SOMETIMES\n", want: showas.Unknown, busy: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item := newTestRecurringItem(t, "UTC", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:event\nDTSTART:20200302T090000Z\n"+test.transp+"END:VEVENT\nEND:VCALENDAR\n")
+			if got := item.ShowAs(); got != test.want {
+				t.Errorf("ShowAs() = %v, want %v", got, test.want)
+			}
+			if got := item.IsBusy(); got != test.busy {
+				t.Errorf("IsBusy() = %v, want %v", got, test.busy)
+			}
+		})
+	}
+	if got := (&calendarItem{}).ShowAs(); got != showas.Unknown {
+		t.Errorf("ShowAs() without the raw VEVENT = %v, want %v", got, showas.Unknown)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		want   status.Status
+	}{
+		{name: "confirmed", status: "STATUS:CONFIRMED\n", want: status.Confirmed},
+		{name: "tentative", status: "STATUS:TENTATIVE\n", want: status.Tentative},
+		{name: "cancelled", status: "STATUS:cancelled\n", want: status.Cancelled},
+		{name: "missing", status: "", want: status.Confirmed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item := newTestRecurringItem(t, "UTC", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:event\nDTSTART:20200302T090000Z\n"+test.status+"END:VEVENT\nEND:VCALENDAR\n")
+			if got := item.Status(); got != test.want {
+				t.Errorf("Status() = %v, want %v", got, test.want)
+			}
+		})
+	}
+	if got := (&calendarItem{}).Status(); got != status.Confirmed {
+		t.Errorf("Status() without the raw VEVENT = %v, want %v", got, status.Confirmed)
+	}
+}
@@ -0,0 +1,26 @@
+package caldav
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// NormalizeHost strips the scheme, path, and port from the given host and
+// lowercases it (e.g., "https://CalDAV.iCloud.com:443/" becomes
+// "caldav.icloud.com"); hosts are entered by users, who often paste URLs,
+// whereas discovery probes the standard ports and paths of the bare host.
+func NormalizeHost(raw string) string {
+	host := strings.TrimSpace(raw)
+	if strings.Contains(host, "://") {
+		if parsed, err := url.Parse(host); err == nil {
+			host = parsed.Host
+		}
+	} else if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,24 @@
+package caldav
+
+import "testing"
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "caldav.icloud.com", want: "caldav.icloud.com"},
+		{host: "CalDAV.iCloud.com", want: "caldav.icloud.com"},
+		{host: "https://caldav.icloud.com", want: "caldav.icloud.com"},
+		{host: "caldav.icloud.com:443", want: "caldav.icloud.com"},
+		{host: "caldav.example.com/remote.php/dav", want: "caldav.example.com"},
+		{host: "https://caldav.example.com:8443", want: "caldav.example.com"},
+		{host: "https://Outlook.com:443/owa", want: "outlook.com"},
+		{host: " caldav.example.com ", want: "caldav.example.com"},
+	}
+	for _, test := range tests {
+		if got := NormalizeHost(test.host); got != test.want {
+			t.Errorf("NormalizeHost(%q) = %q, want %q", test.host, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package caldav
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cepreu/Archive/log"
+)
+
+const (
+	dateFormat             = "20060102"
+	floatingDateTimeFormat = "20060102T150405"
+)
+
+// component is an iCalendar component (e.g., VEVENT) parsed from its content
+// lines (see RFC 5545 section 3.1). caldav-go only unmarshals the components
+// and properties it knows of; this keeps everything.
+type component struct {
+	name       string
+	properties []*property
+	components []*component
+}
+
+// property is a single iCalendar property (e.g., a DTSTART with a TZID
+// parameter). Parameter names are upper-cased and their values unquoted.
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+	// timeZone is the location of the TZID parameter (nil if it has none or
+	// it isn't recognized), loaded once
+	timeZoneOnce sync.Once
+	timeZone     *time.Location
+}
+
+// parseComponents parses the components of the given iCalendar data (i.e.,
+// usually a single VCALENDAR).
+func parseComponents(data string) ([]*component, error) {
+	data = strings.Replace(data, "\r\n", "\n", -1)
+	data = strings.Replace(data, "\n ", "", -1) // unfold
+	data = strings.Replace(data, "\n\t", "", -1)
+
+	root := &component{}
+	stack := []*component{root}
+	for _, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		p, err := parseProperty(line)
+		if err != nil {
+			return nil, err
+		}
+
+		current := stack[len(stack)-1]
+		switch p.name {
+		case "BEGIN":
+			child := &component{name: strings.ToUpper(p.value)}
+			current.components = append(current.components, child)
+			stack = append(stack, child)
+		case "END":
+			if len(stack) == 1 || current.name != strings.ToUpper(p.value) {
+				return nil, fmt.Errorf("unexpected END:%s in %s", p.value, current.name)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			current.properties = append(current.properties, p)
+		}
+	}
+
+	if len(stack) > 1 {
+		return nil, fmt.Errorf("missing END:%s", stack[len(stack)-1].name)
+	}
+	return root.components, nil
+}
+
+// rawComponents parses the resource's components of the given type (e.g.,
+// VEVENT); it returns nil (and logs) if the resource can't be parsed.
+func rawComponents(resource *resource, componentType string) []*component {
+	components, err := parseComponents(resource.data)
+	if err != nil {
+		log.Warn("Failed to parse calendar resource", "href", resource.href, "err", err)
+		return nil
+	}
+
+	raw := []*component{}
+	for _, c := range components {
+		raw = append(raw, c.children(componentType)...)
+	}
+	return raw
+}
+
+// parseProperty parses an unfolded content line.
+func parseProperty(line string) (*property, error) {
+	p := &property{params: map[string]string{}}
+
+	i := strings.IndexAny(line, ";:")
+	if i < 1 {
+		return nil, fmt.Errorf("malformed content line: %q", line)
+	}
+	p.name = strings.ToUpper(line[:i])
+
+	for line[i] == ';' {
+		line = line[i+1:]
+		equals := strings.IndexByte(line, '=')
+		if equals < 1 {
+			return nil, fmt.Errorf("malformed parameter of %s: %q", p.name, line)
+		}
+		name := strings.ToUpper(line[:equals])
+		line = line[equals+1:]
+
+		// parameter values are terminated by ; or : unless quoted
+		value := []byte{}
+		quoted := false
+		for i = 0; i < len(line) && (quoted || (line[i] != ';' && line[i] != ':')); i++ {
+			if line[i] == '"' {
+				quoted = !quoted
+				continue
+			}
+			value = append(value, line[i])
+		}
+		if i == len(line) {
+			return nil, fmt.Errorf("missing value of %s", p.name)
+		}
+		p.params[name] = string(value)
+	}
+
+	p.value = line[i+1:]
+	return p, nil
+}
+
+// children returns the subcomponents with the given name (e.g., VALARM).
+func (c *component) children(name string) []*component {
+	children := []*component{}
+	for _, child := range c.components {
+		if child.name == name {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// property returns the first property with the given name; nil if none.
+func (c *component) property(name string) *property {
+	for _, p := range c.properties {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// propertiesNamed returns the properties with the given name (e.g., every
+// ATTENDEE).
+func (c *component) propertiesNamed(name string) []*property {
+	properties := []*property{}
+	for _, p := range c.properties {
+		if p.name == name {
+			properties = append(properties, p)
+		}
+	}
+	return properties
+}
+
+// value returns the value of the first property with the given name; empty
+// if none.
+func (c *component) value(name string) string {
+	if p := c.property(name); p != nil {
+		return p.value
+	}
+	return ""
+}
+
+func (p *property) param(name string) string {
+	return p.params[name]
+}
+
+// isDate checks whether or not the property's value is a DATE (rather than a
+// DATE-TIME).
+func (p *property) isDate() bool {
+	return p.param("VALUE") == "DATE" || len(p.value) == len(dateFormat)
+}
+
+// isFloating checks whether or not the property's value is a floating
+// DATE-TIME, i.e., neither UTC nor qualified by a TZID.
+func (p *property) isFloating() bool {
+	return !p.isDate() && p.param("TZID") == "" && !strings.HasSuffix(p.value, "Z")
+}
+
+// dateTime parses the property's DATE or DATE-TIME value. Dates and floating
+// date-times (i.e., without a TZID or a UTC designator) are interpreted in the
+// given location, as are date-times with an unrecognized TZID.
+func (p *property) dateTime(location *time.Location) (time.Time, error) {
+	if tz := p.location(); tz != nil {
+		location = tz
+	}
+
+	switch {
+	case p.isDate():
+		return time.ParseInLocation(dateFormat, p.value, location)
+	case strings.HasSuffix(p.value, "Z"):
+		return time.Parse(utcDateTimeFormat, p.value)
+	default:
+		return time.ParseInLocation(floatingDateTimeFormat, p.value, location)
+	}
+}
+
+// location returns the time zone of the property's TZID; nil if it has none
+// or it isn't recognized.
+func (p *property) location() *time.Location {
+	p.timeZoneOnce.Do(func() {
+		if tzid := p.param("TZID"); tzid != "" {
+			if tz, err := time.LoadLocation(resolveTimeZone(tzid)); err == nil {
+				p.timeZone = tz
+			}
+		}
+	})
+	return p.timeZone
+}
+
+// parseDuration parses a DURATION value (see RFC 5545 section 3.3.6) into its
+// nominal days (i.e., weeks and days, which may be 23 or 25 hours long across
+// DST transitions) and its exact hours, minutes, and seconds. Negative
+// durations aren't valid for events and are rejected.
+func parseDuration(value string) (int, time.Duration, error) {
+	s := strings.TrimPrefix(value, "+")
+	if strings.HasPrefix(s, "-") {
+		return 0, 0, fmt.Errorf("negative duration: %s", value)
+	}
+	if !strings.HasPrefix(s, "P") || len(s) < 3 {
+		return 0, 0, fmt.Errorf("malformed duration: %s", value)
+	}
+
+	days := 0
+	var exact time.Duration
+	inTime := false
+	n := -1
+	for _, r := range s[1:] {
+		switch {
+		case r >= '0' && r <= '9':
+			if n < 0 {
+				n = 0
+			}
+			n = n*10 + int(r-'0')
+			continue
+		case r == 'T' && !inTime && n < 0:
+			inTime = true
+			continue
+		case n < 0:
+			return 0, 0, fmt.Errorf("malformed duration: %s", value)
+		case r == 'W' && !inTime:
+			days += 7 * n
+		case r == 'D' && !inTime:
+			days += n
+		case r == 'H' && inTime:
+			exact += time.Duration(n) * time.Hour
+		case r == 'M' && inTime:
+			exact += time.Duration(n) * time.Minute
+		case r == 'S' && inTime:
+			exact += time.Duration(n) * time.Second
+		default:
+			return 0, 0, fmt.Errorf("malformed duration: %s", value)
+		}
+		n = -1
+	}
+	if n >= 0 {
+		return 0, 0, fmt.Errorf("malformed duration: %s", value)
+	}
+	return days, exact, nil
+}
+
+// parseSignedDuration parses a DURATION value that may be signed (e.g., the
+// "-PT15M" or "+PT15M" of an alarm's TRIGGER); days are exactly 24 hours long.
+func parseSignedDuration(value string) (time.Duration, error) {
+	sign := time.Duration(1)
+	switch {
+	case strings.HasPrefix(value, "-"):
+		sign = -1
+		value = value[1:]
+	case strings.HasPrefix(value, "+"):
+		value = value[1:]
+	}
+
+	days, exact, err := parseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	return sign * (time.Duration(days)*24*time.Hour + exact), nil
+}
+
+// unescapeText unescapes a TEXT value (see RFC 5545 section 3.3.11).
+func unescapeText(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+
+	unescaped := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+			if value[i] == 'n' || value[i] == 'N' {
+				unescaped = append(unescaped, '\n')
+				continue
+			}
+		}
+		unescaped = append(unescaped, value[i])
+	}
+	return string(unescaped)
+}
+
+// splitTextList splits a list of TEXT values (e.g., of CATEGORIES) on its
+// unescaped commas and unescapes the values.
+func splitTextList(value string) []string {
+	values := []string{}
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case ',':
+			values = append(values, unescapeText(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(values, unescapeText(value[start:]))
+}
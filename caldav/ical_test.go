@@ -0,0 +1,151 @@
+package caldav
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseSignedDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "PT15M", want: 15 * time.Minute},
+		{value: "+PT15M", want: 15 * time.Minute},
+		{value: "-PT15M", want: -15 * time.Minute},
+		{value: "-P1DT2H", want: -26 * time.Hour},
+		{value: "+P1W", want: 7 * 24 * time.Hour},
+		{value: "15M", wantErr: true},
+		{value: "+-PT15M", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseSignedDuration(test.value)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("parseSignedDuration(%q) = %v, %v, want %v (error: %v)", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestPropertyDateTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		p    *property
+		want time.Time
+	}{
+		{name: "floating", p: &property{value: "20200302T090000"}, want: time.Date(2020, 3, 2, 9, 0, 0, 0, newYork)},
+		{name: "UTC", p: &property{value: "20200302T090000Z"}, want: time.Date(2020, 3, 2, 9, 0, 0, 0, time.UTC)},
+		{name: "date", p: &property{params: map[string]string{"VALUE": "DATE"}, value: "20200302"}, want: time.Date(2020, 3, 2, 0, 0, 0, 0, newYork)},
+		{name: "TZID", p: &property{params: map[string]string{"TZID": "Europe/Berlin"}, value: "20200302T090000"}, want: time.Date(2020, 3, 2, 9, 0, 0, 0, berlin)},
+		{name: "Windows TZID", p: &property{params: map[string]string{"TZID": "W. Europe Standard Time"}, value: "20200302T090000"}, want: time.Date(2020, 3, 2, 9, 0, 0, 0, berlin)},
+		{name: "unknown TZID", p: &property{params: map[string]string{"TZID": "Mars/Olympus_Mons"}, value: "20200302T090000"}, want: time.Date(2020, 3, 2, 9, 0, 0, 0, newYork)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.p.dateTime(newYork)
+			if err != nil {
+				t.Fatalf("dateTime() error = %v", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("dateTime() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPropertyLocationIsResolvedOnce(t *testing.T) {
+	p := &property{params: map[string]string{"TZID": "Europe/Berlin"}, value: "20200302T090000"}
+	location := p.location()
+	if location == nil || location.String() != "Europe/Berlin" {
+		t.Fatalf("location() = %v, want Europe/Berlin", location)
+	}
+
+	p.params["TZID"] = "America/New_York"
+	if got := p.location(); got != location {
+		t.Errorf("location() = %v, want the first location (%v)", got, location)
+	}
+}
+
+func TestFloatingTimesAreInCalendarTimeZone(t *testing.T) {
+	item := newTestRecurringItem(t, "America/New_York", `BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:floating
+DTSTART:20200302T090000
+DTEND:20200302T100000
+END:VEVENT
+END:VCALENDAR
+`)
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := item.Start(), time.Date(2020, 3, 2, 9, 0, 0, 0, newYork); !got.Equal(want) {
+		t.Errorf("Start() = %v, want %v", got, want)
+	}
+	if got, want := item.End(), time.Date(2020, 3, 2, 10, 0, 0, 0, newYork); !got.Equal(want) {
+		t.Errorf("End() = %v, want %v", got, want)
+	}
+}
+
+func TestFloatingTimesOfUnknownTimeZoneAreUTC(t *testing.T) {
+	item := newTestRecurringItem(t, "Mars/Olympus_Mons", `BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:floating
+DTSTART:20200302T090000
+END:VEVENT
+END:VCALENDAR
+`)
+	item.calendar.path = "/calendars/user/floating-unknown/"
+
+	if got, want := item.Start(), time.Date(2020, 3, 2, 9, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Start() = %v, want %v", got, want)
+	}
+	// the fallback has been logged
+	if floatingFallbacks.first(item.calendar.path) {
+		t.Error("the fallback to UTC isn't recorded as logged")
+	}
+}
+
+func TestCalendarLocationIsResolvedOnce(t *testing.T) {
+	cal := &calendarListEntry{timeZone: "Europe/Berlin"}
+	location := cal.location()
+	if location.String() != "Europe/Berlin" {
+		t.Fatalf("location() = %v, want Europe/Berlin", location)
+	}
+
+	cal.timeZone = "America/New_York"
+	if got := cal.location(); got != location {
+		t.Errorf("location() = %v, want the first location (%v)", got, location)
+	}
+	if got := (&calendarListEntry{timeZone: "Mars/Olympus_Mons"}).location(); got != time.UTC {
+		t.Errorf("location() of an unknown time zone = %v, want UTC", got)
+	}
+}
+
+func TestLoggedKeysAreBounded(t *testing.T) {
+	logged := &loggedKeys{}
+	if !logged.first("a") {
+		t.Error("first(a) = false, want true")
+	}
+	if logged.first("a") {
+		t.Error("first(a) = true the second time, want false")
+	}
+
+	for i := 0; i < 2*maxLoggedKeys; i++ {
+		logged.first(fmt.Sprintf("tzid-%d", i))
+		if len(logged.keys) > maxLoggedKeys {
+			t.Fatalf("len(keys) = %d, want at most %d", len(logged.keys), maxLoggedKeys)
+		}
+	}
+}
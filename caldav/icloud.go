@@ -0,0 +1,83 @@
+package caldav
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/WF/caldav-go/caldav"
+	"github.com/WF/commongo/web"
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/log"
+)
+
+const (
+	iCloudServer = "https://caldav.icloud.com"
+	// iCloudPrincipalPath is formatted with the account's DSNID
+	iCloudPrincipalPath = "/%s/principal/"
+)
+
+var (
+	iCloudPrincipalPattern = regexp.MustCompile(`^/(\d+)/principal/?$`)
+)
+
+// NewICloudClient creates a new authenticated CalDAV client for iCloud.
+// iCloud rejects Apple ID passwords over CalDAV; an app-specific password
+// has to be generated for the account (see https://appleid.apple.com).
+func NewICloudClient(appleID string, appSpecificPassword string, options ...ClientOption) (calendar.Client, error) {
+	o := newClientOptions(options)
+	httpClient := newHTTPClient(web.NewBasicAuthRoundTripper(newTransport(o), appleID, appSpecificPassword), appleID, o)
+
+	server, err := caldav.NewServer(iCloudServer)
+	if err != nil {
+		return nil, err
+	}
+	calendarClient := caldav.NewClient(server, httpClient)
+
+	dsnID, err := discoverICloudDSNID(calendarClient, appleID)
+	if err != nil {
+		return nil, err
+	}
+
+	calendarHomeSet, err := findCalendarHomeSetOfPrincipal(calendarClient, fmt.Sprintf(iCloudPrincipalPath, dsnID))
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newClient(calendarClient, iCloudServer, calendarHomeSet, appleID, httpClient, o)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// discoverICloudDSNID finds the DSNID (the numeric account identifier) of
+// the given Apple ID. iCloud's provisioning endpoint – the root of its CalDAV
+// server – reports it as part of the authenticated user's principal URL.
+// The Apple ID alone can't be used to ask for it, so the given client has to
+// authenticate as that Apple ID (i.e., with its app-specific password); the
+// Apple ID is only logged. Passing the client in also lets discovery share
+// its transport options and lets tests point it at a fixture server.
+func discoverICloudDSNID(client *caldav.Client, appleID string) (string, error) {
+	principal, err := findCurrentUserPrincipal(client, "/")
+	if err != nil {
+		return "", err
+	}
+
+	dsnID, err := iCloudDSNID(principal)
+	if err != nil {
+		return "", err
+	}
+	log.Debug("Discovered iCloud DSNID", "appleID", appleID, "dsnID", dsnID)
+	return dsnID, nil
+}
+
+// iCloudDSNID returns the DSNID of the given principal path (e.g., 123 of
+// /123/principal/), or WF11202 if it isn't an iCloud principal.
+func iCloudDSNID(principal string) (string, error) {
+	match := iCloudPrincipalPattern.FindStringSubmatch(principal)
+	if match == nil {
+		return "", errors.WF11202(iCloudServer, "current-user-principal", principal)
+	}
+	return match[1], nil
+}
@@ -0,0 +1,88 @@
+package caldav
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cepreu/Archive/errors"
+)
+
+// iCloud's responses to the current-user-principal PROPFIND of its root,
+// which report the principal as a path or as a URL on the account's
+// partition
+const (
+	testICloudRootMultistatus = `<?xml version="1.0" encoding="UTF-8"?>
+<multistatus xmlns="DAV:">
+  <response xmlns="DAV:">
+    <href>/</href>
+    <propstat>
+      <prop>
+        <current-user-principal xmlns="DAV:">
+          <href xmlns="DAV:">/123456789/principal/</href>
+        </current-user-principal>
+      </prop>
+      <status>HTTP/1.1 200 OK</status>
+    </propstat>
+  </response>
+</multistatus>`
+	testICloudPartitionMultistatus = `<?xml version="1.0" encoding="UTF-8"?>
+<multistatus xmlns="DAV:">
+  <response xmlns="DAV:">
+    <href>/</href>
+    <propstat>
+      <prop>
+        <current-user-principal xmlns="DAV:">
+          <href xmlns="DAV:">https://p42-caldav.icloud.com:443/123456789/principal/</href>
+        </current-user-principal>
+      </prop>
+      <status>HTTP/1.1 200 OK</status>
+    </propstat>
+  </response>
+</multistatus>`
+)
+
+func TestICloudDSNIDOfRoot(t *testing.T) {
+	for _, body := range []string{testICloudRootMultistatus, testICloudPartitionMultistatus} {
+		requests := 0
+		server := httptest.NewTLSServer(principalHandler(t, body, &requests))
+
+		_, principal, err := findPrincipal(server.Client(), &candidate{server: server.URL, path: "/"})
+		server.Close()
+		if err != nil {
+			t.Fatalf("findPrincipal() error = %v", err)
+		}
+		dsnID, err := iCloudDSNID(principal)
+		if err != nil {
+			t.Fatalf("iCloudDSNID(%q) error = %v", principal, err)
+		}
+		if dsnID != "123456789" {
+			t.Errorf("iCloudDSNID(%q) = %q, want 123456789", principal, dsnID)
+		}
+	}
+}
+
+func TestICloudDSNID(t *testing.T) {
+	tests := []struct {
+		principal string
+		want      string
+	}{
+		{principal: "/123456789/principal/", want: "123456789"},
+		{principal: "/123456789/principal", want: "123456789"},
+		{principal: "/principals/user@icloud.com/"},
+		{principal: "/abc/principal/"},
+		{principal: "/123456789/calendars/"},
+		{principal: ""},
+	}
+	for _, test := range tests {
+		got, err := iCloudDSNID(test.principal)
+		if test.want == "" {
+			if !errors.HasCode(err, "WF11202") {
+				t.Errorf("iCloudDSNID(%q) = %q, %v, want WF11202", test.principal, got, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("iCloudDSNID(%q) = %q, %v, want %q", test.principal, got, err, test.want)
+		}
+	}
+}
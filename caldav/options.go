@@ -0,0 +1,289 @@
+package caldav
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultRequestTimeout  = time.Minute
+	defaultAttemptTimeout  = 15 * time.Second
+	defaultMaxResponseSize = 50 << 20 // 50 MiB
+	// defaultMaxDescriptionSize is well above the HTML bodies of ordinary
+	// invitations, which are mostly boilerplate
+	defaultMaxDescriptionSize = 256 << 10 // 256 KiB
+	defaultMaxRetries         = 3
+	defaultMaxRetryWait       = 30 * time.Second
+)
+
+// ClientOption configures optional behavior of a CalDAV client.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	serverType       ServerType
+	detectServerType bool
+	strict           bool
+	// discoveryPaths replaces the generic candidate paths if set
+	discoveryPaths []string
+	requestTimeout time.Duration
+	attemptTimeout time.Duration
+	// eventCache is nil unless caching is opted into
+	eventCache *EventCache
+	// discoveryCache is nil unless caching discovery results is opted into
+	discoveryCache *DiscoveryCache
+	// emailDomainFallback retries discovery against the email domain of
+	// the user if the host has no CalDAV server
+	emailDomainFallback bool
+	// proxy replaces the proxy of http.DefaultTransport (which honors the
+	// environment's HTTP_PROXY, HTTPS_PROXY and NO_PROXY) if proxySet
+	proxy    func(*http.Request) (*url.URL, error)
+	proxySet bool
+	// tlsConfig replaces the TLS configuration of http.DefaultTransport if set
+	tlsConfig *tls.Config
+	// connection pooling and TLS handshake settings that replace those of
+	// http.DefaultTransport if non-zero
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	tlsHandshakeTimeout time.Duration
+	// userAgent and headers are sent with every request that doesn't set
+	// them already
+	userAgent string
+	headers   map[string]string
+	// disableCompression stops requesting gzip-compressed responses
+	disableCompression bool
+	// maxResponseSize bounds the (decompressed) size of responses in bytes
+	maxResponseSize int64
+	// maxDescriptionSize bounds the size of HTML descriptions in bytes
+	maxDescriptionSize int
+	// maxRetries and maxRetryWait bound the retries of throttled requests
+	maxRetries   int
+	maxRetryWait time.Duration
+}
+
+func newClientOptions(options []ClientOption) *clientOptions {
+	o := &clientOptions{detectServerType: true, requestTimeout: defaultRequestTimeout, attemptTimeout: defaultAttemptTimeout, maxResponseSize: defaultMaxResponseSize, maxDescriptionSize: defaultMaxDescriptionSize, maxRetries: defaultMaxRetries, maxRetryWait: defaultMaxRetryWait}
+	for _, option := range options {
+		option(o)
+	}
+	return o
+}
+
+// Options tunes the timeouts and connection pooling of a client; zero fields
+// keep the defaults (i.e., those of http.DefaultTransport, a one-minute
+// request timeout and a 15s discovery attempt timeout).
+type Options struct {
+	// RequestTimeout bounds each request, including reading its response;
+	// large REPORTs may need longer.
+	RequestTimeout time.Duration
+	// DiscoveryTimeout bounds each discovery attempt (see WithAttemptTimeout).
+	DiscoveryTimeout time.Duration
+	// MaxIdleConnsPerHost and IdleConnTimeout keep connections to a host
+	// open between requests, which saves reconnecting when syncing many
+	// calendars on one host.
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	TLSHandshakeTimeout time.Duration
+}
+
+// WithOptions applies the non-zero fields of the given options; setting any
+// of the connection settings gives the client a transport of its own.
+func WithOptions(opts Options) ClientOption {
+	return func(o *clientOptions) {
+		if opts.RequestTimeout > 0 {
+			o.requestTimeout = opts.RequestTimeout
+		}
+		if opts.DiscoveryTimeout > 0 {
+			o.attemptTimeout = opts.DiscoveryTimeout
+		}
+		if opts.MaxIdleConnsPerHost > 0 {
+			o.maxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+		}
+		if opts.IdleConnTimeout > 0 {
+			o.idleConnTimeout = opts.IdleConnTimeout
+		}
+		if opts.TLSHandshakeTimeout > 0 {
+			o.tlsHandshakeTimeout = opts.TLSHandshakeTimeout
+		}
+	}
+}
+
+// customizesConnections determines whether the options replace any of the
+// connection settings of http.DefaultTransport.
+func (o *clientOptions) customizesConnections() bool {
+	return o.maxIdleConnsPerHost > 0 || o.idleConnTimeout > 0 || o.tlsHandshakeTimeout > 0
+}
+
+// WithServerType skips server detection and assumes the given server type.
+func WithServerType(t ServerType) ClientOption {
+	return func(o *clientOptions) {
+		o.serverType = t
+		o.detectServerType = false
+	}
+}
+
+// WithDiscoveryPaths replaces the generic candidate paths that are probed
+// for the user's principal (e.g., "/.well-known/caldav"). Server-specific
+// paths are still tried first.
+func WithDiscoveryPaths(paths ...string) ClientOption {
+	return func(o *clientOptions) {
+		o.discoveryPaths = paths
+	}
+}
+
+// WithAttemptTimeout bounds each discovery attempt (i.e., each candidate
+// path) so that a host that blackholes connections doesn't stall discovery
+// for the full request timeout per candidate.
+func WithAttemptTimeout(timeout time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.attemptTimeout = timeout
+	}
+}
+
+// WithEventCache serves the events of calendars whose CTag is unchanged from
+// the given cache rather than querying them again; see EventCache. Events
+// aren't cached by default.
+func WithEventCache(cache *EventCache) ClientOption {
+	return func(o *clientOptions) {
+		o.eventCache = cache
+	}
+}
+
+// WithDiscoveryCache caches the results of server discovery in the given
+// cache, which clients may share; the server is discovered whenever a client
+// is created by default.
+func WithDiscoveryCache(cache *DiscoveryCache) ClientOption {
+	return func(o *clientOptions) {
+		o.discoveryCache = cache
+	}
+}
+
+// WithEmailDomainFallback makes discovery fall back to the domain of the
+// user's email address (and its dav. and calendar. subdomains) if the given
+// host has no CalDAV server, e.g., when an account carries the host of its
+// IMAP server. It's opt-in since it probes several more hosts on failure.
+func WithEmailDomainFallback() ClientOption {
+	return func(o *clientOptions) {
+		o.emailDomainFallback = true
+	}
+}
+
+// WithProxy sends the client's requests through the proxy that the given
+// function returns for them (e.g., http.ProxyURL); a nil URL sends a request
+// directly. By default, the environment's proxy variables are honored.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) ClientOption {
+	return func(o *clientOptions) {
+		o.proxy = proxy
+		o.proxySet = true
+	}
+}
+
+// WithProxyURL sends all of the client's requests through the given proxy.
+func WithProxyURL(proxyURL *url.URL) ClientOption {
+	return WithProxy(http.ProxyURL(proxyURL))
+}
+
+// WithoutEnvironmentProxy sends the client's requests directly, ignoring the
+// environment's proxy variables.
+func WithoutEnvironmentProxy() ClientOption {
+	return WithProxy(nil)
+}
+
+// WithTLSConfig configures the client's TLS connections with the given
+// configuration (e.g., to present a client certificate).
+func WithTLSConfig(config *tls.Config) ClientOption {
+	return func(o *clientOptions) {
+		o.tlsConfig = config.Clone()
+	}
+}
+
+// WithRootCAs verifies the certificates of the server against the given CAs
+// (e.g., the internal CA of a self-hosted server) instead of the system's.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(o *clientOptions) {
+		if o.tlsConfig == nil {
+			o.tlsConfig = &tls.Config{}
+		}
+		o.tlsConfig.RootCAs = pool
+	}
+}
+
+// WithInsecureSkipVerify accepts any certificate the server presents, which
+// makes the client vulnerable to man-in-the-middle attacks; it's only meant
+// for testing against servers with self-signed certificates.
+func WithInsecureSkipVerify() ClientOption {
+	return func(o *clientOptions) {
+		if o.tlsConfig == nil {
+			o.tlsConfig = &tls.Config{}
+		}
+		o.tlsConfig.InsecureSkipVerify = true
+	}
+}
+
+// WithUserAgent sends the given User-Agent instead of Go's default (some
+// providers, e.g., iCloud, treat clients differently based on it).
+func WithUserAgent(userAgent string) ClientOption {
+	return func(o *clientOptions) {
+		o.userAgent = userAgent
+	}
+}
+
+// WithHeaders sends the given headers with every request. Headers that a
+// request sets already (e.g., Content-Type) aren't overwritten.
+func WithHeaders(headers map[string]string) ClientOption {
+	return func(o *clientOptions) {
+		if o.headers == nil {
+			o.headers = map[string]string{}
+		}
+		for name, value := range headers {
+			o.headers[name] = value
+		}
+	}
+}
+
+// WithoutCompression requests uncompressed responses (e.g., to inspect them
+// on the wire while debugging); responses are gzip-compressed by default.
+func WithoutCompression() ClientOption {
+	return func(o *clientOptions) {
+		o.disableCompression = true
+	}
+}
+
+// WithMaxResponseSize overrides the size (in bytes, after decompression) that
+// responses may have, 50 MiB by default (e.g., for accounts that are known to
+// have very large calendars). Larger responses fail with a WF11205 error.
+func WithMaxResponseSize(bytes int64) ClientOption {
+	return func(o *clientOptions) {
+		o.maxResponseSize = bytes
+	}
+}
+
+// WithMaxDescriptionSize overrides the size (in bytes) past which the HTML
+// descriptions of events are truncated, 256 KiB by default.
+func WithMaxDescriptionSize(bytes int) ClientOption {
+	return func(o *clientOptions) {
+		o.maxDescriptionSize = bytes
+	}
+}
+
+// WithRetries overrides how many times idempotent requests that are throttled
+// (429) or hit an unavailable server (503) are retried, 3 by default, and how
+// long each retry waits at most, 30s by default (servers may ask for longer
+// with Retry-After). Zero retries disables retrying.
+func WithRetries(maxRetries int, maxWait time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.maxRetries = maxRetries
+		o.maxRetryWait = maxWait
+	}
+}
+
+// WithStrictQueries makes CalendarEvents fail if any of the calendars fails
+// to be queried, instead of returning the events of the healthy calendars
+// alongside a WF11302 error.
+func WithStrictQueries() ClientOption {
+	return func(o *clientOptions) {
+		o.strict = true
+	}
+}
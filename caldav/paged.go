@@ -0,0 +1,154 @@
+package caldav
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/log"
+	"github.com/Cepreu/Archive/tracing"
+)
+
+const (
+	// defaultPageDuration is the time window of each REPORT issued by
+	// CalendarEventsPaged unless specified otherwise
+	defaultPageDuration = 7 * 24 * time.Hour
+)
+
+// PageOptions bound how CalendarEventsPaged queries a calendar.
+type PageOptions struct {
+	// Duration is the time window of each REPORT; a week if zero.
+	Duration time.Duration
+	// MaxEventsPerCalendar stops querying a calendar once it yielded that
+	// many events; unbounded if zero.
+	MaxEventsPerCalendar int
+}
+
+// PagedEventGetter gets events from a user's calendars a page at a time, so
+// that enormous calendars needn't be held in memory at once.
+type PagedEventGetter interface {
+	// CalendarEventsPaged gets events from the user's calendars in the
+	// specified time window and yields them a page at a time. Calendars are
+	// queried one at a time, and the events of each are yielded in
+	// chronological order; querying stops at the first error that yield
+	// returns.
+	CalendarEventsPaged(ctx context.Context, startUTC time.Time, endUTC time.Time, options PageOptions, yield func(calendarPath string, events []calendar.Event) error) error
+}
+
+// CalendarEventsPaged is like CalendarEventsContext, but each calendar is
+// queried with a REPORT per page (i.e., per sub-window) and its events are
+// yielded as soon as they're parsed. Events that span several pages are only
+// yielded with the first one. If only some of the calendars fail to be
+// queried, a WF11302 error is returned once the rest have been yielded.
+func (client *client) CalendarEventsPaged(ctx context.Context, startUTC time.Time, endUTC time.Time, options PageOptions, yield func(calendarPath string, events []calendar.Event) error) error {
+	ctx, endSubsegment := tracing.StartSubsegment(ctx, "caldav.CalendarEventsPaged")
+	defer endSubsegment()
+
+	if options.Duration <= 0 {
+		options.Duration = defaultPageDuration
+	}
+
+	calendars, err := client.findCalendars(ctx)
+	if err != nil {
+		return err
+	}
+	calendars = calendarsSupporting(calendars, calendarType) // skip task lists
+
+	// the errors of yield stop the query of every calendar, unlike theirs
+	var yieldErr error
+	yieldPage := func(calendarPath string, events []calendar.Event) error {
+		yieldErr = yield(calendarPath, events)
+		return yieldErr
+	}
+
+	failures := []error{}
+	for _, cal := range calendars {
+		err := client.queryEventsPaged(ctx, cal, startUTC, endUTC, options, yieldPage)
+		if yieldErr != nil {
+			return yieldErr
+		}
+		if err != nil {
+			if client.options.strict {
+				return errors.WF11203(cal.path, err)
+			}
+			failures = append(failures, errors.WF11203(cal.path, err))
+		}
+	}
+
+	switch {
+	case len(failures) == 0:
+		return nil
+	case len(failures) == len(calendars):
+		return errors.WF11301(failures...)
+	default:
+		return errors.WF11302(failures...)
+	}
+}
+
+// queryEventsPaged queries the given calendar a page at a time and yields its
+// events in chronological order.
+func (client *client) queryEventsPaged(ctx context.Context, cal *calendarListEntry, startUTC time.Time, endUTC time.Time, options PageOptions, yield func(calendarPath string, events []calendar.Event) error) error {
+	// resources overlap every page they span, but their events are yielded
+	// with the first page that they're in (see pageKey)
+	yielded := map[string]bool{}
+	count := 0
+	for pageStart := startUTC; pageStart.Before(endUTC); pageStart = pageStart.Add(options.Duration) {
+		pageEnd := pageStart.Add(options.Duration)
+		if pageEnd.After(endUTC) {
+			pageEnd = endUTC
+		}
+
+		events, err := client.queryEvents(ctx, cal, pageStart, pageEnd)
+		if err != nil {
+			return err
+		}
+
+		page := make([]calendar.Event, 0, len(events))
+		for _, event := range events {
+			key := pageKey(event)
+			if key == "" || !yielded[key] {
+				page = append(page, event)
+			}
+		}
+		for _, event := range page {
+			if key := pageKey(event); key != "" {
+				yielded[key] = true
+			}
+		}
+		sort.SliceStable(page, func(i, j int) bool { return page[i].Start().Before(page[j].Start()) })
+
+		full := options.MaxEventsPerCalendar > 0 && count+len(page) >= options.MaxEventsPerCalendar
+		if full {
+			page = page[:options.MaxEventsPerCalendar-count]
+		}
+		count += len(page)
+		if len(page) > 0 {
+			if err := yield(cal.path, page); err != nil {
+				return err
+			}
+		}
+		if full {
+			log.Debug("Stopped querying calendar at its maximum number of events", "path", cal.path, "max", options.MaxEventsPerCalendar, "pageStart", pageStart)
+			return nil
+		}
+	}
+	return nil
+}
+
+// pageKey identifies an event across the pages of a calendar: a resource
+// holds a recurring event's master and its overrides (which may be in later
+// pages than the master), so they're told apart by UID and RECURRENCE-ID, as
+// stored events are. It's empty for events of an unknown resource.
+func pageKey(event calendar.Event) string {
+	item, ok := event.(*calendarItem)
+	if !ok || item.Href() == "" {
+		return ""
+	}
+	key := item.Href() + "#" + item.UID()
+	if originalStart := item.OriginalStart(); !originalStart.IsZero() {
+		key += "#" + originalStart.UTC().Format(time.RFC3339)
+	}
+	return key
+}
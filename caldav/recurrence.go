@@ -0,0 +1,82 @@
+package caldav
+
+import (
+	"time"
+
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/log"
+)
+
+// RecurringEvent is an event that may belong to a recurring series, either as
+// its master or as an override of one of its instances.
+type RecurringEvent interface {
+	calendar.Event
+	// SeriesMasterID returns the ID shared by the events of the series; empty
+	// if the event isn't recurring.
+	SeriesMasterID() string
+	// RecurrenceRule returns the series' RRULE (e.g., "FREQ=WEEKLY;BYDAY=MO");
+	// empty if the event isn't a series master with a rule.
+	RecurrenceRule() string
+	// OriginalStart returns the start of the instance that the event
+	// overrides; zero if the event isn't an override.
+	OriginalStart() time.Time
+}
+
+// SeriesMasterID returns the ID of the recurring series that the event belongs
+// to (i.e., the UID shared by the series master and its overrides); empty if
+// the event isn't recurring.
+func (item *calendarItem) SeriesMasterID() string {
+	if item.raw == nil || (item.raw.property("RRULE") == nil && item.raw.property("RDATE") == nil && item.raw.property("RECURRENCE-ID") == nil) {
+		return ""
+	}
+	return item.UID()
+}
+
+// RecurrenceRule returns the raw value of the event's RRULE (e.g.,
+// "FREQ=WEEKLY;BYDAY=MO"); empty if it has none, which is the case for
+// overrides and for series defined by RDATEs only.
+func (item *calendarItem) RecurrenceRule() string {
+	if item.raw == nil {
+		return ""
+	}
+	return item.raw.value("RRULE")
+}
+
+// OriginalStart returns the start of the instance of its series that the
+// event overrides (i.e., its RECURRENCE-ID); zero if the event isn't an
+// override.
+func (item *calendarItem) OriginalStart() time.Time {
+	if item.raw == nil {
+		return time.Time{}
+	}
+	p := item.raw.property("RECURRENCE-ID")
+	if p == nil {
+		return time.Time{}
+	}
+	originalStart, err := p.dateTime(item.calendar.location())
+	if err != nil {
+		log.Warn("Could not parse RECURRENCE-ID", "err", err, "uid", item.UID(), "value", p.value)
+		return time.Time{}
+	}
+	return originalStart
+}
+
+// withinWindow drops the overrides among the given events of a resource that
+// were moved out of the given time window. The server returns a recurring
+// event's resource whole if any of its instances is in the window, so it may
+// hold such overrides, and they replace instances that are no longer there.
+// Series masters are kept wherever they start, as their other instances may
+// be in the window.
+func withinWindow(events []calendar.Event, startUTC time.Time, endUTC time.Time) []calendar.Event {
+	kept := events[:0]
+	for _, event := range events {
+		if item, ok := event.(*calendarItem); ok && !item.OriginalStart().IsZero() {
+			if !item.Start().Before(endUTC) || !item.End().After(startUTC) {
+				log.Debug("Dropping override outside of the window", "uid", item.UID(), "originalStart", item.OriginalStart())
+				continue
+			}
+		}
+		kept = append(kept, event)
+	}
+	return kept
+}
@@ -0,0 +1,138 @@
+package caldav
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WF/caldav-go/icalendar/components"
+	"github.com/WF/go/calendar"
+)
+
+// newTestRecurringItems returns the VEVENTs of the given iCalendar data, in a
+// calendar in the given time zone.
+func newTestRecurringItems(t *testing.T, timeZone string, data string) []*calendarItem {
+	parsed, err := parseComponents(data)
+	if err != nil {
+		t.Fatalf("parseComponents() error = %v", err)
+	}
+	cal := &calendarListEntry{path: "/calendars/user/work/", timeZone: timeZone}
+	items := []*calendarItem{}
+	for _, event := range parsed[0].children("VEVENT") {
+		items = append(items, &calendarItem{
+			Event:    &components.Event{UID: event.value("UID")},
+			raw:      event,
+			calendar: cal,
+		})
+	}
+	if len(items) == 0 {
+		t.Fatal("parseComponents() found no VEVENT")
+	}
+	return items
+}
+
+// newTestRecurringItem returns the first VEVENT of the given iCalendar data,
+// in a calendar in the given time zone.
+func newTestRecurringItem(t *testing.T, timeZone string, data string) *calendarItem {
+	return newTestRecurringItems(t, timeZone, data)[0]
+}
+
+// testSeries is a daily series in the window from March 2 to 9, 2020, with
+// an override within the window, one moved out of it, and an override of
+// another series (whose master isn't in the resource) moved into it.
+const testSeries = `BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:series
+DTSTART:20200302T090000
+DTEND:20200302T100000
+RRULE:FREQ=DAILY;COUNT=10
+END:VEVENT
+BEGIN:VEVENT
+UID:series
+RECURRENCE-ID:20200303T090000
+DTSTART:20200303T110000
+DTEND:20200303T120000
+END:VEVENT
+BEGIN:VEVENT
+UID:series
+RECURRENCE-ID:20200304T090000
+DTSTART:20200320T090000
+DTEND:20200320T100000
+END:VEVENT
+BEGIN:VEVENT
+UID:earlier-series
+RECURRENCE-ID:20200201T090000
+DTSTART:20200305T090000
+DTEND:20200305T100000
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestOverrides(t *testing.T) {
+	items := newTestRecurringItems(t, "UTC", testSeries)
+
+	want := []time.Time{
+		{},
+		time.Date(2020, 3, 3, 9, 0, 0, 0, time.UTC),
+		time.Date(2020, 3, 4, 9, 0, 0, 0, time.UTC),
+		time.Date(2020, 2, 1, 9, 0, 0, 0, time.UTC),
+	}
+	for i, item := range items {
+		if got := item.OriginalStart(); !got.Equal(want[i]) {
+			t.Errorf("OriginalStart() of %s #%d = %v, want %v", item.UID(), i, got, want[i])
+		}
+		if got := item.SeriesMasterID(); got != item.UID() {
+			t.Errorf("SeriesMasterID() = %q, want %q", got, item.UID())
+		}
+	}
+}
+
+func TestWithinWindow(t *testing.T) {
+	items := newTestRecurringItems(t, "UTC", testSeries)
+	events := make([]calendar.Event, len(items))
+	for i, item := range items {
+		events[i] = item
+	}
+
+	tests := []struct {
+		name  string
+		start time.Time
+		end   time.Time
+		want  []string
+	}{
+		{
+			name:  "override moved out of the window",
+			start: time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2020, 3, 9, 0, 0, 0, 0, time.UTC),
+			want:  []string{"series", "series 2020-03-03", "earlier-series 2020-02-01"},
+		},
+		{
+			name:  "master outside of the window",
+			start: time.Date(2020, 3, 19, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2020, 3, 21, 0, 0, 0, 0, time.UTC),
+			want:  []string{"series", "series 2020-03-04"},
+		},
+		{
+			name:  "override ending at the window's start",
+			start: time.Date(2020, 3, 3, 12, 0, 0, 0, time.UTC),
+			end:   time.Date(2020, 3, 4, 0, 0, 0, 0, time.UTC),
+			want:  []string{"series"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			window := append([]calendar.Event{}, events...)
+			got := []string{}
+			for _, event := range withinWindow(window, test.start, test.end) {
+				name := event.UID()
+				if originalStart := event.(*calendarItem).OriginalStart(); !originalStart.IsZero() {
+					name += " " + originalStart.Format("2006-01-02")
+				}
+				got = append(got, name)
+			}
+			if strings.Join(got, ", ") != strings.Join(test.want, ", ") {
+				t.Errorf("withinWindow() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
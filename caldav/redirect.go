@@ -0,0 +1,123 @@
+package caldav
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/log"
+)
+
+const (
+	// maxRedirects is how many redirects discovery follows per candidate.
+	maxRedirects                 = 5
+	findCurrentUserPrincipalBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:">
+  <D:prop>
+    <D:current-user-principal/>
+  </D:prop>
+</D:propfind>`
+)
+
+// findPrincipal sends the current-user-principal PROPFIND to the given
+// candidate and returns the principal's href, along with the candidate that
+// the request was redirected to, if any (e.g., iCloud and some corporate
+// servers redirect the well-known path to another host). http.Client follows
+// redirects without the PROPFIND body (and, when the authorization is set on
+// the request, without credentials across hosts), so the request is re-sent
+// to each location here instead. Credentials are added by the client's
+// transport, so they're sent to the new host as well, but never over a
+// downgrade from https to http.
+func findPrincipal(client *http.Client, start *candidate) (*candidate, string, error) {
+	noRedirects := *client
+	noRedirects.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	visited := map[string]bool{}
+	current := start
+	for redirects := 0; ; redirects++ {
+		location := current.server + current.path
+		if visited[location] {
+			return nil, "", fmt.Errorf("redirect loop at %s", location)
+		}
+		visited[location] = true
+
+		request, err := http.NewRequest(propfindMethod, location, strings.NewReader(findCurrentUserPrincipalBody))
+		if err != nil {
+			return nil, "", err
+		}
+		request.Header.Set(contentType, xmlContentType)
+		request.Header.Set(depth, "0")
+
+		response, err := noRedirects.Do(request)
+		if err != nil {
+			return nil, "", err
+		}
+		if !isRedirectStatus(response.StatusCode) {
+			principal, err := readPrincipal(response, current.path)
+			if err != nil {
+				return nil, "", err
+			}
+			return current, principal, nil
+		}
+		response.Body.Close()
+		if redirects == maxRedirects {
+			return nil, "", fmt.Errorf("more than %d redirects from %s%s", maxRedirects, start.server, start.path)
+		}
+
+		target, err := response.Location()
+		if err != nil {
+			return nil, "", err
+		}
+		if target.Scheme != "https" && strings.HasPrefix(current.server, "https:") {
+			return nil, "", fmt.Errorf("refusing to follow redirect from %s to %s", location, target)
+		}
+		log.Debug("Following CalDAV redirect", "from", location, "to", target)
+		current = &candidate{server: target.Scheme + "://" + target.Host, path: target.Path}
+	}
+}
+
+// readPrincipal reads the principal's href from the given response to the
+// current-user-principal PROPFIND of the given path, and closes its body. As
+// in findProp, a WF11202 error with the status of the propstats is returned
+// if the multistatus doesn't include the principal.
+func readPrincipal(response *http.Response, path string) (string, error) {
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusMultiStatus {
+		return "", fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	multistatus := &multistatus{}
+	if err := xml.NewDecoder(response.Body).Decode(multistatus); err != nil {
+		return "", err
+	}
+	if len(multistatus.Responses) == 0 || multistatus.Responses[0] == nil {
+		return "", errors.WF11202(path, "current-user-principal", "empty multistatus")
+	}
+
+	first := multistatus.Responses[0]
+	if principal := first.found().CurrentUserPrincipal; principal != nil && principal.Href != "" {
+		return normalizeHref(principal.Href)
+	}
+	statuses := []string{}
+	for _, propertyStatus := range first.PropStats {
+		if propertyStatus != nil {
+			statuses = append(statuses, propertyStatus.Status)
+		}
+	}
+	if len(statuses) == 0 {
+		return "", errors.WF11202(path, "current-user-principal", "no propstat")
+	}
+	return "", errors.WF11202(path, "current-user-principal", strings.Join(statuses, ", "))
+}
+
+func isRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
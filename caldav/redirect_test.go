@@ -0,0 +1,166 @@
+package caldav
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Cepreu/Archive/errors"
+)
+
+const testPrincipalMultistatus = `<?xml version="1.0" encoding="utf-8"?>
+<D:multistatus xmlns:D="DAV:">
+  <D:response>
+    <D:href>/.well-known/caldav</D:href>
+    <D:propstat>
+      <D:prop><D:current-user-principal/></D:prop>
+      <D:status>HTTP/1.1 404 Not Found</D:status>
+    </D:propstat>
+    <D:propstat>
+      <D:prop><D:current-user-principal><D:href>/principals/user%40example.com/</D:href></D:current-user-principal></D:prop>
+      <D:status>HTTP/1.1 200 OK</D:status>
+    </D:propstat>
+  </D:response>
+</D:multistatus>`
+
+// principalHandler answers the current-user-principal PROPFIND with the
+// given multistatus, and counts the requests that it gets.
+func principalHandler(t *testing.T, body string, requests *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		data, _ := io.ReadAll(r.Body)
+		if r.Method != propfindMethod || r.Header.Get(depth) != "0" || !strings.Contains(string(data), "current-user-principal") {
+			t.Errorf("request = %s (Depth: %q) %q, want the current-user-principal PROPFIND", r.Method, r.Header.Get(depth), data)
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(w, body)
+	}
+}
+
+func TestFindPrincipal(t *testing.T) {
+	requests := 0
+	server := httptest.NewTLSServer(principalHandler(t, testPrincipalMultistatus, &requests))
+	defer server.Close()
+
+	start := &candidate{server: server.URL, path: "/.well-known/caldav"}
+	resolved, principal, err := findPrincipal(server.Client(), start)
+	if err != nil {
+		t.Fatalf("findPrincipal() error = %v", err)
+	}
+	if resolved != start {
+		t.Errorf("resolved = %v, want the candidate itself", resolved)
+	}
+	if principal != "/principals/user@example.com/" {
+		t.Errorf("principal = %q, want /principals/user@example.com/", principal)
+	}
+	if requests != 1 {
+		t.Errorf("requests = %d, want 1", requests)
+	}
+}
+
+func TestFindPrincipalFollowsRedirects(t *testing.T) {
+	targetRequests := 0
+	target := httptest.NewTLSServer(principalHandler(t, testPrincipalMultistatus, &targetRequests))
+	defer target.Close()
+
+	startRequests := 0
+	start := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startRequests++
+		http.Redirect(w, r, target.URL+"/dav/", http.StatusMovedPermanently)
+	}))
+	defer start.Close()
+
+	resolved, principal, err := findPrincipal(start.Client(), &candidate{server: start.URL, path: "/.well-known/caldav"})
+	if err != nil {
+		t.Fatalf("findPrincipal() error = %v", err)
+	}
+	if resolved.server != target.URL || resolved.path != "/dav/" {
+		t.Errorf("resolved = %s%s, want %s/dav/", resolved.server, resolved.path, target.URL)
+	}
+	if principal != "/principals/user@example.com/" {
+		t.Errorf("principal = %q, want /principals/user@example.com/", principal)
+	}
+	// the discovery request itself is redirected; nothing probes first
+	if startRequests != 1 || targetRequests != 1 {
+		t.Errorf("requests = %d and %d, want 1 to each server", startRequests, targetRequests)
+	}
+}
+
+func TestFindPrincipalFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  func(server *httptest.Server) http.HandlerFunc
+		wantCode string
+		wantErr  string
+	}{
+		{
+			name: "redirect loop",
+			handler: func(server *httptest.Server) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					http.Redirect(w, r, server.URL+"/.well-known/caldav", http.StatusFound)
+				}
+			},
+			wantErr: "redirect loop",
+		},
+		{
+			name: "downgrade to http",
+			handler: func(server *httptest.Server) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					http.Redirect(w, r, "http://caldav.example.com/dav/", http.StatusFound)
+				}
+			},
+			wantErr: "refusing to follow redirect",
+		},
+		{
+			name: "not found",
+			handler: func(server *httptest.Server) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusNotFound)
+				}
+			},
+			wantErr: "404",
+		},
+		{
+			name: "empty multistatus",
+			handler: func(server *httptest.Server) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusMultiStatus)
+					io.WriteString(w, `<D:multistatus xmlns:D="DAV:"></D:multistatus>`)
+				}
+			},
+			wantCode: "WF11202",
+		},
+		{
+			name: "principal not found",
+			handler: func(server *httptest.Server) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusMultiStatus)
+					io.WriteString(w, `<D:multistatus xmlns:D="DAV:"><D:response><D:href>/</D:href><D:propstat>
+<D:prop><D:current-user-principal/></D:prop><D:status>HTTP/1.1 404 Not Found</D:status>
+</D:propstat></D:response></D:multistatus>`)
+				}
+			},
+			wantCode: "WF11202",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(nil)
+			server.Config.Handler = test.handler(server)
+			server.StartTLS()
+			defer server.Close()
+
+			_, _, err := findPrincipal(server.Client(), &candidate{server: server.URL, path: "/.well-known/caldav"})
+			switch {
+			case err == nil:
+				t.Error("findPrincipal() error = nil")
+			case test.wantCode != "" && !errors.HasCode(err, test.wantCode):
+				t.Errorf("findPrincipal() error = %v, want %s", err, test.wantCode)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Errorf("findPrincipal() error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package caldav
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Cepreu/Archive/log"
+)
+
+// Reminder is an alarm of an event (see RFC 5545 section 3.6.6).
+// It's meant to move to the calendar package (as calendar.Reminder) once the
+// other calendar backends support reminders as well.
+type Reminder struct {
+	// Offset is relative to the start of the event (or its end if
+	// RelatedToEnd); it's usually negative (i.e., before the event).
+	Offset       time.Duration
+	RelatedToEnd bool
+	// Absolute is the time of the reminder if it isn't relative to the event;
+	// zero otherwise.
+	Absolute time.Time
+	// Action is the ACTION of the alarm (e.g., DISPLAY, AUDIO, or EMAIL).
+	Action string
+}
+
+// Time returns the time of the reminder for an event with the given start and
+// end.
+func (reminder *Reminder) Time(start time.Time, end time.Time) time.Time {
+	switch {
+	case !reminder.Absolute.IsZero():
+		return reminder.Absolute
+	case reminder.RelatedToEnd:
+		return end.Add(reminder.Offset)
+	default:
+		return start.Add(reminder.Offset)
+	}
+}
+
+// Reminders returns the reminders of the event; malformed alarms are skipped.
+func (item *calendarItem) Reminders() []Reminder {
+	reminders := []Reminder{}
+	if item.raw == nil {
+		return reminders
+	}
+
+	for _, alarm := range item.raw.children("VALARM") {
+		reminder, err := newReminder(alarm, item.calendar.location())
+		if err != nil {
+			log.Debug("Skipping malformed alarm", "uid", item.Event.UID, "err", err)
+			continue
+		}
+		reminders = append(reminders, *reminder)
+	}
+	return reminders
+}
+
+func newReminder(alarm *component, location *time.Location) (*Reminder, error) {
+	trigger := alarm.property("TRIGGER")
+	if trigger == nil {
+		return nil, fmt.Errorf("missing TRIGGER")
+	}
+
+	reminder := &Reminder{Action: strings.ToUpper(alarm.value("ACTION"))}
+	if trigger.param("VALUE") == "DATE-TIME" {
+		absolute, err := trigger.dateTime(location)
+		if err != nil {
+			return nil, err
+		}
+		reminder.Absolute = absolute
+		return reminder, nil
+	}
+
+	offset, err := parseSignedDuration(trigger.value)
+	if err != nil {
+		return nil, err
+	}
+	reminder.Offset = offset
+	reminder.RelatedToEnd = strings.ToUpper(trigger.param("RELATED")) == "END"
+	return reminder, nil
+}
@@ -0,0 +1,102 @@
+package caldav
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReminders(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := newTestRecurringItem(t, "America/New_York", `BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:event
+DTSTART:20200302T090000
+DTEND:20200302T100000
+BEGIN:VALARM
+ACTION:DISPLAY
+TRIGGER:-PT15M
+END:VALARM
+BEGIN:VALARM
+ACTION:audio
+TRIGGER;RELATED=END:PT5M
+END:VALARM
+BEGIN:VALARM
+ACTION:EMAIL
+TRIGGER;VALUE=DATE-TIME:20200301T120000Z
+END:VALARM
+BEGIN:VALARM
+ACTION:DISPLAY
+TRIGGER;VALUE=DATE-TIME:20200301T080000
+END:VALARM
+BEGIN:VALARM
+ACTION:DISPLAY
+TRIGGER;RELATED=start:-P1D
+END:VALARM
+BEGIN:VALARM
+ACTION:DISPLAY
+END:VALARM
+BEGIN:VALARM
+ACTION:DISPLAY
+TRIGGER:15 minutes before
+END:VALARM
+BEGIN:VALARM
+ACTION:DISPLAY
+TRIGGER;VALUE=DATE-TIME:tomorrow
+END:VALARM
+END:VEVENT
+END:VCALENDAR
+`)
+
+	want := []Reminder{
+		{Offset: -15 * time.Minute, Action: "DISPLAY"},
+		{Offset: 5 * time.Minute, RelatedToEnd: true, Action: "AUDIO"},
+		{Absolute: time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC), Action: "EMAIL"},
+		// floating times are in the calendar's time zone
+		{Absolute: time.Date(2020, 3, 1, 8, 0, 0, 0, newYork), Action: "DISPLAY"},
+		{Offset: -24 * time.Hour, Action: "DISPLAY"},
+	}
+	got := item.Reminders()
+	if len(got) != len(want) {
+		t.Fatalf("Reminders() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Offset != want[i].Offset || got[i].RelatedToEnd != want[i].RelatedToEnd || !got[i].Absolute.Equal(want[i].Absolute) || got[i].Action != want[i].Action {
+			t.Errorf("Reminders()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRemindersOfEventWithoutAlarms(t *testing.T) {
+	item := newTestRecurringItem(t, "UTC", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:event\nDTSTART:20200302T090000Z\nEND:VEVENT\nEND:VCALENDAR\n")
+	if got := item.Reminders(); got == nil || len(got) != 0 {
+		t.Errorf("Reminders() = %+v, want none", got)
+	}
+	if got := (&calendarItem{}).Reminders(); !reflect.DeepEqual(got, []Reminder{}) {
+		t.Errorf("Reminders() without the raw VEVENT = %+v, want none", got)
+	}
+}
+
+func TestReminderTime(t *testing.T) {
+	start := time.Date(2020, 3, 2, 9, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	absolute := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		reminder Reminder
+		want     time.Time
+	}{
+		{name: "before the start", reminder: Reminder{Offset: -15 * time.Minute}, want: start.Add(-15 * time.Minute)},
+		{name: "at the start", reminder: Reminder{}, want: start},
+		{name: "after the end", reminder: Reminder{Offset: 5 * time.Minute, RelatedToEnd: true}, want: end.Add(5 * time.Minute)},
+		{name: "absolute", reminder: Reminder{Offset: time.Hour, RelatedToEnd: true, Absolute: absolute}, want: absolute},
+	}
+	for _, test := range tests {
+		if got := test.reminder.Time(start, end); !got.Equal(test.want) {
+			t.Errorf("%s: Time() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
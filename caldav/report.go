@@ -0,0 +1,267 @@
+package caldav
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Cepreu/Archive/errors"
+)
+
+const (
+	propfindMethod    = "PROPFIND"
+	xmlContentType    = "application/xml; charset=utf-8"
+	utcDateTimeFormat = "20060102T150405Z"
+	// calendarQueryBody is formatted with a component name (e.g., VEVENT) and
+	// the start and end of a time range in UTC
+	calendarQueryBody = `<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop>
+    <D:getetag/>
+    <C:calendar-data/>
+  </D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="%s">
+        <C:time-range start="%s" end="%s"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`
+)
+
+// multistatus is the multi-status response of a CalDAV REPORT (see RFC 4918
+// section 13). Unlike the caldav-go entities, it keeps each resource's ETag.
+type multistatus struct {
+	Responses []*response `xml:"DAV: response"`
+}
+
+type response struct {
+	Href      string      `xml:"DAV: href"`
+	Status    string      `xml:"DAV: status"`
+	PropStats []*propStat `xml:"DAV: propstat"`
+}
+
+type propStat struct {
+	Status string `xml:"DAV: status"`
+	Prop   *prop  `xml:"DAV: prop"`
+}
+
+type prop struct {
+	ETag         string `xml:"DAV: getetag"`
+	CalendarData string `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+	// the properties of calendar collections (see findCalendars)
+	ResourceType          *resourceType          `xml:"DAV: resourcetype"`
+	DisplayName           string                 `xml:"DAV: displayname"`
+	CalendarTimezone      string                 `xml:"urn:ietf:params:xml:ns:caldav calendar-timezone"`
+	SupportedComponentSet *supportedComponentSet `xml:"urn:ietf:params:xml:ns:caldav supported-calendar-component-set"`
+	CalendarColor         string                 `xml:"http://apple.com/ns/ical/ calendar-color"`
+	CalendarOrder         string                 `xml:"http://apple.com/ns/ical/ calendar-order"`
+	CTag                  string                 `xml:"http://calendarserver.org/ns/ getctag"`
+	// the principal of the authenticated user (see findPrincipal)
+	CurrentUserPrincipal *hrefProp `xml:"DAV: current-user-principal"`
+}
+
+type hrefProp struct {
+	Href string `xml:"DAV: href"`
+}
+
+type resourceType struct {
+	// Calendar is set if the resource is a calendar collection
+	Calendar *struct{} `xml:"urn:ietf:params:xml:ns:caldav calendar"`
+}
+
+type supportedComponentSet struct {
+	Components []*supportedComponent `xml:"urn:ietf:params:xml:ns:caldav comp"`
+}
+
+type supportedComponent struct {
+	Name string `xml:"name,attr"`
+}
+
+// found merges the properties of all 2xx propstats of the response; see
+// foundProps for why.
+func (response *response) found() *prop {
+	found := &prop{}
+	for _, propertyStatus := range response.PropStats {
+		if propertyStatus == nil || propertyStatus.Prop == nil || !isSuccessStatus(propertyStatus.Status) {
+			continue
+		}
+
+		p := propertyStatus.Prop
+		if found.ETag == "" {
+			found.ETag = p.ETag
+		}
+		if found.CalendarData == "" {
+			found.CalendarData = p.CalendarData
+		}
+		if found.ResourceType == nil {
+			found.ResourceType = p.ResourceType
+		}
+		if found.DisplayName == "" {
+			found.DisplayName = p.DisplayName
+		}
+		if found.CalendarTimezone == "" {
+			found.CalendarTimezone = p.CalendarTimezone
+		}
+		if found.SupportedComponentSet == nil {
+			found.SupportedComponentSet = p.SupportedComponentSet
+		}
+		if found.CalendarColor == "" {
+			found.CalendarColor = p.CalendarColor
+		}
+		if found.CalendarOrder == "" {
+			found.CalendarOrder = p.CalendarOrder
+		}
+		if found.CTag == "" {
+			found.CTag = p.CTag
+		}
+		if found.CurrentUserPrincipal == nil {
+			found.CurrentUserPrincipal = p.CurrentUserPrincipal
+		}
+	}
+	return found
+}
+
+// resource is a calendar object resource (see RFC 4791 section 4.1); that is,
+// a single iCalendar object stored in a calendar collection.
+type resource struct {
+	href string
+	etag string
+	data string
+}
+
+// queryResources gets the resources of the given calendar that contain
+// components of the given type (e.g., VEVENT) in the specified time window.
+func (client *client) queryResources(ctx context.Context, path string, componentType string, startUTC time.Time, endUTC time.Time) ([]*resource, error) {
+	body := fmt.Sprintf(calendarQueryBody, componentType, startUTC.UTC().Format(utcDateTimeFormat), endUTC.UTC().Format(utcDateTimeFormat))
+	multistatus, err := client.report(ctx, path, body)
+	if err != nil {
+		return nil, err
+	}
+	return multistatus.resources(client.requestURL(path))
+}
+
+// resources returns the calendar object resources of a REPORT's multi-status
+// response to a request of the given URL; responses without calendar data
+// (e.g., 404s) are skipped.
+func (multistatus *multistatus) resources(requestURL *url.URL) ([]*resource, error) {
+	resources := make([]*resource, 0, len(multistatus.Responses))
+	for _, response := range multistatus.Responses {
+		href, err := resolveHref(requestURL, response.Href)
+		if err != nil {
+			return nil, err
+		}
+
+		if prop := response.found(); prop.CalendarData != "" {
+			resources = append(resources, &resource{href: href, etag: prop.ETag, data: prop.CalendarData})
+		}
+	}
+	return resources, nil
+}
+
+// normalizeHref strips the scheme and host from the given href (if absolute)
+// and unescapes its path so that hrefs can be compared. Hrefs are URL paths,
+// so a "+" is kept as-is rather than being decoded to a space.
+func normalizeHref(href string) (string, error) {
+	if parsed, err := url.Parse(href); err == nil && parsed.Host != "" {
+		href = parsed.EscapedPath()
+	}
+	return url.PathUnescape(href)
+}
+
+// resolveHref resolves the given href of a response to a request of the given
+// URL and returns its unescaped path. Relative hrefs are resolved against the
+// request URL; absolute ones (e.g., Fastmail's) have to be on the request's
+// host, or WF11206 is returned.
+func resolveHref(requestURL *url.URL, href string) (string, error) {
+	parsed, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Host != "" && !sameHost(requestURL, parsed) {
+		return "", errors.WF11206(requestURL.Host, parsed.Host)
+	}
+	return url.PathUnescape(requestURL.ResolveReference(parsed).EscapedPath())
+}
+
+// sameHost determines whether the given URLs are on the same host and port;
+// hosts are compared case-insensitively and ports default to their scheme's.
+func sameHost(a *url.URL, b *url.URL) bool {
+	return strings.EqualFold(a.Hostname(), b.Hostname()) && portOf(a) == portOf(b)
+}
+
+func portOf(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if strings.EqualFold(u.Scheme, "http") {
+		return "80"
+	}
+	return "443"
+}
+
+// report issues a REPORT request with the given body and decodes its
+// multi-status response.
+func (client *client) report(ctx context.Context, path string, body string) (*multistatus, error) {
+	return client.multistatusRequest(ctx, reportMethod, path, "", body)
+}
+
+// propfind issues a PROPFIND request with the given depth and body and
+// decodes its multi-status response.
+func (client *client) propfind(ctx context.Context, path string, depth string, body string) (*multistatus, error) {
+	return client.multistatusRequest(ctx, propfindMethod, path, depth, body)
+}
+
+// multistatusRequest issues a WebDAV request that's expected to have a
+// multi-status response and decodes it; the Depth header of REPORT requests
+// is set by customHeadersRoundTripper.
+func (client *client) multistatusRequest(ctx context.Context, method string, path string, depthValue string, body string) (*multistatus, error) {
+	request, err := http.NewRequestWithContext(ctx, method, client.resolve(path), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set(contentType, xmlContentType)
+	if depthValue != "" {
+		request.Header.Set(depth, depthValue)
+	}
+
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound && path == client.path && client.host != "" && client.options.discoveryCache != nil {
+		// the calendar home set may have moved since it was discovered
+		client.options.discoveryCache.invalidate(client.host, client.emailAddress)
+	}
+	if response.StatusCode != http.StatusMultiStatus {
+		return nil, errors.WF11200(response)
+	}
+
+	// the body fails with WF11205 past the maximum response size (see
+	// limitedRoundTripper)
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	multistatus := &multistatus{}
+	if err := xml.Unmarshal(data, multistatus); err != nil {
+		return nil, err
+	}
+	return multistatus, nil
+}
+
+// isSuccessStatus checks whether or not the given status line (e.g.,
+// "HTTP/1.1 200 OK") has a 2xx status code.
+func isSuccessStatus(status string) bool {
+	fields := strings.Fields(status)
+	return len(fields) > 1 && len(fields[1]) == 3 && fields[1][0] == '2'
+}
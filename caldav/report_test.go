@@ -0,0 +1,72 @@
+package caldav
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/Cepreu/Archive/errors"
+)
+
+func TestNormalizeHref(t *testing.T) {
+	tests := []struct {
+		href string
+		want string
+	}{
+		{href: "/calendars/user/work/", want: "/calendars/user/work/"},
+		{href: "/calendars/user/a+b@example.com.ics", want: "/calendars/user/a+b@example.com.ics"},
+		{href: "/calendars/user%40example.com/work/", want: "/calendars/user@example.com/work/"},
+		{href: "/calendars/user/my%20calendar/", want: "/calendars/user/my calendar/"},
+		{href: "https://caldav.example.com/calendars/user/a+b.ics", want: "/calendars/user/a+b.ics"},
+		{href: "https://caldav.example.com:8443/calendars/user%40example.com/", want: "/calendars/user@example.com/"},
+	}
+	for _, test := range tests {
+		got, err := normalizeHref(test.href)
+		if err != nil {
+			t.Errorf("normalizeHref(%q) failed: %v", test.href, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("normalizeHref(%q) = %q, want %q", test.href, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeHrefMalformed(t *testing.T) {
+	if _, err := normalizeHref("/calendars/%zz/"); err == nil {
+		t.Error("normalizeHref of a malformed escape succeeded")
+	}
+}
+
+func TestResolveHref(t *testing.T) {
+	requestURL, _ := url.Parse("https://caldav.example.com/dav/calendars/user/")
+	tests := []struct {
+		href string
+		want string
+	}{
+		{href: "/dav/calendars/user/work/", want: "/dav/calendars/user/work/"},
+		{href: "work/", want: "/dav/calendars/user/work/"},
+		{href: "a+b.ics", want: "/dav/calendars/user/a+b.ics"},
+		{href: "/dav/calendars/user%40example.com/", want: "/dav/calendars/user@example.com/"},
+		{href: "https://caldav.example.com/dav/calendars/user/a+b.ics", want: "/dav/calendars/user/a+b.ics"},
+		{href: "https://CalDAV.example.com:443/dav/calendars/user/", want: "/dav/calendars/user/"},
+	}
+	for _, test := range tests {
+		got, err := resolveHref(requestURL, test.href)
+		if err != nil {
+			t.Errorf("resolveHref(%q) failed: %v", test.href, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("resolveHref(%q) = %q, want %q", test.href, got, test.want)
+		}
+	}
+}
+
+func TestResolveHrefOnAnotherHost(t *testing.T) {
+	requestURL, _ := url.Parse("https://caldav.example.com/dav/calendars/user/")
+	for _, href := range []string{"https://other.example.com/dav/calendars/user/", "https://caldav.example.com:8443/dav/", "http://caldav.example.com/dav/"} {
+		if _, err := resolveHref(requestURL, href); !errors.HasCode(err, "WF11206") {
+			t.Errorf("resolveHref(%q) = %v, want WF11206", href, err)
+		}
+	}
+}
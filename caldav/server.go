@@ -0,0 +1,73 @@
+package caldav
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Cepreu/Archive/log"
+)
+
+// ServerType represents a CalDAV server implementation.
+type ServerType int
+
+const (
+	// GenericServer is a server that has no implementation-specific paths.
+	GenericServer ServerType = iota
+	// Nextcloud is a Nextcloud (or ownCloud) server.
+	Nextcloud
+	// Baikal is a Baïkal server.
+	Baikal
+)
+
+const (
+	nextcloudHeader = "X-Nextcloud-Server"
+	serverHeader    = "Server"
+)
+
+var (
+	// serverPaths lists the principal path prefixes of specific server types;
+	// they're tried before the generic paths
+	serverPaths = map[ServerType][]string{
+		Nextcloud: {"/remote.php/dav"},
+		Baikal:    {"/dav.php", "/cal.php"},
+	}
+)
+
+func (t ServerType) String() string {
+	switch t {
+	case Nextcloud:
+		return "Nextcloud"
+	case Baikal:
+		return "Baikal"
+	default:
+		return "Generic"
+	}
+}
+
+// paths returns the candidate paths to probe for the given server type; the
+// server-specific paths come before the given generic ones.
+func (t ServerType) paths(generic []string) []string {
+	return append(append([]string{}, serverPaths[t]...), generic...)
+}
+
+// detectServerType guesses the server's implementation from the response
+// headers to a HEAD request of its root. It falls back to a generic server
+// when the request fails or the headers are inconclusive.
+func detectServerType(host string, client *http.Client) ServerType {
+	response, err := client.Head("https://" + host + "/")
+	if err != nil {
+		log.Debug("Failed to detect CalDAV server type", "host", host, "err", err)
+		return GenericServer
+	}
+	response.Body.Close()
+
+	server := strings.ToLower(response.Header.Get(serverHeader))
+	switch {
+	case response.Header.Get(nextcloudHeader) != "" || strings.Contains(server, "nextcloud"):
+		return Nextcloud
+	case strings.Contains(server, "baikal"):
+		return Baikal
+	default:
+		return GenericServer
+	}
+}
@@ -0,0 +1,112 @@
+package caldav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDetectServerType(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   ServerType
+	}{
+		{name: "Nextcloud header", header: http.Header{nextcloudHeader: {"1"}}, want: Nextcloud},
+		{name: "Nextcloud server", header: http.Header{serverHeader: {"NextCloud"}}, want: Nextcloud},
+		{name: "Baikal server", header: http.Header{serverHeader: {"Baikal/0.9.3"}}, want: Baikal},
+		{name: "other server", header: http.Header{serverHeader: {"Apache/2.4"}}, want: GenericServer},
+		{name: "no header", header: http.Header{}, want: GenericServer},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodHead || r.URL.Path != "/" {
+					t.Errorf("request = %s %s, want HEAD /", r.Method, r.URL.Path)
+				}
+				for key, values := range test.header {
+					w.Header()[key] = values
+				}
+			}))
+			defer server.Close()
+
+			if got := detectServerType(hostOf(t, server), server.Client()); got != test.want {
+				t.Errorf("detectServerType() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDetectServerTypeFallsBackToGeneric(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	host, client := hostOf(t, server), server.Client()
+	server.Close()
+
+	if got := detectServerType(host, client); got != GenericServer {
+		t.Errorf("detectServerType() = %v, want %v", got, GenericServer)
+	}
+}
+
+func TestDetectServerTypeWithinAttemptTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(nextcloudHeader, "1")
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := server.Client()
+	client.Timeout = 50 * time.Millisecond
+	started := time.Now()
+	if got := detectServerType(hostOf(t, server), client); got != GenericServer {
+		t.Errorf("detectServerType() = %v, want %v", got, GenericServer)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("detectServerType() took %v, want about the attempt timeout", elapsed)
+	}
+}
+
+func TestServerTypePaths(t *testing.T) {
+	generic := []string{"/.well-known/caldav", "/"}
+	tests := []struct {
+		serverType ServerType
+		want       []string
+	}{
+		{serverType: GenericServer, want: []string{"/.well-known/caldav", "/"}},
+		{serverType: Nextcloud, want: []string{"/remote.php/dav", "/.well-known/caldav", "/"}},
+		{serverType: Baikal, want: []string{"/dav.php", "/cal.php", "/.well-known/caldav", "/"}},
+	}
+	for _, test := range tests {
+		t.Run(test.serverType.String(), func(t *testing.T) {
+			if got := test.serverType.paths(generic); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("paths() = %v, want %v", got, test.want)
+			}
+		})
+	}
+	if want := []string{"/.well-known/caldav", "/"}; !reflect.DeepEqual(generic, want) {
+		t.Errorf("generic paths = %v, want them unchanged (%v)", generic, want)
+	}
+}
+
+func TestWithServerTypeSkipsDetection(t *testing.T) {
+	if o := newClientOptions(nil); !o.detectServerType {
+		t.Error("detectServerType = false by default, want true")
+	}
+	o := newClientOptions([]ClientOption{WithServerType(Baikal)})
+	if o.detectServerType || o.serverType != Baikal {
+		t.Errorf("detectServerType, serverType = %v, %v, want false, %v", o.detectServerType, o.serverType, Baikal)
+	}
+}
+
+// hostOf returns the host (and port) of the given test server.
+func hostOf(t *testing.T, server *httptest.Server) string {
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serverURL.Host
+}
@@ -0,0 +1,97 @@
+package caldav
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cepreu/Archive/log"
+)
+
+const (
+	// DNS failures aren't fatal to discovery, so there's no point in waiting
+	// for a slow resolver when the hardcoded paths can be probed instead
+	dnsLookupTimeout = 3 * time.Second
+	wellKnownPath    = "/.well-known/caldav"
+	txtPathKey       = "path="
+	// only CalDAV over TLS is looked up; plain CalDAV (_caldav._tcp) would
+	// have credentials sent in cleartext
+	service = "caldavs"
+)
+
+var (
+	// dnsResolver looks up the SRV and TXT records (replaced in tests)
+	dnsResolver resolver = net.DefaultResolver
+)
+
+// resolver looks up DNS records; it's implemented by *net.Resolver.
+type resolver interface {
+	LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// candidate is a server and a path on it that may lead to the current user's
+// principal.
+type candidate struct {
+	server string
+	path   string
+}
+
+// lookupServiceCandidates finds the CalDAV servers that the given domain
+// publishes via DNS SRV and TXT records (see RFC 6764 section 3). Only
+// targets within the domain are accepted (see RFC 6764 section 8), since DNS
+// answers may be spoofed and credentials are sent to them. Lookup failures
+// are logged and skipped.
+func lookupServiceCandidates(ctx context.Context, domain string) []*candidate {
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+
+	candidates := []*candidate{}
+	_, records, err := dnsResolver.LookupSRV(ctx, service, "tcp", domain)
+	if err != nil {
+		log.Debug("No CalDAV SRV records found", "service", service, "domain", domain, "err", err)
+		return candidates
+	}
+
+	path := lookupContextPath(ctx, service, domain)
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		if target == "" { // the service is decidedly not available
+			continue
+		}
+		if !isWithinDomain(target, domain) {
+			log.Warn("Ignoring CalDAV SRV target outside of the domain", "domain", domain, "target", target)
+			continue
+		}
+		server := fmt.Sprintf("https://%s", net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+		candidates = append(candidates, &candidate{server: server, path: path})
+	}
+	return candidates
+}
+
+// isWithinDomain determines whether the given host is the given domain or
+// one of its subdomains.
+func isWithinDomain(host string, domain string) bool {
+	host, domain = strings.ToLower(host), strings.ToLower(strings.TrimSuffix(domain, "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// lookupContextPath finds the context path of the given service from its TXT
+// records; it defaults to the well-known path when none is published.
+func lookupContextPath(ctx context.Context, service string, domain string) string {
+	records, err := dnsResolver.LookupTXT(ctx, "_"+service+"._tcp."+domain)
+	if err != nil {
+		log.Debug("No CalDAV TXT records found", "service", service, "domain", domain, "err", err)
+		return wellKnownPath
+	}
+
+	for _, record := range records {
+		if strings.HasPrefix(record, txtPathKey) {
+			return strings.TrimPrefix(record, txtPathKey)
+		}
+	}
+	return wellKnownPath
+}
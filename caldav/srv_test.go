@@ -0,0 +1,111 @@
+package caldav
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// fakeResolver answers SRV and TXT lookups from fixed records.
+type fakeResolver struct {
+	srv      map[string][]*net.SRV
+	txt      map[string][]string
+	services []string
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error) {
+	r.services = append(r.services, service)
+	records, ok := r.srv["_"+service+"._"+proto+"."+name]
+	if !ok {
+		return "", nil, errors.New("no such host")
+	}
+	return "", records, nil
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r.txt[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return records, nil
+}
+
+func withTestResolver(t *testing.T, r *fakeResolver) {
+	previous := dnsResolver
+	dnsResolver = r
+	t.Cleanup(func() { dnsResolver = previous })
+}
+
+func TestLookupServiceCandidates(t *testing.T) {
+	tests := []struct {
+		name string
+		srv  []*net.SRV
+		txt  []string
+		want []*candidate
+	}{
+		{
+			name: "well-known path",
+			srv:  []*net.SRV{{Target: "caldav.example.com.", Port: 443}},
+			want: []*candidate{{server: "https://caldav.example.com:443", path: "/.well-known/caldav"}},
+		},
+		{
+			name: "context path",
+			srv:  []*net.SRV{{Target: "caldav.example.com.", Port: 8443}},
+			txt:  []string{"v=1", "path=/dav/"},
+			want: []*candidate{{server: "https://caldav.example.com:8443", path: "/dav/"}},
+		},
+		{
+			name: "domain itself",
+			srv:  []*net.SRV{{Target: "Example.com.", Port: 443}},
+			want: []*candidate{{server: "https://Example.com:443", path: "/.well-known/caldav"}},
+		},
+		{
+			name: "service not available",
+			srv:  []*net.SRV{{Target: ".", Port: 0}},
+			want: []*candidate{},
+		},
+		{
+			name: "targets outside of the domain",
+			srv: []*net.SRV{
+				{Target: "caldav.attacker.com.", Port: 443},
+				{Target: "notexample.com.", Port: 443},
+				{Target: "example.com.attacker.com.", Port: 443},
+				{Target: "caldav.example.com.", Port: 443},
+			},
+			want: []*candidate{{server: "https://caldav.example.com:443", path: "/.well-known/caldav"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &fakeResolver{
+				srv: map[string][]*net.SRV{"_caldavs._tcp.example.com": test.srv},
+				txt: map[string][]string{},
+			}
+			if test.txt != nil {
+				r.txt["_caldavs._tcp.example.com"] = test.txt
+			}
+			withTestResolver(t, r)
+
+			got := lookupServiceCandidates(context.Background(), "example.com")
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("lookupServiceCandidates() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLookupServiceCandidatesIgnoresPlainCalDAV(t *testing.T) {
+	r := &fakeResolver{
+		srv: map[string][]*net.SRV{"_caldav._tcp.example.com": {{Target: "caldav.example.com.", Port: 80}}},
+	}
+	withTestResolver(t, r)
+
+	if got := lookupServiceCandidates(context.Background(), "example.com"); len(got) != 0 {
+		t.Errorf("lookupServiceCandidates() = %v, want none", got)
+	}
+	if want := []string{"caldavs"}; !reflect.DeepEqual(r.services, want) {
+		t.Errorf("looked up services %v, want %v", r.services, want)
+	}
+}
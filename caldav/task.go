@@ -0,0 +1,93 @@
+package caldav
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/log"
+)
+
+// Task is a to-do (VTODO) from one of the user's task lists.
+// It's meant to move to the calendar package once the other calendar backends
+// support tasks as well.
+type Task struct {
+	UID     string
+	Summary string
+	// Due is zero when the task has no due date.
+	Due       time.Time
+	Completed bool
+	// Priority ranges from 1 (highest) to 9 (lowest); 0 means undefined.
+	Priority   int
+	CalendarID string
+}
+
+// TaskLister lists a user's tasks.
+type TaskLister interface {
+	// Tasks gets the user's tasks in the specified time window.
+	Tasks(start time.Time, end time.Time) ([]*Task, error)
+	// TasksContext is like Tasks, but its requests are cancelled with the
+	// given context.
+	TasksContext(ctx context.Context, start time.Time, end time.Time) ([]*Task, error)
+}
+
+// Tasks gets the tasks from the user's task lists that are due (or otherwise
+// overlap) in the specified time window.
+func (client *client) Tasks(start time.Time, end time.Time) ([]*Task, error) {
+	return client.TasksContext(context.Background(), start, end)
+}
+
+// TasksContext is like Tasks, but its requests are cancelled with the given
+// context.
+func (client *client) TasksContext(ctx context.Context, start time.Time, end time.Time) ([]*Task, error) {
+	calendars, err := client.findCalendars(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := []*Task{}
+	for _, cal := range calendarsSupporting(calendars, taskType) {
+		resources, err := client.queryResources(ctx, cal.path, taskType, start, end)
+		if err != nil {
+			return nil, errors.WF11203(cal.path, err)
+		}
+
+		for _, resource := range resources {
+			objects, err := parseComponents(resource.data)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, object := range objects {
+				for _, todo := range object.children(taskType) {
+					tasks = append(tasks, newTask(todo, cal))
+				}
+			}
+		}
+	}
+	return tasks, nil
+}
+
+func newTask(todo *component, parentCalendar *calendarListEntry) *Task {
+	task := &Task{
+		UID:        todo.value("UID"),
+		Summary:    unescapeText(todo.value("SUMMARY")),
+		Completed:  strings.EqualFold(todo.value("STATUS"), "COMPLETED") || todo.property("COMPLETED") != nil,
+		CalendarID: parentCalendar.path,
+	}
+
+	if due := todo.property("DUE"); due != nil {
+		var err error
+		task.Due, err = due.dateTime(parentCalendar.location())
+		if err != nil {
+			log.Debug("Ignoring malformed due date", "uid", task.UID, "due", due.value, "err", err)
+		}
+	}
+
+	if priority := todo.value("PRIORITY"); priority != "" {
+		task.Priority, _ = strconv.Atoi(priority)
+	}
+	return task
+}
@@ -0,0 +1,316 @@
+package caldav
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cepreu/Archive/circuitbreaker"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/log"
+)
+
+const (
+	acceptEncoding  = "Accept-Encoding"
+	contentEncoding = "Content-Encoding"
+	contentLength   = "Content-Length"
+	gzipEncoding    = "gzip"
+	retryAfter      = "Retry-After"
+	// initialRetryWait is how long the first retry of a throttled request
+	// waits if the server doesn't say (i.e., without a Retry-After); it
+	// doubles with every retry
+	initialRetryWait = time.Second
+)
+
+// newTransport returns the transport of a client with the given options: the
+// shared one unless they customize it. Custom headers and retries reuse the
+// shared circuit breaker, while a custom base transport (e.g., with a proxy)
+// needs a new chain on top of a copy of http.DefaultTransport.
+func newTransport(o *clientOptions) http.RoundTripper {
+	if !o.proxySet && o.tlsConfig == nil && !o.disableCompression && !o.customizesConnections() {
+		if o.maxRetries != defaultMaxRetries || o.maxRetryWait != defaultMaxRetryWait {
+			retrying := newRetryRoundTripper(breakerTransport, o.maxRetries, o.maxRetryWait)
+			return newCustomHeadersTransport(newLoggingTransport(&gzipRoundTripper{innerRoundTripper: retrying}), o.userAgent, o.headers)
+		}
+		if o.userAgent == "" && len(o.headers) == 0 {
+			return transport
+		}
+		return newCustomHeadersTransport(loggingTransport, o.userAgent, o.headers)
+	}
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	if o.proxySet {
+		base.Proxy = o.proxy
+	}
+	if o.tlsConfig != nil {
+		if o.tlsConfig.InsecureSkipVerify {
+			log.Warn("TLS CERTIFICATE VERIFICATION IS DISABLED; CalDAV requests are vulnerable to man-in-the-middle attacks")
+		}
+		base.TLSClientConfig = o.tlsConfig
+	}
+	if o.maxIdleConnsPerHost > 0 {
+		base.MaxIdleConnsPerHost = o.maxIdleConnsPerHost
+	}
+	if o.idleConnTimeout > 0 {
+		base.IdleConnTimeout = o.idleConnTimeout
+	}
+	if o.tlsHandshakeTimeout > 0 {
+		base.TLSHandshakeTimeout = o.tlsHandshakeTimeout
+	}
+	breaker := circuitbreaker.NewRoundTripper(&certificateRoundTripper{innerRoundTripper: base}, breakerThreshold, breakerOpenDuration)
+	var inner http.RoundTripper = newRetryRoundTripper(breaker, o.maxRetries, o.maxRetryWait)
+	if o.disableCompression {
+		base.DisableCompression = true
+	} else {
+		inner = &gzipRoundTripper{innerRoundTripper: inner}
+	}
+	return newCustomHeadersTransport(newLoggingTransport(inner), o.userAgent, o.headers)
+}
+
+// certificateRoundTripper turns certificate verification failures into
+// WF10004 errors so that they can be told apart from rejected credentials
+// (WF10002) and other failures.
+type certificateRoundTripper struct {
+	innerRoundTripper http.RoundTripper
+}
+
+func (transport *certificateRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := transport.innerRoundTripper.RoundTrip(request)
+	if err != nil && isCertificateError(err) {
+		return nil, errors.WF10004(request.URL.Host, err.Error())
+	}
+	return response, err
+}
+
+// isCertificateError determines whether the given error, or any error it
+// wraps, is a certificate verification failure.
+func isCertificateError(err error) bool {
+	for err != nil {
+		switch err.(type) {
+		case *tls.CertificateVerificationError, x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError:
+			return true
+		}
+
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = wrapper.Unwrap()
+	}
+	return false
+}
+
+// retryRoundTripper retries the idempotent requests (i.e., PROPFIND, REPORT,
+// GET and HEAD) that are throttled (429) or hit an unavailable server (503),
+// after waiting as long as their Retry-After asks (up to maxWait). Other
+// requests (e.g., PUT) are never retried, lest they be applied twice.
+type retryRoundTripper struct {
+	innerRoundTripper http.RoundTripper
+	maxRetries        int
+	maxWait           time.Duration
+}
+
+func newRetryRoundTripper(inner http.RoundTripper, maxRetries int, maxWait time.Duration) http.RoundTripper {
+	return &retryRoundTripper{innerRoundTripper: inner, maxRetries: maxRetries, maxWait: maxWait}
+}
+
+func (transport *retryRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	// the body has to be sent again, which requires a fresh copy of it
+	retryable := isIdempotent(request.Method) && (request.Body == nil || request.GetBody != nil)
+	for attempt := 1; ; attempt++ {
+		attemptRequest := request
+		if retryable && attempt <= transport.maxRetries {
+			// the circuit breaker only counts the outcome of the last attempt
+			attemptRequest = request.WithContext(circuitbreaker.WithRetry(request.Context()))
+		}
+		response, err := transport.innerRoundTripper.RoundTrip(attemptRequest)
+		if err != nil || !isRetryableStatus(response.StatusCode) || !retryable || attempt > transport.maxRetries {
+			return response, err
+		}
+
+		wait := retryWait(response.Header.Get(retryAfter), attempt, transport.maxWait)
+		log.Warn("Retrying throttled CalDAV request", "method", request.Method, "url", request.URL, "status", response.StatusCode, "attempt", attempt, "wait", wait)
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+
+		select {
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		case <-time.After(wait):
+		}
+
+		if request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			retry := request.Clone(request.Context())
+			retry.Body = body
+			request = retry
+		}
+	}
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, propfindMethod, reportMethod:
+		return true
+	}
+	return false
+}
+
+// retryWait returns how long to wait before the given retry: the given
+// Retry-After (a number of seconds or an HTTP date) if the server sent one,
+// an exponential backoff otherwise, but never longer than maxWait.
+func retryWait(header string, attempt int, maxWait time.Duration) time.Duration {
+	wait := maxWait
+	if attempt <= 30 {
+		wait = initialRetryWait << uint(attempt-1)
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		wait = time.Until(date)
+	}
+
+	switch {
+	case wait < 0:
+		return 0
+	case wait > maxWait:
+		return maxWait
+	default:
+		return wait
+	}
+}
+
+// withContext returns a copy of the given client whose requests are cancelled
+// with the given context, including those issued by libraries that don't take
+// a context (i.e., caldav-go).
+func withContext(ctx context.Context, client *http.Client) *http.Client {
+	inner := client.Transport
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	withContext := *client
+	withContext.Transport = &contextRoundTripper{innerRoundTripper: inner, ctx: ctx}
+	return &withContext
+}
+
+// contextRoundTripper sends requests with its context (unless they have a
+// context of their own).
+type contextRoundTripper struct {
+	innerRoundTripper http.RoundTripper
+	ctx               context.Context
+}
+
+func (transport *contextRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Context() == context.Background() {
+		request = request.WithContext(transport.ctx)
+	}
+	return transport.innerRoundTripper.RoundTrip(request)
+}
+
+// gzipRoundTripper requests gzip-compressed responses and decompresses them
+// before they're parsed (and logged). http.Transport only does so itself as
+// long as requests don't set Accept-Encoding and it's the outermost
+// transport, which a custom transport chain doesn't guarantee.
+type gzipRoundTripper struct {
+	innerRoundTripper http.RoundTripper
+}
+
+func (transport *gzipRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Header.Get(acceptEncoding) == "" {
+		request.Header.Set(acceptEncoding, gzipEncoding)
+	}
+
+	response, err := transport.innerRoundTripper.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(response.Header.Get(contentEncoding), gzipEncoding) {
+		response.Body = &gzipBody{body: response.Body}
+		response.Header.Del(contentEncoding)
+		response.Header.Del(contentLength)
+		response.ContentLength = -1
+		response.Uncompressed = true
+	}
+	return response, nil
+}
+
+// gzipBody decompresses a response body lazily so that empty bodies (e.g.,
+// of HEAD requests) don't fail for lack of a gzip header.
+type gzipBody struct {
+	body   io.ReadCloser
+	reader *gzip.Reader
+}
+
+func (body *gzipBody) Read(p []byte) (int, error) {
+	if body.reader == nil {
+		reader, err := gzip.NewReader(body.body)
+		if err != nil {
+			return 0, err
+		}
+		body.reader = reader
+	}
+	return body.reader.Read(p)
+}
+
+func (body *gzipBody) Close() error {
+	return body.body.Close()
+}
+
+// limitedRoundTripper fails reads of response bodies past the given size
+// (after decompression) with a WF11205 error, so that every response is
+// bounded, including those that caldav-go reads (e.g., the PROPFINDs of
+// discovery).
+type limitedRoundTripper struct {
+	innerRoundTripper http.RoundTripper
+	limit             int64
+}
+
+func (transport *limitedRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := transport.innerRoundTripper.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body = &limitedBody{ReadCloser: response.Body, path: request.URL.Path, limit: transport.limit}
+	return response, nil
+}
+
+// limitedBody reads one byte more than its limit to tell a body that's
+// exactly as large as the limit apart from a larger one.
+type limitedBody struct {
+	io.ReadCloser
+	path  string
+	limit int64
+	read  int64
+	err   error
+}
+
+func (body *limitedBody) Read(p []byte) (int, error) {
+	if body.err != nil {
+		return 0, body.err
+	}
+	if remaining := body.limit - body.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := body.ReadCloser.Read(p)
+	body.read += int64(n)
+	if body.read > body.limit {
+		body.err = errors.WF11205(body.path, body.limit)
+		return n, body.err
+	}
+	return n, err
+}
@@ -0,0 +1,207 @@
+package caldav
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Cepreu/Archive/errors"
+)
+
+func TestLimitedRoundTripper(t *testing.T) {
+	const limit = 1024
+	tests := []struct {
+		name     string
+		size     int
+		wantCode string
+	}{
+		{name: "smaller", size: limit - 1},
+		{name: "exactly the limit", size: limit},
+		{name: "larger", size: limit + 1, wantCode: "WF11205"},
+		{name: "much larger", size: 100 * limit, wantCode: "WF11205"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, strings.Repeat("x", test.size))
+			}))
+			defer server.Close()
+
+			o := newClientOptions([]ClientOption{WithMaxResponseSize(limit)})
+			client := newHTTPClient(http.DefaultTransport, "user@example.com", o)
+			request, err := http.NewRequest(propfindMethod, server.URL+"/.well-known/caldav", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			defer response.Body.Close()
+
+			data, err := io.ReadAll(response.Body)
+			if test.wantCode == "" {
+				if err != nil || len(data) != test.size {
+					t.Errorf("ReadAll() = %d bytes, %v, want %d bytes", len(data), err, test.size)
+				}
+				return
+			}
+			if !errors.HasCode(err, test.wantCode) {
+				t.Errorf("ReadAll() error = %v, want %s", err, test.wantCode)
+			}
+			if len(data) > limit+1 {
+				t.Errorf("read %d bytes, want at most %d", len(data), limit+1)
+			}
+			// the body keeps failing
+			if _, err := response.Body.Read(make([]byte, 1)); !errors.HasCode(err, test.wantCode) {
+				t.Errorf("Read() error = %v, want %s", err, test.wantCode)
+			}
+		})
+	}
+}
+
+// gzipped compresses the given data.
+func gzipped(data string) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	io.WriteString(writer, data)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+// newGzipServer returns a server that answers with the given body, gzipped
+// if the request accepts it, and records the Accept-Encoding of the last
+// request.
+func newGzipServer(t *testing.T, body string, acceptEncoding *string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*acceptEncoding = r.Header.Get("Accept-Encoding")
+		if !strings.Contains(*acceptEncoding, "gzip") {
+			io.WriteString(w, body)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.Method != http.MethodHead {
+			w.Write(gzipped(body))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGzipRoundTripper(t *testing.T) {
+	const body = `<D:multistatus xmlns:D="DAV:"></D:multistatus>`
+	tests := []struct {
+		name               string
+		method             string
+		acceptEncoding     string
+		wantAcceptEncoding string
+		wantBody           string
+	}{
+		{name: "compressed", method: propfindMethod, wantAcceptEncoding: "gzip", wantBody: body},
+		{name: "empty", method: http.MethodHead, wantAcceptEncoding: "gzip", wantBody: ""},
+		{name: "identity", method: propfindMethod, acceptEncoding: "identity", wantAcceptEncoding: "identity", wantBody: body},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var acceptEncoding string
+			server := newGzipServer(t, body, &acceptEncoding)
+			// http.Transport doesn't decompress the responses itself
+			transport := &gzipRoundTripper{innerRoundTripper: &http.Transport{DisableCompression: true}}
+
+			request, err := http.NewRequest(test.method, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.acceptEncoding != "" {
+				request.Header.Set("Accept-Encoding", test.acceptEncoding)
+			}
+			response, err := transport.RoundTrip(request)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			defer response.Body.Close()
+
+			if acceptEncoding != test.wantAcceptEncoding {
+				t.Errorf("Accept-Encoding = %q, want %q", acceptEncoding, test.wantAcceptEncoding)
+			}
+			data, err := io.ReadAll(response.Body)
+			if err != nil || string(data) != test.wantBody {
+				t.Errorf("ReadAll() = %q, %v, want %q", data, err, test.wantBody)
+			}
+			if encoding := response.Header.Get("Content-Encoding"); encoding != "" {
+				t.Errorf("Content-Encoding = %q, want it removed", encoding)
+			}
+		})
+	}
+}
+
+func TestGzipRoundTripperReportsCorruptResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		io.WriteString(w, "not gzipped")
+	}))
+	defer server.Close()
+	transport := &gzipRoundTripper{innerRoundTripper: &http.Transport{DisableCompression: true}}
+
+	request, _ := http.NewRequest(propfindMethod, server.URL, nil)
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	defer response.Body.Close()
+	if _, err := io.ReadAll(response.Body); err != gzip.ErrHeader {
+		t.Errorf("ReadAll() error = %v, want %v", err, gzip.ErrHeader)
+	}
+}
+
+func TestClientCompression(t *testing.T) {
+	const limit = 1024
+	// compresses to much less than the limit
+	body := strings.Repeat("x", 10*limit)
+	tests := []struct {
+		name               string
+		options            []ClientOption
+		wantAcceptEncoding string
+	}{
+		{name: "default", wantAcceptEncoding: "gzip"},
+		{name: "without compression", options: []ClientOption{WithoutCompression()}, wantAcceptEncoding: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var acceptEncoding string
+			server := newGzipServer(t, body, &acceptEncoding)
+			o := newClientOptions(test.options)
+			client := newHTTPClient(newTransport(o), "user@example.com", o)
+
+			request, _ := http.NewRequest(propfindMethod, server.URL, nil)
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			defer response.Body.Close()
+			if acceptEncoding != test.wantAcceptEncoding {
+				t.Errorf("Accept-Encoding = %q, want %q", acceptEncoding, test.wantAcceptEncoding)
+			}
+			if data, err := io.ReadAll(response.Body); err != nil || string(data) != body {
+				t.Errorf("ReadAll() = %d bytes, %v, want %d bytes", len(data), err, len(body))
+			}
+
+			// the size of responses is limited after decompression
+			o = newClientOptions(append(test.options, WithMaxResponseSize(limit)))
+			client = newHTTPClient(newTransport(o), "user@example.com", o)
+			request, _ = http.NewRequest(propfindMethod, server.URL, nil)
+			response, err = client.Do(request)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			defer response.Body.Close()
+			if _, err := io.ReadAll(response.Body); !errors.HasCode(err, "WF11205") {
+				t.Errorf("ReadAll() error = %v, want WF11205", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package caldav
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/WF/caldav-go/icalendar"
+	"github.com/WF/caldav-go/icalendar/components"
+	"github.com/WF/caldav-go/icalendar/values"
+	"github.com/WF/go/enums/sensitivity"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/log"
+)
+
+const (
+	contentType          = "Content-Type"
+	etagHeader           = "ETag"
+	ifMatch              = "If-Match"
+	ifNoneMatch          = "If-None-Match"
+	iCalendarContentType = "text/calendar; charset=utf-8"
+	iCalendarExtension   = ".ics"
+)
+
+// EventInput describes an event to be written to a calendar.
+// It's meant to move to the calendar package (next to calendar.Event) once
+// the other calendar backends support writing events as well.
+type EventInput struct {
+	Subject     string
+	Description string
+	Location    string
+	Start       time.Time
+	End         time.Time
+	// TimeZone is the IANA time zone of the event's start and end (e.g.,
+	// "America/Los_Angeles"); it defaults to UTC.
+	TimeZone  string
+	Attendees []mail.Address
+	// Sensitivity is written as the event's CLASS; it's omitted if Unknown.
+	Sensitivity sensitivity.Sensitivity
+}
+
+// EventWriter writes events to a user's calendars.
+type EventWriter interface {
+	// CreateEvent creates an event in the given calendar and returns its UID.
+	CreateEvent(calendarPath string, input EventInput) (uid string, err error)
+	// UpdateEvent replaces the event with the given UID at the given href
+	// (see DecodeExternalID), provided that it still has the given ETag, and
+	// returns its new ETag.
+	UpdateEvent(href string, uid string, etag string, input EventInput) (newETag string, err error)
+	// DeleteEvent deletes the event at the given href, provided that it still
+	// has the given ETag.
+	DeleteEvent(href string, etag string) error
+	// CreateEventContext is like CreateEvent, but its request is cancelled
+	// with the given context.
+	CreateEventContext(ctx context.Context, calendarPath string, input EventInput) (uid string, err error)
+	// UpdateEventContext is like UpdateEvent, but its request is cancelled
+	// with the given context.
+	UpdateEventContext(ctx context.Context, href string, uid string, etag string, input EventInput) (newETag string, err error)
+	// DeleteEventContext is like DeleteEvent, but its request is cancelled
+	// with the given context.
+	DeleteEventContext(ctx context.Context, href string, etag string) error
+}
+
+// CreateEvent creates an event in the given calendar and returns its UID.
+// It never overwrites an existing calendar resource.
+func (client *client) CreateEvent(calendarPath string, input EventInput) (string, error) {
+	return client.CreateEventContext(context.Background(), calendarPath, input)
+}
+
+// CreateEventContext is like CreateEvent, but its request is cancelled with
+// the given context.
+func (client *client) CreateEventContext(ctx context.Context, calendarPath string, input EventInput) (string, error) {
+	uid, err := newUID()
+	if err != nil {
+		return "", err
+	}
+
+	// validate the input before making any requests
+	event, err := input.newEvent(uid)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := client.putEvent(ctx, resourcePath(calendarPath, uid), event, ifNoneMatch, "*"); err != nil {
+		return "", err
+	}
+
+	log.Debug("Created event", "calendarPath", calendarPath, "uid", uid)
+	return uid, nil
+}
+
+// UpdateEvent replaces the event with the given UID at the given href,
+// provided that it still has the given ETag (i.e., it wasn't modified by
+// another client in the meantime), and returns its new ETag. The href and
+// ETag are those of the event's ExternalID (see DecodeExternalID), since
+// other clients name resources as they please (i.e., not necessarily after
+// the UID). A WF11204 error is returned when the ETag doesn't match; the
+// event should be refetched before retrying. Servers aren't required to
+// return the new ETag, in which case it's empty.
+func (client *client) UpdateEvent(href string, uid string, etag string, input EventInput) (string, error) {
+	return client.UpdateEventContext(context.Background(), href, uid, etag, input)
+}
+
+// UpdateEventContext is like UpdateEvent, but its request is cancelled with
+// the given context.
+func (client *client) UpdateEventContext(ctx context.Context, href string, uid string, etag string, input EventInput) (string, error) {
+	event, err := input.newEvent(uid)
+	if err != nil {
+		return "", err
+	}
+
+	newETag, err := client.putEvent(ctx, href, event, ifMatch, etag)
+	if err != nil {
+		return "", err
+	}
+
+	log.Debug("Updated event", "href", href, "uid", uid, "etag", etag, "newETag", newETag)
+	return newETag, nil
+}
+
+// DeleteEvent deletes the event at the given href (see UpdateEvent),
+// provided that it still has the given ETag. A WF11204 error is returned
+// when the ETag doesn't match.
+func (client *client) DeleteEvent(href string, etag string) error {
+	return client.DeleteEventContext(context.Background(), href, etag)
+}
+
+// DeleteEventContext is like DeleteEvent, but its request is cancelled with
+// the given context.
+func (client *client) DeleteEventContext(ctx context.Context, href string, etag string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodDelete, client.resolve(href), nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.write(href, request, ifMatch, etag); err != nil {
+		return err
+	}
+
+	log.Debug("Deleted event", "href", href, "etag", etag)
+	return nil
+}
+
+// putEvent writes the given event to the given path under the given
+// precondition (e.g., If-Match) and returns the resource's new ETag.
+func (client *client) putEvent(ctx context.Context, path string, event *components.Event, precondition string, value string) (string, error) {
+	body, err := icalendar.Marshal(components.NewCalendar(event))
+	if err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, client.resolve(path), strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set(contentType, iCalendarContentType)
+
+	response, err := client.write(path, request, precondition, value)
+	if err != nil {
+		return "", err
+	}
+	return response.Header.Get(etagHeader), nil
+}
+
+// write issues the given write request under the given precondition (e.g.,
+// If-Match); failed preconditions map to WF11204 and other non-2xx responses
+// to WF11200.
+func (client *client) write(path string, request *http.Request, precondition string, value string) (*http.Response, error) {
+	request.Header.Set(precondition, value)
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusPreconditionFailed:
+		return nil, errors.WF11204(path, precondition, value)
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return nil, errors.WF11200(response)
+	default:
+		return response, nil
+	}
+}
+
+// newEvent validates the input and converts it into a VEVENT with the given
+// UID.
+func (input *EventInput) newEvent(uid string) (*components.Event, error) {
+	if input.Start.IsZero() {
+		return nil, errors.WF12001("Start", "missing")
+	}
+	if input.End.IsZero() {
+		return nil, errors.WF12001("End", "missing")
+	}
+	if input.End.Before(input.Start) {
+		return nil, errors.WF12001("End", "before Start")
+	}
+
+	location := time.UTC
+	if input.TimeZone != "" {
+		var err error
+		location, err = time.LoadLocation(input.TimeZone)
+		if err != nil {
+			return nil, errors.WF12001("TimeZone", err.Error())
+		}
+	}
+
+	event := components.NewEventWithEnd(uid, input.Start.In(location), input.End.In(location))
+	event.DateStamp = values.NewDateTime(time.Now().UTC())
+	event.Summary = input.Subject
+	event.Description = input.Description
+	if input.Location != "" {
+		event.Location = values.NewLocation(input.Location)
+	}
+	for _, attendee := range input.Attendees {
+		event.Attendees = append(event.Attendees, &values.Attendee{Entry: attendee})
+	}
+	event.AccessClassification = sensitivityToAccessClassification(input.Sensitivity)
+	return event, nil
+}
+
+// sensitivityToAccessClassification is the reverse of
+// convert.EventAccessClassificationToSensitivity. iCalendar has no CLASS for
+// personal events, so they're written as private, which is how they're shown
+// to other users anyway.
+func sensitivityToAccessClassification(s sensitivity.Sensitivity) values.EventAccessClassification {
+	switch s {
+	case sensitivity.Normal:
+		return values.PublicEventAccessClassification
+	case sensitivity.Personal, sensitivity.Private:
+		return values.PrivateEventAccessClassification
+	case sensitivity.Confidential:
+		return values.ConfidentialEventAccessClassification
+	}
+	return ""
+}
+
+// resourcePath returns the path of a new calendar resource for the event with
+// the given UID; existing events are addressed by their href instead.
+func resourcePath(calendarPath string, uid string) string {
+	return strings.TrimSuffix(calendarPath, "/") + "/" + uid + iCalendarExtension
+}
+
+// newUID generates a random (version 4) UUID to be used as an event's UID.
+func newUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
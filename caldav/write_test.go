@@ -0,0 +1,82 @@
+package caldav
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Cepreu/Archive/errors"
+)
+
+type recordedRequest struct {
+	method  string
+	path    string
+	ifMatch string
+}
+
+func newTestWriteClient(t *testing.T, status int) (*client, *[]recordedRequest) {
+	requests := &[]recordedRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		*requests = append(*requests, recordedRequest{method: request.Method, path: request.URL.Path, ifMatch: request.Header.Get(ifMatch)})
+		writer.Header().Set(etagHeader, `"2"`)
+		writer.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	serverURL, _ := url.Parse(server.URL)
+	return &client{server: serverURL, httpClient: server.Client()}, requests
+}
+
+func TestUpdateEventUsesHref(t *testing.T) {
+	client, requests := newTestWriteClient(t, http.StatusNoContent)
+	start := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	input := EventInput{Subject: "Standup", Start: start, End: start.Add(time.Hour)}
+
+	newETag, err := client.UpdateEvent("/calendars/user/work/created-elsewhere.ics", "uid-1", `"1"`, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newETag != `"2"` {
+		t.Errorf("new ETag = %s, want \"2\"", newETag)
+	}
+	want := recordedRequest{method: http.MethodPut, path: "/calendars/user/work/created-elsewhere.ics", ifMatch: `"1"`}
+	if len(*requests) != 1 || (*requests)[0] != want {
+		t.Errorf("requests = %+v, want %+v", *requests, want)
+	}
+}
+
+func TestDeleteEventUsesHref(t *testing.T) {
+	client, requests := newTestWriteClient(t, http.StatusNoContent)
+	if err := client.DeleteEvent("/calendars/user/work/created-elsewhere.ics", `"1"`); err != nil {
+		t.Fatal(err)
+	}
+	want := recordedRequest{method: http.MethodDelete, path: "/calendars/user/work/created-elsewhere.ics", ifMatch: `"1"`}
+	if len(*requests) != 1 || (*requests)[0] != want {
+		t.Errorf("requests = %+v, want %+v", *requests, want)
+	}
+}
+
+func TestDeleteEventPreconditionFailed(t *testing.T) {
+	client, _ := newTestWriteClient(t, http.StatusPreconditionFailed)
+	err := client.DeleteEvent("/calendars/user/work/event.ics", `"1"`)
+	if !errors.HasCode(err, "WF11204") {
+		t.Errorf("DeleteEvent = %v, want WF11204", err)
+	}
+}
+
+func TestDeleteEventContextCancelled(t *testing.T) {
+	client, requests := newTestWriteClient(t, http.StatusNoContent)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := client.DeleteEventContext(ctx, "/calendars/user/work/event.ics", `"1"`)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("DeleteEventContext = %v, want context.Canceled", err)
+	}
+	if len(*requests) != 0 {
+		t.Errorf("requests = %+v, want none", *requests)
+	}
+}
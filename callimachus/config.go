@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/log"
+)
+
+const (
+	defaultSyncTimeout = 5 * time.Minute
+	defaultGracePeriod = 30 * time.Second
+	defaultAWSRegion   = "us-west-2"
+	// a user's messages are processed at most once per 30s on average, in
+	// bursts of up to 5
+	defaultUserRateLimit = 1.0 / 30
+	defaultUserRateBurst = 5
+	// the events are synced from 30 days ago to 15 days from now by default
+	defaultSyncWindowPastDays   = 30
+	defaultSyncWindowFutureDays = 15
+	// the values of EVENT_STORE
+	parseEventStore  = "parse"
+	dynamoEventStore = "dynamo"
+)
+
+var (
+	// the path of a queue URL, i.e., /<account ID>/<queue name>
+	queuePathPattern = regexp.MustCompile(`^/[0-9]{12}/[A-Za-z0-9_-]{1,80}(\.fifo)?$`)
+	// e.g., us-east-1 or us-gov-west-1
+	regionPattern = regexp.MustCompile(`^[a-z]{2}(-gov|-iso[a-z]*)?-[a-z]+-[0-9]+$`)
+)
+
+// validateConfig checks the environment variables that the service can't run
+// without so that it fails fast (rather than on the first receive).
+func validateConfig() error {
+	if queueURL == "" {
+		return errors.WF12002("USER_OBJECTS_QUEUE_URL", queueURL, "missing")
+	}
+	if !isQueueURL(queueURL) {
+		return errors.WF12002("USER_OBJECTS_QUEUE_URL", queueURL, "not an SQS queue URL")
+	}
+
+	if deadLetterQueueURL != "" && !isQueueURL(deadLetterQueueURL) {
+		return errors.WF12002("DEAD_LETTER_QUEUE_URL", deadLetterQueueURL, "not an SQS queue URL")
+	}
+
+	// the window may start now, but has to end in the future; the past days
+	// may be signed (e.g., -30)
+	if value := os.Getenv("SYNC_WINDOW_PAST_DAYS"); value != "" {
+		if _, err := strconv.Atoi(value); err != nil {
+			return errors.WF12002("SYNC_WINDOW_PAST_DAYS", value, "not a number of days")
+		}
+	}
+	if value := os.Getenv("SYNC_WINDOW_FUTURE_DAYS"); value != "" {
+		if days, err := strconv.Atoi(value); err != nil || days <= 0 {
+			return errors.WF12002("SYNC_WINDOW_FUTURE_DAYS", value, "not a positive number of days")
+		}
+	}
+
+	switch eventStoreType {
+	case parseEventStore:
+	case dynamoEventStore:
+		if eventTable == "" {
+			return errors.WF12002("EVENT_TABLE", eventTable, "missing for the dynamo event store")
+		}
+	default:
+		return errors.WF12002("EVENT_STORE", eventStoreType, "not parse or dynamo")
+	}
+
+	if region := os.Getenv("AWS_REGION"); region != "" && !regionPattern.MatchString(region) {
+		return errors.WF12002("AWS_REGION", region, "not an AWS region")
+	}
+	return nil
+}
+
+// isQueueURL reports whether the given URL is the URL of an SQS queue, e.g.,
+// https://sqs.us-east-1.amazonaws.com/123456789012/user-objects, the legacy
+// https://us-east-1.queue.amazonaws.com/123456789012/user-objects or that of
+// a VPC endpoint.
+func isQueueURL(rawURL string) bool {
+	queueURL, err := url.Parse(rawURL)
+	if err != nil || queueURL.Scheme != "https" || queueURL.User != nil || queueURL.RawQuery != "" || queueURL.Fragment != "" {
+		return false
+	}
+	host := queueURL.Hostname()
+	if !strings.HasSuffix(host, ".amazonaws.com") && !strings.HasSuffix(host, ".amazonaws.com.cn") {
+		return false
+	}
+	return queuePathPattern.MatchString(queueURL.Path)
+}
+
+// secondsFromEnv reads a positive number of seconds from the given environment
+// variable; it falls back to the given default when the variable is unset or
+// invalid.
+func secondsFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		log.Warn("Ignoring invalid environment variable", "name", name, "value", value, "default", fallback)
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// intFromEnv reads a positive integer from the given environment variable; it
+// falls back to the given default when the variable is unset or invalid.
+func intFromEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Warn("Ignoring invalid environment variable", "name", name, "value", value, "default", fallback)
+		return fallback
+	}
+	return n
+}
+
+// absIntFromEnv reads an integer from the given environment variable and
+// returns its absolute value, so that, e.g., both -30 and 30 days ago are 30
+// days; it falls back to the given default when the variable is unset or
+// invalid.
+func absIntFromEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Warn("Ignoring invalid environment variable", "name", name, "value", value, "default", fallback)
+		return fallback
+	}
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// floatFromEnv reads a positive number from the given environment variable; it
+// falls back to the given default when the variable is unset or invalid.
+func floatFromEnv(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		log.Warn("Ignoring invalid environment variable", "name", name, "value", value, "default", fallback)
+		return fallback
+	}
+	return f
+}
+
+// boolFromEnv reads a boolean (e.g., "true" or "1") from the given environment
+// variable; it falls back to the given default when the variable is unset or
+// invalid.
+func boolFromEnv(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Warn("Ignoring invalid environment variable", "name", name, "value", value, "default", fallback)
+		return fallback
+	}
+	return b
+}
+
+// stringFromEnv reads the given environment variable; it falls back to the
+// given default when the variable is unset.
+func stringFromEnv(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestIsQueueURL(t *testing.T) {
+	tests := []struct {
+		queueURL string
+		want     bool
+	}{
+		{queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/user-objects", want: true},
+		{queueURL: "https://sqs.cn-north-1.amazonaws.com.cn/123456789012/user-objects.fifo", want: true},
+		{queueURL: "https://us-east-1.queue.amazonaws.com/123456789012/user-objects", want: true},
+		{queueURL: "https://vpce-0123456789abcdef0-abcdefgh.sqs.us-east-1.vpce.amazonaws.com/123456789012/user-objects", want: true},
+		{queueURL: "http://sqs.us-east-1.amazonaws.com/123456789012/user-objects", want: false},
+		{queueURL: "https://sqs.us-east-1.example.com/123456789012/user-objects", want: false},
+		{queueURL: "https://sqs.us-east-1.amazonaws.com/user-objects", want: false},
+		{queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/user-objects?Action=SendMessage", want: false},
+		{queueURL: "user-objects", want: false},
+	}
+	for _, test := range tests {
+		if got := isQueueURL(test.queueURL); got != test.want {
+			t.Errorf("isQueueURL(%q) = %v, want %v", test.queueURL, got, test.want)
+		}
+	}
+}
+
+func TestValidateConfigSyncWindow(t *testing.T) {
+	savedQueueURL := queueURL
+	defer func() { queueURL = savedQueueURL }()
+	queueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/user-objects"
+
+	tests := []struct {
+		pastDays   string
+		futureDays string
+		wantErr    bool
+	}{
+		{pastDays: "30", futureDays: "15"},
+		{pastDays: "0", futureDays: "15"},
+		{pastDays: "-30", futureDays: "15"},
+		{pastDays: "30", futureDays: "0", wantErr: true},
+		{pastDays: "a month", futureDays: "15", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Setenv("SYNC_WINDOW_PAST_DAYS", test.pastDays)
+		t.Setenv("SYNC_WINDOW_FUTURE_DAYS", test.futureDays)
+		if err := validateConfig(); (err != nil) != test.wantErr {
+			t.Errorf("validateConfig() with %s past and %s future days = %v, want error: %v", test.pastDays, test.futureDays, err, test.wantErr)
+		}
+	}
+}
+
+func TestValidateConfigEventStore(t *testing.T) {
+	savedQueueURL, savedStoreType, savedTable := queueURL, eventStoreType, eventTable
+	defer func() { queueURL, eventStoreType, eventTable = savedQueueURL, savedStoreType, savedTable }()
+	queueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/user-objects"
+
+	tests := []struct {
+		storeType string
+		table     string
+		wantErr   bool
+	}{
+		{storeType: "parse"},
+		{storeType: "dynamo", table: "events"},
+		{storeType: "dynamo", wantErr: true},
+		{storeType: "postgres", table: "events", wantErr: true},
+	}
+	for _, test := range tests {
+		eventStoreType, eventTable = test.storeType, test.table
+		if err := validateConfig(); (err != nil) != test.wantErr {
+			t.Errorf("validateConfig() with the %q store and table %q = %v, want error: %v", test.storeType, test.table, err, test.wantErr)
+		}
+	}
+}
+
+func TestAbsIntFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{value: "", want: 30},
+		{value: "-30", want: 30},
+		{value: "30", want: 30},
+		{value: "0", want: 0},
+		{value: "a month", want: 30},
+	}
+	for _, test := range tests {
+		t.Setenv("SYNC_WINDOW_PAST_DAYS", test.value)
+		if got := absIntFromEnv("SYNC_WINDOW_PAST_DAYS", defaultSyncWindowPastDays); got != test.want {
+			t.Errorf("absIntFromEnv() with %q = %d, want %d", test.value, got, test.want)
+		}
+	}
+}
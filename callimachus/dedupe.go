@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Cepreu/Archive/caldav"
+	"github.com/WF/go/calendar"
+)
+
+// DeduplicateByUID keeps a single version of the events that share a UID
+// (e.g., an invitation that shows in both a personal and a work calendar):
+// the one that was modified last, in place of the first one. The overrides
+// of a recurring event share its UID, so they're told apart by their
+// original start.
+func DeduplicateByUID(events []calendar.Event) []calendar.Event {
+	return deduplicate(events, func(event calendar.Event) string {
+		key := event.UID()
+		if recurring, ok := event.(caldav.RecurringEvent); ok {
+			if originalStart := recurring.OriginalStart(); !originalStart.IsZero() {
+				key += "|" + originalStart.UTC().Format(time.RFC3339)
+			}
+		}
+		return key
+	})
+}
+
+// DeduplicateByContent keeps a single version of the events that have the
+// same subject (ignoring case and whitespace) and start, like
+// DeduplicateByUID does. It's meant for copies of an event that didn't keep
+// its UID (e.g., events that were exported and imported again).
+func DeduplicateByContent(events []calendar.Event) []calendar.Event {
+	return deduplicate(events, func(event calendar.Event) string {
+		subject := strings.ToLower(strings.Join(strings.Fields(event.Subject()), " "))
+		return subject + "|" + event.Start().UTC().Format(time.RFC3339)
+	})
+}
+
+// deduplicate keeps the last modified of the events with the same key, in
+// place of the first of them.
+func deduplicate(events []calendar.Event, key func(calendar.Event) string) []calendar.Event {
+	deduplicated := make([]calendar.Event, 0, len(events))
+	indexes := map[string]int{}
+	for _, event := range events {
+		k := key(event)
+		i, seen := indexes[k]
+		switch {
+		case !seen:
+			indexes[k] = len(deduplicated)
+			deduplicated = append(deduplicated, event)
+		case event.LastModifiedAt().After(deduplicated[i].LastModifiedAt()):
+			deduplicated[i] = event
+		}
+	}
+	return deduplicated
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WF/go/calendar"
+)
+
+func TestDeduplicateByUID(t *testing.T) {
+	start := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []calendar.Event{
+		&testEvent{uid: "a", subject: "personal", lastModified: modified},
+		&testEvent{uid: "b", lastModified: modified},
+		// a newer copy of a, in another calendar
+		&testEvent{uid: "a", subject: "work", lastModified: modified.Add(time.Hour)},
+		// an older copy of b
+		&testEvent{uid: "b", subject: "older", lastModified: modified.Add(-time.Hour)},
+		// overrides of c, the second of which is in another time zone
+		&testEvent{uid: "c", subject: "first", originalStart: start, lastModified: modified},
+		&testEvent{uid: "c", subject: "second", originalStart: start.AddDate(0, 0, 1), lastModified: modified},
+		&testEvent{uid: "c", subject: "second again", originalStart: start.AddDate(0, 0, 1).In(time.FixedZone("CET", 3600)), lastModified: modified.Add(time.Hour)},
+	}
+
+	got := DeduplicateByUID(events)
+	if uids(got) != "a, b, c, c" {
+		t.Fatalf("DeduplicateByUID() = %s, want a, b, c, c", uids(got))
+	}
+	subjects := []string{}
+	for _, event := range got {
+		subjects = append(subjects, event.Subject())
+	}
+	for i, want := range []string{"work", "", "first", "second again"} {
+		if subjects[i] != want {
+			t.Errorf("DeduplicateByUID()[%d] = %q, want %q", i, subjects[i], want)
+		}
+	}
+}
+
+func TestDeduplicateByContent(t *testing.T) {
+	start := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []calendar.Event{
+		&testEvent{uid: "a", subject: "Weekly standup", start: start, lastModified: modified},
+		&testEvent{uid: "b", subject: "Weekly standup", start: start.Add(time.Hour), lastModified: modified},
+		// an imported copy of a, with another case and whitespace and in
+		// another time zone
+		&testEvent{uid: "c", subject: "  weekly\tSTANDUP ", start: start.In(time.FixedZone("CET", 3600)), lastModified: modified.Add(time.Hour)},
+		// an older copy of b
+		&testEvent{uid: "d", subject: "Weekly standup", start: start.Add(time.Hour), lastModified: modified.Add(-time.Hour)},
+		&testEvent{uid: "e", subject: "Weekly stand-up", start: start, lastModified: modified},
+	}
+
+	if got := DeduplicateByContent(events); uids(got) != "c, b, e" {
+		t.Errorf("DeduplicateByContent() = %s, want c, b, e", uids(got))
+	}
+}
+
+func TestDeduplicateKeepsFirstOfSameModification(t *testing.T) {
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []calendar.Event{
+		&testEvent{uid: "a", subject: "first", lastModified: modified},
+		&testEvent{uid: "a", subject: "second", lastModified: modified},
+	}
+
+	got := DeduplicateByUID(events)
+	if len(got) != 1 || got[0].Subject() != "first" {
+		t.Errorf("DeduplicateByUID() = %v, want the first event", got)
+	}
+	if got := DeduplicateByContent(nil); got == nil || len(got) != 0 {
+		t.Errorf("DeduplicateByContent(nil) = %v, want no events", got)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Cepreu/Archive/aws/sqs"
+	"github.com/Cepreu/Archive/log"
+)
+
+const (
+	defaultMaxDeliveryAttempts = 5
+	// redeliveryBackoff is how long a message that failed to be processed
+	// for the first time stays invisible; it doubles with every failure
+	redeliveryBackoff = time.Minute
+	// maxVisibilityTimeout is the longest SQS lets a message stay invisible
+	maxVisibilityTimeout = 12 * time.Hour
+	// requeueDelay is how long the copy of a rate-limited message stays
+	// invisible (at most 15m)
+	requeueDelay = time.Minute
+)
+
+// DeleteMode determines when messages are deleted from the queue.
+type DeleteMode int
+
+const (
+	// DeleteBeforeProcess deletes messages as soon as they're received, so a
+	// message whose processing fails is lost.
+	DeleteBeforeProcess DeleteMode = iota
+	// DeleteAfterSuccess deletes messages once their processing succeeds;
+	// failed messages are received again after an exponential backoff until
+	// they've been attempted maxDeliveryAttempts times. The queue's
+	// visibility timeout must exceed the time it takes to process a message
+	// (i.e., ACCOUNT_SYNC_TIMEOUT_SECONDS per batch of accounts), or messages
+	// are received again while still being processed.
+	DeleteAfterSuccess
+)
+
+// parseDeleteMode parses the name of a delete mode (e.g.,
+// "DeleteAfterSuccess"); it falls back to DeleteBeforeProcess.
+func parseDeleteMode(name string) DeleteMode {
+	switch name {
+	case "DeleteAfterSuccess":
+		return DeleteAfterSuccess
+	default:
+		return DeleteBeforeProcess
+	}
+}
+
+// settleMessage deletes the given message if it was processed successfully
+// (i.e., the given error is nil). Otherwise, it delays its redelivery, or
+// moves it to the dead-letter queue once it's been attempted too many times.
+func settleMessage(message *sqs.Message, user *user, err error) {
+	if err == nil {
+		deleteMessages([]*sqs.Message{message})
+		return
+	}
+
+	if message.ReceiveCount >= maxDeliveryAttempts {
+		deadLetter(message, user)
+		return
+	}
+
+	timeout := maxVisibilityTimeout
+	if attempt := message.ReceiveCount; attempt < 1 {
+		timeout = redeliveryBackoff // the receive count is unknown
+	} else if attempt < 16 && redeliveryBackoff<<uint(attempt-1) < maxVisibilityTimeout {
+		timeout = redeliveryBackoff << uint(attempt-1)
+	}
+	log.Warn("Delaying redelivery of failed message", "userID", user.ID, "receiveCount", message.ReceiveCount, "timeout", timeout)
+	if changer, ok := queue.(sqs.VisibilityChanger); ok {
+		logNonNilError(changer.ChangeVisibility(message.Handle, timeout))
+	}
+}
+
+// deadLetter moves the given message to the dead-letter queue; without one,
+// it's deleted.
+func deadLetter(message *sqs.Message, user *user) {
+	log.Error("Giving up on failed message", "userID", user.ID, "receiveCount", message.ReceiveCount, "deadLetterQueueURL", deadLetterQueueURL)
+	if deadLetterQueue != nil {
+		if err := deadLetterQueue.SendMessage(message.Body); err != nil {
+			// leave it in the queue rather than lose it
+			logNonNilError(err)
+			return
+		}
+	}
+	deleteMessages([]*sqs.Message{message})
+}
+
+// requeueMessage replaces the given (rate-limited) message with a delayed
+// copy so that being received without being processed doesn't count towards
+// its delivery attempts. If the copy can't be sent, the message is left to
+// be received again once its visibility timeout expires.
+func requeueMessage(message *sqs.Message) {
+	sender, ok := queue.(sqs.DelayedSender)
+	if !ok {
+		return
+	}
+	if err := sender.SendDelayedMessage(message.Body, requeueDelay); err != nil {
+		logNonNilError(err)
+		return
+	}
+	deleteMessages([]*sqs.Message{message})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cepreu/Archive/aws/sqs"
+	"github.com/Cepreu/Archive/metrics"
+	"github.com/Cepreu/Archive/ratelimit"
+)
+
+// fakeQueue records the messages that are deleted and sent.
+type fakeQueue struct {
+	mutex   sync.Mutex
+	deletes [][]string
+	sent    []string
+}
+
+func (q *fakeQueue) Receive() (interface{}, bool, error) {
+	return []*sqs.Message{}, false, nil
+}
+
+func (q *fakeQueue) DeleteMessages(handles []string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.deletes = append(q.deletes, handles)
+	return nil
+}
+
+func (q *fakeQueue) SendDelayedMessage(body string, delay time.Duration) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.sent = append(q.sent, body)
+	return nil
+}
+
+// deleted returns the handles of the deleted messages; it fails the test if
+// a batch was empty.
+func (q *fakeQueue) deleted(t *testing.T) []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	handles := []string{}
+	for _, batch := range q.deletes {
+		if len(batch) == 0 {
+			t.Error("deleted an empty batch of messages")
+		}
+		handles = append(handles, batch...)
+	}
+	return handles
+}
+
+// consumeTestBatch consumes the given messages in the given mode with a fake
+// queue and waits for them to be processed.
+func consumeTestBatch(t *testing.T, mode DeleteMode, messages ...*sqs.Message) *fakeQueue {
+	fake := &fakeQueue{}
+	savedQueue, savedMode, savedPool, savedHealth, savedSyncer, savedLimiter := queue, deleteMode, syncPool, health, accountSyncer, userLimiter
+	defer func() {
+		queue, deleteMode, syncPool, health, accountSyncer, userLimiter = savedQueue, savedMode, savedPool, savedHealth, savedSyncer, savedLimiter
+	}()
+	queue, deleteMode = fake, mode
+	syncPool = NewSyncWorkerPool(2)
+	health = newHealthServer("0", nil, syncPool)
+	accountSyncer = newSyncer()
+	userLimiter = ratelimit.NewUserLimiter(1.0/3600, 1)
+
+	consumeBatch(context.Background(), messages, metrics.Nop{})
+	if err := syncPool.Drain(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return fake
+}
+
+func withHandle(message *sqs.Message, handle string) *sqs.Message {
+	message.Handle = handle
+	message.ReceiveCount = 1
+	return message
+}
+
+func TestConsumeBatchDeleteBeforeProcess(t *testing.T) {
+	fake := consumeTestBatch(t, DeleteBeforeProcess,
+		withHandle(newSignedMessage(t, `{\"objectId\":\"user-1\"}`), "valid"),
+		&sqs.Message{Body: "malformed", Handle: "malformed"})
+
+	deleted := fake.deleted(t)
+	if len(deleted) != 2 || deleted[0] != "malformed" || deleted[1] != "valid" {
+		t.Errorf("deleted %v, want the malformed and then the submitted message", deleted)
+	}
+}
+
+func TestConsumeBatchDeleteAfterSuccess(t *testing.T) {
+	fake := consumeTestBatch(t, DeleteAfterSuccess,
+		withHandle(newSignedMessage(t, `{\"objectId\":\"user-1\"}`), "valid"))
+
+	deleted := fake.deleted(t)
+	if len(deleted) != 1 || deleted[0] != "valid" {
+		t.Errorf("deleted %v, want the processed message", deleted)
+	}
+}
+
+func TestConsumeBatchRequeuesRateLimitedMessages(t *testing.T) {
+	limited := withHandle(newSignedMessage(t, `{\"objectId\":\"user-1\"}`), "limited")
+	fake := consumeTestBatch(t, DeleteAfterSuccess,
+		withHandle(newSignedMessage(t, `{\"objectId\":\"user-1\"}`), "valid"), limited)
+
+	if len(fake.sent) != 1 || fake.sent[0] != limited.Body {
+		t.Errorf("sent %d messages, want a copy of the rate-limited one", len(fake.sent))
+	}
+	deleted := map[string]bool{}
+	for _, handle := range fake.deleted(t) {
+		deleted[handle] = true
+	}
+	if len(deleted) != 2 || !deleted["valid"] || !deleted["limited"] {
+		t.Errorf("deleted %v, want the processed and the requeued message", deleted)
+	}
+}
+
+func TestConsumeBatchKeepsRateLimitedMessagesBeforeProcess(t *testing.T) {
+	fake := consumeTestBatch(t, DeleteBeforeProcess,
+		withHandle(newSignedMessage(t, `{\"objectId\":\"user-1\"}`), "valid"),
+		withHandle(newSignedMessage(t, `{\"objectId\":\"user-1\"}`), "limited"))
+
+	deleted := fake.deleted(t)
+	if len(fake.sent) != 0 || len(deleted) != 1 || deleted[0] != "valid" {
+		t.Errorf("sent %d and deleted %v, want only the submitted message deleted", len(fake.sent), deleted)
+	}
+}
+
+func TestConsumeBatchKeepsMessagesWithUnreachableSigningCert(t *testing.T) {
+	fake := consumeTestBatch(t, DeleteBeforeProcess,
+		withHandle(withUnreachableSigningCert(t, newSignedMessage(t, `{\"objectId\":\"user-1\"}`)), "unverified"),
+		&sqs.Message{Body: "malformed", Handle: "malformed"})
+
+	deleted := fake.deleted(t)
+	if len(deleted) != 1 || deleted[0] != "malformed" {
+		t.Errorf("deleted %v, want only the malformed message", deleted)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Cepreu/Archive/caldav"
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/WF/go/ews"
+	"github.com/WF/go/google"
+)
+
+const (
+	office365EWSURL = "https://outlook.office365.com/EWS/Exchange.asmx"
+	// defaultCalDAVUserAgent identifies the service to CalDAV servers rather
+	// than Go's default User-Agent
+	defaultCalDAVUserAgent = "Callimachus/1.0 (calendar sync)"
+)
+
+var (
+	// factories are tried in registration order; the first match wins
+	factories = []*registeredFactory{}
+	// caldavProviders override the User-Agent and headers sent to CalDAV
+	// providers (matched by host suffix) that treat clients differently
+	// based on them; the first match wins
+	caldavProviders = []*caldavProvider{
+		{hostSuffix: "icloud.com", userAgent: "Callimachus/1.0 (calendar sync; iCloud)"},
+	}
+	// eventCache serves the events of CalDAV calendars that are unchanged
+	// since the last sync; nil (i.e., events aren't cached) unless
+	// CALDAV_EVENT_CACHE_SIZE (the number of cached queries) is set
+	eventCache = newEventCache(intFromEnv("CALDAV_EVENT_CACHE_SIZE", 0))
+	// discoveryCache saves discovering the CalDAV server of an account on
+	// every sync
+	discoveryCache = caldav.NewDiscoveryCache(caldav.DefaultDiscoveryTTL)
+)
+
+// ClientFactory creates a calendar client for an account; the requests it
+// makes to do so (e.g., CalDAV discovery) are cancelled with the given
+// context.
+type ClientFactory func(ctx context.Context, account *account) (calendar.Client, error)
+
+type registeredFactory struct {
+	loginType string
+	matcher   func(*account) bool
+	factory   ClientFactory
+}
+
+func init() {
+	RegisterClientFactory("Exchange", func(account *account) bool {
+		return account.LoginType == "Exchange"
+	}, createExchangeClient)
+	RegisterClientFactory("Office365", func(account *account) bool {
+		return strings.HasSuffix(account.Host, "outlook.com") || strings.HasSuffix(account.Host, "office365.com")
+	}, createOffice365Client)
+	RegisterClientFactory("Google", func(account *account) bool {
+		return account.Host == "imap.gmail.com"
+	}, createGoogleClient)
+	RegisterClientFactory("CalDAV", func(account *account) bool {
+		return account.Host != ""
+	}, createCalDAVClient)
+}
+
+// RegisterClientFactory registers a calendar client factory for the accounts
+// that the given matcher matches. Factories are tried in registration order,
+// so more specific matchers have to be registered first.
+func RegisterClientFactory(loginType string, matcher func(*account) bool, factory ClientFactory) {
+	factories = append(factories, &registeredFactory{loginType: loginType, matcher: matcher, factory: factory})
+}
+
+// createCalendarClient is a calendar client factory function that returns
+// the appropriate calendar client for the given user's account.
+func createCalendarClient(ctx context.Context, account *account) (calendar.Client, error) {
+	account = account.withNormalizedHost()
+	for _, f := range factories {
+		if f.matcher(account) {
+			return f.factory(ctx, account)
+		}
+	}
+	return nil, errors.WF13005(account.LoginType, account.Host)
+}
+
+// kind returns the login type of the factory that matches the account (e.g.,
+// "Exchange"); it's used to label metrics.
+func (account *account) kind() string {
+	account = account.withNormalizedHost()
+	for _, f := range factories {
+		if f.matcher(account) {
+			return f.loginType
+		}
+	}
+	return "Unknown"
+}
+
+// withNormalizedHost returns a copy of the account whose host is normalized
+// (see caldav.NormalizeHost) so that the factories' matchers see a bare host.
+func (account *account) withNormalizedHost() *account {
+	normalized := *account
+	normalized.Host = caldav.NormalizeHost(account.Host)
+	return &normalized
+}
+
+func createExchangeClient(ctx context.Context, account *account) (calendar.Client, error) {
+	loginInfo := strings.Split(account.LoginInfo, " ")
+	if len(loginInfo) < 3 {
+		return nil, fmt.Errorf("WF00000: Malformed login info: %#v", loginInfo)
+	}
+
+	password, err := secretBackend.RetrieveUserSecret(account.Password)
+	if err != nil {
+		return nil, err
+	}
+	return ews.NewClient(loginInfo[2], account.Email, password), nil
+}
+
+// createOffice365Client creates a CalDAV client if the account's host serves
+// CalDAV (see probeCalDAV) and falls back to an EWS client otherwise.
+func createOffice365Client(ctx context.Context, account *account) (calendar.Client, error) {
+	if probeCalDAV(ctx, account.Host, probeHTTPClient) {
+		return createCalDAVClient(ctx, account)
+	}
+
+	password, err := secretBackend.RetrieveUserSecret(account.Password)
+	if err != nil {
+		return nil, err
+	}
+	return ews.NewClient(office365EWSURL, account.Email, password), nil
+}
+
+func createGoogleClient(ctx context.Context, account *account) (calendar.Client, error) {
+	return google.NewCalendarClient(account.RefreshToken)
+}
+
+func createCalDAVClient(ctx context.Context, account *account) (calendar.Client, error) {
+	password, err := secretBackend.RetrieveUserSecret(account.Password)
+	if err != nil {
+		return nil, err
+	}
+	options := append(caldavHeaderOptions(account.Host), caldav.WithDiscoveryCache(discoveryCache))
+	if eventCache != nil {
+		options = append(options, caldav.WithEventCache(eventCache))
+	}
+	if !isCalDAVProvider(account.Host) {
+		// generic accounts carry the host of their IMAP server, which may not
+		// serve CalDAV
+		options = append(options, caldav.WithEmailDomainFallback())
+	}
+	return caldav.NewClientContext(ctx, account.Host, account.Email, password, options...)
+}
+
+// newEventCache creates a cache of the events of the given number of CalDAV
+// queries; it returns nil if the size is zero.
+func newEventCache(size int) *caldav.EventCache {
+	if size == 0 {
+		return nil
+	}
+	return caldav.NewEventCache(size)
+}
+
+type caldavProvider struct {
+	hostSuffix string
+	userAgent  string
+	headers    map[string]string
+}
+
+// caldavHeaderOptions returns the User-Agent and headers to send to the
+// CalDAV server at the given host.
+func caldavHeaderOptions(host string) []caldav.ClientOption {
+	for _, provider := range caldavProviders {
+		if strings.HasSuffix(host, provider.hostSuffix) {
+			return []caldav.ClientOption{caldav.WithUserAgent(provider.userAgent), caldav.WithHeaders(provider.headers)}
+		}
+	}
+	return []caldav.ClientOption{caldav.WithUserAgent(defaultCalDAVUserAgent)}
+}
+
+// isCalDAVProvider determines whether the given host belongs to one of the
+// known CalDAV providers.
+func isCalDAVProvider(host string) bool {
+	for _, provider := range caldavProviders {
+		if strings.HasSuffix(host, provider.hostSuffix) {
+			return true
+		}
+	}
+	return false
+}
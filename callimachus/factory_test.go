@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/errors"
+)
+
+// customClient is the client of the custom factory.
+type customClient struct {
+	calendar.Client
+	email string
+}
+
+// withCustomFactory registers a factory of the "Custom" login type, after the
+// built-in ones, for the duration of the test.
+func withCustomFactory(t *testing.T) {
+	savedFactories := factories
+	t.Cleanup(func() { factories = savedFactories })
+	factories = append([]*registeredFactory{}, factories...)
+	RegisterClientFactory("Custom", func(account *account) bool {
+		return account.LoginType == "Custom"
+	}, func(ctx context.Context, account *account) (calendar.Client, error) {
+		return &customClient{email: account.Email}, nil
+	})
+}
+
+func TestAccountKind(t *testing.T) {
+	withCustomFactory(t)
+	tests := []struct {
+		account *account
+		want    string
+	}{
+		{account: &account{LoginType: "Exchange", Host: "mail.example.com"}, want: "Exchange"},
+		{account: &account{Host: "outlook.office365.com"}, want: "Office365"},
+		{account: &account{Host: "https://outlook.com/"}, want: "Office365"},
+		{account: &account{Host: "imap.gmail.com"}, want: "Google"},
+		{account: &account{Host: "caldav.fastmail.com"}, want: "CalDAV"},
+		{account: &account{LoginType: "Custom"}, want: "Custom"},
+		// the built-in factories are registered first
+		{account: &account{LoginType: "Custom", Host: "imap.gmail.com"}, want: "Google"},
+		{account: &account{}, want: "Unknown"},
+	}
+	for _, test := range tests {
+		if got := test.account.kind(); got != test.want {
+			t.Errorf("kind() of %+v = %q, want %q", test.account, got, test.want)
+		}
+	}
+}
+
+func TestCreateCalendarClientWithCustomFactory(t *testing.T) {
+	withCustomFactory(t)
+
+	client, err := createCalendarClient(context.Background(), &account{LoginType: "Custom", Email: "user@example.com"})
+	if err != nil {
+		t.Fatalf("createCalendarClient() error = %v", err)
+	}
+	if custom, ok := client.(*customClient); !ok || custom.email != "user@example.com" {
+		t.Errorf("createCalendarClient() = %#v, want the custom factory's client of user@example.com", client)
+	}
+}
+
+func TestCreateCalendarClientWithoutFactory(t *testing.T) {
+	if client, err := createCalendarClient(context.Background(), &account{LoginType: "IMAP"}); !errors.HasCode(err, "WF13005") {
+		t.Errorf("createCalendarClient() = %v, %v, want WF13005", client, err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/log"
+)
+
+const (
+	defaultMaxConsecutiveFailures = 3
+	defaultFailureBackoff         = time.Minute
+	maxFailureBackoff             = time.Hour
+)
+
+// failureTracker counts the consecutive failures of each account and, once
+// an account reaches MaxConsecutiveFailures, skips it for an exponentially
+// increasing backoff (e.g., while its Exchange server is down).
+type failureTracker struct {
+	// MaxConsecutiveFailures is the number of consecutive failures after
+	// which an account is skipped.
+	MaxConsecutiveFailures int
+	// Backoff is the time an account is skipped for after reaching
+	// MaxConsecutiveFailures; it doubles with every further failure.
+	Backoff time.Duration
+	// failures maps userID+email to *failureRecord
+	failures sync.Map
+	now      func() time.Time
+}
+
+type failureRecord struct {
+	sync.Mutex
+	consecutive int
+	nextRetry   time.Time
+}
+
+func newFailureTracker(maxConsecutiveFailures int, backoff time.Duration) *failureTracker {
+	return &failureTracker{MaxConsecutiveFailures: maxConsecutiveFailures, Backoff: backoff, now: time.Now}
+}
+
+// shouldSkip checks whether or not the given account is backing off; if so,
+// it logs a warning and returns true.
+func (tracker *failureTracker) shouldSkip(userID string, email string) bool {
+	value, ok := tracker.failures.Load(userID + email)
+	if !ok {
+		return false
+	}
+
+	record := value.(*failureRecord)
+	record.Lock()
+	defer record.Unlock()
+	if tracker.now().Before(record.nextRetry) {
+		log.Warn("Skipping failing account", "userID", userID, "email", email, "consecutiveFailures", record.consecutive, "nextRetry", record.nextRetry)
+		return true
+	}
+	return false
+}
+
+// record records the outcome of syncing the given account. Partial failures
+// (WF11302) count as successes since the server is reachable.
+func (tracker *failureTracker) record(userID string, email string, err error) {
+	if err == nil || errors.HasCode(err, "WF11302") {
+		tracker.failures.Delete(userID + email)
+		return
+	}
+
+	value, _ := tracker.failures.LoadOrStore(userID+email, &failureRecord{})
+	record := value.(*failureRecord)
+	record.Lock()
+	defer record.Unlock()
+	record.consecutive++
+	if record.consecutive >= tracker.MaxConsecutiveFailures {
+		record.nextRetry = tracker.now().Add(tracker.backoff(record.consecutive))
+	}
+}
+
+// backoff returns the time to skip an account for after the given number of
+// consecutive failures.
+func (tracker *failureTracker) backoff(consecutive int) time.Duration {
+	backoff := tracker.Backoff
+	for i := tracker.MaxConsecutiveFailures; i < consecutive && backoff < maxFailureBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxFailureBackoff {
+		return maxFailureBackoff
+	}
+	return backoff
+}
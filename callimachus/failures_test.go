@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Cepreu/Archive/errors"
+)
+
+// newTestFailureTracker returns a tracker that skips accounts after 3
+// consecutive failures, for a minute at first, and whose clock is the
+// returned time.
+func newTestFailureTracker() (*failureTracker, *time.Time) {
+	now := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	tracker := newFailureTracker(3, time.Minute)
+	tracker.now = func() time.Time { return now }
+	return tracker, &now
+}
+
+func TestFailureTrackerSkipsForBackoff(t *testing.T) {
+	tracker, now := newTestFailureTracker()
+	failure := fmt.Errorf("connection refused")
+
+	for i := 0; i < 2; i++ {
+		tracker.record("user-1", "user@example.com", failure)
+		if tracker.shouldSkip("user-1", "user@example.com") {
+			t.Fatalf("shouldSkip() = true after %d failures, want false", i+1)
+		}
+	}
+	tracker.record("user-1", "user@example.com", failure)
+	if !tracker.shouldSkip("user-1", "user@example.com") {
+		t.Error("shouldSkip() = false after 3 failures, want true")
+	}
+	if tracker.shouldSkip("user-1", "other@example.com") || tracker.shouldSkip("user-2", "user@example.com") {
+		t.Error("shouldSkip() = true for other accounts, want false")
+	}
+
+	*now = now.Add(59 * time.Second)
+	if !tracker.shouldSkip("user-1", "user@example.com") {
+		t.Error("shouldSkip() = false within the backoff, want true")
+	}
+	*now = now.Add(time.Second)
+	if tracker.shouldSkip("user-1", "user@example.com") {
+		t.Error("shouldSkip() = true after the backoff, want false")
+	}
+}
+
+func TestFailureTrackerBackoffDoubles(t *testing.T) {
+	tracker, _ := newTestFailureTracker()
+	tests := []struct {
+		consecutive int
+		want        time.Duration
+	}{
+		{consecutive: 3, want: time.Minute},
+		{consecutive: 4, want: 2 * time.Minute},
+		{consecutive: 5, want: 4 * time.Minute},
+		{consecutive: 8, want: 32 * time.Minute},
+		{consecutive: 9, want: maxFailureBackoff},
+		{consecutive: 100, want: maxFailureBackoff},
+	}
+	for _, test := range tests {
+		if got := tracker.backoff(test.consecutive); got != test.want {
+			t.Errorf("backoff(%d) = %v, want %v", test.consecutive, got, test.want)
+		}
+	}
+}
+
+func TestFailureTrackerRecordsNextRetry(t *testing.T) {
+	tracker, now := newTestFailureTracker()
+	start := *now
+	for i := 0; i < 5; i++ {
+		tracker.record("user-1", "user@example.com", fmt.Errorf("connection refused"))
+	}
+
+	value, _ := tracker.failures.Load("user-1user@example.com")
+	record := value.(*failureRecord)
+	if record.consecutive != 5 {
+		t.Errorf("consecutive = %d, want 5", record.consecutive)
+	}
+	if want := start.Add(4 * time.Minute); !record.nextRetry.Equal(want) {
+		t.Errorf("nextRetry = %v, want %v", record.nextRetry, want)
+	}
+}
+
+func TestFailureTrackerResetsOnSuccess(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "success"},
+		{name: "partial failure", err: errors.WF11302(fmt.Errorf("calendar not found"))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker, _ := newTestFailureTracker()
+			for i := 0; i < 3; i++ {
+				tracker.record("user-1", "user@example.com", fmt.Errorf("connection refused"))
+			}
+
+			tracker.record("user-1", "user@example.com", test.err)
+			if tracker.shouldSkip("user-1", "user@example.com") {
+				t.Error("shouldSkip() = true, want false")
+			}
+			// the count starts over
+			for i := 0; i < 2; i++ {
+				tracker.record("user-1", "user@example.com", fmt.Errorf("connection refused"))
+			}
+			if tracker.shouldSkip("user-1", "user@example.com") {
+				t.Error("shouldSkip() = true after 2 failures, want false")
+			}
+		})
+	}
+}
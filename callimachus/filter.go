@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	"github.com/WF/go/calendar"
+	"github.com/WF/go/enums/sensitivity"
+	"github.com/Cepreu/Archive/enums/status"
+)
+
+// EventFilter decides whether an event is persisted.
+type EventFilter func(event calendar.Event) bool
+
+// applyFilters returns the events that pass all of the given filters, which
+// are applied in order.
+func applyFilters(events []calendar.Event, filters ...EventFilter) []calendar.Event {
+	if len(filters) == 0 {
+		return events
+	}
+
+	filtered := make([]calendar.Event, 0, len(events))
+	for _, event := range events {
+		if passes(event, filters) {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
+}
+
+func passes(event calendar.Event, filters []EventFilter) bool {
+	for _, filter := range filters {
+		if !filter(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterByStatus creates a filter that rejects the events with any of the
+// given statuses; events that don't expose their status pass.
+func FilterByStatus(excluded ...status.Status) EventFilter {
+	return func(event calendar.Event) bool {
+		e, ok := event.(statusEvent)
+		if !ok {
+			return true
+		}
+		for _, s := range excluded {
+			if e.Status() == s {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// FilterByDateRange creates a filter that only passes the events that overlap
+// the given time window.
+func FilterByDateRange(start time.Time, end time.Time) EventFilter {
+	return func(event calendar.Event) bool {
+		return event.Start().Before(end) && event.End().After(start)
+	}
+}
+
+// FilterBySensitivity creates a filter that rejects the events with any of
+// the given sensitivities.
+func FilterBySensitivity(excluded ...sensitivity.Sensitivity) EventFilter {
+	return func(event calendar.Event) bool {
+		for _, s := range excluded {
+			if event.Sensitivity() == s {
+				return false
+			}
+		}
+		return true
+	}
+}
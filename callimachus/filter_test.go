@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WF/go/calendar"
+	"github.com/WF/go/enums/sensitivity"
+	"github.com/Cepreu/Archive/enums/status"
+)
+
+// testEvent is an event with the given properties; its other methods panic.
+type testEvent struct {
+	calendar.Event
+	uid           string
+	subject       string
+	description   string
+	start         time.Time
+	end           time.Time
+	sensitivity   sensitivity.Sensitivity
+	lastModified  time.Time
+	originalStart time.Time
+}
+
+func (event *testEvent) UID() string                          { return event.uid }
+func (event *testEvent) Subject() string                      { return event.subject }
+func (event *testEvent) Description() string                  { return event.description }
+func (event *testEvent) Start() time.Time                     { return event.start }
+func (event *testEvent) End() time.Time                       { return event.end }
+func (event *testEvent) Sensitivity() sensitivity.Sensitivity { return event.sensitivity }
+func (event *testEvent) LastModifiedAt() time.Time            { return event.lastModified }
+func (event *testEvent) SeriesMasterID() string               { return event.uid }
+func (event *testEvent) RecurrenceRule() string               { return "" }
+func (event *testEvent) OriginalStart() time.Time             { return event.originalStart }
+
+// uids returns the UIDs of the given events, separated by commas.
+func uids(events []calendar.Event) string {
+	uids := []string{}
+	for _, event := range events {
+		uids = append(uids, event.UID())
+	}
+	return strings.Join(uids, ", ")
+}
+
+func TestApplyFilters(t *testing.T) {
+	events := []calendar.Event{
+		&testEvent{uid: "a", subject: "Standup"},
+		&testEvent{uid: "b", subject: "Lunch"},
+		&testEvent{uid: "c", subject: "Standup", sensitivity: sensitivity.Private},
+	}
+	isStandup := func(event calendar.Event) bool { return event.Subject() == "Standup" }
+
+	if got := applyFilters(events); uids(got) != "a, b, c" {
+		t.Errorf("applyFilters() without filters = %s, want all events", uids(got))
+	}
+	if got := applyFilters(events, isStandup); uids(got) != "a, c" {
+		t.Errorf("applyFilters() = %s, want a, c", uids(got))
+	}
+	if got := applyFilters(events, isStandup, FilterBySensitivity(sensitivity.Private)); uids(got) != "a" {
+		t.Errorf("applyFilters() with two filters = %s, want a", uids(got))
+	}
+	if got := applyFilters(events, func(calendar.Event) bool { return false }); got == nil || len(got) != 0 {
+		t.Errorf("applyFilters() rejecting everything = %v, want no events", got)
+	}
+}
+
+func TestApplyFiltersStopsAtFirstRejection(t *testing.T) {
+	calls := 0
+	counting := func(calendar.Event) bool {
+		calls++
+		return true
+	}
+	applyFilters([]calendar.Event{&testEvent{uid: "a"}}, func(calendar.Event) bool { return false }, counting)
+	if calls != 0 {
+		t.Errorf("later filter called %d times, want 0", calls)
+	}
+}
+
+func TestFilterByStatus(t *testing.T) {
+	events := []calendar.Event{
+		statusedEvent{uid: "confirmed", status: status.Confirmed},
+		statusedEvent{uid: "tentative", status: status.Tentative},
+		statusedEvent{uid: "cancelled", status: status.Cancelled},
+		// doesn't expose its status
+		&testEvent{uid: "plain"},
+	}
+
+	tests := []struct {
+		excluded []status.Status
+		want     string
+	}{
+		{excluded: nil, want: "confirmed, tentative, cancelled, plain"},
+		{excluded: []status.Status{status.Cancelled}, want: "confirmed, tentative, plain"},
+		{excluded: []status.Status{status.Cancelled, status.Tentative}, want: "confirmed, plain"},
+	}
+	for _, test := range tests {
+		if got := applyFilters(events, FilterByStatus(test.excluded...)); uids(got) != test.want {
+			t.Errorf("FilterByStatus(%v) passed %s, want %s", test.excluded, uids(got), test.want)
+		}
+	}
+}
+
+func TestFilterByDateRange(t *testing.T) {
+	start := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+	filter := FilterByDateRange(start, end)
+
+	tests := []struct {
+		name  string
+		start time.Time
+		end   time.Time
+		want  bool
+	}{
+		{name: "within", start: start.Add(time.Hour), end: start.Add(2 * time.Hour), want: true},
+		{name: "across the start", start: start.Add(-time.Hour), end: start.Add(time.Hour), want: true},
+		{name: "across the end", start: end.Add(-time.Hour), end: end.Add(time.Hour), want: true},
+		{name: "around the window", start: start.Add(-time.Hour), end: end.Add(time.Hour), want: true},
+		{name: "ending at the start", start: start.Add(-time.Hour), end: start, want: false},
+		{name: "starting at the end", start: end, end: end.Add(time.Hour), want: false},
+		{name: "before", start: start.AddDate(0, 0, -2), end: start.AddDate(0, 0, -1), want: false},
+		{name: "other time zone", start: time.Date(2020, 1, 2, 23, 30, 0, 0, time.FixedZone("EST", -5*3600)), end: time.Date(2020, 1, 3, 1, 0, 0, 0, time.FixedZone("EST", -5*3600)), want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := filter(&testEvent{start: test.start, end: test.end}); got != test.want {
+				t.Errorf("filter(%v - %v) = %v, want %v", test.start, test.end, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterBySensitivity(t *testing.T) {
+	events := []calendar.Event{
+		&testEvent{uid: "normal", sensitivity: sensitivity.Normal},
+		&testEvent{uid: "personal", sensitivity: sensitivity.Personal},
+		&testEvent{uid: "private", sensitivity: sensitivity.Private},
+		&testEvent{uid: "confidential", sensitivity: sensitivity.Confidential},
+	}
+
+	if got := applyFilters(events, FilterBySensitivity(sensitivity.Private, sensitivity.Confidential)); uids(got) != "normal, personal" {
+		t.Errorf("FilterBySensitivity(Private, Confidential) passed %s, want normal, personal", uids(got))
+	}
+	if got := applyFilters(events, FilterBySensitivity()); uids(got) != "normal, personal, private, confidential" {
+		t.Errorf("FilterBySensitivity() passed %s, want all events", uids(got))
+	}
+}
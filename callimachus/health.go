@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Cepreu/Archive/log"
+	"github.com/Cepreu/Archive/metrics"
+)
+
+const (
+	defaultHealthPort = "8080"
+)
+
+// healthServer serves the liveness (/healthz) and readiness (/readyz) probes
+// as well as the Prometheus metrics (/metrics).
+type healthServer struct {
+	server *http.Server
+	// pollerDone is closed when the poller goroutine exits
+	pollerDone <-chan struct{}
+	// pool is reported by /healthz
+	pool      *SyncWorkerPool
+	ready     int32
+	readyOnce sync.Once
+}
+
+func newHealthServer(port string, pollerDone <-chan struct{}, pool *SyncWorkerPool) *healthServer {
+	h := &healthServer{pollerDone: pollerDone, pool: pool}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.Handle("/metrics", metrics.Handler())
+	h.server = &http.Server{Addr: ":" + port, Handler: mux}
+	return h
+}
+
+// start starts serving the probes in the background.
+func (h *healthServer) start() {
+	go func() {
+		log.Info("Serving health checks", "addr", h.server.Addr)
+		if err := h.server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Error("Health check server failed", "err", err)
+		}
+	}()
+}
+
+// Shutdown stops serving the probes; see http.Server.Shutdown.
+func (h *healthServer) Shutdown(ctx context.Context) error {
+	return h.server.Shutdown(ctx)
+}
+
+// markReady marks the service as ready; it's called once the first message
+// has been processed successfully.
+func (h *healthServer) markReady() {
+	h.readyOnce.Do(func() {
+		atomic.StoreInt32(&h.ready, 1)
+		log.Info("Ready")
+	})
+}
+
+// healthStatus is the body of /healthz.
+type healthStatus struct {
+	QueueDepth    int `json:"queueDepth"`
+	ActiveWorkers int `json:"activeWorkers"`
+}
+
+// healthz responds with 200 as long as the poller goroutine is running; the
+// body reports the load of the sync worker pool.
+func (h *healthServer) healthz(writer http.ResponseWriter, request *http.Request) {
+	select {
+	case <-h.pollerDone:
+		http.Error(writer, "poller stopped", http.StatusServiceUnavailable)
+	default:
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		logNonNilError(json.NewEncoder(writer).Encode(&healthStatus{
+			QueueDepth:    h.pool.QueueDepth(),
+			ActiveWorkers: h.pool.ActiveWorkers(),
+		}))
+	}
+}
+
+// readyz responds with 200 once the first message has been processed.
+func (h *healthServer) readyz(writer http.ResponseWriter, request *http.Request) {
+	if atomic.LoadInt32(&h.ready) == 0 {
+		http.Error(writer, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveHealth returns the response of the given health server to a GET of
+// the given path.
+func serveHealth(h *healthServer, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder
+}
+
+func TestHealthz(t *testing.T) {
+	pollerDone := make(chan struct{})
+	pool := NewSyncWorkerPool(2)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	if err := pool.Submit(func() {
+		close(started)
+		<-release
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		close(release)
+		pool.Drain(time.Second)
+	}()
+	<-started
+	h := newHealthServer("0", pollerDone, pool)
+
+	response := serveHealth(h, "/healthz")
+	if response.Code != http.StatusOK {
+		t.Fatalf("/healthz status = %d, want %d", response.Code, http.StatusOK)
+	}
+	if contentType := response.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", contentType)
+	}
+	status := &healthStatus{}
+	if err := json.Unmarshal(response.Body.Bytes(), status); err != nil {
+		t.Fatal(err)
+	}
+	if status.ActiveWorkers != 1 || status.QueueDepth != 0 {
+		t.Errorf("/healthz = %+v, want 1 active worker and an empty queue", status)
+	}
+
+	// the poller exited
+	close(pollerDone)
+	if response := serveHealth(h, "/healthz"); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz status = %d after the poller stopped, want %d", response.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	h := newHealthServer("0", make(chan struct{}), NewSyncWorkerPool(1))
+
+	if response := serveHealth(h, "/readyz"); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz status = %d before the first message, want %d", response.Code, http.StatusServiceUnavailable)
+	}
+	h.markReady()
+	h.markReady()
+	if response := serveHealth(h, "/readyz"); response.Code != http.StatusOK {
+		t.Errorf("/readyz status = %d after the first message, want %d", response.Code, http.StatusOK)
+	}
+}
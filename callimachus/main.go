@@ -1,55 +1,272 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
-	"fmt"
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/WF/commongo/polling"
+	"github.com/Cepreu/Archive/aws/kinesis"
 	"github.com/Cepreu/Archive/aws/sqs"
-	"github.com/Cepreu/Archive/caldav"
-	"github.com/WF/go/calendar"
-	"github.com/WF/go/ews"
-	"github.com/WF/go/google"
+	"github.com/Cepreu/Archive/errors"
 	"github.com/Cepreu/Archive/log"
-	"github.com/WF/go/parse"
-	"github.com/WF/go/secrets"
+	"github.com/Cepreu/Archive/metrics"
+	"github.com/Cepreu/Archive/ratelimit"
+	"github.com/Cepreu/Archive/secrets"
+	"github.com/Cepreu/Archive/storage"
+	"github.com/Cepreu/Archive/syncstatus"
+	"github.com/Cepreu/Archive/tracing"
+	"github.com/WF/commongo/polling"
+	"github.com/WF/go/calendar"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	awskinesis "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
-	queue      sqs.MessageQueue
-	debugUsers = os.Getenv("DEBUG_USERS")
-	queueURL   = os.Getenv("USER_OBJECTS_QUEUE_URL")
+	queue          sqs.MessageQueue
+	accountSyncer  *syncer
+	health         *healthServer
+	syncPool       *SyncWorkerPool
+	recorder       metrics.Recorder
+	debugUsers     = os.Getenv("DEBUG_USERS")
+	queueURL       = os.Getenv("USER_OBJECTS_QUEUE_URL")
+	syncTimeout    = secondsFromEnv("ACCOUNT_SYNC_TIMEOUT_SECONDS", defaultSyncTimeout)
+	gracePeriod    = secondsFromEnv("TERMINATION_GRACE_PERIOD_SECONDS", defaultGracePeriod)
+	healthPort     = stringFromEnv("HEALTH_PORT", defaultHealthPort)
+	maxFailures    = intFromEnv("MAX_CONSECUTIVE_FAILURES", defaultMaxConsecutiveFailures)
+	failureBackoff = secondsFromEnv("FAILURE_BACKOFF_SECONDS", defaultFailureBackoff)
+	secretsTTL     = secondsFromEnv("SECRETS_CACHE_TTL_SECONDS", secrets.DefaultTTL)
+	userLimiter    = ratelimit.NewUserLimiter(floatFromEnv("USER_RATE_LIMIT_RPS", defaultUserRateLimit), intFromEnv("USER_RATE_LIMIT_BURST", defaultUserRateBurst))
+	// syncStatusTable is the DynamoDB table of the sync statuses; they aren't
+	// recorded if it's unset
+	syncStatusTable = os.Getenv("SYNC_STATUS_TABLE")
+	awsRegion       = stringFromEnv("AWS_REGION", defaultAWSRegion)
+	// eventStreamName is the Kinesis stream that synced events are published
+	// to; they aren't published if it's unset
+	eventStreamName = os.Getenv("EVENT_STREAM_NAME")
+	// eventStoreType is where synced events are persisted: "parse" (the
+	// default) or "dynamo", in the DynamoDB table eventTable
+	eventStoreType = stringFromEnv("EVENT_STORE", parseEventStore)
+	eventTable     = os.Getenv("EVENT_TABLE")
+	privacyFilter  = NewPrivacyFilter(parsePrivacyMode(os.Getenv("PRIVACY_MODE")))
+	deleteMode     = parseDeleteMode(os.Getenv("MESSAGE_DELETE_MODE"))
+	keepCancelled  = boolFromEnv("KEEP_CANCELLED_EVENTS", false)
+	// maxSyncWorkers is the number of messages processed at once
+	maxSyncWorkers = intFromEnv("MAX_SYNC_WORKERS", defaultMaxSyncWorkers)
+	// the events are synced from syncWindowPastDays ago to
+	// syncWindowFutureDays from now (see syncWindow);
+	// SYNC_WINDOW_PAST_DAYS may be signed (e.g., -30)
+	syncWindowPastDays   = absIntFromEnv("SYNC_WINDOW_PAST_DAYS", defaultSyncWindowPastDays)
+	syncWindowFutureDays = intFromEnv("SYNC_WINDOW_FUTURE_DAYS", defaultSyncWindowFutureDays)
+	// secretBackend caches the accounts' passwords across syncs
+	secretBackend *secrets.CachingSecretBackend
+	// rotationQueueURL is the SQS queue that secret rotations are delivered
+	// to (see secrets.RotationWatcher); rotated passwords stay cached until
+	// they expire if it's unset
+	rotationQueueURL = os.Getenv("SECRETS_ROTATION_QUEUE_URL")
+	// batchSecrets retrieves the passwords with BatchGetSecretValue rather
+	// than one call per password (see secrets.SecretsManagerBackend)
+	batchSecrets = boolFromEnv("SECRETS_BATCH_RETRIEVAL", false)
+	// maxDeliveryAttempts is how many times a message is processed in
+	// DeleteAfterSuccess mode before it's moved to the dead-letter queue
+	maxDeliveryAttempts = intFromEnv("MAX_DELIVERY_ATTEMPTS", defaultMaxDeliveryAttempts)
+	deadLetterQueueURL  = os.Getenv("DEAD_LETTER_QUEUE_URL")
+	// deadLetterQueue is nil unless deadLetterQueueURL is set
+	deadLetterQueue sqs.MessageSender
 )
 
 func main() {
 	defer logBeforeExiting()
 
 	flag.Parse()
+	log.Configure()
+	if err := validateConfig(); err != nil {
+		log.Fatal("Invalid configuration", "err", err)
+	}
+
 	queue = sqs.NewMessageQueue(queueURL)
-	poller := polling.NewBernoulliExponentialBackoffPoller(queue, 0.95, time.Millisecond, time.Minute)
-	go poller.Start()
-	go consumeMessages(poller.Channel())
-	waitIndefinitely()
+	if deadLetterQueueURL != "" {
+		deadLetterQueue = sqs.NewMessageQueue(deadLetterQueueURL).(sqs.MessageSender)
+	}
+	recorder = metrics.NewRecorder(prometheus.DefaultRegisterer)
+	awsSession := session.New(aws.NewConfig().WithRegion(awsRegion))
+	secretBackend = secrets.NewCachingBackend(newSecretBackend(awsSession), secretsTTL)
+	accountSyncer = newSyncer(syncOptions(awsSession)...)
+	logStartupInfo(newStartupInfo(accountSyncer))
+	receiver := metrics.InstrumentReceiver(queue, prometheus.DefaultRegisterer, "callimachus")
+	// signals received while starting up are handled once the consumer runs
+	signals := terminationSignals()
+	poller := polling.NewBernoulliExponentialBackoffPoller(receiver, 0.95, time.Millisecond, time.Minute)
+	pollerDone := make(chan struct{})
+	go func() {
+		defer close(pollerDone)
+		poller.Start()
+	}()
+	syncPool = NewSyncWorkerPool(maxSyncWorkers)
+	health = newHealthServer(healthPort, pollerDone, syncPool)
+	health.start()
+	consumeCtx, stopConsuming := context.WithCancel(context.Background())
+	if rotationQueueURL != "" {
+		go watchRotations(consumeCtx, secrets.NewRotationWatcher(rotationQueueURL, secretBackend))
+	}
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		consumeMessages(consumeCtx, poller.Channel(), recorder)
+	}()
+	shutdownOnSignal(signals, poller, stopConsuming, consumerDone, gracePeriod)
+}
+
+// newSecretBackend creates the backend that the accounts' passwords are
+// retrieved from (before they're cached).
+func newSecretBackend(awsSession *session.Session) secrets.Backend {
+	if batchSecrets {
+		return secrets.NewSecretsManagerBackend(secretsmanager.New(awsSession))
+	}
+	return secrets.RemoteBackend{}
+}
+
+// watchRotations evicts the passwords that are rotated from secretBackend
+// until the given context is done.
+func watchRotations(ctx context.Context, watcher *secrets.RotationWatcher) {
+	log.Info("Watching secret rotations", "queueURL", rotationQueueURL)
+	if err := watcher.Watch(ctx, nil); err != context.Canceled {
+		logNonNilError(err)
+	}
+}
+
+// newEventStore creates the store that synced events are persisted to; see
+// eventStoreType.
+func newEventStore(awsSession *session.Session) storage.EventStore {
+	if eventStoreType == dynamoEventStore {
+		return storage.NewDynamoEventStore(dynamodb.New(awsSession), eventTable)
+	}
+	return storage.ParseEventStore{}
 }
 
-func consumeMessages(channel <-chan interface{}) {
+// syncOptions configures the account syncer from the environment.
+func syncOptions(awsSession *session.Session) []SyncOption {
+	options := []SyncOption{
+		WithSyncTimeout(syncTimeout),
+		WithMetrics(recorder),
+		WithEventStore(newEventStore(awsSession)),
+		WithFailureTracker(newFailureTracker(maxFailures, failureBackoff)),
+	}
+
+	if syncStatusTable != "" {
+		options = append(options, WithSyncStatusStore(syncstatus.NewDynamoStore(dynamodb.New(awsSession), syncStatusTable)))
+	}
+	if eventStreamName != "" {
+		options = append(options, WithEventSink(kinesis.NewKinesisEventSink(awskinesis.New(awsSession), eventStreamName)))
+	}
+	if keepCancelled {
+		options = append(options, WithCancelledEvents())
+	}
+	return options
+}
+
+// consumeMessages submits the messages received on the given channel to
+// syncPool until the channel is closed or the context is done; the messages
+// that it doesn't get to are received again once their visibility timeout
+// expires.
+func consumeMessages(ctx context.Context, channel <-chan interface{}, recorder metrics.Recorder) {
 	log.Debug("Started consuming messages")
-	for batch := range channel {
-		messages := batch.([]*sqs.Message)
-		deleteMessages(messages)
-		log.Debug("Received messages", "len(messages)", len(messages))
-		for _, message := range messages {
-			go logNonNilError(processMessage(message))
+	for {
+		var batch interface{}
+		var ok bool
+		select {
+		case batch, ok = <-channel:
+		case <-ctx.Done():
+			ok = false
+		}
+		if !ok {
+			log.Debug("Stopped consuming messages")
+			return
+		}
+		consumeBatch(ctx, batch.([]*sqs.Message), recorder)
+	}
+}
+
+// consumeBatch submits the given messages to syncPool. Malformed messages are
+// deleted right away, while the ones that couldn't be decoded for another
+// reason (e.g., the SNS signing certificate couldn't be fetched) are left in
+// the queue to be received again. In DeleteBeforeProcess mode, the others are
+// deleted once they've been submitted, so that a message the pool rejects
+// (e.g., while shutting down) is received again rather than lost.
+func consumeBatch(ctx context.Context, messages []*sqs.Message, recorder metrics.Recorder) {
+	log.Debug("Received messages", "len(messages)", len(messages))
+
+	// the messages of rate-limited users aren't deleted, so they're received
+	// again once their visibility timeout expires; in DeleteAfterSuccess
+	// mode, they're replaced by a delayed copy (see requeueMessage) instead
+	malformed := make([]*sqs.Message, 0, len(messages))
+	processable := make([]*sqs.Message, 0, len(messages))
+	users := make([]*user, 0, len(messages))
+	for _, message := range messages {
+		recorder.MessageReceived()
+		decoded, err := decodeMessage(message)
+		switch {
+		case isMalformed(err):
+			recorder.MessageFailed(failureReason(err))
+			logNonNilError(err)
+			malformed = append(malformed, message)
+		case err != nil:
+			log.Warn("Leaving message that couldn't be decoded in the queue", "handle", message.Handle, "err", err)
+			recorder.MessageFailed(failureReason(err))
+		case !userLimiter.Allow(decoded.ID):
+			log.Warn("Requeuing message of rate-limited user", "userID", decoded.ID)
+			recorder.MessageFailed("rate_limited")
+			if deleteMode == DeleteAfterSuccess {
+				requeueMessage(message)
+			}
+		default:
+			users = append(users, decoded)
+			processable = append(processable, message)
+		}
+	}
+	deleteMessages(malformed)
+
+	submitted := make([]*sqs.Message, 0, len(users))
+	for i, decoded := range users {
+		if ctx.Err() != nil {
+			break
+		}
+		message, decoded := processable[i], decoded
+		err := syncPool.Submit(func() {
+			err := processMessage(decoded)
+			if deleteMode == DeleteAfterSuccess {
+				settleMessage(message, decoded, err)
+			}
+			// a sync that fails for some accounts still shows that the
+			// service works, one that fails for all of them doesn't
+			if err == nil || errors.HasCode(err, "WF11304") {
+				health.markReady()
+			}
+		})
+		if err != nil {
+			// the pool is only closed while shutting down
+			logNonNilError(err)
+			break
 		}
+		submitted = append(submitted, message)
+	}
+	if deleteMode == DeleteBeforeProcess {
+		deleteMessages(submitted)
 	}
 }
 
 func deleteMessages(messages []*sqs.Message) {
+	if len(messages) == 0 {
+		return
+	}
 	handles := make([]string, len(messages))
 	for i, message := range messages {
 		handles[i] = message.Handle
@@ -59,21 +276,28 @@ func deleteMessages(messages []*sqs.Message) {
 	logNonNilError(queue.DeleteMessages(handles))
 }
 
-func processMessage(message *sqs.Message) error {
-	log.Debug("Processing message", "message", message.Body)
-
-	payload := map[string]string{}
-	err := json.Unmarshal([]byte(message.Body), &payload)
+// decodeMessage verifies the signature of the given message and decodes the
+// user that it carries.
+func decodeMessage(message *sqs.Message) (*user, error) {
+	log.Debug("Decoding message", "message", message.Body)
+	payload, err := unmarshalSNSMessage(message.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	user := &user{}
-	body := strings.Replace(payload["Message"], "\\\"", "\"", -1)
-	err = json.Unmarshal([]byte(body), user)
+	err = json.Unmarshal(payload, user)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return user, nil
+}
+
+// processMessage syncs the accounts of the user of a message; see
+// syncAccounts for the errors it returns.
+func processMessage(user *user) (err error) {
+	ctx, endSegment := tracing.BeginSegment(context.Background(), "callimachus")
+	defer func() { endSegment(err) }()
 
 	if strings.Contains(debugUsers, user.ID) {
 		defer log.ExitTestMode()
@@ -85,82 +309,87 @@ func processMessage(message *sqs.Message) error {
 			defer log.ExitTestMode()
 			log.EnterTestMode()
 		}
-
-		logNonNilError(syncAccount(user.ID, account))
 	}
 
-	return nil
+	return accountSyncer.syncAccounts(ctx, user.ID, user.Accounts)
 }
 
-func syncAccount(userID string, account *account) error {
+// syncAccount fetches the events of the given account and prepares them for
+// storage (see syncer.storeEvents). A partial failure (WF11302) still yields
+// the events of the healthy calendars.
+func syncAccount(ctx context.Context, config *SyncConfig, userID string, account *account) ([]calendar.Event, error) {
 	log.Debug("Started syncing", "userID", userID, "email", account.Email)
+	start := time.Now()
+	defer func() {
+		config.Recorder.SyncDuration(account.kind(), time.Since(start))
+	}()
 
-	client, err := createCalendarClient(account)
+	client, err := createCalendarClient(ctx, account)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	events, err := client.CalendarEvents(time.Now().UTC().AddDate(0, -1, 0), time.Now().UTC().AddDate(0, 0, 15))
-	if err != nil {
-		return err
+	startUTC, endUTC := syncWindow(time.Now())
+	events, queryErr := fetchEvents(ctx, client, startUTC, endUTC)
+	config.Recorder.CalendarEventsFetched(len(events))
+	if errors.Is(queryErr, context.DeadlineExceeded) {
+		log.Warn("Timed out syncing", "userID", userID, "email", account.Email)
 	}
-
-	err = parse.DeleteUserEvents(userID)
-	if err != nil {
-		return err
+	if queryErr != nil && !errors.HasCode(queryErr, "WF11302") {
+		return nil, queryErr
 	}
 
-	err = parse.PutEvents(userID, events)
-	if err != nil {
-		return err
+	if config.Deduplicate {
+		events = DeduplicateByUID(events)
 	}
-
-	log.Info("Done syncing", "userID", userID, "email", account.Email)
-	return nil
-}
-
-// createCalendarClient is a calendar client factory function that returns
-// the appropriate calendar client for the given user's account.
-func createCalendarClient(account *account) (calendar.Client, error) {
-	if account.LoginType == "Exchange" {
-		loginInfo := strings.Split(account.LoginInfo, " ")
-		if len(loginInfo) < 3 {
-			return nil, fmt.Errorf("WF00000: Malformed login info: %#v", loginInfo)
-		}
-
-		password, err := secrets.RetrieveUserSecret(account.Password)
-		if err != nil {
-			return nil, err
-		}
-		return ews.NewClient(loginInfo[2], account.Email, password), nil
+	if config.DeduplicateContent {
+		events = DeduplicateByContent(events)
 	}
-
-	if strings.HasSuffix(account.Host, "outlook.com") || strings.HasSuffix(account.Host, "office365.com") {
-		password, err := secrets.RetrieveUserSecret(account.Password)
-		if err != nil {
-			return nil, err
-		}
-		return ews.NewClient("https://outlook.office365.com/EWS/Exchange.asmx", account.Email, password), nil
+	events = applyFilters(events, config.Filters...)
+	if !config.KeepCancelled {
+		events = transformEvents(events, omitCancelled)
 	}
+	events = applyTransformers(events, config.Transformers...)
+	events = transformEvents(events, privacyFilter)
+	return events, queryErr
+}
 
-	if account.Host == "imap.gmail.com" {
-		return google.NewCalendarClient(account.RefreshToken)
+// syncWindow returns the window of the events that are synced at the given
+// time: from syncWindowPastDays before it to syncWindowFutureDays after it.
+// While CalDAV events are cached (see eventCache), the window is aligned to
+// UTC days instead, from the start of the day to the end of the day
+// syncWindowFutureDays later, so that the syncs of a day query the same
+// window and share its cached events.
+func syncWindow(now time.Time) (time.Time, time.Time) {
+	if eventCache == nil {
+		now = now.UTC()
+		return now.AddDate(0, 0, -syncWindowPastDays), now.AddDate(0, 0, syncWindowFutureDays)
 	}
+	today := now.UTC().Truncate(24 * time.Hour)
+	return today.AddDate(0, 0, -syncWindowPastDays), today.AddDate(0, 0, syncWindowFutureDays+1)
+}
 
-	password, err := secrets.RetrieveUserSecret(account.Password)
-	if err != nil {
-		return nil, err
+// recordSyncStatus records the outcome of syncing an account; partial
+// failures (WF11302) count as successes. Failing to record it doesn't fail
+// the sync.
+func recordSyncStatus(statuses syncstatus.Store, userID string, email string, eventCount int, err error) {
+	if err == nil || errors.HasCode(err, "WF11302") {
+		logNonNilError(statuses.RecordSuccess(userID, email, eventCount))
+	} else {
+		logNonNilError(statuses.RecordFailure(userID, email, err))
 	}
-	return caldav.NewClient(account.Host, account.Email, password)
 }
 
-func waitIndefinitely() {
+// terminationSignals returns a channel that receives interrupts (e.g.,
+// Ctrl-C) and termination signals (e.g., sent by Kubernetes when terminating
+// a pod); they no longer kill the process.
+func terminationSignals() chan os.Signal {
 	// Set up a channel on which to send signal notifications.
 	// We must use a buffered channel or risk missing the signal
 	// if we're not ready to receive when the signal is sent.
 	channel := make(chan os.Signal, 1)
-	signal.Notify(channel, os.Interrupt)
-	<-channel
+	signal.Notify(channel, os.Interrupt, syscall.SIGTERM)
+	return channel
 }
 
 func logBeforeExiting() {
@@ -170,6 +399,26 @@ func logBeforeExiting() {
 	log.Info("Bye!")
 }
 
+// failureReason classifies the error of a message that couldn't be processed
+// for the messages_failed_total metric.
+func failureReason(err error) string {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return "malformed_message"
+	}
+	if errors.HasCode(err, "WF10003") {
+		return "invalid_signature"
+	}
+	return "unknown"
+}
+
+// isMalformed tells whether the given error of decodeMessage means that the
+// message can never be decoded (rather than, e.g., that its signature
+// couldn't be verified yet).
+func isMalformed(err error) bool {
+	return failureReason(err) != "unknown"
+}
+
 func logNonNilError(err error) {
 	if err != nil {
 		log.ErrorObject(err)
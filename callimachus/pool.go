@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Cepreu/Archive/errors"
+)
+
+const (
+	defaultMaxSyncWorkers = 50
+)
+
+// SyncWorkerPool runs tasks (i.e., the processing of messages) on a fixed
+// number of goroutines so that a backlog of messages doesn't spawn thousands
+// of them; tasks are queued (and Submit blocks) while every worker is busy.
+type SyncWorkerPool struct {
+	tasks chan func()
+	// done is closed by Drain to release the submits that are blocked on a
+	// full queue
+	done chan struct{}
+	// mutex guards closed; submitting counts the submits in progress, which
+	// must finish before tasks is closed
+	mutex      sync.Mutex
+	closed     bool
+	submitting sync.WaitGroup
+	workers    sync.WaitGroup
+	active     int64
+}
+
+// NewSyncWorkerPool starts a pool of the given number of workers; it falls
+// back to one worker if size isn't positive.
+func NewSyncWorkerPool(size int) *SyncWorkerPool {
+	if size < 1 {
+		size = 1
+	}
+
+	pool := &SyncWorkerPool{tasks: make(chan func(), size), done: make(chan struct{})}
+	pool.workers.Add(size)
+	for i := 0; i < size; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+func (pool *SyncWorkerPool) work() {
+	defer pool.workers.Done()
+	for task := range pool.tasks {
+		atomic.AddInt64(&pool.active, 1)
+		task()
+		atomic.AddInt64(&pool.active, -1)
+	}
+}
+
+// Submit queues the given task, blocking while the queue is full; it returns
+// WF13007 once the pool is being drained, in which case the task doesn't run.
+func (pool *SyncWorkerPool) Submit(task func()) error {
+	pool.mutex.Lock()
+	if pool.closed {
+		pool.mutex.Unlock()
+		return errors.WF13007("sync")
+	}
+	pool.submitting.Add(1)
+	pool.mutex.Unlock()
+	defer pool.submitting.Done()
+
+	select {
+	case pool.tasks <- task:
+		return nil
+	case <-pool.done:
+		return errors.WF13007("sync")
+	}
+}
+
+// Drain stops accepting tasks and waits for the queued and running ones to
+// finish, up to the given timeout; it returns WF13008 if they don't.
+func (pool *SyncWorkerPool) Drain(timeout time.Duration) error {
+	pool.mutex.Lock()
+	if !pool.closed {
+		pool.closed = true
+		close(pool.done)
+		go func() {
+			// a submit that was blocked may still have queued its task
+			pool.submitting.Wait()
+			close(pool.tasks)
+		}()
+	}
+	pool.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		pool.workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-time.After(timeout):
+		return errors.WF13008("sync", timeout, pool.QueueDepth()+pool.ActiveWorkers())
+	}
+}
+
+// QueueDepth is the number of tasks waiting for a worker.
+func (pool *SyncWorkerPool) QueueDepth() int {
+	return len(pool.tasks)
+}
+
+// ActiveWorkers is the number of workers running a task.
+func (pool *SyncWorkerPool) ActiveWorkers() int {
+	return int(atomic.LoadInt64(&pool.active))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Cepreu/Archive/errors"
+)
+
+func TestSyncWorkerPoolBoundsConcurrency(t *testing.T) {
+	const size = 3
+	pool := NewSyncWorkerPool(size)
+	var running, peak, ran int64
+	for i := 0; i < 20; i++ {
+		err := pool.Submit(func() {
+			n := atomic.AddInt64(&running, 1)
+			for {
+				p := atomic.LoadInt64(&peak)
+				if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt64(&running, -1)
+			atomic.AddInt64(&ran, 1)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pool.Drain(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 20 {
+		t.Errorf("ran %d tasks, want 20", ran)
+	}
+	if peak > size {
+		t.Errorf("ran %d tasks at once, want at most %d", peak, size)
+	}
+}
+
+func TestSyncWorkerPoolDrainReleasesBlockedSubmit(t *testing.T) {
+	pool := NewSyncWorkerPool(1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	if err := pool.Submit(func() { close(started); <-release }); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := pool.Submit(func() {}); err != nil { // fills the queue
+		t.Fatal(err)
+	}
+
+	submitted := make(chan error, 1)
+	go func() { submitted <- pool.Submit(func() {}) }()
+	drained := make(chan error, 1)
+	go func() { drained <- pool.Drain(time.Second) }()
+
+	select {
+	case err := <-submitted:
+		if !errors.HasCode(err, "WF13007") {
+			t.Errorf("blocked Submit = %v, want WF13007", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Submit is still blocked after Drain")
+	}
+
+	close(release)
+	if err := <-drained; err != nil {
+		t.Errorf("Drain = %v, want nil", err)
+	}
+}
+
+func TestSyncWorkerPoolSubmitAfterDrain(t *testing.T) {
+	pool := NewSyncWorkerPool(1)
+	if err := pool.Drain(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Submit(func() {}); !errors.HasCode(err, "WF13007") {
+		t.Errorf("Submit after Drain = %v, want WF13007", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"github.com/WF/go/calendar"
+	"github.com/WF/go/enums/sensitivity"
+)
+
+const (
+	privateSubject = "Private event"
+)
+
+// PrivacyMode determines how private and confidential events are persisted.
+type PrivacyMode int
+
+const (
+	// StripSubjectAndDescription replaces the subject with a placeholder and
+	// clears the description.
+	StripSubjectAndDescription PrivacyMode = iota
+	// StripAll also clears the location, the URL, the organizer, and the
+	// attendees; only the time slot remains.
+	StripAll
+	// OmitEvent doesn't persist the events at all.
+	OmitEvent
+)
+
+// parsePrivacyMode parses the name of a privacy mode (e.g., "StripAll"); it
+// falls back to StripSubjectAndDescription.
+func parsePrivacyMode(name string) PrivacyMode {
+	switch name {
+	case "StripAll":
+		return StripAll
+	case "OmitEvent":
+		return OmitEvent
+	default:
+		return StripSubjectAndDescription
+	}
+}
+
+// NewPrivacyFilter creates a transformer that strips the details of private
+// and confidential events according to the given mode; other events are
+// returned as is.
+func NewPrivacyFilter(mode PrivacyMode) EventTransformer {
+	return func(event calendar.Event) calendar.Event {
+		if !isPrivate(event) {
+			return event
+		}
+
+		switch mode {
+		case OmitEvent:
+			return nil
+		case StripAll:
+			return &strippedEvent{wrappedEvent: wrappedEvent{event}, all: true}
+		default:
+			return &strippedEvent{wrappedEvent: wrappedEvent{event}}
+		}
+	}
+}
+
+func isPrivate(event calendar.Event) bool {
+	s := event.Sensitivity()
+	return s == sensitivity.Private || s == sensitivity.Confidential
+}
+
+// strippedEvent hides the details of the event that it wraps.
+type strippedEvent struct {
+	wrappedEvent
+	// all strips everything but the time slot
+	all bool
+}
+
+func (event *strippedEvent) Subject() string {
+	return privateSubject
+}
+
+func (event *strippedEvent) Description() string {
+	return ""
+}
+
+func (event *strippedEvent) Location() string {
+	if event.all {
+		return ""
+	}
+	return event.Event.Location()
+}
+
+func (event *strippedEvent) URL() string {
+	if event.all {
+		return ""
+	}
+	return event.Event.URL()
+}
+
+func (event *strippedEvent) Organizer() calendar.EmailAddress {
+	if event.all {
+		return nil
+	}
+	return event.Event.Organizer()
+}
+
+func (event *strippedEvent) Attendees() []calendar.Attendee {
+	if event.all {
+		return []calendar.Attendee{}
+	}
+	return event.Event.Attendees()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/WF/go/calendar"
+	"github.com/WF/go/enums/rsvp"
+	"github.com/WF/go/enums/sensitivity"
+)
+
+type emailAddress struct {
+	name    string
+	address string
+}
+
+func (address emailAddress) Name() string    { return address.name }
+func (address emailAddress) Address() string { return address.address }
+
+type attendee struct {
+	emailAddress
+}
+
+func (attendee attendee) EmailAddress() calendar.EmailAddress { return attendee.emailAddress }
+func (attendee) ResponseType() *rsvp.MeetingResponseType      { return nil }
+
+// detailedEvent is an event with all of the details that a privacy filter
+// may strip, and the given sensitivity.
+type detailedEvent struct {
+	calendar.Event
+	sensitivity sensitivity.Sensitivity
+}
+
+func (detailedEvent) UID() string         { return "event-1" }
+func (detailedEvent) Subject() string     { return "Doctor's appointment" }
+func (detailedEvent) Description() string { return "Bring the test results" }
+func (detailedEvent) Location() string    { return "Clinic" }
+func (detailedEvent) URL() string         { return "https://example.com/appointment" }
+func (detailedEvent) Organizer() calendar.EmailAddress {
+	return emailAddress{name: "Clinic", address: "clinic@example.com"}
+}
+func (detailedEvent) Attendees() []calendar.Attendee {
+	return []calendar.Attendee{attendee{emailAddress{name: "User", address: "user@example.com"}}}
+}
+func (event detailedEvent) Sensitivity() sensitivity.Sensitivity { return event.sensitivity }
+
+func TestPrivacyFilter(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          PrivacyMode
+		sensitivity   sensitivity.Sensitivity
+		wantOmitted   bool
+		wantSubject   string
+		wantDetails   bool
+		wantAttendees int
+	}{
+		{name: "normal event", mode: StripAll, sensitivity: sensitivity.Normal, wantSubject: "Doctor's appointment", wantDetails: true, wantAttendees: 1},
+		{name: "personal event", mode: OmitEvent, sensitivity: sensitivity.Personal, wantSubject: "Doctor's appointment", wantDetails: true, wantAttendees: 1},
+		{name: "strip subject and description", mode: StripSubjectAndDescription, sensitivity: sensitivity.Private, wantSubject: privateSubject, wantDetails: true, wantAttendees: 1},
+		{name: "strip all", mode: StripAll, sensitivity: sensitivity.Private, wantSubject: privateSubject},
+		{name: "strip all of confidential event", mode: StripAll, sensitivity: sensitivity.Confidential, wantSubject: privateSubject},
+		{name: "omit event", mode: OmitEvent, sensitivity: sensitivity.Private, wantOmitted: true},
+		{name: "omit confidential event", mode: OmitEvent, sensitivity: sensitivity.Confidential, wantOmitted: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := NewPrivacyFilter(test.mode)(detailedEvent{sensitivity: test.sensitivity})
+			if test.wantOmitted {
+				if event != nil {
+					t.Errorf("filtered event = %#v, want nil", event)
+				}
+				return
+			}
+			if event == nil {
+				t.Fatal("filtered event = nil")
+			}
+
+			if event.UID() != "event-1" {
+				t.Errorf("UID() = %q, want event-1", event.UID())
+			}
+			if event.Subject() != test.wantSubject {
+				t.Errorf("Subject() = %q, want %q", event.Subject(), test.wantSubject)
+			}
+			if (event.Description() != "") != (test.wantSubject != privateSubject) {
+				t.Errorf("Description() = %q", event.Description())
+			}
+			if got := event.Location() != "" && event.URL() != "" && event.Organizer() != nil; got != test.wantDetails {
+				t.Errorf("Location(), URL(), Organizer() = %q, %q, %v, want details %v", event.Location(), event.URL(), event.Organizer(), test.wantDetails)
+			}
+			if attendees := event.Attendees(); attendees == nil || len(attendees) != test.wantAttendees {
+				t.Errorf("Attendees() = %v, want %d attendees", attendees, test.wantAttendees)
+			}
+		})
+	}
+}
+
+func TestParsePrivacyMode(t *testing.T) {
+	tests := []struct {
+		name string
+		want PrivacyMode
+	}{
+		{name: "StripSubjectAndDescription", want: StripSubjectAndDescription},
+		{name: "StripAll", want: StripAll},
+		{name: "OmitEvent", want: OmitEvent},
+		{name: "", want: StripSubjectAndDescription},
+		{name: "stripall", want: StripSubjectAndDescription},
+	}
+	for _, test := range tests {
+		if got := parsePrivacyMode(test.name); got != test.want {
+			t.Errorf("parsePrivacyMode(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
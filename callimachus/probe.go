@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cepreu/Archive/log"
+)
+
+const (
+	calDAVProbeTimeout = 10 * time.Second
+	// calDAVProbeBody asks for the current user principal, which every CalDAV
+	// server supports
+	calDAVProbeBody = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><current-user-principal/></prop></propfind>`
+)
+
+var (
+	probeHTTPClient = &http.Client{Timeout: calDAVProbeTimeout}
+	// calDAVProbes maps hosts to whether they serve CalDAV; hosts rarely
+	// change protocols, so they're probed until the answer is definitive
+	calDAVProbes sync.Map
+)
+
+// probeCalDAV determines whether the given host serves CalDAV by sending a
+// PROPFIND to its well-known CalDAV URL; it returns true only for a valid
+// CalDAV response, i.e., a multi-status or a DAV header that advertises
+// calendar-access (servers advertise it even when authentication is
+// required). Definitive answers are cached per host; failed probes (e.g.,
+// timeouts or 5xx responses) aren't, so the host is probed again next time.
+func probeCalDAV(ctx context.Context, host string, httpClient *http.Client) bool {
+	if cached, ok := calDAVProbes.Load(host); ok {
+		return cached.(bool)
+	}
+
+	ok, definitive := sendCalDAVProbe(ctx, host, httpClient)
+	log.Debug("Probed CalDAV", "host", host, "ok", ok, "definitive", definitive)
+	if definitive {
+		calDAVProbes.Store(host, ok)
+	}
+	return ok
+}
+
+// sendCalDAVProbe returns whether the given host serves CalDAV, and whether
+// that's definitive, i.e., the host responded without a server error.
+func sendCalDAVProbe(ctx context.Context, host string, httpClient *http.Client) (ok bool, definitive bool) {
+	request, err := http.NewRequestWithContext(ctx, "PROPFIND", "https://"+host+"/.well-known/caldav", strings.NewReader(calDAVProbeBody))
+	if err != nil {
+		return false, true
+	}
+	request.Header.Set("Depth", "0")
+	request.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		log.Debug("Failed to probe CalDAV", "host", host, "err", err)
+		return false, false
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusMultiStatus {
+		return true, true
+	}
+	for _, value := range response.Header.Values("DAV") {
+		if strings.Contains(value, "calendar-access") {
+			return true, true
+		}
+	}
+	return false, response.StatusCode < http.StatusInternalServerError
+}
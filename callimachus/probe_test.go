@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newProbedServer starts a TLS server that responds to CalDAV probes with the
+// given handler and returns its host.
+func newProbedServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, string) {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	return server, strings.TrimPrefix(server.URL, "https://")
+}
+
+func TestProbeCalDAV(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    bool
+	}{
+		{name: "multi-status", want: true, handler: func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PROPFIND" || r.URL.Path != "/.well-known/caldav" || r.Header.Get("Depth") != "0" {
+				t.Errorf("probe was %s %s with Depth %q", r.Method, r.URL.Path, r.Header.Get("Depth"))
+			}
+			w.WriteHeader(http.StatusMultiStatus)
+		}},
+		{name: "unauthorized with calendar-access", want: true, handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("DAV", "1, 2, access-control, calendar-access")
+			w.WriteHeader(http.StatusUnauthorized)
+		}},
+		{name: "not found", want: false, handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}},
+	}
+	for _, test := range tests {
+		server, host := newProbedServer(t, test.handler)
+		if got := probeCalDAV(context.Background(), host, server.Client()); got != test.want {
+			t.Errorf("%s: probeCalDAV = %v, want %v", test.name, got, test.want)
+		}
+		if cached, ok := calDAVProbes.Load(host); !ok || cached.(bool) != test.want {
+			t.Errorf("%s: cached %v, want %v", test.name, cached, test.want)
+		}
+	}
+}
+
+func TestProbeCalDAVDoesNotCacheFailures(t *testing.T) {
+	server, host := newProbedServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	if probeCalDAV(context.Background(), host, server.Client()) {
+		t.Error("probeCalDAV of an unavailable server = true")
+	}
+	if _, ok := calDAVProbes.Load(host); ok {
+		t.Error("cached the probe of an unavailable server")
+	}
+
+	server.Close()
+	if probeCalDAV(context.Background(), host, server.Client()) {
+		t.Error("probeCalDAV of a closed server = true")
+	}
+	if _, ok := calDAVProbes.Load(host); ok {
+		t.Error("cached the probe of a closed server")
+	}
+}
+
+func TestProbeCalDAVUsesContext(t *testing.T) {
+	server, host := newProbedServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMultiStatus)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if probeCalDAV(ctx, host, server.Client()) {
+		t.Error("probeCalDAV with a cancelled context = true")
+	}
+	if _, ok := calDAVProbes.Load(host); ok {
+		t.Error("cached the probe of a cancelled context")
+	}
+}
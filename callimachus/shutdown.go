@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/Cepreu/Archive/log"
+)
+
+// stopper is implemented by pollers that can stop polling gracefully.
+type stopper interface {
+	Stop(ctx context.Context) error
+}
+
+// shutdownOnSignal waits for a signal on the given channel (see
+// terminationSignals), then stops consuming messages and shuts down
+// gracefully.
+func shutdownOnSignal(signals <-chan os.Signal, poller interface{}, stopConsuming context.CancelFunc, consumerDone <-chan struct{}, timeout time.Duration) {
+	received := <-signals
+	log.Info("Received signal", "signal", received)
+	stopConsuming()
+	shutdown(poller, consumerDone, timeout)
+}
+
+// shutdown stops polling for new messages (if the poller supports it) and
+// waits for the in-flight messages to be processed, up to the given timeout.
+// The consumer's context must be done already so that it stops submitting
+// messages; shutdown waits for it to exit after draining the pool, which
+// releases a submit that's blocked on a full queue.
+func shutdown(poller interface{}, consumerDone <-chan struct{}, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.Info("Shutting down", "queueDepth", syncPool.QueueDepth(), "activeWorkers", syncPool.ActiveWorkers(), "timeout", timeout)
+	if s, ok := poller.(stopper); ok {
+		logNonNilError(s.Stop(ctx))
+	}
+
+	// Drain logs WF13008 if the in-flight messages aren't processed in time
+	deadline, _ := ctx.Deadline()
+	if syncPool.Drain(time.Until(deadline)) == nil {
+		log.Info("Drained in-flight operations")
+	}
+	select {
+	case <-consumerDone:
+	case <-ctx.Done():
+	}
+
+	logNonNilError(health.Shutdown(context.Background()))
+}
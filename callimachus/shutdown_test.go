@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeStopper counts the times that it's stopped.
+type fakeStopper struct {
+	stops int32
+}
+
+func (s *fakeStopper) Stop(ctx context.Context) error {
+	atomic.AddInt32(&s.stops, 1)
+	return nil
+}
+
+func TestShutdownOnSignalDrains(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		t.Run(sig.String(), func(t *testing.T) {
+			signals := terminationSignals()
+			defer signal.Stop(signals)
+			savedPool, savedHealth := syncPool, health
+			defer func() { syncPool, health = savedPool, savedHealth }()
+			syncPool = NewSyncWorkerPool(1)
+			health = newHealthServer("0", make(chan struct{}), syncPool)
+
+			// an in-flight message
+			var processed int32
+			if err := syncPool.Submit(func() {
+				time.Sleep(50 * time.Millisecond)
+				atomic.StoreInt32(&processed, 1)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			poller := &fakeStopper{}
+			consumeCtx, stopConsuming := context.WithCancel(context.Background())
+			consumerDone := make(chan struct{})
+			go func() {
+				defer close(consumerDone)
+				<-consumeCtx.Done()
+			}()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				shutdownOnSignal(signals, poller, stopConsuming, consumerDone, 5*time.Second)
+			}()
+			select {
+			case <-done:
+				t.Fatal("shut down without a signal")
+			case <-time.After(20 * time.Millisecond):
+			}
+
+			if err := syscall.Kill(os.Getpid(), sig); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("didn't shut down on %v", sig)
+			}
+
+			if atomic.LoadInt32(&processed) != 1 {
+				t.Error("shut down before the in-flight message was processed")
+			}
+			if stops := atomic.LoadInt32(&poller.stops); stops != 1 {
+				t.Errorf("poller stopped %d times, want 1", stops)
+			}
+			select {
+			case <-consumerDone:
+			default:
+				t.Error("consumer still running")
+			}
+		})
+	}
+}
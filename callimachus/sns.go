@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cepreu/Archive/errors"
+)
+
+const (
+	notificationType = "Notification"
+)
+
+var (
+	// signingCertHostPattern matches the hosts that serve SNS signing
+	// certificates (e.g., sns.us-east-1.amazonaws.com)
+	signingCertHostPattern = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+	signingCerts           = &certificateCache{certificates: map[string]*x509.Certificate{}}
+	certificateClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+// snsEnvelope is an SNS notification as delivered to an SQS queue (see
+// https://docs.aws.amazon.com/sns/latest/dg/sns-message-and-json-formats.html).
+type snsEnvelope struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject,omitempty"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+}
+
+// unmarshalSNSMessage unmarshals the SNS envelope of the given message body,
+// verifies its signature, and returns the published message. The publisher
+// escapes the quotes of the JSON it publishes once more than needed, so they
+// are unescaped, but only after verifying the signature, which covers the
+// message as published.
+func unmarshalSNSMessage(body string) ([]byte, error) {
+	envelope := &snsEnvelope{}
+	if err := json.Unmarshal([]byte(body), envelope); err != nil {
+		return nil, err
+	}
+
+	if err := validateSNSSignature(envelope); err != nil {
+		return nil, err
+	}
+	return []byte(strings.Replace(envelope.Message, "\\\"", "\"", -1)), nil
+}
+
+// validateSNSSignature verifies the envelope's signature with the signing
+// certificate that it references, provided that the certificate is served by
+// SNS itself. A signature that can't be verified because the certificate
+// couldn't be fetched (e.g., SNS is unreachable) isn't invalid, so that error
+// is returned as is rather than as a WF10003.
+func validateSNSSignature(envelope *snsEnvelope) error {
+	if envelope.Type != notificationType {
+		return errors.WF10003(envelope.MessageID, "unexpected type: "+envelope.Type)
+	}
+
+	var hash crypto.Hash
+	switch envelope.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return errors.WF10003(envelope.MessageID, "unsupported signature version: "+envelope.SignatureVersion)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return errors.WF10003(envelope.MessageID, "malformed signature")
+	}
+
+	certificate, err := signingCerts.get(envelope.SigningCertURL)
+	if errors.HasCode(err, "WF12001") {
+		return errors.WF10003(envelope.MessageID, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	publicKey, ok := certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.WF10003(envelope.MessageID, "signing certificate doesn't have an RSA key")
+	}
+
+	if err := rsa.VerifyPKCS1v15(publicKey, hash, digest(hash, envelope.stringToSign()), signature); err != nil {
+		return errors.WF10003(envelope.MessageID, "signature mismatch")
+	}
+	return nil
+}
+
+// stringToSign returns the canonical form of a notification that SNS signs;
+// its fields are listed in byte order and Subject only if present.
+func (envelope *snsEnvelope) stringToSign() string {
+	s := "Message\n" + envelope.Message + "\n"
+	s += "MessageId\n" + envelope.MessageID + "\n"
+	if envelope.Subject != "" {
+		s += "Subject\n" + envelope.Subject + "\n"
+	}
+	s += "Timestamp\n" + envelope.Timestamp + "\n"
+	s += "TopicArn\n" + envelope.TopicArn + "\n"
+	s += "Type\n" + envelope.Type + "\n"
+	return s
+}
+
+func digest(hash crypto.Hash, s string) []byte {
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum([]byte(s))
+		return sum[:]
+	}
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
+
+// certificateCache caches signing certificates by URL; SNS rotates them
+// rarely, and fetching one per message would double the latency.
+type certificateCache struct {
+	sync.Mutex
+	certificates map[string]*x509.Certificate
+}
+
+func (cache *certificateCache) get(rawURL string) (*x509.Certificate, error) {
+	cache.Lock()
+	certificate, ok := cache.certificates[rawURL]
+	cache.Unlock()
+	if ok {
+		return certificate, nil
+	}
+
+	certificate, err := fetchSigningCert(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.Lock()
+	cache.certificates[rawURL] = certificate
+	cache.Unlock()
+	return certificate, nil
+}
+
+// fetchSigningCert downloads and parses the PEM certificate at the given URL,
+// which has to be an HTTPS URL of an SNS host; otherwise anyone could sign
+// messages with a certificate of their own. It returns WF12001 if the URL or
+// the certificate is invalid; other errors are those of the download.
+func fetchSigningCert(rawURL string) (*x509.Certificate, error) {
+	certURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.WF12001("SigningCertURL", err.Error())
+	}
+	if certURL.Scheme != "https" || !signingCertHostPattern.MatchString(certURL.Host) {
+		return nil, errors.WF12001("SigningCertURL", "untrusted host: "+certURL.Host)
+	}
+
+	response, err := certificateClient.Get(certURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.WF11200(response)
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.WF12001("SigningCertURL", "not a PEM certificate")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.WF12001("SigningCertURL", err.Error())
+	}
+	return certificate, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cepreu/Archive/aws/sqs"
+	"github.com/Cepreu/Archive/errors"
+)
+
+const testSigningCertURL = "https://sns.us-west-2.amazonaws.com/SimpleNotificationService-test.pem"
+
+var (
+	// testSigningKey signs the messages of newSignedMessage
+	testSigningKey     *rsa.PrivateKey
+	testSigningKeyOnce sync.Once
+)
+
+// newSignedMessage returns an SQS message carrying an SNS notification of the
+// given message, signed with a key whose certificate is cached under
+// testSigningCertURL.
+func newSignedMessage(t *testing.T, message string) *sqs.Message {
+	testSigningKeyOnce.Do(func() {
+		testSigningKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	key := testSigningKey
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingCerts.Lock()
+	signingCerts.certificates[testSigningCertURL] = certificate
+	signingCerts.Unlock()
+
+	envelope := &snsEnvelope{
+		Type:             notificationType,
+		MessageID:        "message-1",
+		TopicArn:         "arn:aws:sns:us-west-2:123456789012:user-objects",
+		Message:          message,
+		Timestamp:        "2020-01-02T10:00:00.000Z",
+		SignatureVersion: "2",
+		SigningCertURL:   testSigningCertURL,
+	}
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest(crypto.SHA256, envelope.stringToSign()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sqs.Message{Body: string(body)}
+}
+
+func TestDecodeMessageUnescapesMessage(t *testing.T) {
+	// the publisher escapes the quotes of the user object once more
+	message := newSignedMessage(t, `{\"objectId\":\"user-1\",\"imapUsers\":[{\"hostname\":\"caldav.example.com\"}]}`)
+
+	decoded, err := decodeMessage(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != "user-1" || len(decoded.Accounts) != 1 || decoded.Accounts[0].Host != "caldav.example.com" {
+		t.Errorf("decodeMessage = %+v, want user-1 with one account", decoded)
+	}
+}
+
+func TestDecodeMessageUnescapedMessage(t *testing.T) {
+	decoded, err := decodeMessage(newSignedMessage(t, `{"objectId":"user-1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != "user-1" {
+		t.Errorf("decodeMessage ID = %q, want user-1", decoded.ID)
+	}
+}
+
+func TestDecodeMessageTampered(t *testing.T) {
+	message := newSignedMessage(t, `{\"objectId\":\"user-1\"}`)
+	envelope := &snsEnvelope{}
+	if err := json.Unmarshal([]byte(message.Body), envelope); err != nil {
+		t.Fatal(err)
+	}
+	envelope.Message = `{\"objectId\":\"user-2\"}`
+	body, _ := json.Marshal(envelope)
+
+	_, err := decodeMessage(&sqs.Message{Body: string(body)})
+	if !errors.HasCode(err, "WF10003") {
+		t.Errorf("decodeMessage of a tampered message = %v, want WF10003", err)
+	}
+}
+
+// failingTransport fails every request, like an unreachable host.
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("dial tcp %s: connection refused", request.URL.Host)
+}
+
+// withUnreachableSigningCert returns the given message with a signing
+// certificate URL that isn't cached, and makes fetching it fail.
+func withUnreachableSigningCert(t *testing.T, message *sqs.Message) *sqs.Message {
+	savedClient := certificateClient
+	certificateClient = &http.Client{Transport: failingTransport{}}
+	t.Cleanup(func() { certificateClient = savedClient })
+
+	envelope := &snsEnvelope{}
+	if err := json.Unmarshal([]byte(message.Body), envelope); err != nil {
+		t.Fatal(err)
+	}
+	envelope.SigningCertURL = "https://sns.us-west-2.amazonaws.com/SimpleNotificationService-unreachable.pem"
+	body, _ := json.Marshal(envelope)
+	message.Body = string(body)
+	return message
+}
+
+func TestDecodeMessageUnreachableSigningCert(t *testing.T) {
+	message := withUnreachableSigningCert(t, newSignedMessage(t, `{\"objectId\":\"user-1\"}`))
+
+	_, err := decodeMessage(message)
+	if err == nil || errors.HasCode(err, "WF10003") {
+		t.Errorf("decodeMessage with an unreachable signing certificate = %v, want the download's error", err)
+	}
+}
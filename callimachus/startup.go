@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/Cepreu/Archive/log"
+)
+
+var (
+	// buildVersion is set when building, e.g., with
+	// go build -ldflags "-X main.buildVersion=$(git describe --always --dirty)"
+	buildVersion = "dev"
+	// logInfo logs the startup information; tests capture it
+	logInfo = log.Info
+)
+
+// StartupInfo describes the running build and its configuration.
+type StartupInfo struct {
+	BuildVersion string
+	GoVersion    string
+	QueueURL     string
+	// SyncWindowPast and SyncWindowFuture are ISO 8601 durations (e.g.,
+	// "P15D") before and after the time of each sync
+	SyncWindowPast   string
+	SyncWindowFuture string
+	// MaxConcurrency is the number of accounts of a user synced at once
+	MaxConcurrency int
+	// MaxSyncWorkers is the number of messages processed at once
+	MaxSyncWorkers int
+}
+
+func newStartupInfo(s *syncer) *StartupInfo {
+	return &StartupInfo{
+		BuildVersion:     buildVersion,
+		GoVersion:        runtime.Version(),
+		QueueURL:         queueURL,
+		SyncWindowPast:   fmt.Sprintf("P%dD", syncWindowPastDays),
+		SyncWindowFuture: fmt.Sprintf("P%dD", syncWindowFutureDays),
+		MaxConcurrency:   s.concurrency,
+		MaxSyncWorkers:   maxSyncWorkers,
+	}
+}
+
+// logStartupInfo logs the given startup information, so that it's known which
+// build runs with which configuration.
+func logStartupInfo(info *StartupInfo) {
+	logInfo("Starting callimachus",
+		"buildVersion", info.BuildVersion,
+		"goVersion", info.GoVersion,
+		"queueURL", info.QueueURL,
+		"syncWindowPast", info.SyncWindowPast,
+		"syncWindowFuture", info.SyncWindowFuture,
+		"maxConcurrency", info.MaxConcurrency,
+		"maxSyncWorkers", info.MaxSyncWorkers,
+	)
+}
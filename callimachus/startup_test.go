@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestNewStartupInfo(t *testing.T) {
+	savedQueueURL, savedPast, savedFuture, savedWorkers := queueURL, syncWindowPastDays, syncWindowFutureDays, maxSyncWorkers
+	defer func() {
+		queueURL, syncWindowPastDays, syncWindowFutureDays, maxSyncWorkers = savedQueueURL, savedPast, savedFuture, savedWorkers
+	}()
+	queueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/user-objects"
+	syncWindowPastDays, syncWindowFutureDays, maxSyncWorkers = 0, 15, 8
+
+	info := newStartupInfo(newSyncer(WithConcurrency(4)))
+
+	want := StartupInfo{
+		BuildVersion:     "dev",
+		GoVersion:        runtime.Version(),
+		QueueURL:         queueURL,
+		SyncWindowPast:   "P0D",
+		SyncWindowFuture: "P15D",
+		MaxConcurrency:   4,
+		MaxSyncWorkers:   8,
+	}
+	if *info != want {
+		t.Errorf("newStartupInfo = %+v, want %+v", *info, want)
+	}
+}
+
+func TestLogStartupInfo(t *testing.T) {
+	var message string
+	fields := map[string]interface{}{}
+	savedLogInfo := logInfo
+	defer func() { logInfo = savedLogInfo }()
+	logInfo = func(m string, args ...interface{}) {
+		message = m
+		for i := 0; i+1 < len(args); i += 2 {
+			fields[args[i].(string)] = args[i+1]
+		}
+	}
+
+	logStartupInfo(&StartupInfo{
+		BuildVersion:     "v1.2.3",
+		GoVersion:        "go1.16",
+		QueueURL:         "https://sqs.us-east-1.amazonaws.com/123456789012/user-objects",
+		SyncWindowPast:   "P30D",
+		SyncWindowFuture: "P15D",
+		MaxConcurrency:   4,
+		MaxSyncWorkers:   8,
+	})
+
+	if message != "Starting callimachus" {
+		t.Errorf("logged %q, want the startup message", message)
+	}
+	want := map[string]interface{}{
+		"buildVersion":     "v1.2.3",
+		"goVersion":        "go1.16",
+		"queueURL":         "https://sqs.us-east-1.amazonaws.com/123456789012/user-objects",
+		"syncWindowPast":   "P30D",
+		"syncWindowFuture": "P15D",
+		"maxConcurrency":   4,
+		"maxSyncWorkers":   8,
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("logged fields %v, want %v", fields, want)
+	}
+}
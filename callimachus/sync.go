@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Cepreu/Archive/caldav"
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/log"
+	"github.com/Cepreu/Archive/metrics"
+	"github.com/Cepreu/Archive/storage"
+	"github.com/Cepreu/Archive/syncstatus"
+	"github.com/Cepreu/Archive/tracing"
+)
+
+const (
+	defaultConcurrency = 3
+	// maxAbandonedQueries bounds the queries that timed out but can't be
+	// cancelled (see fetchEvents)
+	maxAbandonedQueries = 100
+)
+
+var (
+	// abandonedQueries counts the queries that timed out but are still
+	// running
+	abandonedQueries int64
+)
+
+// SyncConfig holds the dependencies of syncing accounts.
+type SyncConfig struct {
+	// Store is where the synced events are persisted.
+	Store storage.EventStore
+	// Recorder records the sync metrics.
+	Recorder metrics.Recorder
+	// Statuses records the outcome of each sync.
+	Statuses syncstatus.Store
+	// Sink publishes the synced events to downstream consumers; nil if they
+	// aren't published.
+	Sink storage.EventSink
+	// KeepCancelled stores cancelled events rather than omitting them; their
+	// status is recorded by stores and sinks that keep it (e.g., DynamoDB and
+	// Kinesis, but not Parse).
+	KeepCancelled bool
+	// Filters decide which of the fetched events are persisted; all of them
+	// are by default.
+	Filters []EventFilter
+	// Transformers normalize the events that are persisted, in order; the
+	// privacy filter is applied after them.
+	Transformers []EventTransformer
+	// Deduplicate keeps a single version of the events that share a UID (see
+	// DeduplicateByUID).
+	Deduplicate bool
+	// DeduplicateContent also keeps a single version of the events that have
+	// the same subject and start (see DeduplicateByContent).
+	DeduplicateContent bool
+}
+
+// syncer syncs the calendar accounts of users.
+type syncer struct {
+	concurrency int
+	syncTimeout time.Duration
+	config      *SyncConfig
+	failures    *failureTracker
+}
+
+// SyncOption configures a syncer.
+type SyncOption func(*syncer)
+
+// WithConcurrency sets the number of accounts of a single user that are
+// synced in parallel.
+func WithConcurrency(n int) SyncOption {
+	return func(s *syncer) {
+		s.concurrency = n
+	}
+}
+
+// WithSyncTimeout sets the deadline for syncing a single account.
+func WithSyncTimeout(timeout time.Duration) SyncOption {
+	return func(s *syncer) {
+		s.syncTimeout = timeout
+	}
+}
+
+// WithMetrics sets the recorder of the sync metrics; they're discarded by
+// default.
+func WithMetrics(recorder metrics.Recorder) SyncOption {
+	return func(s *syncer) {
+		s.config.Recorder = recorder
+	}
+}
+
+// WithEventStore sets where the synced events are persisted; Parse by
+// default.
+func WithEventStore(store storage.EventStore) SyncOption {
+	return func(s *syncer) {
+		s.config.Store = store
+	}
+}
+
+// WithSyncStatusStore sets where the outcome of each sync is recorded; it's
+// not recorded by default.
+func WithSyncStatusStore(statuses syncstatus.Store) SyncOption {
+	return func(s *syncer) {
+		s.config.Statuses = statuses
+	}
+}
+
+// WithFailureTracker makes the syncer skip accounts that keep failing; see
+// failureTracker.
+func WithFailureTracker(tracker *failureTracker) SyncOption {
+	return func(s *syncer) {
+		s.failures = tracker
+	}
+}
+
+// WithEventSink publishes the synced events to the given sink; they aren't
+// published by default.
+func WithEventSink(sink storage.EventSink) SyncOption {
+	return func(s *syncer) {
+		s.config.Sink = sink
+	}
+}
+
+// WithCancelledEvents keeps cancelled events, e.g., for consumers that show
+// them struck through; they're omitted by default.
+func WithCancelledEvents() SyncOption {
+	return func(s *syncer) {
+		s.config.KeepCancelled = true
+	}
+}
+
+// WithEventFilters only persists the events that pass all of the given
+// filters (see, e.g., FilterByStatus).
+func WithEventFilters(filters ...EventFilter) SyncOption {
+	return func(s *syncer) {
+		s.config.Filters = append(s.config.Filters, filters...)
+	}
+}
+
+// WithEventTransformers normalizes the events before they're persisted (see,
+// e.g., NormalizeTimeZonesTransformer).
+func WithEventTransformers(transformers ...EventTransformer) SyncOption {
+	return func(s *syncer) {
+		s.config.Transformers = append(s.config.Transformers, transformers...)
+	}
+}
+
+// WithDeduplication keeps a single version of the events that show in several
+// of an account's calendars; see DeduplicateByUID.
+func WithDeduplication() SyncOption {
+	return func(s *syncer) {
+		s.config.Deduplicate = true
+	}
+}
+
+// WithContentDeduplication also deduplicates the events that have the same
+// subject and start but different UIDs; see DeduplicateByContent.
+func WithContentDeduplication() SyncOption {
+	return func(s *syncer) {
+		s.config.Deduplicate = true
+		s.config.DeduplicateContent = true
+	}
+}
+
+func newSyncer(options ...SyncOption) *syncer {
+	s := &syncer{
+		concurrency: defaultConcurrency,
+		syncTimeout: defaultSyncTimeout,
+		config: &SyncConfig{
+			Store:    storage.ParseEventStore{},
+			Recorder: metrics.Nop{},
+			Statuses: syncstatus.Nop{},
+		},
+	}
+	for _, option := range options {
+		option(s)
+	}
+	if s.concurrency < 1 {
+		s.concurrency = 1
+	}
+	return s
+}
+
+// accountSync is the outcome of syncing one of a user's accounts.
+type accountSync struct {
+	account *account
+	events  []calendar.Event
+	err     error
+}
+
+// syncAccounts syncs the given accounts of a user in parallel, with at most
+// s.concurrency of them at a time, and then stores their events at once (see
+// storeEvents). It returns WF11303 if every account that wasn't skipped
+// failed to sync and WF11304 if only some did; partial failures of an account
+// (i.e., of some of its calendars) don't count.
+func (s *syncer) syncAccounts(ctx context.Context, userID string, accounts []*account) error {
+	prefetchSecrets(accounts)
+	semaphore := make(chan struct{}, s.concurrency)
+	var wg sync.WaitGroup
+	results := make([]*accountSync, len(accounts)) // nil for skipped accounts
+	gauge := &concurrencyGauge{}
+	for i, a := range accounts {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, a *account) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			gauge.enter()
+			defer gauge.leave()
+			if s.failures != nil && s.failures.shouldSkip(userID, a.Email) {
+				return
+			}
+			ctx, cancel := context.WithTimeout(ctx, s.syncTimeout)
+			defer cancel()
+			ctx, endSubsegment := tracing.StartSubsegment(ctx, "sync "+a.kind())
+			defer endSubsegment()
+			events, err := syncAccount(ctx, s.config, userID, a)
+			results[i] = &accountSync{account: a, events: events, err: err}
+		}(i, a)
+	}
+	wg.Wait()
+	log.Debug("Synced accounts", "userID", userID, "len(accounts)", len(accounts), "peakConcurrency", gauge.peakConcurrency())
+	s.storeEvents(userID, results)
+
+	failures := []error{}
+	ran := 0
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		ran++
+		if errors.HasCode(result.err, "WF10002") {
+			// the password may have been changed (or rotated) since it was cached
+			secretBackend.InvalidateCache(result.account.Password)
+		}
+		if s.failures != nil {
+			s.failures.record(userID, result.account.Email, result.err)
+		}
+		recordSyncStatus(s.config.Statuses, userID, result.account.Email, len(result.events), result.err)
+		logNonNilError(result.err)
+		if result.err != nil && !errors.HasCode(result.err, "WF11302") {
+			failures = append(failures, result.err)
+		}
+	}
+
+	switch {
+	case len(failures) == 0:
+		return nil
+	case len(failures) == ran:
+		return errors.WF11303(userID, failures...)
+	default:
+		return errors.WF11304(userID, failures...)
+	}
+}
+
+// storeEvents stores the events of the accounts that synced (at least
+// partially) at once, since the store keeps the events of a user rather than
+// of an account. If every account synced completely, they replace the user's
+// stored events; otherwise, they're merged with them, so that the stored
+// events of the accounts that failed or were skipped (and of the calendars
+// that failed) are kept until they sync again. A store that can't merge
+// events replaces the stored ones instead, so that a failing account doesn't
+// hold back the events of the others. A failure to store the events fails all
+// of the synced accounts.
+func (s *syncer) storeEvents(userID string, results []*accountSync) {
+	synced := []*accountSync{}
+	events := []calendar.Event{}
+	complete := true
+	for _, result := range results {
+		switch {
+		case result == nil:
+			complete = false
+		case result.err == nil:
+			synced = append(synced, result)
+			events = append(events, result.events...)
+		case errors.HasCode(result.err, "WF11302"):
+			complete = false
+			synced = append(synced, result)
+			events = append(events, result.events...)
+		default:
+			complete = false
+		}
+	}
+	if len(synced) == 0 {
+		return
+	}
+
+	// the events that are gone are only known when all of them are replaced
+	var stored map[string]string
+	if complete && s.config.Sink != nil {
+		stored = s.storedEventUIDs(userID)
+	}
+
+	var err error
+	if complete {
+		err = s.config.Store.PutEvents(userID, events)
+	} else {
+		err = s.config.Store.MergeEvents(userID, events)
+	}
+	if errors.HasCode(err, "WF13006") {
+		log.Info("Replacing the stored events of a user whose accounts didn't all sync", "userID", userID)
+		err = s.config.Store.PutEvents(userID, events)
+	}
+	if err != nil {
+		for _, result := range synced {
+			result.err = err
+		}
+		return
+	}
+	if s.config.Sink != nil {
+		s.publishEvents(userID, events, stored)
+	}
+	for _, result := range synced {
+		s.config.Recorder.EventsSynced(result.account.kind(), len(result.events))
+		log.Info("Done syncing", "userID", userID, "email", result.account.Email, "len(events)", len(result.events))
+	}
+}
+
+// storedEventUIDs returns the UIDs of the user's stored events (see
+// EventStore.GetEventUIDs); nil if the store can't tell.
+func (s *syncer) storedEventUIDs(userID string) map[string]string {
+	stored, err := s.config.Store.GetEventUIDs(userID)
+	if err != nil {
+		if !errors.HasCode(err, "WF13006") {
+			log.Warn("Could not get the stored events; their deletions won't be published", "userID", userID, "err", err)
+		}
+		return nil
+	}
+	return stored
+}
+
+// publishEvents publishes the given events of the user that were just stored
+// to the sink. If the UIDs of the events that were stored before are known
+// (i.e., not nil), new events are published as Created and the ones that are
+// gone as Deleted. All other events are rewritten, so it's unknown which of
+// them changed, and they're published as Updated.
+func (s *syncer) publishEvents(userID string, events []calendar.Event, stored map[string]string) {
+	if stored == nil {
+		logNonNilError(s.config.Sink.PublishEvents(userID, events, storage.Updated))
+		return
+	}
+
+	created := []calendar.Event{}
+	updated := []calendar.Event{}
+	synced := map[string]bool{}
+	for _, event := range events {
+		synced[event.UID()] = true
+		if _, ok := stored[event.UID()]; ok {
+			updated = append(updated, event)
+		} else {
+			created = append(created, event)
+		}
+	}
+	deletedUIDs := []string{}
+	for uid := range stored {
+		if !synced[uid] {
+			deletedUIDs = append(deletedUIDs, uid)
+		}
+	}
+	sort.Strings(deletedUIDs)
+	deleted := make([]calendar.Event, len(deletedUIDs))
+	for i, uid := range deletedUIDs {
+		deleted[i] = storage.DeletedEvent(uid)
+	}
+
+	for _, change := range []struct {
+		events     []calendar.Event
+		changeType storage.ChangeType
+	}{
+		{events: created, changeType: storage.Created},
+		{events: updated, changeType: storage.Updated},
+		{events: deleted, changeType: storage.Deleted},
+	} {
+		if len(change.events) > 0 {
+			logNonNilError(s.config.Sink.PublishEvents(userID, change.events, change.changeType))
+		}
+	}
+}
+
+// prefetchSecrets retrieves the passwords of the given accounts in one batch
+// so that their clients find them in the cache. The accounts whose password
+// couldn't be retrieved will fail when their client is created.
+func prefetchSecrets(accounts []*account) {
+	if len(accounts) < 2 {
+		return
+	}
+	var secretNames []string
+	for _, a := range accounts {
+		if a.Password != "" {
+			secretNames = append(secretNames, a.Password)
+		}
+	}
+	if _, err := secretBackend.RetrieveBatch(secretNames); err != nil {
+		log.Warn("Could not prefetch account secrets", "err", err)
+	}
+}
+
+// concurrencyGauge counts the accounts of a user that are being synced at
+// once.
+type concurrencyGauge struct {
+	active int64
+	peak   int64
+}
+
+func (gauge *concurrencyGauge) enter() {
+	active := atomic.AddInt64(&gauge.active, 1)
+	for {
+		peak := atomic.LoadInt64(&gauge.peak)
+		if active <= peak || atomic.CompareAndSwapInt64(&gauge.peak, peak, active) {
+			return
+		}
+	}
+}
+
+func (gauge *concurrencyGauge) leave() {
+	atomic.AddInt64(&gauge.active, -1)
+}
+
+// peakConcurrency returns the highest number of accounts that were synced at
+// once so far.
+func (gauge *concurrencyGauge) peakConcurrency() int64 {
+	return atomic.LoadInt64(&gauge.peak)
+}
+
+// fetchEvents gets the events of the given client in the given time window,
+// giving up once the context is done. Clients that accept a context (see
+// caldav.ContextEventGetter) cancel their requests, and trace them as part of
+// the context's segment. The others can't be cancelled, so their query is
+// abandoned and keeps running until it returns; while maxAbandonedQueries
+// of them are running, such clients aren't queried at all (WF13009).
+func fetchEvents(ctx context.Context, client calendar.Client, startUTC time.Time, endUTC time.Time) ([]calendar.Event, error) {
+	if contextClient, ok := client.(caldav.ContextEventGetter); ok {
+		return contextClient.CalendarEventsContext(ctx, startUTC, endUTC)
+	}
+	if running := atomic.LoadInt64(&abandonedQueries); running >= maxAbandonedQueries {
+		return nil, errors.WF13009(running)
+	}
+
+	type result struct {
+		events []calendar.Event
+		err    error
+	}
+
+	done := make(chan *result, 1) // buffered so that an abandoned query can finish
+	var mutex sync.Mutex
+	finished, abandoned := false, false
+	go func() {
+		events, err := client.CalendarEvents(startUTC, endUTC)
+		done <- &result{events, err}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		finished = true
+		if abandoned {
+			atomic.AddInt64(&abandonedQueries, -1)
+			log.Debug("Abandoned query finished", "err", err)
+		}
+	}()
+
+	select {
+	case r := <-done:
+		return r.events, r.err
+	case <-ctx.Done():
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !finished {
+			abandoned = true
+			atomic.AddInt64(&abandonedQueries, 1)
+		}
+		return nil, ctx.Err()
+	}
+}
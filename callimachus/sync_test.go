@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/enums/status"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/metrics"
+	"github.com/Cepreu/Archive/secrets"
+	"github.com/Cepreu/Archive/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeEventStore records the events that are put and merged.
+type fakeEventStore struct {
+	storage.EventStore
+	puts     [][]calendar.Event
+	merges   [][]calendar.Event
+	err      error
+	mergeErr error
+	// uids are the UIDs of the stored events; unsupported if nil
+	uids map[string]string
+}
+
+func (store *fakeEventStore) GetEventUIDs(userID string) (map[string]string, error) {
+	if store.uids == nil {
+		return nil, errors.WF13006("GetEventUIDs", "test")
+	}
+	return store.uids, nil
+}
+
+func (store *fakeEventStore) PutEvents(userID string, events []calendar.Event) error {
+	store.puts = append(store.puts, events)
+	return store.err
+}
+
+func (store *fakeEventStore) MergeEvents(userID string, events []calendar.Event) error {
+	store.merges = append(store.merges, events)
+	if store.mergeErr != nil {
+		return store.mergeErr
+	}
+	return store.err
+}
+
+func TestStoreEventsReplacesEventsIfAllAccountsSynced(t *testing.T) {
+	store := &fakeEventStore{}
+	s := newSyncer(WithEventStore(store))
+	results := []*accountSync{
+		{account: &account{Email: "a@example.com"}, events: []calendar.Event{overrideEvent{}}},
+		{account: &account{Email: "b@example.com"}, events: []calendar.Event{overrideEvent{}, overrideEvent{}}},
+	}
+
+	s.storeEvents("user-1", results)
+
+	if len(store.puts) != 1 || len(store.puts[0]) != 3 || len(store.merges) != 0 {
+		t.Errorf("put %v and merged %v, want a single put of the events of both accounts", store.puts, store.merges)
+	}
+}
+
+func TestStoreEventsKeepsEventsOfFailedAccounts(t *testing.T) {
+	store := &fakeEventStore{}
+	s := newSyncer(WithEventStore(store))
+	results := []*accountSync{
+		{account: &account{Email: "a@example.com"}, events: []calendar.Event{overrideEvent{}}},
+		{account: &account{Email: "b@example.com"}, err: context.DeadlineExceeded},
+		{account: &account{Email: "c@example.com"}, events: []calendar.Event{overrideEvent{}, overrideEvent{}}, err: errors.WF11302(context.DeadlineExceeded)},
+		nil, // skipped
+	}
+
+	s.storeEvents("user-1", results)
+
+	if len(store.puts) != 0 || len(store.merges) != 1 || len(store.merges[0]) != 3 {
+		t.Fatalf("put %v and merged %v, want a single merge of the events of the synced accounts", store.puts, store.merges)
+	}
+	if results[0].err != nil || !errors.HasCode(results[2].err, "WF11302") {
+		t.Errorf("synced accounts have errors %v and %v, want none and WF11302", results[0].err, results[2].err)
+	}
+}
+
+func TestStoreEventsKeepsEventsOfSkippedAccounts(t *testing.T) {
+	store := &fakeEventStore{}
+	s := newSyncer(WithEventStore(store))
+	results := []*accountSync{
+		{account: &account{Email: "healthy@example.com"}, events: []calendar.Event{overrideEvent{}}},
+		nil, // skipped by the failure tracker
+	}
+
+	s.storeEvents("user-1", results)
+
+	if len(store.puts) != 0 || len(store.merges) != 1 || len(store.merges[0]) != 1 {
+		t.Errorf("put %v and merged %v, want the healthy account's events merged", store.puts, store.merges)
+	}
+}
+
+func TestStoreEventsPutsEventsIfStoreCantMerge(t *testing.T) {
+	store := &fakeEventStore{mergeErr: errors.WF13006("MergeEvents", "test")}
+	s := newSyncer(WithEventStore(store))
+	results := []*accountSync{
+		{account: &account{Email: "a@example.com"}, events: []calendar.Event{overrideEvent{}}},
+		{account: &account{Email: "b@example.com"}, err: context.DeadlineExceeded},
+	}
+
+	s.storeEvents("user-1", results)
+
+	if len(store.merges) != 1 || len(store.puts) != 1 || len(store.puts[0]) != 1 {
+		t.Errorf("merged %v and put %v, want the synced events put after the merge failed", store.merges, store.puts)
+	}
+	if results[0].err != nil {
+		t.Errorf("synced account has error %v, want none", results[0].err)
+	}
+}
+
+func TestStoreEventsKeepsEventsIfNoAccountSynced(t *testing.T) {
+	store := &fakeEventStore{}
+	s := newSyncer(WithEventStore(store))
+
+	s.storeEvents("user-1", []*accountSync{{account: &account{Email: "a@example.com"}, err: context.DeadlineExceeded}, nil})
+
+	if len(store.puts) != 0 || len(store.merges) != 0 {
+		t.Errorf("put %v and merged %v, want the stored events kept", store.puts, store.merges)
+	}
+}
+
+func TestStoreEventsFailsSyncedAccounts(t *testing.T) {
+	store := &fakeEventStore{err: context.Canceled}
+	s := newSyncer(WithEventStore(store))
+	results := []*accountSync{
+		{account: &account{Email: "a@example.com"}, events: []calendar.Event{overrideEvent{}}},
+		{account: &account{Email: "b@example.com"}, events: []calendar.Event{overrideEvent{}}},
+	}
+
+	s.storeEvents("user-1", results)
+
+	for _, result := range results {
+		if result.err != context.Canceled {
+			t.Errorf("account %s has error %v, want the store's", result.account.Email, result.err)
+		}
+	}
+}
+
+// fakeEventSink records the UIDs of the events that are published by change
+// type.
+type fakeEventSink struct {
+	published map[storage.ChangeType][]string
+}
+
+func (sink *fakeEventSink) PublishEvent(userID string, event calendar.Event, changeType storage.ChangeType) error {
+	return sink.PublishEvents(userID, []calendar.Event{event}, changeType)
+}
+
+func (sink *fakeEventSink) PublishEvents(userID string, events []calendar.Event, changeType storage.ChangeType) error {
+	for _, event := range events {
+		sink.published[changeType] = append(sink.published[changeType], event.UID())
+	}
+	return nil
+}
+
+func TestStoreEventsPublishesChanges(t *testing.T) {
+	events := []calendar.Event{statusedEvent{uid: "new"}, overrideEvent{}}
+	tests := []struct {
+		name   string
+		uids   map[string]string
+		failed bool
+		want   map[storage.ChangeType][]string
+	}{
+		{
+			name: "stored events known",
+			uids: map[string]string{"series-1": "2020-01-01T00:00:00Z", "gone": "2020-01-01T00:00:00Z", "also-gone": "2020-01-01T00:00:00Z"},
+			want: map[storage.ChangeType][]string{storage.Created: {"new"}, storage.Updated: {"series-1"}, storage.Deleted: {"also-gone", "gone"}},
+		},
+		{
+			name: "no stored events",
+			uids: map[string]string{},
+			want: map[storage.ChangeType][]string{storage.Created: {"new", "series-1"}},
+		},
+		{
+			name: "stored events unknown",
+			want: map[storage.ChangeType][]string{storage.Updated: {"new", "series-1"}},
+		},
+		{
+			name:   "events merged",
+			uids:   map[string]string{"series-1": "2020-01-01T00:00:00Z", "gone": "2020-01-01T00:00:00Z"},
+			failed: true,
+			want:   map[storage.ChangeType][]string{storage.Updated: {"new", "series-1"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := &fakeEventSink{published: map[storage.ChangeType][]string{}}
+			s := newSyncer(WithEventStore(&fakeEventStore{uids: test.uids}), WithEventSink(sink))
+			results := []*accountSync{{account: &account{Email: "a@example.com"}, events: events}}
+			if test.failed {
+				results = append(results, &accountSync{account: &account{Email: "b@example.com"}, err: context.DeadlineExceeded})
+			}
+
+			s.storeEvents("user-1", results)
+
+			if !reflect.DeepEqual(sink.published, test.want) {
+				t.Errorf("published %v, want %v", sink.published, test.want)
+			}
+		})
+	}
+}
+
+func TestStoreEventsPublishesNothingIfStoreFails(t *testing.T) {
+	sink := &fakeEventSink{published: map[storage.ChangeType][]string{}}
+	s := newSyncer(WithEventStore(&fakeEventStore{err: context.Canceled, uids: map[string]string{"gone": ""}}), WithEventSink(sink))
+
+	s.storeEvents("user-1", []*accountSync{{account: &account{Email: "a@example.com"}, events: []calendar.Event{overrideEvent{}}}})
+
+	if len(sink.published) != 0 {
+		t.Errorf("published %v, want nothing", sink.published)
+	}
+}
+
+// concurrentClient records how many of its queries run at once.
+type concurrentClient struct {
+	calendar.Client
+	gauge *concurrencyGauge
+}
+
+func (client *concurrentClient) CalendarEvents(startUTC time.Time, endUTC time.Time) ([]calendar.Event, error) {
+	client.gauge.enter()
+	defer client.gauge.leave()
+	time.Sleep(10 * time.Millisecond)
+	return []calendar.Event{}, nil
+}
+
+// withTestClient makes every account use the given client for the duration
+// of the test.
+func withTestClient(t *testing.T, client calendar.Client) {
+	savedFactories, savedBackend := factories, secretBackend
+	t.Cleanup(func() { factories, secretBackend = savedFactories, savedBackend })
+	factories = nil
+	RegisterClientFactory("Test", func(*account) bool { return true }, func(context.Context, *account) (calendar.Client, error) {
+		return client, nil
+	})
+	secretBackend = secrets.NewCachingBackend(&fakeSecretBackend{}, time.Minute)
+}
+
+func TestSyncAccountsBoundsConcurrency(t *testing.T) {
+	const concurrency = 3
+	client := &concurrentClient{gauge: &concurrencyGauge{}}
+	withTestClient(t, client)
+	s := newSyncer(WithConcurrency(concurrency), WithEventStore(&fakeEventStore{}))
+	accounts := []*account{}
+	for i := 0; i < 10; i++ {
+		accounts = append(accounts, &account{Email: fmt.Sprintf("user-%d@example.com", i), Password: fmt.Sprintf("secret-%d", i)})
+	}
+
+	if err := s.syncAccounts(context.Background(), "user-1", accounts); err != nil {
+		t.Fatal(err)
+	}
+
+	if peak := client.gauge.peakConcurrency(); peak != concurrency {
+		t.Errorf("queried %d accounts at once, want %d", peak, concurrency)
+	}
+}
+
+// failingClient fails every query.
+type failingClient struct {
+	calendar.Client
+}
+
+func (client *failingClient) CalendarEvents(startUTC time.Time, endUTC time.Time) ([]calendar.Event, error) {
+	return nil, errors.WF11301(context.DeadlineExceeded)
+}
+
+func TestSyncAccountsFailsIfEveryAccountThatRanFailed(t *testing.T) {
+	withTestClient(t, &failingClient{})
+	tracker := newFailureTracker(1, time.Hour)
+	tracker.record("user-1", "skipped@example.com", context.DeadlineExceeded)
+	s := newSyncer(WithEventStore(&fakeEventStore{}), WithFailureTracker(tracker))
+	accounts := []*account{{Email: "skipped@example.com"}, {Email: "failing@example.com"}}
+
+	if err := s.syncAccounts(context.Background(), "user-1", accounts); !errors.HasCode(err, "WF11303") {
+		t.Errorf("syncAccounts() = %v, want WF11303", err)
+	}
+}
+
+// windowClient records the window of the events that are queried.
+type windowClient struct {
+	calendar.Client
+	startUTC time.Time
+	endUTC   time.Time
+}
+
+func (client *windowClient) CalendarEvents(startUTC time.Time, endUTC time.Time) ([]calendar.Event, error) {
+	client.startUTC, client.endUTC = startUTC, endUTC
+	return []calendar.Event{}, nil
+}
+
+func TestSyncAccountQueriesSyncWindow(t *testing.T) {
+	client := &windowClient{}
+	withTestClient(t, client)
+	savedPast, savedFuture := syncWindowPastDays, syncWindowFutureDays
+	defer func() { syncWindowPastDays, syncWindowFutureDays = savedPast, savedFuture }()
+
+	tests := []struct {
+		pastDays   int
+		futureDays int
+	}{
+		{pastDays: 30, futureDays: 15},
+		{pastDays: 0, futureDays: 1},
+	}
+	for _, test := range tests {
+		syncWindowPastDays, syncWindowFutureDays = test.pastDays, test.futureDays
+		before := time.Now().UTC()
+		if _, err := syncAccount(context.Background(), &SyncConfig{Recorder: metrics.Nop{}}, "user-1", &account{Email: "a@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		after := time.Now().UTC()
+
+		if client.startUTC.Before(before.AddDate(0, 0, -test.pastDays)) || client.startUTC.After(after.AddDate(0, 0, -test.pastDays)) {
+			t.Errorf("queried from %v with %d past days, want %d days before %v", client.startUTC, test.pastDays, test.pastDays, before)
+		}
+		if client.endUTC.Before(before.AddDate(0, 0, test.futureDays)) || client.endUTC.After(after.AddDate(0, 0, test.futureDays)) {
+			t.Errorf("queried until %v with %d future days, want %d days after %v", client.endUTC, test.futureDays, test.futureDays, before)
+		}
+		if client.startUTC.Location() != time.UTC || client.endUTC.Location() != time.UTC {
+			t.Errorf("queried from %v until %v, want UTC", client.startUTC, client.endUTC)
+		}
+	}
+}
+
+// eventsClient returns the given events.
+type eventsClient struct {
+	calendar.Client
+	events []calendar.Event
+}
+
+func (client *eventsClient) CalendarEvents(startUTC time.Time, endUTC time.Time) ([]calendar.Event, error) {
+	return client.events, nil
+}
+
+func TestSyncAccountKeepsCancelledEvents(t *testing.T) {
+	withTestClient(t, &eventsClient{events: []calendar.Event{
+		statusedEvent{uid: "confirmed", status: status.Confirmed},
+		statusedEvent{uid: "tentative", status: status.Tentative},
+		statusedEvent{uid: "cancelled", status: status.Cancelled},
+		overrideEvent{},
+	}})
+
+	tests := []struct {
+		keepCancelled bool
+		want          map[string]status.Status
+	}{
+		{
+			keepCancelled: false,
+			want:          map[string]status.Status{"confirmed": status.Confirmed, "tentative": status.Tentative, "series-1": status.Unknown},
+		},
+		{
+			keepCancelled: true,
+			want:          map[string]status.Status{"confirmed": status.Confirmed, "tentative": status.Tentative, "cancelled": status.Cancelled, "series-1": status.Unknown},
+		},
+	}
+	for _, test := range tests {
+		config := &SyncConfig{Recorder: metrics.Nop{}, KeepCancelled: test.keepCancelled}
+		events, err := syncAccount(context.Background(), config, "user-1", &account{Email: "a@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := map[string]status.Status{}
+		for _, event := range events {
+			got[event.UID()] = event.(statusEvent).Status()
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("synced %v with KeepCancelled = %v, want %v", got, test.keepCancelled, test.want)
+		}
+	}
+}
+
+// gatheredValue returns the value of the given counter, or the number of
+// observations of the given histogram, with the given account type (if any).
+func gatheredValue(t *testing.T, registry *prometheus.Registry, name string, accountType string) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "account_type" && label.GetValue() != accountType {
+					metric = nil
+					break
+				}
+			}
+			switch {
+			case metric == nil:
+			case metric.GetCounter() != nil:
+				return metric.GetCounter().GetValue()
+			case metric.GetHistogram() != nil:
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+func TestSyncAccountsRecordsMetrics(t *testing.T) {
+	withTestClient(t, &eventsClient{events: []calendar.Event{
+		statusedEvent{uid: "confirmed", status: status.Confirmed},
+		statusedEvent{uid: "tentative", status: status.Tentative},
+		statusedEvent{uid: "cancelled", status: status.Cancelled},
+	}})
+	registry := prometheus.NewRegistry()
+	s := newSyncer(WithMetrics(metrics.NewRecorder(registry)), WithEventStore(&fakeEventStore{}))
+	accounts := []*account{{Email: "a@example.com"}, {Email: "b@example.com"}}
+
+	if err := s.syncAccounts(context.Background(), "user-1", accounts); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		accountType string
+		want        float64
+	}{
+		{name: "calendar_events_fetched_total", want: 6},
+		// cancelled events are fetched, but not stored
+		{name: "events_synced_total", accountType: "Test", want: 4},
+		{name: "events_synced_total", accountType: "Exchange", want: 0},
+		{name: "sync_duration_seconds", accountType: "Test", want: 2},
+		{name: "messages_received_total", want: 0},
+	}
+	for _, test := range tests {
+		if got := gatheredValue(t, registry, test.name, test.accountType); got != test.want {
+			t.Errorf("%s{account_type=%q} = %v, want %v", test.name, test.accountType, got, test.want)
+		}
+	}
+}
+
+// blockingClient doesn't accept a context; its queries block until release
+// is closed.
+type blockingClient struct {
+	calendar.Client
+	release chan struct{}
+}
+
+func (client *blockingClient) CalendarEvents(startUTC time.Time, endUTC time.Time) ([]calendar.Event, error) {
+	<-client.release
+	return []calendar.Event{}, nil
+}
+
+// cancellableClient accepts a context; its queries block until it's done.
+type cancellableClient struct {
+	calendar.Client
+}
+
+func (client *cancellableClient) CalendarEventsContext(ctx context.Context, startUTC time.Time, endUTC time.Time) ([]calendar.Event, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestFetchEventsAbandonsQueryAtDeadline(t *testing.T) {
+	client := &blockingClient{release: make(chan struct{})}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := fetchEvents(ctx, client, time.Time{}, time.Time{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("fetchEvents() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if running := atomic.LoadInt64(&abandonedQueries); running != 1 {
+		t.Errorf("abandonedQueries = %d, want 1", running)
+	}
+
+	close(client.release)
+	waitForAbandonedQueries(t)
+}
+
+// waitForAbandonedQueries waits for the abandoned queries to finish.
+func waitForAbandonedQueries(t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&abandonedQueries) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if running := atomic.LoadInt64(&abandonedQueries); running != 0 {
+		t.Errorf("abandonedQueries = %d after the queries finished, want 0", running)
+	}
+}
+
+func TestFetchEventsCancelsContextClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := fetchEvents(ctx, &cancellableClient{}, time.Time{}, time.Time{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("fetchEvents() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if running := atomic.LoadInt64(&abandonedQueries); running != 0 {
+		t.Errorf("abandonedQueries = %d, want 0", running)
+	}
+}
+
+func TestFetchEventsRefusesWhileTooManyQueriesAreAbandoned(t *testing.T) {
+	atomic.AddInt64(&abandonedQueries, maxAbandonedQueries)
+	defer atomic.AddInt64(&abandonedQueries, -maxAbandonedQueries)
+
+	client := &blockingClient{release: make(chan struct{})}
+	if _, err := fetchEvents(context.Background(), client, time.Time{}, time.Time{}); !errors.HasCode(err, "WF13009") {
+		t.Errorf("fetchEvents() error = %v, want WF13009", err)
+	}
+}
+
+func TestSyncAccountTimesOut(t *testing.T) {
+	client := &blockingClient{release: make(chan struct{})}
+	withTestClient(t, client)
+	defer func() {
+		close(client.release)
+		waitForAbandonedQueries(t)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := syncAccount(ctx, &SyncConfig{Recorder: metrics.Nop{}}, "user-1", &account{Email: "a@example.com"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("syncAccount() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("syncAccount() returned after %v, want right after the deadline", elapsed)
+	}
+}
+
+func TestSyncWindow(t *testing.T) {
+	savedPast, savedFuture := syncWindowPastDays, syncWindowFutureDays
+	defer func() { syncWindowPastDays, syncWindowFutureDays = savedPast, savedFuture }()
+	syncWindowPastDays, syncWindowFutureDays = 30, 15
+
+	now := time.Date(2020, 3, 2, 1, 30, 0, 0, time.FixedZone("PST", -8*3600)) // 09:30 UTC
+	startUTC, endUTC := syncWindow(now)
+	wantStart, wantEnd := time.Date(2020, 2, 1, 9, 30, 0, 0, time.UTC), time.Date(2020, 3, 17, 9, 30, 0, 0, time.UTC)
+	if !startUTC.Equal(wantStart) || !endUTC.Equal(wantEnd) || startUTC.Location() != time.UTC || endUTC.Location() != time.UTC {
+		t.Errorf("syncWindow(%v) = %v, %v, want %v, %v", now, startUTC, endUTC, wantStart, wantEnd)
+	}
+}
+
+func TestSyncWindowWithEventCache(t *testing.T) {
+	savedPast, savedFuture, savedCache := syncWindowPastDays, syncWindowFutureDays, eventCache
+	defer func() { syncWindowPastDays, syncWindowFutureDays, eventCache = savedPast, savedFuture, savedCache }()
+	syncWindowPastDays, syncWindowFutureDays, eventCache = 30, 15, newEventCache(10)
+
+	morning := time.Date(2020, 3, 2, 1, 30, 0, 0, time.FixedZone("PST", -8*3600)) // 09:30 UTC
+	evening := time.Date(2020, 3, 2, 23, 59, 59, 0, time.UTC)
+	wantStart, wantEnd := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 3, 18, 0, 0, 0, 0, time.UTC)
+	for _, now := range []time.Time{morning, evening} {
+		startUTC, endUTC := syncWindow(now)
+		if !startUTC.Equal(wantStart) || !endUTC.Equal(wantEnd) || startUTC.Location() != time.UTC || endUTC.Location() != time.UTC {
+			t.Errorf("syncWindow(%v) = %v, %v, want %v, %v", now, startUTC, endUTC, wantStart, wantEnd)
+		}
+	}
+}
+
+// fakeSecretBackend returns a value for every secret.
+type fakeSecretBackend struct{}
+
+func (fakeSecretBackend) RetrieveUserSecret(secretName string) (string, error) {
+	return "value of " + secretName, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Cepreu/Archive/caldav"
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/enums/status"
+)
+
+var (
+	// htmlTag matches HTML tags and comments; it's no parser, but good enough
+	// for the markup of event descriptions
+	htmlTag = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]*>`)
+)
+
+// EventTransformer transforms an event before it's persisted; it returns nil
+// to omit the event altogether.
+type EventTransformer func(event calendar.Event) calendar.Event
+
+// transformEvents applies the given transformer to the events, dropping the
+// ones it omits.
+func transformEvents(events []calendar.Event, transform EventTransformer) []calendar.Event {
+	transformed := make([]calendar.Event, 0, len(events))
+	for _, event := range events {
+		if event = transform(event); event != nil {
+			transformed = append(transformed, event)
+		}
+	}
+	return transformed
+}
+
+// applyTransformers applies the given transformers to the events in order,
+// dropping the ones that any of them omits.
+func applyTransformers(events []calendar.Event, transformers ...EventTransformer) []calendar.Event {
+	for _, transform := range transformers {
+		events = transformEvents(events, transform)
+	}
+	return events
+}
+
+// statusEvent is implemented by events that expose their status; it's meant
+// to be folded into calendar.Event once all calendar clients implement it.
+type statusEvent interface {
+	Status() status.Status
+}
+
+// omitCancelled is a transformer that omits cancelled events so that users
+// don't see meetings that won't take place.
+func omitCancelled(event calendar.Event) calendar.Event {
+	if e, ok := event.(statusEvent); ok && e.Status() == status.Cancelled {
+		return nil
+	}
+	return event
+}
+
+// NormalizeTimeZonesTransformer creates a transformer that converts the start
+// and end of events to UTC.
+func NormalizeTimeZonesTransformer() EventTransformer {
+	return func(event calendar.Event) calendar.Event {
+		return &utcEvent{wrappedEvent{event}}
+	}
+}
+
+// utcEvent is an event whose start and end are in UTC.
+type utcEvent struct {
+	wrappedEvent
+}
+
+func (event *utcEvent) Start() time.Time {
+	return event.Event.Start().UTC()
+}
+
+func (event *utcEvent) End() time.Time {
+	return event.Event.End().UTC()
+}
+
+// StripHTMLTransformer creates a transformer that strips the HTML tags from
+// the description of events and unescapes its entities (e.g., &amp;).
+func StripHTMLTransformer() EventTransformer {
+	return func(event calendar.Event) calendar.Event {
+		return &describedEvent{wrappedEvent: wrappedEvent{event}, description: html.UnescapeString(htmlTag.ReplaceAllString(event.Description(), ""))}
+	}
+}
+
+// TruncateDescriptionTransformer creates a transformer that truncates the
+// description of events to the given number of characters.
+func TruncateDescriptionTransformer(maxLen int) EventTransformer {
+	if maxLen < 0 {
+		maxLen = 0
+	}
+	return func(event calendar.Event) calendar.Event {
+		description := event.Description()
+		if utf8.RuneCountInString(description) <= maxLen {
+			return event
+		}
+		return &describedEvent{wrappedEvent: wrappedEvent{event}, description: string([]rune(description)[:maxLen])}
+	}
+}
+
+// describedEvent replaces the description of the event that it wraps.
+type describedEvent struct {
+	wrappedEvent
+	description string
+}
+
+func (event *describedEvent) Description() string {
+	return event.description
+}
+
+// wrappedEvent is embedded by the events that transformers wrap so that they
+// keep exposing the methods that calendar.Event doesn't declare but the
+// store relies on (to discard stale revisions, to key overrides, and to mark
+// cancelled events).
+type wrappedEvent struct {
+	calendar.Event
+}
+
+// Sequence returns the sequence of the wrapped event; zero if it isn't
+// sequenced.
+func (event wrappedEvent) Sequence() int {
+	if sequenced, ok := event.Event.(caldav.SequencedEvent); ok {
+		return sequenced.Sequence()
+	}
+	return 0
+}
+
+// SeriesMasterID returns the series ID of the wrapped event; empty if it
+// isn't recurring.
+func (event wrappedEvent) SeriesMasterID() string {
+	if recurring, ok := event.Event.(caldav.RecurringEvent); ok {
+		return recurring.SeriesMasterID()
+	}
+	return ""
+}
+
+// RecurrenceRule returns the RRULE of the wrapped event; empty if it has
+// none.
+func (event wrappedEvent) RecurrenceRule() string {
+	if recurring, ok := event.Event.(caldav.RecurringEvent); ok {
+		return recurring.RecurrenceRule()
+	}
+	return ""
+}
+
+// Status returns the status of the wrapped event; Unknown if it doesn't
+// expose one.
+func (event wrappedEvent) Status() status.Status {
+	if e, ok := event.Event.(statusEvent); ok {
+		return e.Status()
+	}
+	return status.Unknown
+}
+
+// OriginalStart returns the start of the instance that the wrapped event
+// overrides; zero if it isn't an override.
+func (event wrappedEvent) OriginalStart() time.Time {
+	if recurring, ok := event.Event.(caldav.RecurringEvent); ok {
+		return recurring.OriginalStart()
+	}
+	return time.Time{}
+}
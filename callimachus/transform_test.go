@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Cepreu/Archive/caldav"
+	"github.com/WF/go/calendar"
+	"github.com/WF/go/enums/sensitivity"
+	"github.com/Cepreu/Archive/enums/status"
+)
+
+// overrideEvent is a private override of a recurring event in its third
+// revision.
+type overrideEvent struct {
+	calendar.Event
+}
+
+func (overrideEvent) UID() string         { return "series-1" }
+func (overrideEvent) Description() string { return "<b>Agenda</b>" }
+func (overrideEvent) Start() time.Time {
+	return time.Date(2020, 1, 9, 11, 0, 0, 0, time.FixedZone("CET", 3600))
+}
+func (overrideEvent) End() time.Time {
+	return time.Date(2020, 1, 9, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+}
+func (overrideEvent) Sensitivity() sensitivity.Sensitivity { return sensitivity.Private }
+func (overrideEvent) Sequence() int                        { return 3 }
+func (overrideEvent) SeriesMasterID() string               { return "series-1" }
+func (overrideEvent) RecurrenceRule() string               { return "" }
+func (overrideEvent) OriginalStart() time.Time             { return time.Date(2020, 1, 9, 10, 0, 0, 0, time.UTC) }
+
+func TestTransformersKeepSequenceAndRecurrence(t *testing.T) {
+	transformers := []EventTransformer{
+		NormalizeTimeZonesTransformer(),
+		StripHTMLTransformer(),
+		TruncateDescriptionTransformer(3),
+		NewPrivacyFilter(StripAll),
+	}
+	events := applyTransformers([]calendar.Event{overrideEvent{}}, transformers...)
+	if len(events) != 1 {
+		t.Fatalf("applyTransformers returned %d events, want 1", len(events))
+	}
+
+	sequenced, ok := events[0].(caldav.SequencedEvent)
+	if !ok || sequenced.Sequence() != 3 {
+		t.Errorf("transformed event isn't sequenced or has the wrong sequence: %#v", events[0])
+	}
+	recurring, ok := events[0].(caldav.RecurringEvent)
+	if !ok || !recurring.OriginalStart().Equal(time.Date(2020, 1, 9, 10, 0, 0, 0, time.UTC)) || recurring.SeriesMasterID() != "series-1" {
+		t.Errorf("transformed event lost its recurrence: %#v", events[0])
+	}
+}
+
+func TestWrappedEventOfPlainEvent(t *testing.T) {
+	event := wrappedEvent{}
+	if event.Sequence() != 0 || !event.OriginalStart().IsZero() || event.SeriesMasterID() != "" || event.RecurrenceRule() != "" {
+		t.Errorf("wrappedEvent of a plain event = %d, %v, %q, %q, want zero values", event.Sequence(), event.OriginalStart(), event.SeriesMasterID(), event.RecurrenceRule())
+	}
+}
+
+// statusedEvent is an override with the given UID and status.
+type statusedEvent struct {
+	overrideEvent
+	uid    string
+	status status.Status
+}
+
+func (event statusedEvent) UID() string           { return event.uid }
+func (event statusedEvent) Status() status.Status { return event.status }
+
+func TestTransformersKeepStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		event calendar.Event
+		want  status.Status
+	}{
+		{name: "confirmed", event: statusedEvent{uid: "a", status: status.Confirmed}, want: status.Confirmed},
+		{name: "tentative", event: statusedEvent{uid: "a", status: status.Tentative}, want: status.Tentative},
+		{name: "cancelled", event: statusedEvent{uid: "a", status: status.Cancelled}, want: status.Cancelled},
+		{name: "without status", event: overrideEvent{}, want: status.Unknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := applyTransformers([]calendar.Event{test.event},
+				NormalizeTimeZonesTransformer(),
+				StripHTMLTransformer(),
+				TruncateDescriptionTransformer(3),
+				NewPrivacyFilter(StripAll),
+			)
+			if len(events) != 1 {
+				t.Fatalf("applyTransformers returned %d events, want 1", len(events))
+			}
+			e, ok := events[0].(statusEvent)
+			if !ok {
+				t.Fatalf("transformed event doesn't expose its status: %#v", events[0])
+			}
+			if got := e.Status(); got != test.want {
+				t.Errorf("Status() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStripHTMLTransformer(t *testing.T) {
+	tests := []struct {
+		description string
+		want        string
+	}{
+		{description: "Agenda", want: "Agenda"},
+		{description: "<p>The <b>agenda</b></p>", want: "The agenda"},
+		{description: "<a href=\"https://example.com/?a=1&amp;b=2\">Link</a>", want: "Link"},
+		{description: "Q&amp;A &lt;draft&gt;", want: "Q&A <draft>"},
+		{description: "Before<!-- a <b>comment</b>\nover lines -->after", want: "Beforeafter"},
+		{description: "<div\nclass=\"x\">Multi-line tag</div>", want: "Multi-line tag"},
+		{description: "", want: ""},
+	}
+	for _, test := range tests {
+		got := StripHTMLTransformer()(&testEvent{description: test.description}).Description()
+		if got != test.want {
+			t.Errorf("Description() of %q = %q, want %q", test.description, got, test.want)
+		}
+	}
+}
+
+func TestTruncateDescriptionTransformer(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxLen      int
+		description string
+		want        string
+	}{
+		{name: "shorter", maxLen: 10, description: "Agenda", want: "Agenda"},
+		{name: "exact", maxLen: 6, description: "Agenda", want: "Agenda"},
+		{name: "longer", maxLen: 3, description: "Agenda", want: "Age"},
+		{name: "accented", maxLen: 5, description: "héllo wörld", want: "héllo"},
+		{name: "accented within the limit", maxLen: 11, description: "héllo wörld", want: "héllo wörld"},
+		{name: "cjk", maxLen: 2, description: "会議の議題", want: "会議"},
+		{name: "emoji", maxLen: 1, description: "🎉🎂", want: "🎉"},
+		{name: "zero", maxLen: 0, description: "Agenda", want: ""},
+		{name: "negative", maxLen: -1, description: "Agenda", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := &testEvent{description: test.description}
+			transformed := TruncateDescriptionTransformer(test.maxLen)(event)
+			if got := transformed.Description(); got != test.want {
+				t.Errorf("Description() = %q, want %q", got, test.want)
+			}
+			if !utf8.ValidString(transformed.Description()) {
+				t.Errorf("Description() = %q isn't valid UTF-8", transformed.Description())
+			}
+			// descriptions within the limit are kept as is
+			if test.description == test.want && transformed != calendar.Event(event) {
+				t.Errorf("event within the limit was wrapped: %#v", transformed)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+// Package circuitbreaker stops sending requests to a backend that keeps
+// failing (e.g., a CalDAV server that's down) for a while, so that syncs
+// fail fast instead of tying up goroutines on it.
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of sending a request while the circuit
+// of its host is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// State is the state of a circuit breaker.
+type State int
+
+const (
+	// Closed lets all requests through.
+	Closed State = iota
+	// Open rejects all requests until the open duration has passed.
+	Open
+	// HalfOpen lets a single (probe) request through; its outcome closes or
+	// reopens the circuit.
+	HalfOpen
+)
+
+func (state State) String() string {
+	switch state {
+	case Closed:
+		return "Closed"
+	case Open:
+		return "Open"
+	case HalfOpen:
+		return "HalfOpen"
+	default:
+		return "Unknown"
+	}
+}
+
+// Breaker is a circuit breaker that opens after a number of consecutive
+// failures and half-opens once it's been open for a while.
+type Breaker struct {
+	threshold    int
+	openDuration time.Duration
+
+	mutex    sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	// probing is set while the probe request of a half-open circuit is in
+	// flight
+	probing bool
+	now     func() time.Time `test-hook:"verify-unexported"`
+}
+
+// NewBreaker creates a closed circuit breaker that opens after the given
+// number of consecutive failures and stays open for the given duration.
+func NewBreaker(threshold int, openDuration time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, openDuration: openDuration, now: time.Now}
+}
+
+// State returns the current state of the breaker.
+func (breaker *Breaker) State() State {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.halfOpenIfDue()
+	return breaker.state
+}
+
+// Allow determines whether a request may be sent. Every allowed request must
+// be followed by a call to Success or Failure.
+func (breaker *Breaker) Allow() bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.halfOpenIfDue()
+	switch breaker.state {
+	case Open:
+		return false
+	case HalfOpen:
+		if breaker.probing {
+			return false
+		}
+		breaker.probing = true
+	}
+	return true
+}
+
+// Success records a successful request, which closes the circuit.
+func (breaker *Breaker) Success() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.state = Closed
+	breaker.failures = 0
+	breaker.probing = false
+}
+
+// Failure records a failed request, which opens the circuit if it's the
+// threshold-th consecutive one or if it was the probe of a half-open circuit.
+func (breaker *Breaker) Failure() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.failures++
+	if breaker.state == HalfOpen || breaker.failures >= breaker.threshold {
+		breaker.state = Open
+		breaker.openedAt = breaker.now()
+		breaker.probing = false
+	}
+}
+
+// abandon records that an allowed request was abandoned without an outcome.
+func (breaker *Breaker) abandon() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.probing = false
+}
+
+// halfOpenIfDue half-opens the circuit once it's been open for the open
+// duration. The mutex must be held.
+func (breaker *Breaker) halfOpenIfDue() {
+	if breaker.state == Open && breaker.now().Sub(breaker.openedAt) >= breaker.openDuration {
+		breaker.state = HalfOpen
+	}
+}
+
+type contextKey int
+
+const (
+	retriedKey contextKey = iota
+)
+
+// WithRetry returns a copy of the given context for a request whose
+// unavailable (503) response is going to be retried; such a response doesn't
+// count as a failure, only the outcome of the last attempt does.
+func WithRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retriedKey, true)
+}
+
+// roundTripper keeps a breaker per host.
+type roundTripper struct {
+	innerRoundTripper http.RoundTripper
+	threshold         int
+	openDuration      time.Duration
+	// breakers maps hosts to *Breaker
+	breakers sync.Map
+}
+
+// NewRoundTripper wraps the given round tripper with a circuit breaker per
+// host that opens after the given number of consecutive failures (i.e.,
+// transport errors and 5xx responses) and stays open for the given duration,
+// during which ErrCircuitOpen is returned. Requests abandoned by their
+// context aren't failures of the host, and neither are responses that are
+// retried (see WithRetry).
+func NewRoundTripper(inner http.RoundTripper, threshold int, openDuration time.Duration) http.RoundTripper {
+	return &roundTripper{innerRoundTripper: inner, threshold: threshold, openDuration: openDuration}
+}
+
+func (transport *roundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	breaker := transport.breaker(request.URL.Host)
+	if !breaker.Allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	response, err := transport.innerRoundTripper.RoundTrip(request)
+	switch {
+	case err != nil && request.Context().Err() != nil,
+		err == nil && response.StatusCode == http.StatusServiceUnavailable && request.Context().Value(retriedKey) != nil:
+		// neither a success nor a failure, but a half-open circuit needs a
+		// new probe
+		breaker.abandon()
+	case err != nil || response.StatusCode >= http.StatusInternalServerError:
+		breaker.Failure()
+	default:
+		breaker.Success()
+	}
+	return response, err
+}
+
+func (transport *roundTripper) breaker(host string) *Breaker {
+	if breaker, ok := transport.breakers.Load(host); ok {
+		return breaker.(*Breaker)
+	}
+	breaker, _ := transport.breakers.LoadOrStore(host, NewBreaker(transport.threshold, transport.openDuration))
+	return breaker.(*Breaker)
+}
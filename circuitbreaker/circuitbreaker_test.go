@@ -0,0 +1,171 @@
+package circuitbreaker
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestBreaker returns a breaker whose clock is advanced by the returned
+// function.
+func newTestBreaker(threshold int, openDuration time.Duration) (*Breaker, func(time.Duration)) {
+	now := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	breaker := NewBreaker(threshold, openDuration)
+	breaker.now = func() time.Time { return now }
+	return breaker, func(d time.Duration) { now = now.Add(d) }
+}
+
+// fail sends the given number of failed requests.
+func fail(t *testing.T, breaker *Breaker, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if !breaker.Allow() {
+			t.Fatalf("request %d isn't allowed", i)
+		}
+		breaker.Failure()
+	}
+}
+
+func TestBreakerOpensAtThreshold(t *testing.T) {
+	breaker, _ := newTestBreaker(3, time.Minute)
+
+	fail(t, breaker, 2)
+	if state := breaker.State(); state != Closed {
+		t.Fatalf("state after 2 failures = %v, want %v", state, Closed)
+	}
+	fail(t, breaker, 1)
+	if state := breaker.State(); state != Open {
+		t.Fatalf("state after 3 failures = %v, want %v", state, Open)
+	}
+	if breaker.Allow() {
+		t.Error("open breaker allows a request")
+	}
+}
+
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	breaker, _ := newTestBreaker(3, time.Minute)
+
+	fail(t, breaker, 2)
+	breaker.Allow()
+	breaker.Success()
+	fail(t, breaker, 2)
+
+	if state := breaker.State(); state != Closed {
+		t.Errorf("state after 2, a success, and 2 failures = %v, want %v", state, Closed)
+	}
+}
+
+func TestBreakerHalfOpensAfterOpenDuration(t *testing.T) {
+	breaker, advance := newTestBreaker(1, time.Minute)
+	fail(t, breaker, 1)
+
+	advance(time.Minute - time.Second)
+	if state := breaker.State(); state != Open {
+		t.Fatalf("state before the open duration = %v, want %v", state, Open)
+	}
+	advance(time.Second)
+	if state := breaker.State(); state != HalfOpen {
+		t.Fatalf("state after the open duration = %v, want %v", state, HalfOpen)
+	}
+}
+
+func TestBreakerSuccessfulProbeCloses(t *testing.T) {
+	breaker, advance := newTestBreaker(1, time.Minute)
+	fail(t, breaker, 1)
+	advance(time.Minute)
+
+	if !breaker.Allow() {
+		t.Fatal("half-open breaker doesn't allow a probe")
+	}
+	breaker.Success()
+
+	if state := breaker.State(); state != Closed {
+		t.Errorf("state after a successful probe = %v, want %v", state, Closed)
+	}
+	if !breaker.Allow() || !breaker.Allow() {
+		t.Error("closed breaker doesn't allow requests")
+	}
+}
+
+func TestBreakerFailedProbeReopens(t *testing.T) {
+	breaker, advance := newTestBreaker(3, time.Minute)
+	fail(t, breaker, 3)
+	advance(time.Minute)
+
+	fail(t, breaker, 1)
+
+	if state := breaker.State(); state != Open {
+		t.Fatalf("state after a failed probe = %v, want %v", state, Open)
+	}
+	advance(time.Minute - time.Second)
+	if breaker.Allow() {
+		t.Error("reopened breaker allows a request before the open duration")
+	}
+}
+
+func TestBreakerRejectsRequestsDuringProbe(t *testing.T) {
+	breaker, advance := newTestBreaker(1, time.Minute)
+	fail(t, breaker, 1)
+	advance(time.Minute)
+
+	if !breaker.Allow() {
+		t.Fatal("half-open breaker doesn't allow a probe")
+	}
+	if breaker.Allow() {
+		t.Error("half-open breaker allows a second request during the probe")
+	}
+	breaker.abandon()
+	if !breaker.Allow() {
+		t.Error("half-open breaker doesn't allow a new probe after the first was abandoned")
+	}
+}
+
+// statusRoundTripper answers every request with the given status.
+type statusRoundTripper int
+
+func (status statusRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: int(status), Body: http.NoBody, Request: request}, nil
+}
+
+func send(ctx context.Context, t *testing.T, transport http.RoundTripper, host string) error {
+	t.Helper()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = transport.RoundTrip(request)
+	return err
+}
+
+func TestRoundTripperKeepsHostsApart(t *testing.T) {
+	transport := NewRoundTripper(statusRoundTripper(http.StatusInternalServerError), 2, time.Minute)
+	for i := 0; i < 2; i++ {
+		send(context.Background(), t, transport, "caldav.example.com")
+	}
+
+	if err := send(context.Background(), t, transport, "caldav.example.com"); err != ErrCircuitOpen {
+		t.Errorf("request to the failing host = %v, want %v", err, ErrCircuitOpen)
+	}
+	if err := send(context.Background(), t, transport, "caldav.example.org"); err != nil {
+		t.Errorf("request to another host = %v, want nil", err)
+	}
+}
+
+func TestRoundTripperIgnoresRetriedResponses(t *testing.T) {
+	transport := NewRoundTripper(statusRoundTripper(http.StatusServiceUnavailable), 2, time.Minute)
+	retried := WithRetry(context.Background())
+	for i := 0; i < 5; i++ {
+		if err := send(retried, t, transport, "caldav.example.com"); err != nil {
+			t.Fatalf("retried request %d = %v, want nil", i, err)
+		}
+	}
+
+	// the last attempts count
+	for i := 0; i < 2; i++ {
+		send(context.Background(), t, transport, "caldav.example.com")
+	}
+	if err := send(context.Background(), t, transport, "caldav.example.com"); err != ErrCircuitOpen {
+		t.Errorf("request after the last attempts failed = %v, want %v", err, ErrCircuitOpen)
+	}
+}
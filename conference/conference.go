@@ -0,0 +1,21 @@
+// Package conference recognizes the join links of online meetings (e.g.,
+// Zoom, Google Meet and Microsoft Teams) in free text, so that every calendar
+// backend finds them the same way.
+package conference
+
+import (
+	"regexp"
+	"strings"
+)
+
+// meetingURLPattern matches the join links of the supported services,
+// including those on vanity subdomains (e.g., us02web.zoom.us/j/...).
+var meetingURLPattern = regexp.MustCompile(`(?i)https?://(?:[a-z0-9-]+\.)*(?:zoom\.us/j/|meet\.google\.com/|teams\.microsoft\.com/l/meetup-join/)[^\s<>"']+`)
+
+// FindURL returns the first meeting link in the given text (e.g., an event's
+// location or description); empty if none.
+func FindURL(text string) string {
+	url := meetingURLPattern.FindString(text)
+	// links in prose are often followed by punctuation
+	return strings.TrimRight(url, ".,;:!?)]}")
+}
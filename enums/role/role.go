@@ -0,0 +1,36 @@
+// Package role enumerates the roles of meeting attendees.
+package role
+
+// Role is the participation role of an attendee (see RFC 5545 section
+// 3.2.16).
+type Role int
+
+const (
+	// Unknown means that the role couldn't be determined.
+	Unknown Role = iota
+	// Required is the role of attendees whose participation is required
+	// (and the default when none is specified).
+	Required
+	// Optional is the role of attendees whose participation is optional.
+	Optional
+	// NonParticipant is the role of attendees who are copied for
+	// information purposes only.
+	NonParticipant
+	// Chair is the role of the attendee who chairs the meeting.
+	Chair
+)
+
+func (r Role) String() string {
+	switch r {
+	case Required:
+		return "Required"
+	case Optional:
+		return "Optional"
+	case NonParticipant:
+		return "NonParticipant"
+	case Chair:
+		return "Chair"
+	default:
+		return "Unknown"
+	}
+}
@@ -0,0 +1,94 @@
+// Package showas enumerates how events show on their attendees' free/busy
+// schedules.
+package showas
+
+import (
+	"strings"
+)
+
+// ShowAs is how an event shows on a free/busy schedule.
+type ShowAs int
+
+const (
+	// Unknown means that the free/busy status couldn't be determined.
+	Unknown ShowAs = iota
+	// Free is the status of events that don't block time.
+	Free
+	// Tentative is the status of events that may block time.
+	Tentative
+	// Busy is the status of events that block time.
+	Busy
+	// OutOfOffice is the status of events during which the attendee is away.
+	OutOfOffice
+	// WorkingElsewhere is the status of events during which the attendee
+	// works from another location.
+	WorkingElsewhere
+)
+
+func (s ShowAs) String() string {
+	switch s {
+	case Free:
+		return "Free"
+	case Tentative:
+		return "Tentative"
+	case Busy:
+		return "Busy"
+	case OutOfOffice:
+		return "OutOfOffice"
+	case WorkingElsewhere:
+		return "WorkingElsewhere"
+	default:
+		return "Unknown"
+	}
+}
+
+// IsBusy determines whether the status blocks time.
+func (s ShowAs) IsBusy() bool {
+	return s == Busy || s == OutOfOffice
+}
+
+// FromTransp maps the value of an iCalendar TRANSP property (see RFC 5545
+// section 3.8.2.7): OPAQUE (the default when it's missing) is Busy and
+// TRANSPARENT is Free.
+func FromTransp(transp string) ShowAs {
+	switch strings.ToUpper(strings.TrimSpace(transp)) {
+	case "", "OPAQUE":
+		return Busy
+	case "TRANSPARENT":
+		return Free
+	default:
+		return Unknown
+	}
+}
+
+// FromGoogleTransparency maps the transparency of a Google Calendar event:
+// opaque (the default when it's missing) is Busy and transparent is Free.
+func FromGoogleTransparency(transparency string) ShowAs {
+	switch transparency {
+	case "", "opaque":
+		return Busy
+	case "transparent":
+		return Free
+	default:
+		return Unknown
+	}
+}
+
+// FromLegacyFreeBusy maps the value of an Exchange LegacyFreeBusyStatus
+// (e.g., "OOF").
+func FromLegacyFreeBusy(value string) ShowAs {
+	switch value {
+	case "Free":
+		return Free
+	case "Tentative":
+		return Tentative
+	case "Busy":
+		return Busy
+	case "OOF":
+		return OutOfOffice
+	case "WorkingElsewhere":
+		return WorkingElsewhere
+	default:
+		return Unknown
+	}
+}
@@ -0,0 +1,81 @@
+package showas
+
+import (
+	"testing"
+)
+
+func TestFromTransp(t *testing.T) {
+	tests := []struct {
+		transp string
+		want   ShowAs
+	}{
+		{transp: "", want: Busy},
+		{transp: "OPAQUE", want: Busy},
+		{transp: "opaque", want: Busy},
+		{transp: " Opaque ", want: Busy},
+		{transp: "TRANSPARENT", want: Free},
+		{transp: "transparent", want: Free},
+		{transp: "X-TENTATIVE", want: Unknown},
+	}
+	for _, test := range tests {
+		if got := FromTransp(test.transp); got != test.want {
+			t.Errorf("FromTransp(%q) = %v, want %v", test.transp, got, test.want)
+		}
+	}
+}
+
+func TestFromGoogleTransparency(t *testing.T) {
+	tests := []struct {
+		transparency string
+		want         ShowAs
+	}{
+		{transparency: "", want: Busy},
+		{transparency: "opaque", want: Busy},
+		{transparency: "transparent", want: Free},
+		{transparency: "TRANSPARENT", want: Unknown},
+	}
+	for _, test := range tests {
+		if got := FromGoogleTransparency(test.transparency); got != test.want {
+			t.Errorf("FromGoogleTransparency(%q) = %v, want %v", test.transparency, got, test.want)
+		}
+	}
+}
+
+func TestFromLegacyFreeBusy(t *testing.T) {
+	tests := []struct {
+		value string
+		want  ShowAs
+	}{
+		{value: "Free", want: Free},
+		{value: "Tentative", want: Tentative},
+		{value: "Busy", want: Busy},
+		{value: "OOF", want: OutOfOffice},
+		{value: "WorkingElsewhere", want: WorkingElsewhere},
+		{value: "NoData", want: Unknown},
+		{value: "", want: Unknown},
+	}
+	for _, test := range tests {
+		if got := FromLegacyFreeBusy(test.value); got != test.want {
+			t.Errorf("FromLegacyFreeBusy(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestIsBusy(t *testing.T) {
+	tests := []struct {
+		showAs ShowAs
+		want   bool
+	}{
+		{showAs: Unknown, want: false},
+		{showAs: Free, want: false},
+		{showAs: Tentative, want: false},
+		{showAs: Busy, want: true},
+		{showAs: OutOfOffice, want: true},
+		{showAs: WorkingElsewhere, want: false},
+	}
+	for _, test := range tests {
+		if got := test.showAs.IsBusy(); got != test.want {
+			t.Errorf("%v.IsBusy() = %v, want %v", test.showAs, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Package status enumerates the statuses of calendar events.
+package status
+
+// Status is the overall status of an event (see RFC 5545 section 3.8.1.11).
+type Status int
+
+const (
+	// Unknown means that the status couldn't be determined.
+	Unknown Status = iota
+	// Confirmed is the status of events that take place as scheduled.
+	Confirmed
+	// Tentative is the status of events that aren't confirmed yet.
+	Tentative
+	// Cancelled is the status of events that won't take place.
+	Cancelled
+)
+
+func (s Status) String() string {
+	switch s {
+	case Confirmed:
+		return "Confirmed"
+	case Tentative:
+		return "Tentative"
+	case Cancelled:
+		return "Cancelled"
+	default:
+		return "Unknown"
+	}
+}
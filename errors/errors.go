@@ -38,6 +38,9 @@ package errors
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	common "github.com/WF/commongo/errors"
 	"github.com/Cepreu/Archive/log"
@@ -53,6 +56,36 @@ func WF10001() error {
 	return newError(wf10001)
 }
 
+const wf10002 = `WF10002: authentication failed`
+
+// WF10002 occurs when a server rejects a user's credentials (e.g., a revoked
+// OAuth token); unlike WF11200, retrying won't help until the user
+// reauthenticates.
+func WF10002(host string, username string) error {
+	log.Error(wf10002, "host", host, "username", username)
+	return newError(wf10002)
+}
+
+const wf10003 = `WF10003: message signature verification failed`
+
+// WF10003 occurs when a message's signature can't be verified (e.g., it was
+// tampered with or it's signed by an untrusted certificate); the message
+// must not be processed.
+func WF10003(messageID string, reason string) error {
+	log.Error(wf10003, "messageID", messageID, "reason", reason)
+	return newError(fmt.Sprintf("%s; messageID: %s; reason: %s", wf10003, messageID, reason))
+}
+
+const wf10004 = `WF10004: certificate verification failed`
+
+// WF10004 occurs when a server's TLS certificate can't be verified (e.g.,
+// it's issued by an internal CA or for another host); unlike WF10002, the
+// credentials were never sent, and a custom CA bundle may help.
+func WF10004(host string, reason string) error {
+	log.Error(wf10004, "host", host, "reason", reason)
+	return newError(fmt.Sprintf("%s; host: %s; reason: %s", wf10004, host, reason))
+}
+
 const wf11200 = `WF11200: HTTP response status code was not 2xx`
 
 // WF11200 occurs when an HTTP reponse has a status code other than 2xx.
@@ -69,6 +102,53 @@ func WF11201(request interface{}, response interface{}) error {
 	return newError(wf11201)
 }
 
+const wf11202 = `WF11202: unexpected WebDAV response`
+
+// WF11202 occurs when a WebDAV server responds successfully but the response
+// is missing an expected property or the property has an unexpected value.
+func WF11202(path string, property string, response interface{}) error {
+	log.Error(wf11202, "path", path, "property", property, "response", response)
+	return newError(fmt.Sprintf("%s; path: %s; property: %s; response: %v", wf11202, path, property, response))
+}
+
+const wf11203 = `WF11203: calendar query failed`
+
+// WF11203 occurs when querying the events of a specific calendar fails.
+func WF11203(path string, err error) error {
+	log.Error(wf11203, "path", path, "err", err)
+	return newError(fmt.Sprintf("%s; path: %s; error: %v", wf11203, path, err))
+}
+
+const wf11204 = `WF11204: precondition failed`
+
+// WF11204 occurs when a conditional write is rejected because the resource
+// was modified (or created) by someone else in the meantime; the resource
+// should be refetched before retrying.
+func WF11204(path string, precondition string, value string) error {
+	log.Error(wf11204, "path", path, "precondition", precondition, "value", value)
+	return newError(fmt.Sprintf("%s; path: %s; %s: %s", wf11204, path, precondition, value))
+}
+
+const wf11205 = `WF11205: response too large`
+
+// WF11205 occurs when a server's response exceeds the size that the client
+// is willing to read (e.g., a calendar with a pathological number of events);
+// the response is discarded rather than parsed partially.
+func WF11205(path string, limit int64) error {
+	log.Error(wf11205, "path", path, "limit", limit)
+	return newError(fmt.Sprintf("%s; path: %s; limit: %d bytes", wf11205, path, limit))
+}
+
+const wf11206 = `WF11206: href on another host`
+
+// WF11206 occurs when a server returns an absolute href on a host other than
+// the one that the request was sent to (e.g., a misconfigured proxy), so the
+// resource it names can't be requested.
+func WF11206(requestHost string, hrefHost string) error {
+	log.Error(wf11206, "requestHost", requestHost, "hrefHost", hrefHost)
+	return newError(fmt.Sprintf("%s; request host: %s; href host: %s", wf11206, requestHost, hrefHost))
+}
+
 const wf11301 = `WF11301: all attempts failed with the following errors:`
 
 // WF11301 occurs when all attempts failed with an aggregate error.
@@ -78,6 +158,115 @@ func WF11301(errors ...error) error {
 	return err
 }
 
+const wf11302 = `WF11302: some attempts failed with the following errors:`
+
+// WF11302 occurs when some, but not all, attempts failed with an aggregate
+// error; the results of the successful attempts are returned alongside it.
+func WF11302(errors ...error) error {
+	err := common.NewAggregateError(wf11302, errors...)
+	log.ErrorObject(err)
+	return err
+}
+
+const wf11303 = `WF11303: all accounts failed to sync with the following errors:`
+
+// WF11303 occurs when none of a user's accounts could be synced. The errors
+// of the accounts are logged as they occur, so only their count is logged.
+func WF11303(userID string, errors ...error) error {
+	log.Error(wf11303, "userID", userID, "failures", len(errors))
+	return common.NewAggregateError(wf11303, errors...)
+}
+
+const wf11304 = `WF11304: some accounts failed to sync with the following errors:`
+
+// WF11304 occurs when some, but not all, of a user's accounts could be
+// synced; like WF11303, it logs only the number of failed accounts.
+func WF11304(userID string, errors ...error) error {
+	log.Error(wf11304, "userID", userID, "failures", len(errors))
+	return common.NewAggregateError(wf11304, errors...)
+}
+
+const wf12001 = `WF12001: invalid input`
+
+// WF12001 occurs when an input fails validation (e.g., a required field is
+// missing); it's reported before any side effects take place.
+func WF12001(field string, reason string) error {
+	log.Error(wf12001, "field", field, "reason", reason)
+	return newError(fmt.Sprintf("%s; field: %s; reason: %s", wf12001, field, reason))
+}
+
+const wf12002 = `WF12002: invalid configuration`
+
+// WF12002 occurs when a required environment variable is missing or has an
+// invalid value; the service fails to start.
+func WF12002(name string, value string, reason string) error {
+	log.Error(wf12002, "name", name, "value", value, "reason", reason)
+	return newError(fmt.Sprintf("%s; name: %s; value: %q; reason: %s", wf12002, name, value, reason))
+}
+
+const wf13005 = `WF13005: unrecognized account type`
+
+// WF13005 occurs when none of the registered calendar client factories
+// matches an account (e.g., a new login type).
+func WF13005(loginType string, host string) error {
+	log.Error(wf13005, "loginType", loginType, "host", host)
+	return newError(fmt.Sprintf("%s; loginType: %s; host: %s", wf13005, loginType, host))
+}
+
+const wf13006 = `WF13006: operation not supported`
+
+// WF13006 occurs when a backend doesn't support an operation (yet).
+func WF13006(operation string, backend string) error {
+	log.Error(wf13006, "operation", operation, "backend", backend)
+	return newError(fmt.Sprintf("%s; operation: %s; backend: %s", wf13006, operation, backend))
+}
+
+const wf13007 = `WF13007: worker pool closed`
+
+// WF13007 occurs when a task is submitted to a worker pool that has been
+// drained (e.g., while shutting down).
+func WF13007(pool string) error {
+	log.Error(wf13007, "pool", pool)
+	return newError(fmt.Sprintf("%s; pool: %s", wf13007, pool))
+}
+
+const wf13008 = `WF13008: timed out draining worker pool`
+
+// WF13008 occurs when the tasks of a worker pool don't finish within the
+// drain timeout; the remaining tasks are abandoned.
+func WF13008(pool string, timeout time.Duration, remaining int) error {
+	log.Error(wf13008, "pool", pool, "timeout", timeout, "remaining", remaining)
+	return newError(fmt.Sprintf("%s; pool: %s; timeout: %s; remaining: %d", wf13008, pool, timeout, remaining))
+}
+
+const wf13009 = `WF13009: too many abandoned queries`
+
+// WF13009 occurs when an account isn't queried because too many queries of
+// clients that can't be cancelled timed out and are still running; it keeps
+// their goroutines from piling up while a server hangs.
+func WF13009(running int64) error {
+	log.Error(wf13009, "running", running)
+	return newError(fmt.Sprintf("%s; running: %d", wf13009, running))
+}
+
+// Is checks whether or not the given error, or any error it wraps, is the
+// given target (e.g., context.DeadlineExceeded); see errors.Is.
+func Is(err error, target error) bool {
+	return errors.Is(err, target)
+}
+
+// HasCode checks whether or not the given error, or any error it wraps
+// (e.g., a *url.Error returned by an http.Client), is identified by the given
+// code (e.g., "WF11302").
+func HasCode(err error, code string) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if strings.HasPrefix(err.Error(), code+":") {
+			return true
+		}
+	}
+	return false
+}
+
 // newError returns an error that formats as the given text.
 // It's a wrapper around Go's errors.New function to allow for creating
 // errors that can be handled differently in recovery.
@@ -9,6 +9,7 @@ import (
 	"flag"
 	"fmt"
 	stdlog "log"
+	"os"
 	"time"
 
 	"github.com/WF/commongo"
@@ -25,7 +26,14 @@ var (
 )
 
 func init() {
-	flag.Parse()
+	Configure()
+}
+
+// Configure sets up the logger from the log.level and log.engine flags. The
+// package is set up with their defaults when it's initialized, so that
+// packages can log before main runs; main calls Configure again once it has
+// parsed the command line.
+func Configure() {
 	level := zap.InfoLevel
 	level.UnmarshalText([]byte(*levelFlag))
 	if *engine == "human" {
@@ -76,6 +84,13 @@ func Error(message string, args ...interface{}) {
 	logger.Error(message, args...)
 }
 
+// Fatal logs an error message and exits with status 1; deferred functions
+// don't run. It accepts varargs of alternating key and value parameters.
+func Fatal(message string, args ...interface{}) {
+	logger.Error(message, args...)
+	os.Exit(1)
+}
+
 // ErrorObject logs an error object.
 func ErrorObject(err error) {
 	logger.Error(err.Error())
@@ -0,0 +1,102 @@
+// Package metrics instruments the sync pipeline with Prometheus metrics.
+// Callers depend on the Recorder interface rather than on Prometheus itself
+// so that the metrics can be swapped out (e.g., with Nop in tests).
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Recorder records the metrics of the sync pipeline.
+type Recorder interface {
+	// MessageReceived counts a message received from the queue.
+	MessageReceived()
+	// MessageFailed counts a message that couldn't be processed for the given
+	// reason (e.g., "malformed_payload").
+	MessageFailed(reason string)
+	// SyncDuration observes how long syncing an account of the given type
+	// (e.g., "Exchange") took.
+	SyncDuration(accountType string, duration time.Duration)
+	// EventsSynced counts the events stored for an account of the given type.
+	EventsSynced(accountType string, n int)
+	// CalendarEventsFetched counts the events fetched from calendar servers.
+	CalendarEventsFetched(n int)
+}
+
+type prometheusRecorder struct {
+	messagesReceived      prometheus.Counter
+	messagesFailed        *prometheus.CounterVec
+	syncDuration          *prometheus.HistogramVec
+	eventsSynced          *prometheus.CounterVec
+	calendarEventsFetched prometheus.Counter
+}
+
+// NewRecorder creates a recorder whose metrics are registered with the given
+// registerer (usually prometheus.DefaultRegisterer, which Handler serves).
+// It panics if the metrics are already registered.
+func NewRecorder(registerer prometheus.Registerer) Recorder {
+	r := &prometheusRecorder{
+		messagesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "messages_received_total",
+			Help: "Number of messages received from the queue.",
+		}),
+		messagesFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "messages_failed_total",
+			Help: "Number of messages that couldn't be processed, by reason.",
+		}, []string{"reason"}),
+		syncDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sync_duration_seconds",
+			Help:    "Time it took to sync an account, by account type.",
+			Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"account_type"}),
+		eventsSynced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "events_synced_total",
+			Help: "Number of events stored, by account type.",
+		}, []string{"account_type"}),
+		calendarEventsFetched: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "calendar_events_fetched_total",
+			Help: "Number of events fetched from calendar servers.",
+		}),
+	}
+	registerer.MustRegister(r.messagesReceived, r.messagesFailed, r.syncDuration, r.eventsSynced, r.calendarEventsFetched)
+	return r
+}
+
+// Handler serves the metrics of the default registry in the Prometheus
+// exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+func (r *prometheusRecorder) MessageReceived() {
+	r.messagesReceived.Inc()
+}
+
+func (r *prometheusRecorder) MessageFailed(reason string) {
+	r.messagesFailed.WithLabelValues(reason).Inc()
+}
+
+func (r *prometheusRecorder) SyncDuration(accountType string, duration time.Duration) {
+	r.syncDuration.WithLabelValues(accountType).Observe(duration.Seconds())
+}
+
+func (r *prometheusRecorder) EventsSynced(accountType string, n int) {
+	r.eventsSynced.WithLabelValues(accountType).Add(float64(n))
+}
+
+func (r *prometheusRecorder) CalendarEventsFetched(n int) {
+	r.calendarEventsFetched.Add(float64(n))
+}
+
+// Nop is a recorder that discards all metrics.
+type Nop struct{}
+
+func (Nop) MessageReceived()                                        {}
+func (Nop) MessageFailed(reason string)                             {}
+func (Nop) SyncDuration(accountType string, duration time.Duration) {}
+func (Nop) EventsSynced(accountType string, n int)                  {}
+func (Nop) CalendarEventsFetched(n int)                             {}
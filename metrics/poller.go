@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"reflect"
+
+	"github.com/WF/commongo/polling"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// instrumentedReceiver counts the receives of a poller's receiver.
+type instrumentedReceiver struct {
+	receiver  polling.Receiver
+	attempts  prometheus.Counter
+	errors    prometheus.Counter
+	empty     prometheus.Counter
+	batchSize prometheus.Gauge
+}
+
+// InstrumentReceiver wraps the given receiver (e.g., an SQS queue) so that
+// every poll updates the following metrics, registered with the given
+// registerer: <namespace>_poll_attempts_total, <namespace>_poll_errors_total,
+// <namespace>_poll_empty_total (polls that received nothing) and
+// <namespace>_batch_size (the size of the last batch). The poller itself
+// lives in another repository, so its receiver is instrumented instead.
+// It panics if the metrics are already registered.
+func InstrumentReceiver(receiver polling.Receiver, registerer prometheus.Registerer, namespace string) polling.Receiver {
+	r := &instrumentedReceiver{
+		receiver: receiver,
+		attempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "poll_attempts_total",
+			Help:      "Number of polls.",
+		}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "poll_errors_total",
+			Help:      "Number of polls that failed.",
+		}),
+		empty: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "poll_empty_total",
+			Help:      "Number of polls that received nothing.",
+		}),
+		batchSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "batch_size",
+			Help:      "Size of the last batch received.",
+		}),
+	}
+	registerer.MustRegister(r.attempts, r.errors, r.empty, r.batchSize)
+	return r
+}
+
+func (r *instrumentedReceiver) Receive() (interface{}, bool, error) {
+	batch, received, err := r.receiver.Receive()
+	r.attempts.Inc()
+	switch {
+	case err != nil:
+		r.errors.Inc()
+	case !received:
+		r.empty.Inc()
+	}
+	r.batchSize.Set(float64(batchLen(batch)))
+	return batch, received, err
+}
+
+// batchLen returns the length of the given batch if it's a slice; batches
+// are opaque to pollers.
+func batchLen(batch interface{}) int {
+	value := reflect.ValueOf(batch)
+	if value.Kind() != reflect.Slice {
+		return 0
+	}
+	return value.Len()
+}
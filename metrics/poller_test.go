@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeReceiver returns the given results, one per receive.
+type fakeReceiver struct {
+	results []receiveResult
+}
+
+type receiveResult struct {
+	batch    interface{}
+	received bool
+	err      error
+}
+
+func (r *fakeReceiver) Receive() (interface{}, bool, error) {
+	result := r.results[0]
+	r.results = r.results[1:]
+	return result.batch, result.received, result.err
+}
+
+func TestInstrumentReceiver(t *testing.T) {
+	inner := &fakeReceiver{results: []receiveResult{
+		{batch: []string{"a", "b", "c"}, received: true},
+		{received: false},
+		{err: fmt.Errorf("AWS.SimpleQueueService.NonExistentQueue")},
+		{batch: []string{"d", "e"}, received: true},
+		{received: false},
+	}}
+	registry := prometheus.NewRegistry()
+	receiver := InstrumentReceiver(inner, registry, "test")
+
+	for i := 0; i < 4; i++ {
+		receiver.Receive()
+	}
+	// the batch is passed on as is
+	batch, received, err := receiver.Receive()
+	if batch != nil || received || err != nil {
+		t.Errorf("Receive() = %v, %v, %v, want nil, false, nil", batch, received, err)
+	}
+
+	expected := `
+# HELP test_batch_size Size of the last batch received.
+# TYPE test_batch_size gauge
+test_batch_size 0
+# HELP test_poll_attempts_total Number of polls.
+# TYPE test_poll_attempts_total counter
+test_poll_attempts_total 5
+# HELP test_poll_empty_total Number of polls that received nothing.
+# TYPE test_poll_empty_total counter
+test_poll_empty_total 2
+# HELP test_poll_errors_total Number of polls that failed.
+# TYPE test_poll_errors_total counter
+test_poll_errors_total 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInstrumentReceiverRecordsBatchSize(t *testing.T) {
+	inner := &fakeReceiver{results: []receiveResult{{batch: []int{1, 2, 3}, received: true}}}
+	registry := prometheus.NewRegistry()
+	receiver := InstrumentReceiver(inner, registry, "test")
+
+	batch, received, err := receiver.Receive()
+	if len(batch.([]int)) != 3 || !received || err != nil {
+		t.Errorf("Receive() = %v, %v, %v, want the batch", batch, received, err)
+	}
+	expected := `
+# HELP test_batch_size Size of the last batch received.
+# TYPE test_batch_size gauge
+test_batch_size 3
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "test_batch_size"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBatchLen(t *testing.T) {
+	tests := []struct {
+		batch interface{}
+		want  int
+	}{
+		{batch: nil, want: 0},
+		{batch: []string{}, want: 0},
+		{batch: []string{"a", "b"}, want: 2},
+		{batch: "not a slice", want: 0},
+	}
+	for _, test := range tests {
+		if got := batchLen(test.batch); got != test.want {
+			t.Errorf("batchLen(%#v) = %d, want %d", test.batch, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Package ratelimit limits how often the messages of a single user are
+// processed so that a user whose accounts keep failing (and whose messages
+// keep being published) can't flood the sync service.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// sweepInterval is how often the limiters of idle users are evicted at most.
+const sweepInterval = time.Minute
+
+// UserLimiter limits the rate of events per user with a token bucket each.
+type UserLimiter struct {
+	limit rate.Limit
+	burst int
+	// limiters maps user IDs to *rate.Limiter
+	limiters sync.Map
+	// sweepMutex guards lastSweep, the last time that the limiters of idle
+	// users were evicted
+	sweepMutex sync.Mutex
+	lastSweep  time.Time
+	now        func() time.Time
+}
+
+// NewUserLimiter creates a limiter that allows each user rps events per
+// second on average, in bursts of up to burst events.
+func NewUserLimiter(rps float64, burst int) *UserLimiter {
+	return &UserLimiter{limit: rate.Limit(rps), burst: burst, now: time.Now}
+}
+
+// Allow determines whether an event of the given user may happen now, and
+// takes a token from the user's bucket if so.
+func (limiter *UserLimiter) Allow(userID string) bool {
+	return limiter.limiter(userID).Allow()
+}
+
+// Wait blocks until an event of the given user may happen or the given
+// context is done, in which case its error is returned.
+func (limiter *UserLimiter) Wait(ctx context.Context, userID string) error {
+	return limiter.limiter(userID).Wait(ctx)
+}
+
+func (limiter *UserLimiter) limiter(userID string) *rate.Limiter {
+	limiter.sweep()
+	if userLimiter, ok := limiter.limiters.Load(userID); ok {
+		return userLimiter.(*rate.Limiter)
+	}
+	userLimiter, _ := limiter.limiters.LoadOrStore(userID, rate.NewLimiter(limiter.limit, limiter.burst))
+	return userLimiter.(*rate.Limiter)
+}
+
+// sweep evicts, at most once per sweepInterval, the limiters whose bucket is
+// full again, so that those of users who stopped sending messages don't pile
+// up; such a limiter allows as much as a new one.
+func (limiter *UserLimiter) sweep() {
+	now := limiter.now()
+	limiter.sweepMutex.Lock()
+	if now.Sub(limiter.lastSweep) < sweepInterval {
+		limiter.sweepMutex.Unlock()
+		return
+	}
+	limiter.lastSweep = now
+	limiter.sweepMutex.Unlock()
+
+	limiter.limiters.Range(func(userID, userLimiter interface{}) bool {
+		if userLimiter.(*rate.Limiter).TokensAt(now) >= float64(limiter.burst) {
+			limiter.limiters.Delete(userID)
+		}
+		return true
+	})
+}
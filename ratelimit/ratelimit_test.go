@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// count returns the number of limiters that are kept.
+func count(limiter *UserLimiter) int {
+	n := 0
+	limiter.limiters.Range(func(interface{}, interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestUserLimiterLimitsEachUser(t *testing.T) {
+	limiter := NewUserLimiter(1.0/3600, 2)
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow("user-1") {
+			t.Fatalf("event %d of user-1 isn't allowed", i)
+		}
+	}
+	if limiter.Allow("user-1") {
+		t.Error("event beyond the burst of user-1 is allowed")
+	}
+	if !limiter.Allow("user-2") {
+		t.Error("event of user-2 isn't allowed")
+	}
+}
+
+func TestUserLimiterEvictsIdleUsers(t *testing.T) {
+	now := time.Now()
+	limiter := NewUserLimiter(1, 1)
+	limiter.now = func() time.Time { return now }
+	limiter.Allow("user-1")
+	limiter.Allow("user-2")
+
+	now = now.Add(sweepInterval)
+	limiter.Allow("user-3")
+
+	if n := count(limiter); n != 1 {
+		t.Errorf("kept %d limiters, want only that of user-3", n)
+	}
+}
+
+func TestUserLimiterKeepsLimitedUsers(t *testing.T) {
+	now := time.Now()
+	limiter := NewUserLimiter(1.0/3600, 1)
+	limiter.now = func() time.Time { return now }
+	limiter.Allow("user-1")
+
+	now = now.Add(sweepInterval)
+	if limiter.Allow("user-1") {
+		t.Error("event of user-1 is allowed before its bucket refilled")
+	}
+}
@@ -0,0 +1,159 @@
+package secrets
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Cepreu/Archive/errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+const (
+	// maxBatchSize is the most secrets BatchGetSecretValue retrieves at once.
+	maxBatchSize = 20
+	// maxConcurrentRetrievals is the most secrets that backends without a
+	// batch API retrieve at once.
+	maxConcurrentRetrievals = 8
+)
+
+// BatchBackend is a backend that can retrieve several secrets at once.
+type BatchBackend interface {
+	Backend
+	// RetrieveUserSecrets retrieves the values of the given secrets, mapped by
+	// name. If only some of them could be retrieved, the rest are returned
+	// alongside a WF11302 error.
+	RetrieveUserSecrets(secretNames []string) (map[string]string, error)
+}
+
+// RetrieveBatch retrieves the values of the given secrets, mapped by name,
+// in as few calls as the given backend allows: all at once if it's a
+// BatchBackend, one at a time otherwise. If only some of them could be
+// retrieved, the rest are returned alongside a WF11302 error.
+func RetrieveBatch(backend Backend, secretNames []string) (map[string]string, error) {
+	if len(secretNames) == 0 {
+		return map[string]string{}, nil
+	}
+	if batchBackend, ok := backend.(BatchBackend); ok {
+		return batchBackend.RetrieveUserSecrets(secretNames)
+	}
+
+	values := make(map[string]string, len(secretNames))
+	var errs []error
+	for _, secretName := range secretNames {
+		value, err := backend.RetrieveUserSecret(secretName)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", secretName, err))
+			continue
+		}
+		values[secretName] = value
+	}
+	return values, batchError(values, errs)
+}
+
+// retrieveConcurrently retrieves the values of the given secrets, mapped by
+// name, from the given backend with up to the given number of calls at once.
+// If only some of them could be retrieved, the rest are returned alongside a
+// WF11302 error.
+func retrieveConcurrently(backend Backend, secretNames []string, concurrency int) (map[string]string, error) {
+	values := make([]string, len(secretNames))
+	errs := make([]error, len(secretNames))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, secretName := range secretNames {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, secretName string) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			values[i], errs[i] = backend.RetrieveUserSecret(secretName)
+		}(i, secretName)
+	}
+	wg.Wait()
+
+	retrieved := make(map[string]string, len(secretNames))
+	var failures []error
+	for i, secretName := range secretNames {
+		if errs[i] != nil {
+			failures = append(failures, fmt.Errorf("%s: %v", secretName, errs[i]))
+			continue
+		}
+		retrieved[secretName] = values[i]
+	}
+	return retrieved, batchError(retrieved, failures)
+}
+
+// batchError aggregates the errors of a batch retrieval: WF11301 if every
+// secret failed, WF11302 if only some did.
+func batchError(values map[string]string, errs []error) error {
+	switch {
+	case len(errs) == 0:
+		return nil
+	case len(values) == 0:
+		return errors.WF11301(errs...)
+	default:
+		return errors.WF11302(errs...)
+	}
+}
+
+// SecretsManagerBackend retrieves user secrets from Secrets Manager directly,
+// in batches when possible. It returns the raw SecretString of the secrets,
+// whereas RemoteBackend goes through github.com/WF/go/secrets, which may
+// decode them; it must not replace RemoteBackend until both are known to
+// return the same values.
+type SecretsManagerBackend struct {
+	client secretsmanageriface.SecretsManagerAPI
+}
+
+// NewSecretsManagerBackend creates a backend that retrieves user secrets with
+// the given Secrets Manager client.
+func NewSecretsManagerBackend(client secretsmanageriface.SecretsManagerAPI) *SecretsManagerBackend {
+	return &SecretsManagerBackend{client: client}
+}
+
+// RetrieveUserSecret retrieves the value of the given secret.
+func (backend *SecretsManagerBackend) RetrieveUserSecret(secretName string) (string, error) {
+	output, err := backend.client.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(secretName)})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(output.SecretString), nil
+}
+
+// RetrieveUserSecrets retrieves the values of the given secrets with one
+// BatchGetSecretValue call per 20 secrets.
+func (backend *SecretsManagerBackend) RetrieveUserSecrets(secretNames []string) (map[string]string, error) {
+	values := make(map[string]string, len(secretNames))
+	var errs []error
+	for start := 0; start < len(secretNames); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(secretNames) {
+			end = len(secretNames)
+		}
+		batch := secretNames[start:end]
+
+		output, err := backend.client.BatchGetSecretValue(&secretsmanager.BatchGetSecretValueInput{SecretIdList: aws.StringSlice(batch)})
+		if err != nil {
+			for _, secretName := range batch {
+				errs = append(errs, fmt.Errorf("%s: %v", secretName, err))
+			}
+			continue
+		}
+		// the secrets are identified by name or ARN, whichever they were
+		// requested by
+		for _, secret := range output.SecretValues {
+			for _, secretName := range batch {
+				if secretName == aws.StringValue(secret.Name) || secretName == aws.StringValue(secret.ARN) {
+					values[secretName] = aws.StringValue(secret.SecretString)
+				}
+			}
+		}
+		for _, failure := range output.Errors {
+			errs = append(errs, fmt.Errorf("%s: %s: %s", aws.StringValue(failure.SecretId), aws.StringValue(failure.ErrorCode), aws.StringValue(failure.Message)))
+		}
+	}
+	return values, batchError(values, errs)
+}
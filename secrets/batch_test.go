@@ -0,0 +1,214 @@
+package secrets
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/Cepreu/Archive/errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+// fakeSecretsManager serves the secrets it has by name, or by ARN when
+// requested by one.
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	values map[string]string
+	// failBatch fails the BatchGetSecretValue calls with this index
+	failBatch  int
+	batches    [][]string
+	singleGets int
+}
+
+func (sm *fakeSecretsManager) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	sm.singleGets++
+	value, ok := sm.values[aws.StringValue(input.SecretId)]
+	if !ok {
+		return nil, fmt.Errorf("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(value)}, nil
+}
+
+func (sm *fakeSecretsManager) BatchGetSecretValue(input *secretsmanager.BatchGetSecretValueInput) (*secretsmanager.BatchGetSecretValueOutput, error) {
+	batch := aws.StringValueSlice(input.SecretIdList)
+	sm.batches = append(sm.batches, batch)
+	if len(sm.batches) == sm.failBatch {
+		return nil, fmt.Errorf("ThrottlingException")
+	}
+
+	output := &secretsmanager.BatchGetSecretValueOutput{}
+	for _, secretID := range batch {
+		value, ok := sm.values[secretID]
+		if !ok {
+			output.Errors = append(output.Errors, &secretsmanager.APIErrorType{
+				SecretId:  aws.String(secretID),
+				ErrorCode: aws.String("ResourceNotFoundException"),
+				Message:   aws.String("not found"),
+			})
+			continue
+		}
+		entry := &secretsmanager.SecretValueEntry{Name: aws.String(secretID), SecretString: aws.String(value)}
+		if name := secretNameOf(secretID); name != "" {
+			entry.Name, entry.ARN = aws.String(name), aws.String(secretID)
+		}
+		output.SecretValues = append(output.SecretValues, entry)
+	}
+	return output, nil
+}
+
+// newTestSecretsManager returns a fake with the given number of secrets,
+// named secret-0, secret-1, and so on, and their names.
+func newTestSecretsManager(n int) (*fakeSecretsManager, []string) {
+	sm := &fakeSecretsManager{values: map[string]string{}}
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("secret-%d", i)
+		sm.values[names[i]] = "value of " + names[i]
+	}
+	return sm, names
+}
+
+func TestSecretsManagerBackendRetrievesInBatches(t *testing.T) {
+	sm, names := newTestSecretsManager(45)
+	arn := "arn:aws:secretsmanager:us-west-2:123456789012:secret:calendar/user-1-a1b2c3"
+	sm.values[arn] = "value of calendar/user-1"
+	names = append(names, arn)
+
+	values, err := RetrieveBatch(NewSecretsManagerBackend(sm), names)
+	if err != nil {
+		t.Fatalf("RetrieveBatch() error = %v", err)
+	}
+
+	if len(sm.batches) != 3 || len(sm.batches[0]) != 20 || len(sm.batches[1]) != 20 || len(sm.batches[2]) != 6 {
+		t.Errorf("batches = %v, want 20, 20, and 6 secrets", sm.batches)
+	}
+	if sm.singleGets != 0 {
+		t.Errorf("singleGets = %d, want 0", sm.singleGets)
+	}
+	if len(values) != len(names) {
+		t.Errorf("len(values) = %d, want %d", len(values), len(names))
+	}
+	for _, name := range names {
+		if values[name] != sm.values[name] {
+			t.Errorf("values[%q] = %q, want %q", name, values[name], sm.values[name])
+		}
+	}
+}
+
+func TestSecretsManagerBackendReportsFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		missing    []string
+		failBatch  int
+		wantValues int
+		wantCode   string
+	}{
+		{name: "all retrieved", wantValues: 25},
+		{name: "missing secret", missing: []string{"secret-3"}, wantValues: 24, wantCode: "WF11302"},
+		{name: "failed batch", failBatch: 2, wantValues: 20, wantCode: "WF11302"},
+		{name: "all failed", failBatch: 1, missing: []string{"secret-20", "secret-21", "secret-22", "secret-23", "secret-24"}, wantValues: 0, wantCode: "WF11301"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sm, names := newTestSecretsManager(25)
+			sm.failBatch = test.failBatch
+			for _, name := range test.missing {
+				delete(sm.values, name)
+			}
+
+			values, err := NewSecretsManagerBackend(sm).RetrieveUserSecrets(names)
+			if len(values) != test.wantValues {
+				t.Errorf("len(values) = %d, want %d", len(values), test.wantValues)
+			}
+			switch {
+			case test.wantCode == "" && err != nil:
+				t.Errorf("RetrieveUserSecrets() error = %v, want nil", err)
+			case test.wantCode != "" && !errors.HasCode(err, test.wantCode):
+				t.Errorf("RetrieveUserSecrets() error = %v, want %s", err, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestCachingBackendRetrievesMissingSecretsInOneBatch(t *testing.T) {
+	sm, names := newTestSecretsManager(10)
+	cache := NewCachingBackend(NewSecretsManagerBackend(sm), DefaultTTL)
+	for _, name := range names[:4] {
+		if _, err := cache.RetrieveUserSecret(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	values, err := cache.RetrieveBatch(names)
+	if err != nil {
+		t.Fatalf("RetrieveBatch() error = %v", err)
+	}
+	if len(values) != len(names) {
+		t.Errorf("len(values) = %d, want %d", len(values), len(names))
+	}
+	if len(sm.batches) != 1 || len(sm.batches[0]) != 6 {
+		t.Errorf("batches = %v, want one of the 6 uncached secrets", sm.batches)
+	}
+
+	// they're all cached now
+	if _, err := cache.RetrieveBatch(names); err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.batches) != 1 {
+		t.Errorf("batches = %v, want no more", sm.batches)
+	}
+}
+
+// concurrentBackend tracks how many secrets are retrieved at once.
+type concurrentBackend struct {
+	mutex  sync.Mutex
+	active int
+	peak   int
+	// release unblocks the retrievals
+	release chan struct{}
+}
+
+func (backend *concurrentBackend) RetrieveUserSecret(secretName string) (string, error) {
+	backend.mutex.Lock()
+	backend.active++
+	if backend.active > backend.peak {
+		backend.peak = backend.active
+	}
+	backend.mutex.Unlock()
+
+	<-backend.release
+
+	backend.mutex.Lock()
+	backend.active--
+	backend.mutex.Unlock()
+	if secretName == "missing" {
+		return "", fmt.Errorf("ResourceNotFoundException")
+	}
+	return "value of " + secretName, nil
+}
+
+func TestRetrieveConcurrentlyBoundsConcurrency(t *testing.T) {
+	backend := &concurrentBackend{release: make(chan struct{})}
+	names := []string{"missing"}
+	for i := 0; i < 19; i++ {
+		names = append(names, fmt.Sprintf("secret-%d", i))
+	}
+	go func() {
+		for range names {
+			backend.release <- struct{}{}
+		}
+	}()
+
+	values, err := retrieveConcurrently(backend, names, 4)
+	if !errors.HasCode(err, "WF11302") {
+		t.Errorf("retrieveConcurrently() error = %v, want WF11302", err)
+	}
+	if len(values) != 19 || values["secret-0"] != "value of secret-0" {
+		t.Errorf("values = %v, want all but the missing secret", values)
+	}
+	if backend.peak > 4 {
+		t.Errorf("peak = %d, want at most 4", backend.peak)
+	}
+}
@@ -0,0 +1,189 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/Cepreu/Archive/aws/sqs"
+	"github.com/Cepreu/Archive/log"
+)
+
+// Secrets Manager doesn't notify anyone when it rotates a secret, but
+// CloudTrail records the API calls, and EventBridge can forward them to an
+// SQS queue. A RotationWatcher consumes that queue; it requires:
+//
+//  1. A CloudTrail trail that records the management events of Secrets
+//     Manager (rotation events aren't delivered without one).
+//  2. An SQS queue whose access policy allows events.amazonaws.com to
+//     sqs:SendMessage to it.
+//  3. An EventBridge rule on the default event bus, with the queue as its
+//     target and the following event pattern (to watch only some secrets,
+//     add e.g. "requestParameters": {"secretId": [{"prefix": "calendar/"}]}
+//     to its detail):
+//
+//     {
+//       "source": ["aws.secretsmanager"],
+//       "detail-type": ["AWS API Call via CloudTrail"],
+//       "detail": {
+//         "eventSource": ["secretsmanager.amazonaws.com"],
+//         "eventName": ["RotateSecret"]
+//       }
+//     }
+//
+// RotateSecret is logged when rotation starts, so the secret retrieved right
+// after it may still be the old one. To be notified once rotation completes
+// as well, add a second rule matching the "AWS Service Event via CloudTrail"
+// events named RotationSucceeded (which carry the secret's ARN in
+// additionalEventData.SecretId).
+//
+// A single watcher handles the rotations of all secrets. Only the rotation
+// events are deleted from the queue; other messages are left for whoever else
+// consumes it.
+
+const (
+	rotateSecretEventName = "RotateSecret"
+	// rotationSucceededEventName is the service event that Secrets Manager
+	// logs once the new version of a rotated secret becomes current.
+	rotationSucceededEventName = "RotationSucceeded"
+	// receiveRetryDelay is how long to wait before receiving again after
+	// the queue failed to receive messages.
+	receiveRetryDelay = 5 * time.Second
+)
+
+// RotationWatcher watches an SQS queue for rotations of secrets and evicts
+// them from a cache.
+type RotationWatcher struct {
+	queue   sqs.MessageQueue
+	backend *CachingSecretBackend
+}
+
+// rotationEvent is a CloudTrail event delivered by EventBridge.
+type rotationEvent struct {
+	Source string `json:"source"`
+	Detail struct {
+		EventName         string `json:"eventName"`
+		RequestParameters struct {
+			SecretID string `json:"secretId"`
+		} `json:"requestParameters"`
+		AdditionalEventData struct {
+			SecretID string `json:"SecretId"`
+		} `json:"additionalEventData"`
+	} `json:"detail"`
+}
+
+// NewRotationWatcher creates a watcher that receives rotation events from the
+// given SQS queue (see the setup above) and evicts the rotated secrets from
+// the given backend.
+func NewRotationWatcher(queueURL string, backend *CachingSecretBackend) *RotationWatcher {
+	return &RotationWatcher{queue: sqs.NewMessageQueue(queueURL), backend: backend}
+}
+
+// Watch blocks until the given context is done, which it returns the error
+// of. Whenever a secret is rotated, it's evicted from the cache and onRotate
+// (unless nil) is called with the secret's ID (a name or an ARN). The context
+// is only checked between (long) polls of the queue, so it can take up to
+// 20s to return.
+func (watcher *RotationWatcher) Watch(ctx context.Context, onRotate func(secretID string)) error {
+	for ctx.Err() == nil {
+		batch, _, err := watcher.queue.Receive()
+		if err != nil {
+			log.Warn("Could not receive rotation events", "err", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(receiveRetryDelay):
+			}
+			continue
+		}
+
+		messages := batch.([]*sqs.Message)
+		handled := make([]string, 0, len(messages))
+		for _, message := range messages {
+			secretID := rotatedSecretID(message.Body)
+			if secretID == "" {
+				continue
+			}
+			watcher.evict(secretID)
+			log.Info("Secret was rotated", "secretID", secretID)
+			if onRotate != nil {
+				onRotate(secretID)
+			}
+			handled = append(handled, message.Handle)
+		}
+		if len(handled) == 0 {
+			continue
+		}
+		if err := watcher.queue.DeleteMessages(handled); err != nil {
+			log.Error("Could not delete rotation events", "err", err)
+		}
+	}
+	return ctx.Err()
+}
+
+// WatchRotation is like Watch, but onChange is only called for rotations of
+// the given secret (by name or ARN), with its new value. Rotations of other
+// secrets still evict them from the cache. A new value that can't be
+// retrieved is logged, and onChange isn't called.
+func (watcher *RotationWatcher) WatchRotation(ctx context.Context, secretName string, onChange func(newValue string)) error {
+	return watcher.Watch(ctx, func(secretID string) {
+		if secretID != secretName && secretNameOf(secretID) != secretName {
+			return
+		}
+		value, err := watcher.backend.RetrieveUserSecret(secretName)
+		if err != nil {
+			log.Error("Could not retrieve rotated secret", "err", err, "secretName", secretName)
+			return
+		}
+		onChange(value)
+	})
+}
+
+// evict evicts the given secret from the cache under both the given ID and,
+// if it's an ARN, the secret's name, whichever it was retrieved by.
+func (watcher *RotationWatcher) evict(secretID string) {
+	watcher.backend.InvalidateCache(secretID)
+	if name := secretNameOf(secretID); name != "" {
+		watcher.backend.InvalidateCache(name)
+	}
+}
+
+// rotatedSecretID returns the ID of the secret that the given message body is
+// a rotation event of; empty if it isn't one.
+func rotatedSecretID(body string) string {
+	var event rotationEvent
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		log.Warn("Could not parse rotation event", "err", err, "body", body)
+		return ""
+	}
+	if event.Source != "aws.secretsmanager" {
+		return ""
+	}
+
+	switch event.Detail.EventName {
+	case rotateSecretEventName:
+		return event.Detail.RequestParameters.SecretID
+	case rotationSucceededEventName:
+		return event.Detail.AdditionalEventData.SecretID
+	}
+	return ""
+}
+
+// secretNameOf returns the name of the secret with the given ARN; empty if
+// it isn't an ARN. The ARN of a secret ends with its name, a hyphen and six
+// random characters,
+// e.g., arn:aws:secretsmanager:us-west-2:123456789012:secret:my-secret-a1b2c3
+func secretNameOf(secretID string) string {
+	if !strings.HasPrefix(secretID, "arn:") {
+		return ""
+	}
+	i := strings.LastIndex(secretID, ":secret:")
+	if i < 0 {
+		return ""
+	}
+	name := secretID[i+len(":secret:"):]
+	if len(name) > 7 && name[len(name)-7] == '-' {
+		return name[:len(name)-7]
+	}
+	return name
+}
@@ -0,0 +1,138 @@
+package secrets
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Cepreu/Archive/aws/sqs"
+)
+
+// fakeBackend counts the retrievals of each secret.
+type fakeBackend struct {
+	retrievals map[string]int
+}
+
+func (backend *fakeBackend) RetrieveUserSecret(secretName string) (string, error) {
+	backend.retrievals[secretName]++
+	return "value of " + secretName, nil
+}
+
+// fakeQueue returns its batches once, then cancels the watch.
+type fakeQueue struct {
+	batches [][]*sqs.Message
+	cancel  context.CancelFunc
+	deleted []string
+}
+
+func (q *fakeQueue) Receive() (interface{}, bool, error) {
+	if len(q.batches) == 0 {
+		q.cancel()
+		return []*sqs.Message{}, false, nil
+	}
+	batch := q.batches[0]
+	q.batches = q.batches[1:]
+	return batch, true, nil
+}
+
+func (q *fakeQueue) DeleteMessages(handles []string) error {
+	q.deleted = append(q.deleted, handles...)
+	return nil
+}
+
+func TestWatchEvictsRotatedSecrets(t *testing.T) {
+	inner := &fakeBackend{retrievals: map[string]int{}}
+	cache := NewCachingBackend(inner, DefaultTTL)
+	for _, secretName := range []string{"a", "b", "c"} {
+		if _, err := cache.RetrieveUserSecret(secretName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queue := &fakeQueue{cancel: cancel, batches: [][]*sqs.Message{{
+		{Handle: "1", Body: `{"source":"aws.secretsmanager","detail":{"eventName":"RotateSecret","requestParameters":{"secretId":"a"}}}`},
+		{Handle: "2", Body: `{"source":"aws.ec2","detail":{"eventName":"RunInstances"}}`},
+		{Handle: "3", Body: `{"source":"aws.secretsmanager","detail":{"eventName":"RotationSucceeded","additionalEventData":{"SecretId":"arn:aws:secretsmanager:us-west-2:123456789012:secret:b-a1b2c3"}}}`},
+	}}}
+	watcher := &RotationWatcher{queue: queue, backend: cache}
+
+	rotated := []string{}
+	if err := watcher.Watch(ctx, func(secretID string) { rotated = append(rotated, secretID) }); err != context.Canceled {
+		t.Errorf("Watch = %v, want %v", err, context.Canceled)
+	}
+
+	if len(rotated) != 2 {
+		t.Errorf("rotated %v, want a and b", rotated)
+	}
+	if len(queue.deleted) != 2 || queue.deleted[0] != "1" || queue.deleted[1] != "3" {
+		t.Errorf("deleted %v, want only the rotation events", queue.deleted)
+	}
+	for _, secretName := range []string{"a", "b", "c"} {
+		if _, err := cache.RetrieveUserSecret(secretName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if inner.retrievals["a"] != 2 || inner.retrievals["b"] != 2 || inner.retrievals["c"] != 1 {
+		t.Errorf("retrieved %v, want a and b again and c from the cache", inner.retrievals)
+	}
+}
+
+func TestWatchRotationDeliversNewValue(t *testing.T) {
+	inner := &fakeBackend{retrievals: map[string]int{}}
+	cache := NewCachingBackend(inner, DefaultTTL)
+	for _, secretName := range []string{"calendar/user-1", "other"} {
+		if _, err := cache.RetrieveUserSecret(secretName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queue := &fakeQueue{cancel: cancel, batches: [][]*sqs.Message{
+		{{Handle: "1", Body: `{"source":"aws.secretsmanager","detail":{"eventName":"RotateSecret","requestParameters":{"secretId":"other"}}}`}},
+		{{Handle: "2", Body: `{"source":"aws.secretsmanager","detail":{"eventName":"RotateSecret","requestParameters":{"secretId":"calendar/user-1"}}}`}},
+		{{Handle: "3", Body: `{"source":"aws.secretsmanager","detail":{"eventName":"RotationSucceeded","additionalEventData":{"SecretId":"arn:aws:secretsmanager:us-west-2:123456789012:secret:calendar/user-1-a1b2c3"}}}`}},
+	}}
+	watcher := &RotationWatcher{queue: queue, backend: cache}
+
+	changes := []string{}
+	if err := watcher.WatchRotation(ctx, "calendar/user-1", func(newValue string) { changes = append(changes, newValue) }); err != context.Canceled {
+		t.Errorf("WatchRotation = %v, want %v", err, context.Canceled)
+	}
+
+	if len(changes) != 2 || changes[0] != "value of calendar/user-1" || changes[1] != "value of calendar/user-1" {
+		t.Errorf("changes = %v, want the new value once per rotation event", changes)
+	}
+	if inner.retrievals["calendar/user-1"] != 3 {
+		t.Errorf("retrieved calendar/user-1 %d times, want 3", inner.retrievals["calendar/user-1"])
+	}
+	// other secrets are evicted, but not retrieved again
+	if inner.retrievals["other"] != 1 {
+		t.Errorf("retrieved other %d times, want 1", inner.retrievals["other"])
+	}
+	if _, err := cache.RetrieveUserSecret("other"); err != nil {
+		t.Fatal(err)
+	}
+	if inner.retrievals["other"] != 2 {
+		t.Errorf("retrieved other %d times, want it evicted", inner.retrievals["other"])
+	}
+	if len(queue.deleted) != 3 {
+		t.Errorf("deleted %v, want all rotation events", queue.deleted)
+	}
+}
+
+func TestSecretNameOf(t *testing.T) {
+	tests := []struct {
+		secretID string
+		want     string
+	}{
+		{secretID: "my-secret", want: ""},
+		{secretID: "arn:aws:secretsmanager:us-west-2:123456789012:secret:my-secret-a1b2c3", want: "my-secret"},
+		{secretID: "arn:aws:secretsmanager:us-west-2:123456789012:secret:calendar/user-1-a1b2c3", want: "calendar/user-1"},
+		{secretID: "arn:aws:sqs:us-west-2:123456789012:queue", want: ""},
+	}
+	for _, test := range tests {
+		if got := secretNameOf(test.secretID); got != test.want {
+			t.Errorf("secretNameOf(%q) = %q, want %q", test.secretID, got, test.want)
+		}
+	}
+}
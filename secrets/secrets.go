@@ -0,0 +1,147 @@
+// Package secrets retrieves user secrets (e.g., calendar passwords) and
+// caches them to reduce the number of Secrets Manager API calls.
+package secrets
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Cepreu/Archive/errors"
+	remote "github.com/WF/go/secrets"
+)
+
+const (
+	// DefaultTTL is how long secrets are cached for by default.
+	DefaultTTL = 5 * time.Minute
+)
+
+// Backend retrieves user secrets.
+type Backend interface {
+	// RetrieveUserSecret retrieves the value of the given secret.
+	RetrieveUserSecret(secretName string) (string, error)
+}
+
+// RemoteBackend retrieves user secrets from Secrets Manager on every call,
+// one per API call (see SecretsManagerBackend).
+type RemoteBackend struct{}
+
+// RetrieveUserSecret retrieves the value of the given secret.
+func (RemoteBackend) RetrieveUserSecret(secretName string) (string, error) {
+	return remote.RetrieveUserSecret(secretName)
+}
+
+// RetrieveUserSecrets retrieves the values of the given secrets, mapped by
+// name, with up to maxConcurrentRetrievals calls at once.
+func (backend RemoteBackend) RetrieveUserSecrets(secretNames []string) (map[string]string, error) {
+	return retrieveConcurrently(backend, secretNames, maxConcurrentRetrievals)
+}
+
+// CachingSecretBackend caches the secrets of another backend for a TTL.
+type CachingSecretBackend struct {
+	inner Backend
+	ttl   time.Duration
+	// secrets maps secret names to *cachedSecret
+	secrets sync.Map
+	// sweepMutex guards lastSweep, the last time that the expired secrets
+	// were evicted
+	sweepMutex sync.Mutex
+	lastSweep  time.Time
+	// now returns the current time (overridden in tests)
+	now func() time.Time
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// NewCachingBackend creates a backend that caches the secrets of the given
+// backend for the given TTL (DefaultTTL if not positive). Failures aren't
+// cached.
+func NewCachingBackend(inner Backend, ttl time.Duration) *CachingSecretBackend {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &CachingSecretBackend{inner: inner, ttl: ttl, now: time.Now}
+}
+
+// RetrieveUserSecret retrieves the value of the given secret from the cache
+// or, if it's missing or expired, from the inner backend.
+func (backend *CachingSecretBackend) RetrieveUserSecret(secretName string) (string, error) {
+	if value, ok := backend.secrets.Load(secretName); ok {
+		secret := value.(*cachedSecret)
+		if backend.now().Before(secret.expires) {
+			return secret.value, nil
+		}
+	}
+
+	value, err := backend.inner.RetrieveUserSecret(secretName)
+	if err != nil {
+		return "", err
+	}
+	backend.store(secretName, value, backend.now().Add(backend.ttl))
+	return value, nil
+}
+
+// RetrieveBatch retrieves the values of the given secrets, mapped by name,
+// from the cache or, if they're missing or expired, from the inner backend in
+// one batch (see RetrieveBatch). If only some of them could be retrieved, the
+// rest are returned alongside a WF11302 error.
+func (backend *CachingSecretBackend) RetrieveBatch(secretNames []string) (map[string]string, error) {
+	values := make(map[string]string, len(secretNames))
+	var missing []string
+	for _, secretName := range secretNames {
+		if value, ok := backend.secrets.Load(secretName); ok {
+			secret := value.(*cachedSecret)
+			if backend.now().Before(secret.expires) {
+				values[secretName] = secret.value
+				continue
+			}
+		}
+		missing = append(missing, secretName)
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	retrieved, err := RetrieveBatch(backend.inner, missing)
+	expires := backend.now().Add(backend.ttl)
+	for secretName, value := range retrieved {
+		backend.store(secretName, value, expires)
+		values[secretName] = value
+	}
+	if errors.HasCode(err, "WF11301") && len(values) > 0 {
+		// the cached secrets make this a partial failure
+		return values, errors.WF11302(err)
+	}
+	return values, err
+}
+
+// store caches the given secret until the given time. At most once per TTL,
+// it also evicts the expired secrets, so that those of accounts that aren't
+// synced anymore don't pile up.
+func (backend *CachingSecretBackend) store(secretName string, value string, expires time.Time) {
+	backend.secrets.Store(secretName, &cachedSecret{value: value, expires: expires})
+
+	now := backend.now()
+	backend.sweepMutex.Lock()
+	if now.Sub(backend.lastSweep) < backend.ttl {
+		backend.sweepMutex.Unlock()
+		return
+	}
+	backend.lastSweep = now
+	backend.sweepMutex.Unlock()
+
+	backend.secrets.Range(func(key, value interface{}) bool {
+		if !now.Before(value.(*cachedSecret).expires) {
+			backend.secrets.Delete(key)
+		}
+		return true
+	})
+}
+
+// InvalidateCache evicts the given secret (e.g., after it's been rotated) so
+// that it's retrieved from the inner backend next time.
+func (backend *CachingSecretBackend) InvalidateCache(secretName string) {
+	backend.secrets.Delete(secretName)
+}
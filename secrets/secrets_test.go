@@ -0,0 +1,54 @@
+package secrets
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachingBackendEvictsExpiredSecrets(t *testing.T) {
+	inner := &fakeBackend{retrievals: map[string]int{}}
+	cache := NewCachingBackend(inner, time.Minute)
+	now := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	if _, err := cache.RetrieveUserSecret("a"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(30 * time.Second)
+	if _, err := cache.RetrieveBatch([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(45 * time.Second) // a expired, b didn't
+	if _, err := cache.RetrieveUserSecret("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	cached := map[string]bool{}
+	cache.secrets.Range(func(key, value interface{}) bool {
+		cached[key.(string)] = true
+		return true
+	})
+	if len(cached) != 2 || !cached["b"] || !cached["c"] {
+		t.Errorf("cached %v, want b and c", cached)
+	}
+}
+
+func TestCachingBackendRetrievesExpiredSecrets(t *testing.T) {
+	inner := &fakeBackend{retrievals: map[string]int{}}
+	cache := NewCachingBackend(inner, time.Minute)
+	now := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if value, err := cache.RetrieveUserSecret("a"); err != nil || value != "value of a" {
+			t.Fatalf("RetrieveUserSecret = %q, %v", value, err)
+		}
+	}
+	now = now.Add(time.Minute)
+	if _, err := cache.RetrieveUserSecret("a"); err != nil {
+		t.Fatal(err)
+	}
+	if inner.retrievals["a"] != 2 {
+		t.Errorf("retrieved a %d times, want 2", inner.retrievals["a"])
+	}
+}
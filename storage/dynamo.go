@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/enums/status"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/Cepreu/Archive/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	// userIDIndex is a global secondary index of the table with userID as its
+	// partition key; it projects uid and lastModified
+	userIDIndex = "userID-index"
+	// maxBatchSize is the maximum number of requests of a BatchWriteItem
+	maxBatchSize = 25
+	// maxBatchAttempts bounds the retries of unprocessed batch items
+	maxBatchAttempts = 5
+	// eventTTL is how long events are kept after they end
+	eventTTL       = 30 * 24 * time.Hour
+	userKeyPrefix  = "USER#"
+	eventKeyPrefix = "EVENT#"
+	// syncKey is the sort key of the item that holds a user's version
+	syncKey = "SYNC"
+)
+
+const (
+	conditionalCheckFailedErrorCode = "ConditionalCheckFailedException"
+)
+
+// sequencedEvent is implemented by events whose revisions are numbered (e.g.,
+// caldav.SequencedEvent); other events are stored as revision zero.
+type sequencedEvent interface {
+	Sequence() int
+}
+
+// recurringEvent is implemented by events that may override an instance of a
+// recurring series (e.g., caldav.RecurringEvent).
+type recurringEvent interface {
+	OriginalStart() time.Time
+}
+
+// ruledEvent is implemented by events that may be the master of a series
+// defined by a rule (e.g., caldav.RecurringEvent).
+type ruledEvent interface {
+	RecurrenceRule() string
+}
+
+// statusEvent is implemented by events that expose their status (e.g.,
+// cancelled events that are kept); other events are stored as Unknown.
+type statusEvent interface {
+	Status() status.Status
+}
+
+type dynamoEventStore struct {
+	client    dynamodbiface.DynamoDBAPI
+	tableName string
+}
+
+// eventItem is the DynamoDB item of an event.
+type eventItem struct {
+	PK           string `dynamodbav:"PK"`
+	SK           string `dynamodbav:"SK"`
+	UserID       string `dynamodbav:"userID"`
+	UID          string `dynamodbav:"uid"`
+	Subject      string `dynamodbav:"subject,omitempty"`
+	Description  string `dynamodbav:"description,omitempty"`
+	Location     string `dynamodbav:"location,omitempty"`
+	URL          string `dynamodbav:"url,omitempty"`
+	StartTime    string `dynamodbav:"startTime"`
+	EndTime      string `dynamodbav:"endTime"`
+	TimeZone     string `dynamodbav:"timeZone,omitempty"`
+	IsAllDay     bool   `dynamodbav:"isAllDay"`
+	IsRecurring  bool   `dynamodbav:"isRecurring"`
+	CalendarID   string `dynamodbav:"calendarID"`
+	LastModified string `dynamodbav:"lastModified"`
+	// Status is the name of the event's status (e.g., "Cancelled")
+	Status string `dynamodbav:"status"`
+	// Sequence is the event's revision number (e.g., an iCalendar SEQUENCE)
+	Sequence int `dynamodbav:"sequence"`
+	// TTL is the (Unix) time at which DynamoDB expires the item; unset for
+	// recurring series that don't end
+	TTL     int64 `dynamodbav:"ttl,omitempty"`
+	Version int64 `dynamodbav:"version"`
+}
+
+// NewDynamoEventStore creates an event store backed by the given DynamoDB
+// table. Its partition key is PK and its sort key SK (both strings), ttl is
+// its TTL attribute, and it has a userID-index global secondary index.
+func NewDynamoEventStore(client dynamodbiface.DynamoDBAPI, tableName string) EventStore {
+	return &dynamoEventStore{client: client, tableName: tableName}
+}
+
+// DeleteUserEvents deletes all of the user's events.
+func (store *dynamoEventStore) DeleteUserEvents(userID string) error {
+	requests := []*dynamodb.WriteRequest{}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(store.tableName),
+		KeyConditionExpression: aws.String("PK = :pk AND begins_with(SK, :prefix)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk":     {S: aws.String(userKeyPrefix + userID)},
+			":prefix": {S: aws.String(eventKeyPrefix)},
+		},
+		ProjectionExpression: aws.String("PK, SK"),
+	}
+	err := store.client.QueryPages(input, func(output *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, key := range output.Items {
+			requests = append(requests, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: key}})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return store.batchWrite(requests)
+}
+
+// PutEvents stores the given events of the user in place of the ones that it
+// stored before. Each sync stamps the items that it writes with a new version
+// of the user, so that a sync that overlaps with a later one neither
+// overwrites the later one's items nor deletes them. Events whose sequence is
+// lower than that of their stored version are stale (e.g., read from a
+// lagging replica) and aren't stored. Events are written with a PutItem each
+// rather than in BatchWriteItem batches, since only the former can be
+// conditional.
+func (store *dynamoEventStore) PutEvents(userID string, events []calendar.Event) error {
+	version, written, err := store.putEvents(userID, events)
+	if err != nil {
+		return err
+	}
+	return store.deleteUnwritten(userID, version, written)
+}
+
+// MergeEvents stores the given events of the user alongside the ones that are
+// stored; like PutEvents, it neither overwrites the items of a later sync nor
+// stale events.
+func (store *dynamoEventStore) MergeEvents(userID string, events []calendar.Event) error {
+	_, _, err := store.putEvents(userID, events)
+	return err
+}
+
+// putEvents writes the given events of the user with a new version, which it
+// returns along with the sort keys of the written items.
+func (store *dynamoEventStore) putEvents(userID string, events []calendar.Event) (int64, map[string]bool, error) {
+	version, err := store.nextVersion(userID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	written := map[string]bool{}
+	for _, event := range events {
+		item := newEventItem(userID, event, version)
+		written[item.SK] = true
+		if err := store.putEventItem(item); err != nil {
+			return 0, nil, err
+		}
+	}
+	return version, written, nil
+}
+
+// GetEventUIDs returns the UIDs of the user's stored events mapped to their
+// last modification time (RFC 3339).
+func (store *dynamoEventStore) GetEventUIDs(userID string) (map[string]string, error) {
+	uids := map[string]string{}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(store.tableName),
+		IndexName:              aws.String(userIDIndex),
+		KeyConditionExpression: aws.String("userID = :userID"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":userID": {S: aws.String(userID)},
+		},
+		ProjectionExpression: aws.String("uid, lastModified"),
+	}
+
+	var unmarshalErr error
+	err := store.client.QueryPages(input, func(output *dynamodb.QueryOutput, lastPage bool) bool {
+		items := []*eventItem{}
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(output.Items, &items); unmarshalErr != nil {
+			return false
+		}
+		for _, item := range items {
+			uids[item.UID] = item.LastModified
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	return uids, nil
+}
+
+// putEventItem writes the given item unless its stored version has a higher
+// sequence or was written by a later sync.
+func (store *dynamoEventStore) putEventItem(item *eventItem) error {
+	attributes, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+	_, err = store.client.PutItem(&dynamodb.PutItemInput{
+		TableName:                aws.String(store.tableName),
+		Item:                     attributes,
+		ConditionExpression:      aws.String("(attribute_not_exists(#sequence) OR #sequence <= :sequence) AND (attribute_not_exists(version) OR version <= :version)"),
+		ExpressionAttributeNames: map[string]*string{"#sequence": aws.String("sequence")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":sequence": {N: aws.String(strconv.Itoa(item.Sequence))},
+			":version":  {N: aws.String(strconv.FormatInt(item.Version, 10))},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		log.Warn("Skipping stale event", "userID", item.UserID, "key", item.SK, "sequence", item.Sequence, "version", item.Version)
+		return nil
+	}
+	return err
+}
+
+// deleteUnwritten deletes the user's events that the sync of the given
+// version didn't write, except for those that a later sync wrote.
+func (store *dynamoEventStore) deleteUnwritten(userID string, version int64, written map[string]bool) error {
+	keys, err := store.getEventKeys(userID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if written[aws.StringValue(key["SK"].S)] {
+			continue
+		}
+		_, err := store.client.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName:           aws.String(store.tableName),
+			Key:                 key,
+			ConditionExpression: aws.String("version < :version"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":version": {N: aws.String(strconv.FormatInt(version, 10))},
+			},
+		})
+		if err != nil && !isConditionalCheckFailed(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// getEventKeys returns the keys of the user's stored events.
+func (store *dynamoEventStore) getEventKeys(userID string) ([]map[string]*dynamodb.AttributeValue, error) {
+	keys := []map[string]*dynamodb.AttributeValue{}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(store.tableName),
+		KeyConditionExpression: aws.String("PK = :pk AND begins_with(SK, :prefix)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk":     {S: aws.String(userKeyPrefix + userID)},
+			":prefix": {S: aws.String(eventKeyPrefix)},
+		},
+		ProjectionExpression: aws.String("PK, SK"),
+	}
+	err := store.client.QueryPages(input, func(output *dynamodb.QueryOutput, lastPage bool) bool {
+		keys = append(keys, output.Items...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// nextVersion atomically increments the user's version and returns the new
+// one; concurrent syncs get distinct versions rather than failing.
+func (store *dynamoEventStore) nextVersion(userID string) (int64, error) {
+	output, err := store.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(store.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {S: aws.String(userKeyPrefix + userID)},
+			"SK": {S: aws.String(syncKey)},
+		},
+		UpdateExpression: aws.String("ADD version :one"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {N: aws.String("1")},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	updated := &eventItem{} // only its version is set
+	if err := dynamodbattribute.UnmarshalMap(output.Attributes, updated); err != nil {
+		return 0, err
+	}
+	return updated.Version, nil
+}
+
+// batchWrite issues the given write requests in batches, retrying the
+// unprocessed ones (e.g., due to throttling).
+func (store *dynamoEventStore) batchWrite(requests []*dynamodb.WriteRequest) error {
+	for len(requests) > 0 {
+		n := len(requests)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+
+		batch := map[string][]*dynamodb.WriteRequest{store.tableName: requests[:n]}
+		for attempt := 1; len(batch) > 0; attempt++ {
+			if attempt > maxBatchAttempts {
+				return errors.WF11201(n, unprocessedKeys(batch[store.tableName]))
+			}
+
+			output, err := store.client.BatchWriteItem(&dynamodb.BatchWriteItemInput{RequestItems: batch})
+			if err != nil {
+				return err
+			}
+			batch = output.UnprocessedItems
+			if len(batch) > 0 {
+				time.Sleep(time.Duration(attempt*attempt) * 50 * time.Millisecond)
+			}
+		}
+		requests = requests[n:]
+	}
+	return nil
+}
+
+// unprocessedKeys returns the keys of the given write requests, leaving out
+// the contents of put items.
+func unprocessedKeys(requests []*dynamodb.WriteRequest) []string {
+	keys := make([]string, 0, len(requests))
+	for _, request := range requests {
+		var key map[string]*dynamodb.AttributeValue
+		if request.DeleteRequest != nil {
+			key = request.DeleteRequest.Key
+		} else if request.PutRequest != nil {
+			key = request.PutRequest.Item
+		}
+		keys = append(keys, aws.StringValue(key["PK"].S)+" "+aws.StringValue(key["SK"].S))
+	}
+	return keys
+}
+
+func isConditionalCheckFailed(err error) bool {
+	awsError, ok := err.(awserr.Error)
+	return ok && awsError.Code() == conditionalCheckFailedErrorCode
+}
+
+func newEventItem(userID string, event calendar.Event, version int64) *eventItem {
+	return &eventItem{
+		PK:           userKeyPrefix + userID,
+		SK:           eventKeyPrefix + eventKey(event),
+		UserID:       userID,
+		UID:          event.UID(),
+		Subject:      event.Subject(),
+		Description:  event.Description(),
+		Location:     event.Location(),
+		URL:          event.URL(),
+		StartTime:    event.Start().UTC().Format(time.RFC3339),
+		EndTime:      event.End().UTC().Format(time.RFC3339),
+		TimeZone:     event.TimeZone(),
+		IsAllDay:     event.IsAllDay(),
+		IsRecurring:  event.IsRecurring(),
+		CalendarID:   event.CalendarID(),
+		LastModified: event.LastModifiedAt().UTC().Format(time.RFC3339),
+		Status:       statusOf(event).String(),
+		Sequence:     sequenceOf(event),
+		TTL:          expiryOf(event),
+		Version:      version,
+	}
+}
+
+// expiryOf returns the (Unix) time at which the given event expires: eventTTL
+// after it ends. Recurrences aren't expanded, so the master of a series ends
+// with its last instance, i.e., the UNTIL of its rule; a series that doesn't
+// end (or whose end is unknown) never expires, and zero is returned.
+func expiryOf(event calendar.Event) int64 {
+	if !event.IsRecurring() {
+		return event.End().Add(eventTTL).Unix()
+	}
+	if recurring, ok := event.(recurringEvent); ok && !recurring.OriginalStart().IsZero() {
+		// an override is a single instance
+		return event.End().Add(eventTTL).Unix()
+	}
+
+	ruled, ok := event.(ruledEvent)
+	if !ok {
+		return 0
+	}
+	until := recurrenceUntil(ruled.RecurrenceRule())
+	if until.IsZero() {
+		return 0
+	}
+	return until.Add(event.End().Sub(event.Start())).Add(eventTTL).Unix()
+}
+
+// recurrenceUntil returns the UNTIL of the given RRULE (e.g.,
+// "FREQ=WEEKLY;UNTIL=20201231T235959Z"); zero if it has none or it's
+// malformed. Floating and date values are read as UTC, which is at most a
+// day off.
+func recurrenceUntil(rule string) time.Time {
+	for _, part := range strings.Split(rule, ";") {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 || !strings.EqualFold(pair[0], "UNTIL") {
+			continue
+		}
+		for _, layout := range []string{"20060102T150405Z", "20060102T150405", "20060102"} {
+			if until, err := time.Parse(layout, pair[1]); err == nil {
+				return until
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// eventKey identifies the given event among the user's: by its UID, and the
+// start of the instance that it overrides for the overrides of recurring
+// events, which share their master's UID.
+func eventKey(event calendar.Event) string {
+	key := event.UID()
+	if recurring, ok := event.(recurringEvent); ok {
+		if originalStart := recurring.OriginalStart(); !originalStart.IsZero() {
+			key += "#" + originalStart.UTC().Format(time.RFC3339)
+		}
+	}
+	return key
+}
+
+// statusOf returns the status of the given event; Unknown if it doesn't
+// expose one.
+func statusOf(event calendar.Event) status.Status {
+	if e, ok := event.(statusEvent); ok {
+		return e.Status()
+	}
+	return status.Unknown
+}
+
+// sequenceOf returns the sequence of the given event; zero if it isn't
+// sequenced.
+func sequenceOf(event calendar.Event) int {
+	if sequenced, ok := event.(sequencedEvent); ok {
+		return sequenced.Sequence()
+	}
+	return 0
+}
@@ -0,0 +1,405 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/enums/status"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const testTable = "events"
+
+// fakeDynamoDB keeps items in memory and evaluates the few condition
+// expressions that dynamoEventStore uses.
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	mutex sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+	// batches counts the BatchWriteItem requests
+	batches int
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{items: map[string]map[string]*dynamodb.AttributeValue{}}
+}
+
+func itemKey(item map[string]*dynamodb.AttributeValue) string {
+	return aws.StringValue(item["PK"].S) + "|" + aws.StringValue(item["SK"].S)
+}
+
+func number(value *dynamodb.AttributeValue) int64 {
+	if value == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+	return n
+}
+
+func conditionalCheckFailed() error {
+	return awserr.New(conditionalCheckFailedErrorCode, "The conditional request failed", nil)
+}
+
+func (db *fakeDynamoDB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	key := itemKey(input.Key)
+	item, ok := db.items[key]
+	if !ok {
+		item = map[string]*dynamodb.AttributeValue{"PK": input.Key["PK"], "SK": input.Key["SK"]}
+		db.items[key] = item
+	}
+	version := number(item["version"]) + number(input.ExpressionAttributeValues[":one"])
+	item["version"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(version, 10))}
+	return &dynamodb.UpdateItemOutput{Attributes: map[string]*dynamodb.AttributeValue{"version": item["version"]}}, nil
+}
+
+func (db *fakeDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	key := itemKey(input.Item)
+	if stored, ok := db.items[key]; ok {
+		values := input.ExpressionAttributeValues
+		if number(stored["sequence"]) > number(values[":sequence"]) || number(stored["version"]) > number(values[":version"]) {
+			return nil, conditionalCheckFailed()
+		}
+	}
+	db.items[key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (db *fakeDynamoDB) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	key := itemKey(input.Key)
+	if stored, ok := db.items[key]; ok && number(stored["version"]) >= number(input.ExpressionAttributeValues[":version"]) {
+		return nil, conditionalCheckFailed()
+	}
+	delete(db.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (db *fakeDynamoDB) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if aws.StringValue(input.IndexName) == userIDIndex {
+		userID := aws.StringValue(input.ExpressionAttributeValues[":userID"].S)
+		output := &dynamodb.QueryOutput{}
+		for _, item := range db.items {
+			if item["userID"] != nil && aws.StringValue(item["userID"].S) == userID {
+				output.Items = append(output.Items, map[string]*dynamodb.AttributeValue{"uid": item["uid"], "lastModified": item["lastModified"]})
+			}
+		}
+		fn(output, true)
+		return nil
+	}
+
+	pk := aws.StringValue(input.ExpressionAttributeValues[":pk"].S)
+	prefix := aws.StringValue(input.ExpressionAttributeValues[":prefix"].S)
+	output := &dynamodb.QueryOutput{}
+	for _, item := range db.items {
+		if aws.StringValue(item["PK"].S) == pk && strings.HasPrefix(aws.StringValue(item["SK"].S), prefix) {
+			output.Items = append(output.Items, map[string]*dynamodb.AttributeValue{"PK": item["PK"], "SK": item["SK"]})
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+// BatchWriteItem leaves the first request of each batch unprocessed once, so
+// that the retries are exercised.
+func (db *fakeDynamoDB) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.batches++
+	unprocessed := map[string][]*dynamodb.WriteRequest{}
+	for table, requests := range input.RequestItems {
+		for i, request := range requests {
+			if i == 0 && db.batches%2 == 1 {
+				unprocessed[table] = append(unprocessed[table], request)
+				continue
+			}
+			if request.DeleteRequest != nil {
+				delete(db.items, itemKey(request.DeleteRequest.Key))
+			}
+			if request.PutRequest != nil {
+				db.items[itemKey(request.PutRequest.Item)] = request.PutRequest.Item
+			}
+		}
+	}
+	return &dynamodb.BatchWriteItemOutput{UnprocessedItems: unprocessed}, nil
+}
+
+// eventKeys returns the sort keys of the stored events.
+func (db *fakeDynamoDB) eventKeys() map[string]bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	keys := map[string]bool{}
+	for _, item := range db.items {
+		if sk := aws.StringValue(item["SK"].S); strings.HasPrefix(sk, eventKeyPrefix) {
+			keys[sk] = true
+		}
+	}
+	return keys
+}
+
+// testEvent implements the methods of calendar.Event that the store reads.
+type testEvent struct {
+	calendar.Event
+	uid           string
+	sequence      int
+	originalStart time.Time
+	end           time.Time
+	// recurring and rule make the event the master of a series
+	recurring bool
+	rule      string
+}
+
+func (event *testEvent) UID() string         { return event.uid }
+func (event *testEvent) Subject() string     { return "Meeting" }
+func (event *testEvent) Description() string { return "" }
+func (event *testEvent) Location() string    { return "" }
+func (event *testEvent) URL() string         { return "" }
+func (event *testEvent) Start() time.Time    { return time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC) }
+func (event *testEvent) End() time.Time {
+	if event.end.IsZero() {
+		return time.Date(2020, 1, 2, 11, 0, 0, 0, time.UTC)
+	}
+	return event.end
+}
+func (event *testEvent) TimeZone() string { return "UTC" }
+func (event *testEvent) IsAllDay() bool   { return false }
+func (event *testEvent) IsRecurring() bool {
+	return event.recurring || !event.originalStart.IsZero()
+}
+func (event *testEvent) CalendarID() string { return "/calendars/user/work/" }
+func (event *testEvent) LastModifiedAt() time.Time {
+	return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+func (event *testEvent) Sequence() int            { return event.sequence }
+func (event *testEvent) OriginalStart() time.Time { return event.originalStart }
+func (event *testEvent) RecurrenceRule() string   { return event.rule }
+
+func TestPutEventsReplacesEvents(t *testing.T) {
+	db := newFakeDynamoDB()
+	store := NewDynamoEventStore(db, testTable)
+
+	if err := store.PutEvents("user-1", []calendar.Event{&testEvent{uid: "a"}, &testEvent{uid: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutEvents("user-1", []calendar.Event{&testEvent{uid: "b"}, &testEvent{uid: "c"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := db.eventKeys()
+	if len(keys) != 2 || !keys[eventKeyPrefix+"b"] || !keys[eventKeyPrefix+"c"] {
+		t.Errorf("stored %v, want events b and c", keys)
+	}
+}
+
+func TestPutEventsKeepsOverridesApart(t *testing.T) {
+	db := newFakeDynamoDB()
+	store := NewDynamoEventStore(db, testTable)
+	override := &testEvent{uid: "a", originalStart: time.Date(2020, 1, 9, 10, 0, 0, 0, time.UTC)}
+
+	if err := store.PutEvents("user-1", []calendar.Event{&testEvent{uid: "a"}, override}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := db.eventKeys()
+	if len(keys) != 2 || !keys[eventKeyPrefix+"a"] || !keys[eventKeyPrefix+"a#2020-01-09T10:00:00Z"] {
+		t.Errorf("stored %v, want the master and its override", keys)
+	}
+}
+
+func TestPutEventsSkipsStaleEvents(t *testing.T) {
+	db := newFakeDynamoDB()
+	store := NewDynamoEventStore(db, testTable)
+
+	if err := store.PutEvents("user-1", []calendar.Event{&testEvent{uid: "a", sequence: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutEvents("user-1", []calendar.Event{&testEvent{uid: "a", sequence: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := db.items["USER#user-1|"+eventKeyPrefix+"a"]
+	if stored == nil || number(stored["sequence"]) != 2 {
+		t.Errorf("stored %v, want sequence 2", stored)
+	}
+}
+
+func TestPutEventsKeepsLaterSyncs(t *testing.T) {
+	db := newFakeDynamoDB()
+	store := NewDynamoEventStore(db, testTable).(*dynamoEventStore)
+
+	// an earlier sync got version 1 but writes after the later one
+	earlier, err := store.nextVersion("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutEvents("user-1", []calendar.Event{&testEvent{uid: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.putEventItem(newEventItem("user-1", &testEvent{uid: "b"}, earlier)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.deleteUnwritten("user-1", earlier, map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := db.items["USER#user-1|"+eventKeyPrefix+"b"]
+	if stored == nil || number(stored["version"]) != earlier+1 {
+		t.Errorf("stored %v, want the later sync's version %d", stored, earlier+1)
+	}
+}
+
+func TestMergeEventsKeepsStoredEvents(t *testing.T) {
+	db := newFakeDynamoDB()
+	store := NewDynamoEventStore(db, testTable)
+
+	if err := store.PutEvents("user-1", []calendar.Event{&testEvent{uid: "a"}, &testEvent{uid: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MergeEvents("user-1", []calendar.Event{&testEvent{uid: "b", sequence: 1}, &testEvent{uid: "c"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := db.eventKeys()
+	if len(keys) != 3 || !keys[eventKeyPrefix+"a"] || !keys[eventKeyPrefix+"b"] || !keys[eventKeyPrefix+"c"] {
+		t.Errorf("stored %v, want events a, b and c", keys)
+	}
+	if stored := db.items["USER#user-1|"+eventKeyPrefix+"b"]; number(stored["sequence"]) != 1 {
+		t.Errorf("stored %v, want the merged revision of b", stored)
+	}
+}
+
+func TestNewEventItemTTL(t *testing.T) {
+	end := time.Date(2020, 1, 2, 11, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		event *testEvent
+		want  time.Time
+	}{
+		{name: "single event", event: &testEvent{uid: "a"}, want: end.Add(eventTTL)},
+		{name: "override", event: &testEvent{uid: "a", originalStart: end.Add(-time.Hour)}, want: end.Add(eventTTL)},
+		{name: "endless series", event: &testEvent{uid: "a", recurring: true, rule: "FREQ=WEEKLY;BYDAY=TH"}},
+		{name: "series of RDATEs", event: &testEvent{uid: "a", recurring: true}},
+		{name: "series until a time", event: &testEvent{uid: "a", recurring: true, rule: "FREQ=WEEKLY;UNTIL=20200130T100000Z"}, want: time.Date(2020, 1, 30, 11, 0, 0, 0, time.UTC).Add(eventTTL)},
+		{name: "series until a date", event: &testEvent{uid: "a", recurring: true, rule: "UNTIL=20200130;FREQ=DAILY"}, want: time.Date(2020, 1, 30, 1, 0, 0, 0, time.UTC).Add(eventTTL)},
+		{name: "malformed until", event: &testEvent{uid: "a", recurring: true, rule: "FREQ=DAILY;UNTIL=soon"}},
+	}
+	for _, test := range tests {
+		item := newEventItem("user-1", test.event, 1)
+		want := int64(0)
+		if !test.want.IsZero() {
+			want = test.want.Unix()
+		}
+		if item.TTL != want {
+			t.Errorf("%s: TTL = %v, want %v", test.name, time.Unix(item.TTL, 0).UTC(), test.want)
+		}
+	}
+}
+
+// statusedEvent is a test event with the given status.
+type statusedEvent struct {
+	testEvent
+	status status.Status
+}
+
+func (event *statusedEvent) Status() status.Status { return event.status }
+
+func TestPutEventsStoresStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		event calendar.Event
+		want  string
+	}{
+		{name: "confirmed", event: &statusedEvent{testEvent: testEvent{uid: "a"}, status: status.Confirmed}, want: "Confirmed"},
+		{name: "tentative", event: &statusedEvent{testEvent: testEvent{uid: "a"}, status: status.Tentative}, want: "Tentative"},
+		{name: "cancelled", event: &statusedEvent{testEvent: testEvent{uid: "a"}, status: status.Cancelled}, want: "Cancelled"},
+		{name: "without status", event: &testEvent{uid: "a"}, want: "Unknown"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newFakeDynamoDB()
+			store := NewDynamoEventStore(db, testTable)
+			if err := store.PutEvents("user-1", []calendar.Event{test.event}); err != nil {
+				t.Fatal(err)
+			}
+
+			stored := db.items["USER#user-1|"+eventKeyPrefix+"a"]
+			if stored == nil || stored["status"] == nil || aws.StringValue(stored["status"].S) != test.want {
+				t.Errorf("stored %v, want status %s", stored, test.want)
+			}
+		})
+	}
+}
+
+func TestPutEventsStoresSeriesWithoutTTL(t *testing.T) {
+	db := newFakeDynamoDB()
+	store := NewDynamoEventStore(db, testTable)
+
+	series := &testEvent{uid: "a", recurring: true, rule: "FREQ=WEEKLY", end: time.Now().AddDate(-1, 0, 0)}
+	if err := store.PutEvents("user-1", []calendar.Event{series}); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored := db.items["USER#user-1|"+eventKeyPrefix+"a"]; stored == nil || stored["ttl"] != nil {
+		t.Errorf("stored %v, want the series without a TTL", stored)
+	}
+}
+
+func TestGetEventUIDs(t *testing.T) {
+	db := newFakeDynamoDB()
+	store := NewDynamoEventStore(db, testTable)
+	if err := store.PutEvents("user-1", []calendar.Event{&testEvent{uid: "a"}, &testEvent{uid: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutEvents("user-2", []calendar.Event{&testEvent{uid: "c"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	uids, err := store.GetEventUIDs("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "2020-01-01T00:00:00Z", "b": "2020-01-01T00:00:00Z"}
+	if len(uids) != len(want) || uids["a"] != want["a"] || uids["b"] != want["b"] {
+		t.Errorf("GetEventUIDs = %v, want %v", uids, want)
+	}
+}
+
+func TestDeleteUserEvents(t *testing.T) {
+	db := newFakeDynamoDB()
+	store := NewDynamoEventStore(db, testTable)
+	events := []calendar.Event{}
+	for i := 0; i < 2*maxBatchSize+1; i++ {
+		events = append(events, &testEvent{uid: strconv.Itoa(i)})
+	}
+	if err := store.PutEvents("user-1", events); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutEvents("user-2", []calendar.Event{&testEvent{uid: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteUserEvents("user-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := db.eventKeys()
+	if len(keys) != 1 || !keys[eventKeyPrefix+"a"] {
+		t.Errorf("stored %d events, want only that of user-2", len(keys))
+	}
+	if db.batches != 6 {
+		t.Errorf("sent %d batches, want 3 and a retry of each", db.batches)
+	}
+}
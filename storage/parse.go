@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"github.com/WF/go/calendar"
+	"github.com/Cepreu/Archive/errors"
+	"github.com/WF/go/parse"
+)
+
+// ParseEventStore stores events in Parse.
+type ParseEventStore struct{}
+
+// DeleteUserEvents deletes all of the user's events.
+func (ParseEventStore) DeleteUserEvents(userID string) error {
+	return parse.DeleteUserEvents(userID)
+}
+
+// PutEvents stores the given events of the user in place of the ones that
+// are stored. Parse can neither write conditionally nor delete selectively,
+// so the stored events are deleted first.
+func (ParseEventStore) PutEvents(userID string, events []calendar.Event) error {
+	if err := parse.DeleteUserEvents(userID); err != nil {
+		return err
+	}
+	return parse.PutEvents(userID, events)
+}
+
+// MergeEvents isn't supported, since Parse can't replace stored events
+// selectively; it always returns a WF13006 error, and callers use PutEvents
+// instead.
+func (ParseEventStore) MergeEvents(userID string, events []calendar.Event) error {
+	return errors.WF13006("MergeEvents", "Parse")
+}
+
+// GetEventUIDs isn't supported by the parse package yet; it always returns a
+// WF13006 error.
+func (ParseEventStore) GetEventUIDs(userID string) (map[string]string, error) {
+	return nil, errors.WF13006("GetEventUIDs", "Parse")
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/WF/go/calendar"
+	"github.com/WF/go/enums/importance"
+	"github.com/WF/go/enums/rsvp"
+	"github.com/WF/go/enums/sensitivity"
+)
+
+// ChangeType is the type of change that an event underwent.
+type ChangeType int
+
+const (
+	// Created means the event is new.
+	Created ChangeType = iota
+	// Updated means the event was modified; it's also used for events that
+	// may or may not have changed (e.g., when all events are rewritten).
+	Updated
+	// Deleted means the event no longer exists.
+	Deleted
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case Created:
+		return "Created"
+	case Deleted:
+		return "Deleted"
+	default:
+		return "Updated"
+	}
+}
+
+// MarshalText marshals the change type as its name (e.g., in JSON).
+func (t ChangeType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// EventSink publishes event changes to downstream consumers (e.g., search or
+// notifications) so that they needn't poll the event store.
+type EventSink interface {
+	// PublishEvent publishes a change of the given user's event.
+	PublishEvent(userID string, event calendar.Event, changeType ChangeType) error
+	// PublishEvents publishes the same change of several of the given user's
+	// events in as few requests as possible.
+	PublishEvents(userID string, events []calendar.Event, changeType ChangeType) error
+}
+
+// DeletedEvent returns a stand-in for the deleted event with the given UID,
+// for sinks to publish its deletion; all of its other properties are zero.
+func DeletedEvent(uid string) calendar.Event {
+	return deletedEvent{uid: uid}
+}
+
+// deletedEvent is an event that only has a UID left.
+type deletedEvent struct {
+	uid string
+}
+
+func (event deletedEvent) UID() string                       { return event.uid }
+func (deletedEvent) Subject() string                         { return "" }
+func (deletedEvent) Description() string                     { return "" }
+func (deletedEvent) URL() string                             { return "" }
+func (deletedEvent) Start() time.Time                        { return time.Time{} }
+func (deletedEvent) End() time.Time                          { return time.Time{} }
+func (deletedEvent) TimeZone() string                        { return "" }
+func (deletedEvent) Location() string                        { return "" }
+func (deletedEvent) ResponseType() *rsvp.MeetingResponseType { return nil }
+func (deletedEvent) Organizer() calendar.EmailAddress        { return nil }
+func (deletedEvent) Attendees() []calendar.Attendee          { return nil }
+func (deletedEvent) IsRecurring() bool                       { return false }
+func (deletedEvent) IsAllDay() bool                          { return false }
+func (deletedEvent) Importance() importance.Importance       { return importance.Unknown }
+func (deletedEvent) Sensitivity() sensitivity.Sensitivity    { return sensitivity.Unknown }
+func (deletedEvent) CreatedAt() time.Time                    { return time.Time{} }
+func (deletedEvent) LastModifiedAt() time.Time               { return time.Time{} }
+func (deletedEvent) CalendarID() string                      { return "" }
+func (deletedEvent) CalendarDisplayName() string             { return "" }
+func (deletedEvent) CalendarItemID() string                  { return "" }
@@ -0,0 +1,25 @@
+// Package storage abstracts where synced calendar events are persisted so
+// that the sync logic doesn't depend on a specific backend (e.g., Parse).
+package storage
+
+import (
+	"github.com/WF/go/calendar"
+)
+
+// EventStore persists the calendar events of users.
+type EventStore interface {
+	// DeleteUserEvents deletes all of the user's events.
+	DeleteUserEvents(userID string) error
+	// PutEvents stores the given events of the user in place of the ones
+	// that are stored.
+	PutEvents(userID string, events []calendar.Event) error
+	// MergeEvents stores the given events of the user alongside the ones
+	// that are stored (e.g., when the events of some of the user's accounts
+	// couldn't be synced); stored events with the same keys are replaced.
+	// Stores that can't replace events selectively return WF13006, and
+	// callers put the events instead.
+	MergeEvents(userID string, events []calendar.Event) error
+	// GetEventUIDs returns the UIDs of the user's stored events mapped to
+	// their last modification time (formatted by the backend).
+	GetEventUIDs(userID string) (map[string]string, error)
+}
@@ -0,0 +1,100 @@
+package syncstatus
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+type dynamoStore struct {
+	client    dynamodbiface.DynamoDBAPI
+	tableName string
+	now       func() time.Time `test-hook:"verify-unexported"`
+}
+
+// NewDynamoStore creates a store that keeps the sync statuses in the given
+// DynamoDB table; its partition key is userID and its sort key email (both
+// strings).
+func NewDynamoStore(client dynamodbiface.DynamoDBAPI, tableName string) Store {
+	return &dynamoStore{client: client, tableName: tableName, now: time.Now}
+}
+
+// RecordSuccess records that the given account was synced with the given
+// number of events.
+func (store *dynamoStore) RecordSuccess(userID string, email string, eventCount int) error {
+	_, err := store.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(store.tableName),
+		Key:              key(userID, email),
+		UpdateExpression: aws.String("SET lastSuccess = :now, eventCount = :eventCount, consecutiveFailures = :zero REMOVE lastError"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now":        unixTime(store.now()),
+			":eventCount": number(eventCount),
+			":zero":       number(0),
+		},
+	})
+	return err
+}
+
+// RecordFailure records that syncing the given account failed.
+func (store *dynamoStore) RecordFailure(userID string, email string, syncErr error) error {
+	_, err := store.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(store.tableName),
+		Key:              key(userID, email),
+		UpdateExpression: aws.String("SET lastFailure = :now, lastError = :lastError ADD consecutiveFailures :one"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now":       unixTime(store.now()),
+			":lastError": {S: aws.String(syncErr.Error())},
+			":one":       number(1),
+		},
+	})
+	return err
+}
+
+// GetStaleSyncs returns the accounts that haven't been synced successfully
+// for longer than the given duration (or ever). It scans the whole table.
+func (store *dynamoStore) GetStaleSyncs(olderThan time.Duration) ([]SyncStatus, error) {
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(store.tableName),
+		FilterExpression: aws.String("attribute_not_exists(lastSuccess) OR lastSuccess < :cutoff"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":cutoff": unixTime(store.now().Add(-olderThan)),
+		},
+	}
+
+	statuses := []SyncStatus{}
+	var unmarshalErr error
+	err := store.client.ScanPages(input, func(output *dynamodb.ScanOutput, lastPage bool) bool {
+		page := []SyncStatus{}
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(output.Items, &page); unmarshalErr != nil {
+			return false
+		}
+		statuses = append(statuses, page...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	return statuses, nil
+}
+
+func key(userID string, email string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"userID": {S: aws.String(userID)},
+		"email":  {S: aws.String(email)},
+	}
+}
+
+func number(n int) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(n))}
+}
+
+func unixTime(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.Unix(), 10))}
+}
@@ -0,0 +1,252 @@
+package syncstatus
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	testTable     = "sync-statuses"
+	staleFilter   = "attribute_not_exists(lastSuccess) OR lastSuccess < :cutoff"
+	testPageItems = 2
+)
+
+// fakeDynamoDB keeps items in memory and evaluates the SET, ADD and REMOVE
+// clauses of update expressions, and the filter of stale syncs.
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+	// pages counts the pages that were scanned
+	pages int
+	err   error
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{items: map[string]map[string]*dynamodb.AttributeValue{}}
+}
+
+func itemKey(key map[string]*dynamodb.AttributeValue) string {
+	return aws.StringValue(key["userID"].S) + "|" + aws.StringValue(key["email"].S)
+}
+
+func numberOf(value *dynamodb.AttributeValue) int64 {
+	if value == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+	return n
+}
+
+func (db *fakeDynamoDB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if db.err != nil {
+		return nil, db.err
+	}
+	if aws.StringValue(input.TableName) != testTable {
+		return nil, fmt.Errorf("unexpected table %q", aws.StringValue(input.TableName))
+	}
+	key := itemKey(input.Key)
+	item, ok := db.items[key]
+	if !ok {
+		item = map[string]*dynamodb.AttributeValue{"userID": input.Key["userID"], "email": input.Key["email"]}
+		db.items[key] = item
+	}
+
+	values := input.ExpressionAttributeValues
+	clause := ""
+	for _, field := range strings.Fields(strings.Replace(aws.StringValue(input.UpdateExpression), ",", " , ", -1)) {
+		switch field {
+		case "SET", "ADD", "REMOVE":
+			clause = field
+			continue
+		case ",", "=":
+			continue
+		}
+		if strings.HasPrefix(field, ":") {
+			continue
+		}
+		// the attribute's value follows it (after an = in SET clauses)
+		switch clause {
+		case "SET":
+			item[field] = valueAfter(aws.StringValue(input.UpdateExpression), field, values)
+		case "ADD":
+			sum := numberOf(item[field]) + numberOf(valueAfter(aws.StringValue(input.UpdateExpression), field, values))
+			item[field] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(sum, 10))}
+		case "REMOVE":
+			delete(item, field)
+		}
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+// valueAfter returns the value of the placeholder that follows the given
+// attribute in the given update expression.
+func valueAfter(expression string, attribute string, values map[string]*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	rest := expression[strings.Index(expression, attribute+" ")+len(attribute):]
+	rest = strings.TrimLeft(rest, " =")
+	placeholder := strings.TrimRight(strings.Fields(rest)[0], ",")
+	return values[placeholder]
+}
+
+func (db *fakeDynamoDB) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	if db.err != nil {
+		return db.err
+	}
+	if filter := aws.StringValue(input.FilterExpression); filter != staleFilter {
+		return fmt.Errorf("unexpected filter %q", filter)
+	}
+	cutoff := numberOf(input.ExpressionAttributeValues[":cutoff"])
+
+	keys := []string{}
+	for key := range db.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	matching := []map[string]*dynamodb.AttributeValue{}
+	for _, key := range keys {
+		item := db.items[key]
+		if lastSuccess, ok := item["lastSuccess"]; !ok || numberOf(lastSuccess) < cutoff {
+			matching = append(matching, item)
+		}
+	}
+
+	for start := 0; start == 0 || start < len(matching); start += testPageItems {
+		end := start + testPageItems
+		if end > len(matching) {
+			end = len(matching)
+		}
+		db.pages++
+		if !fn(&dynamodb.ScanOutput{Items: matching[start:end]}, end == len(matching)) {
+			break
+		}
+	}
+	return nil
+}
+
+// newTestStore returns a store of a fake DynamoDB whose clock is the returned
+// time.
+func newTestStore() (*dynamoStore, *fakeDynamoDB, *time.Time) {
+	now := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	db := newFakeDynamoDB()
+	store := NewDynamoStore(db, testTable).(*dynamoStore)
+	store.now = func() time.Time { return now }
+	return store, db, &now
+}
+
+func TestRecordSuccess(t *testing.T) {
+	store, db, now := newTestStore()
+	if err := store.RecordFailure("user-1", "user@example.com", fmt.Errorf("connection refused")); err != nil {
+		t.Fatal(err)
+	}
+	*now = now.Add(time.Hour)
+
+	if err := store.RecordSuccess("user-1", "user@example.com", 42); err != nil {
+		t.Fatalf("RecordSuccess() error = %v", err)
+	}
+	item := db.items["user-1|user@example.com"]
+	if got := numberOf(item["lastSuccess"]); got != now.Unix() {
+		t.Errorf("lastSuccess = %d, want %d", got, now.Unix())
+	}
+	if got := numberOf(item["eventCount"]); got != 42 {
+		t.Errorf("eventCount = %d, want 42", got)
+	}
+	if got := numberOf(item["consecutiveFailures"]); got != 0 {
+		t.Errorf("consecutiveFailures = %d, want 0", got)
+	}
+	if _, ok := item["lastError"]; ok {
+		t.Errorf("lastError = %v, want it removed", item["lastError"])
+	}
+	// the last failure is kept
+	if _, ok := item["lastFailure"]; !ok {
+		t.Error("lastFailure was removed")
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	store, db, now := newTestStore()
+	for i := 0; i < 3; i++ {
+		if err := store.RecordFailure("user-1", "user@example.com", fmt.Errorf("failure %d", i)); err != nil {
+			t.Fatalf("RecordFailure() error = %v", err)
+		}
+		*now = now.Add(time.Minute)
+	}
+
+	item := db.items["user-1|user@example.com"]
+	if got := numberOf(item["consecutiveFailures"]); got != 3 {
+		t.Errorf("consecutiveFailures = %d, want 3", got)
+	}
+	if got := aws.StringValue(item["lastError"].S); got != "failure 2" {
+		t.Errorf("lastError = %q, want failure 2", got)
+	}
+	if got, want := numberOf(item["lastFailure"]), now.Add(-time.Minute).Unix(); got != want {
+		t.Errorf("lastFailure = %d, want %d", got, want)
+	}
+	if _, ok := item["lastSuccess"]; ok {
+		t.Error("lastSuccess is set, want it unset")
+	}
+}
+
+func TestRecordReportsErrors(t *testing.T) {
+	store, db, _ := newTestStore()
+	db.err = fmt.Errorf("ProvisionedThroughputExceededException")
+
+	if err := store.RecordSuccess("user-1", "user@example.com", 1); err != db.err {
+		t.Errorf("RecordSuccess() error = %v, want %v", err, db.err)
+	}
+	if err := store.RecordFailure("user-1", "user@example.com", fmt.Errorf("failure")); err != db.err {
+		t.Errorf("RecordFailure() error = %v, want %v", err, db.err)
+	}
+	if _, err := store.GetStaleSyncs(time.Hour); err != db.err {
+		t.Errorf("GetStaleSyncs() error = %v, want %v", err, db.err)
+	}
+}
+
+func TestGetStaleSyncs(t *testing.T) {
+	store, db, now := newTestStore()
+	start := *now
+	// a, b and c synced at different times; d never did
+	for i, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		*now = start.Add(time.Duration(i) * time.Hour)
+		if err := store.RecordSuccess("user-1", email, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.RecordFailure("user-2", "d@example.com", fmt.Errorf("connection refused")); err != nil {
+		t.Fatal(err)
+	}
+	*now = start.Add(3 * time.Hour)
+
+	statuses, err := store.GetStaleSyncs(90 * time.Minute)
+	if err != nil {
+		t.Fatalf("GetStaleSyncs() error = %v", err)
+	}
+	emails := []string{}
+	for _, status := range statuses {
+		emails = append(emails, status.Email)
+	}
+	if got, want := strings.Join(emails, ", "), "a@example.com, b@example.com, d@example.com"; got != want {
+		t.Fatalf("stale syncs = %s, want %s", got, want)
+	}
+	if db.pages != 2 {
+		t.Errorf("pages = %d, want 2", db.pages)
+	}
+
+	a, d := statuses[0], statuses[2]
+	if a.UserID != "user-1" || !a.LastSuccess.Equal(start) || a.EventCount != 0 {
+		t.Errorf("status of a = %+v, want user-1 synced at %v", a, start)
+	}
+	if d.UserID != "user-2" || !d.LastSuccess.IsZero() || d.ConsecutiveFailures != 1 || d.LastError != "connection refused" {
+		t.Errorf("status of d = %+v, want user-2 never synced after a failure", d)
+	}
+
+	if statuses, err := store.GetStaleSyncs(4 * time.Hour); err != nil || len(statuses) != 1 {
+		t.Errorf("GetStaleSyncs(4h) = %+v, %v, want only d", statuses, err)
+	}
+}
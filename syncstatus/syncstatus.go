@@ -0,0 +1,40 @@
+// Package syncstatus persists when each account was last synced so that
+// accounts that haven't synced in a while (i.e., stale syncs) can be alerted
+// on.
+package syncstatus
+
+import (
+	"time"
+)
+
+// SyncStatus is the sync status of a single account.
+type SyncStatus struct {
+	UserID string `dynamodbav:"userID"`
+	Email  string `dynamodbav:"email"`
+	// LastSuccess is zero if the account has never been synced successfully.
+	LastSuccess time.Time `dynamodbav:"lastSuccess,unixtime,omitempty"`
+	EventCount  int       `dynamodbav:"eventCount"`
+	LastFailure time.Time `dynamodbav:"lastFailure,unixtime,omitempty"`
+	LastError   string    `dynamodbav:"lastError,omitempty"`
+	// ConsecutiveFailures is reset by every success.
+	ConsecutiveFailures int `dynamodbav:"consecutiveFailures"`
+}
+
+// Store records the outcome of account syncs.
+type Store interface {
+	// RecordSuccess records that the given account was synced with the given
+	// number of events.
+	RecordSuccess(userID string, email string, eventCount int) error
+	// RecordFailure records that syncing the given account failed.
+	RecordFailure(userID string, email string, err error) error
+	// GetStaleSyncs returns the accounts that haven't been synced
+	// successfully for longer than the given duration (or ever).
+	GetStaleSyncs(olderThan time.Duration) ([]SyncStatus, error)
+}
+
+// Nop is a store that records nothing.
+type Nop struct{}
+
+func (Nop) RecordSuccess(userID string, email string, eventCount int) error { return nil }
+func (Nop) RecordFailure(userID string, email string, err error) error      { return nil }
+func (Nop) GetStaleSyncs(olderThan time.Duration) ([]SyncStatus, error)     { return nil, nil }
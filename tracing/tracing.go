@@ -0,0 +1,65 @@
+// Package tracing traces the sync pipeline with AWS X-Ray so that a message
+// can be correlated with all the HTTP calls it triggers. Segments are sent to
+// the X-Ray daemon (AWS_XRAY_DAEMON_ADDRESS, 127.0.0.1:2000 by default);
+// setting AWS_XRAY_SDK_DISABLED=true turns tracing off.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// BeginSegment begins a segment (e.g., for a message) and returns a context
+// carrying it, and a function that ends it with the given error (if any).
+func BeginSegment(ctx context.Context, name string) (context.Context, func(error)) {
+	ctx, segment := xray.BeginSegment(ctx, name)
+	return ctx, segment.Close
+}
+
+// StartSubsegment begins a subsegment of the segment of the given context
+// and returns a context carrying it, and a function that ends it. It does
+// nothing if the context isn't being traced.
+func StartSubsegment(ctx context.Context, name string) (context.Context, func()) {
+	if xray.GetSegment(ctx) == nil {
+		return ctx, func() {}
+	}
+	ctx, subsegment := xray.BeginSubsegment(ctx, name)
+	return ctx, func() { subsegment.Close(nil) }
+}
+
+// WrapHTTPClient returns a copy of the given client whose requests are traced
+// as subsegments of their context's segment, grouped under a subsegment of
+// the given name. Requests whose context isn't being traced are sent as is.
+func WrapHTTPClient(client *http.Client, segmentName string) *http.Client {
+	inner := client.Transport
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+
+	wrapped := *client
+	wrapped.Transport = &tracingRoundTripper{
+		innerRoundTripper:  inner,
+		tracedRoundTripper: xray.RoundTripper(inner),
+		segmentName:        segmentName,
+	}
+	return &wrapped
+}
+
+type tracingRoundTripper struct {
+	innerRoundTripper  http.RoundTripper
+	tracedRoundTripper http.RoundTripper
+	segmentName        string
+}
+
+func (transport *tracingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	if xray.GetSegment(request.Context()) == nil {
+		return transport.innerRoundTripper.RoundTrip(request)
+	}
+
+	ctx, subsegment := xray.BeginSubsegment(request.Context(), transport.segmentName)
+	response, err := transport.tracedRoundTripper.RoundTrip(request.WithContext(ctx))
+	subsegment.Close(err)
+	return response, err
+}
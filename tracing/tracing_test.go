@@ -0,0 +1,126 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/strategy/sampling"
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// alwaysSample samples every segment so that tests don't depend on the
+// default sampling rate.
+type alwaysSample struct{}
+
+func (alwaysSample) ShouldTrace(*sampling.Request) *sampling.Decision {
+	return &sampling.Decision{Sample: true}
+}
+
+// tracedSegment is a segment as sent to the X-Ray daemon.
+type tracedSegment struct {
+	Name        string          `json:"name"`
+	Subsegments []tracedSegment `json:"subsegments"`
+}
+
+// newTestDaemon returns a context whose segments are sent to a fake X-Ray
+// daemon, and a function that returns the next segment that it receives.
+func newTestDaemon(t *testing.T) (context.Context, func() *tracedSegment) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	emitter, err := xray.NewDefaultEmitter(conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := xray.ContextWithConfig(context.Background(), xray.Config{Emitter: emitter, SamplingStrategy: alwaysSample{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ctx, func() *tracedSegment {
+		buffer := make([]byte, 64*1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("no segment was sent: %v", err)
+		}
+		// each datagram is a header line followed by the segment
+		data := buffer[:n]
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+		segment := &tracedSegment{}
+		if err := json.Unmarshal(data, segment); err != nil {
+			t.Fatalf("malformed segment %q: %v", data, err)
+		}
+		return segment
+	}
+}
+
+func TestSubsegmentNames(t *testing.T) {
+	ctx, nextSegment := newTestDaemon(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	client := WrapHTTPClient(server.Client(), "caldav")
+
+	ctx, endSegment := BeginSegment(ctx, "callimachus")
+	syncCtx, endSubsegment := StartSubsegment(ctx, "sync CalDAV")
+	request, _ := http.NewRequestWithContext(syncCtx, http.MethodGet, server.URL, nil)
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	endSubsegment()
+	endSegment(nil)
+
+	segment := nextSegment()
+	if segment.Name != "callimachus" {
+		t.Fatalf("segment = %q, want callimachus", segment.Name)
+	}
+	if len(segment.Subsegments) != 1 || segment.Subsegments[0].Name != "sync CalDAV" {
+		t.Fatalf("subsegments of callimachus = %+v, want sync CalDAV", segment.Subsegments)
+	}
+	sync := segment.Subsegments[0]
+	if len(sync.Subsegments) != 1 || sync.Subsegments[0].Name != "caldav" {
+		t.Fatalf("subsegments of sync CalDAV = %+v, want caldav", sync.Subsegments)
+	}
+	// the request itself is traced by X-Ray's round tripper
+	if len(sync.Subsegments[0].Subsegments) == 0 {
+		t.Error("the request wasn't traced")
+	}
+}
+
+func TestUntracedContext(t *testing.T) {
+	ctx := context.Background()
+	if got, end := StartSubsegment(ctx, "sync CalDAV"); got != ctx {
+		t.Errorf("StartSubsegment() of an untraced context = %v, want it as is", got)
+	} else {
+		end()
+	}
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if header := r.Header.Get(xray.TraceIDHeaderKey); header != "" {
+			t.Errorf("%s = %q, want no trace header", xray.TraceIDHeaderKey, header)
+		}
+	}))
+	defer server.Close()
+	response, err := WrapHTTPClient(server.Client(), "caldav").Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if requests != 1 {
+		t.Errorf("requests = %d, want 1", requests)
+	}
+}